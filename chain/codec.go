@@ -0,0 +1,477 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrUnsupportedOpEncoding = errors.New("binary operation encoding requires operation tags v1 (protocol v005 or later)")
+)
+
+// ManagerOp is a manager operation that can be converted to and from Tezos
+// binary wire format.
+type ManagerOp interface {
+	Kind() OpType
+	Common() *Manager
+	encodeBuffer(buf *bytes.Buffer) error
+	decodeBuffer(buf *bytes.Buffer) error
+}
+
+// Manager holds the fields shared by all manager operations.
+type Manager struct {
+	Source       Address
+	Fee          int64
+	Counter      int64
+	GasLimit     int64
+	StorageLimit int64
+}
+
+func (m *Manager) Common() *Manager {
+	return m
+}
+
+func (m Manager) encodeBuffer(buf *bytes.Buffer) error {
+	if err := writePkh(buf, m.Source); err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	for _, v := range []struct {
+		name string
+		val  int64
+	}{
+		{"fee", m.Fee},
+		{"counter", m.Counter},
+		{"gas_limit", m.GasLimit},
+		{"storage_limit", m.StorageLimit},
+	} {
+		if err := writeN(buf, v.val); err != nil {
+			return fmt.Errorf("%s: %v", v.name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) decodeBuffer(buf *bytes.Buffer) (err error) {
+	if m.Source, err = readPkh(buf); err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	for _, v := range []struct {
+		name string
+		val  *int64
+	}{
+		{"fee", &m.Fee},
+		{"counter", &m.Counter},
+		{"gas_limit", &m.GasLimit},
+		{"storage_limit", &m.StorageLimit},
+	} {
+		if *v.val, err = readN(buf); err != nil {
+			return fmt.Errorf("%s: %v", v.name, err)
+		}
+	}
+	return nil
+}
+
+// Reveal publishes the public key of an implicit account.
+type Reveal struct {
+	Manager
+	PublicKey Key
+}
+
+func (o *Reveal) Kind() OpType {
+	return OpTypeReveal
+}
+
+func (o *Reveal) encodeBuffer(buf *bytes.Buffer) error {
+	if err := o.Manager.encodeBuffer(buf); err != nil {
+		return err
+	}
+	if !o.PublicKey.IsValid() {
+		return fmt.Errorf("invalid public key")
+	}
+	buf.Write(o.PublicKey.Bytes())
+	return nil
+}
+
+func (o *Reveal) decodeBuffer(buf *bytes.Buffer) error {
+	if err := o.Manager.decodeBuffer(buf); err != nil {
+		return err
+	}
+	tag, err := buf.ReadByte()
+	if err != nil {
+		return io.ErrShortBuffer
+	}
+	typ := ParseKeyTag(tag)
+	if !typ.IsValid() {
+		return fmt.Errorf("invalid public key type %x", tag)
+	}
+	data := buf.Next(typ.Len())
+	if len(data) < typ.Len() {
+		return io.ErrShortBuffer
+	}
+	o.PublicKey = NewKey(typ, append([]byte(nil), data...))
+	return nil
+}
+
+// Transaction transfers tez and optionally calls a contract. Parameters are
+// stored in micheline.Parameters binary format, nil means no parameters.
+type Transaction struct {
+	Manager
+	Amount      int64
+	Destination Address
+	Parameters  []byte
+}
+
+func (o *Transaction) Kind() OpType {
+	return OpTypeTransaction
+}
+
+func (o *Transaction) encodeBuffer(buf *bytes.Buffer) error {
+	if err := o.Manager.encodeBuffer(buf); err != nil {
+		return err
+	}
+	if err := writeN(buf, o.Amount); err != nil {
+		return fmt.Errorf("amount: %v", err)
+	}
+	dest, err := o.Destination.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	buf.Write(dest)
+	// micheline uses a leading 0/1 flag where the wire format has a presence tag
+	if len(o.Parameters) == 0 || o.Parameters[0] == 0 {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(0xff)
+		buf.Write(o.Parameters[1:])
+	}
+	return nil
+}
+
+func (o *Transaction) decodeBuffer(buf *bytes.Buffer) (err error) {
+	if err = o.Manager.decodeBuffer(buf); err != nil {
+		return err
+	}
+	if o.Amount, err = readN(buf); err != nil {
+		return fmt.Errorf("amount: %v", err)
+	}
+	dest := buf.Next(22)
+	if len(dest) < 22 {
+		return io.ErrShortBuffer
+	}
+	if err = o.Destination.UnmarshalBinary(dest); err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	ok, err := readBool(buf)
+	if err != nil || !ok {
+		return err
+	}
+	// entrypoint tag, named entrypoints carry a length-prefixed name
+	params := bytes.NewBuffer([]byte{1})
+	tag, err := buf.ReadByte()
+	if err != nil {
+		return io.ErrShortBuffer
+	}
+	params.WriteByte(tag)
+	if tag == 255 {
+		n, err := buf.ReadByte()
+		if err != nil {
+			return io.ErrShortBuffer
+		}
+		name := buf.Next(int(n))
+		if len(name) < int(n) {
+			return io.ErrShortBuffer
+		}
+		params.WriteByte(n)
+		params.Write(name)
+	}
+	value, err := readBytes(buf)
+	if err != nil {
+		return fmt.Errorf("parameters: %v", err)
+	}
+	binary.Write(params, binary.BigEndian, uint32(len(value)))
+	params.Write(value)
+	o.Parameters = params.Bytes()
+	return nil
+}
+
+// Origination creates a smart contract. Script is stored in micheline.Script
+// binary format.
+type Origination struct {
+	Manager
+	Balance  int64
+	Delegate *Address
+	Script   []byte
+}
+
+func (o *Origination) Kind() OpType {
+	return OpTypeOrigination
+}
+
+func (o *Origination) encodeBuffer(buf *bytes.Buffer) error {
+	if err := o.Manager.encodeBuffer(buf); err != nil {
+		return err
+	}
+	if err := writeN(buf, o.Balance); err != nil {
+		return fmt.Errorf("balance: %v", err)
+	}
+	if err := writeOptPkh(buf, o.Delegate); err != nil {
+		return fmt.Errorf("delegate: %v", err)
+	}
+	if len(o.Script) == 0 {
+		return fmt.Errorf("missing script")
+	}
+	buf.Write(o.Script)
+	return nil
+}
+
+func (o *Origination) decodeBuffer(buf *bytes.Buffer) (err error) {
+	if err = o.Manager.decodeBuffer(buf); err != nil {
+		return err
+	}
+	if o.Balance, err = readN(buf); err != nil {
+		return fmt.Errorf("balance: %v", err)
+	}
+	if o.Delegate, err = readOptPkh(buf); err != nil {
+		return fmt.Errorf("delegate: %v", err)
+	}
+	// code and storage, both length-prefixed
+	script := bytes.NewBuffer(nil)
+	for _, name := range []string{"code", "storage"} {
+		b, err := readBytes(buf)
+		if err != nil {
+			return fmt.Errorf("script %s: %v", name, err)
+		}
+		binary.Write(script, binary.BigEndian, uint32(len(b)))
+		script.Write(b)
+	}
+	o.Script = script.Bytes()
+	return nil
+}
+
+// Delegation sets or, with a nil delegate, withdraws the delegate of an account.
+type Delegation struct {
+	Manager
+	Delegate *Address
+}
+
+func (o *Delegation) Kind() OpType {
+	return OpTypeDelegation
+}
+
+func (o *Delegation) encodeBuffer(buf *bytes.Buffer) error {
+	if err := o.Manager.encodeBuffer(buf); err != nil {
+		return err
+	}
+	if err := writeOptPkh(buf, o.Delegate); err != nil {
+		return fmt.Errorf("delegate: %v", err)
+	}
+	return nil
+}
+
+func (o *Delegation) decodeBuffer(buf *bytes.Buffer) (err error) {
+	if err = o.Manager.decodeBuffer(buf); err != nil {
+		return err
+	}
+	if o.Delegate, err = readOptPkh(buf); err != nil {
+		return fmt.Errorf("delegate: %v", err)
+	}
+	return nil
+}
+
+// OpGroup is a group of manager operations sharing a branch and a signature.
+type OpGroup struct {
+	Branch    BlockHash
+	Contents  []ManagerOp
+	Signature Signature // invalid for unsigned groups
+}
+
+// Encode serializes the group to binary wire format. A valid signature is
+// appended, otherwise the result is ready for signing.
+func (g OpGroup) Encode(p *Params) ([]byte, error) {
+	if p == nil || p.OperationTagsVersion < 1 {
+		return nil, ErrUnsupportedOpEncoding
+	}
+	if len(g.Branch.Hash.Hash) != 32 {
+		return nil, fmt.Errorf("invalid branch %s", g.Branch)
+	}
+	if len(g.Contents) == 0 {
+		return nil, fmt.Errorf("empty operation group")
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.Write(g.Branch.Hash.Hash)
+	for i, op := range g.Contents {
+		buf.WriteByte(op.Kind().Tag(p))
+		if err := op.encodeBuffer(buf); err != nil {
+			return nil, fmt.Errorf("op %d %s: %v", i, op.Kind(), err)
+		}
+	}
+	if g.Signature.IsValid() {
+		buf.Write(g.Signature.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeOpGroup parses an operation group from binary wire format using the
+// operation tags of protocol params p. When signed is true the last 64 bytes
+// are read as signature.
+func DecodeOpGroup(data []byte, signed bool, p *Params) (*OpGroup, error) {
+	if p == nil || p.OperationTagsVersion < 1 {
+		return nil, ErrUnsupportedOpEncoding
+	}
+	if signed {
+		if len(data) < 64 {
+			return nil, io.ErrShortBuffer
+		}
+		data, sig := data[:len(data)-64], data[len(data)-64:]
+		g, err := DecodeOpGroup(data, false, p)
+		if err != nil {
+			return nil, err
+		}
+		g.Signature = NewSignature(SignatureTypeGeneric, append([]byte(nil), sig...))
+		return g, nil
+	}
+	buf := bytes.NewBuffer(data)
+	branch := buf.Next(32)
+	if len(branch) < 32 {
+		return nil, io.ErrShortBuffer
+	}
+	g := &OpGroup{
+		Branch:   NewBlockHash(append([]byte(nil), branch...)),
+		Contents: make([]ManagerOp, 0),
+	}
+	for i := 0; buf.Len() > 0; i++ {
+		tag, _ := buf.ReadByte()
+		op := newManagerOp(ParseOpTagParams(tag, p))
+		if op == nil {
+			return nil, fmt.Errorf("op %d: unsupported operation tag %d", i, tag)
+		}
+		if err := op.decodeBuffer(buf); err != nil {
+			return nil, fmt.Errorf("op %d %s: %v", i, op.Kind(), err)
+		}
+		g.Contents = append(g.Contents, op)
+	}
+	if len(g.Contents) == 0 {
+		return nil, fmt.Errorf("empty operation group")
+	}
+	return g, nil
+}
+
+// newManagerOp returns an empty manager op of type typ or nil when typ has
+// no binary codec.
+func newManagerOp(typ OpType) ManagerOp {
+	switch typ {
+	case OpTypeReveal:
+		return &Reveal{}
+	case OpTypeTransaction:
+		return &Transaction{}
+	case OpTypeOrigination:
+		return &Origination{}
+	case OpTypeDelegation:
+		return &Delegation{}
+	default:
+		return nil
+	}
+}
+
+// writeN writes a zarith encoded natural number, 7 bits per byte in little
+// endian order with the most significant bit set on all but the last byte.
+func writeN(buf *bytes.Buffer, v int64) error {
+	if v < 0 {
+		return fmt.Errorf("negative value %d", v)
+	}
+	for v >= 0x80 {
+		buf.WriteByte(byte(v&0x7f) | 0x80)
+		v >>= 7
+	}
+	buf.WriteByte(byte(v))
+	return nil
+}
+
+func readN(buf *bytes.Buffer) (int64, error) {
+	var v int64
+	for s := uint(0); ; s += 7 {
+		b, err := buf.ReadByte()
+		if err != nil {
+			return 0, io.ErrShortBuffer
+		}
+		if s > 56 && b > 0x7f>>(s-56) {
+			return 0, fmt.Errorf("zarith value overflows int64")
+		}
+		v |= int64(b&0x7f) << s
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+}
+
+func readBool(buf *bytes.Buffer) (bool, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return false, io.ErrShortBuffer
+	}
+	switch b {
+	case 0:
+		return false, nil
+	case 0xff:
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid bool tag %x", b)
+	}
+}
+
+// readBytes reads a 4 byte big endian length-prefixed byte string.
+func readBytes(buf *bytes.Buffer) ([]byte, error) {
+	if buf.Len() < 4 {
+		return nil, io.ErrShortBuffer
+	}
+	n := int(binary.BigEndian.Uint32(buf.Next(4)))
+	if buf.Len() < n {
+		return nil, io.ErrShortBuffer
+	}
+	return append([]byte(nil), buf.Next(n)...), nil
+}
+
+// writePkh writes the 21 byte form of an implicit account address.
+func writePkh(buf *bytes.Buffer, a Address) error {
+	if !a.IsValid() || a.Type == AddressTypeContract {
+		return fmt.Errorf("invalid implicit address %s", a)
+	}
+	buf.Write(a.Bytes())
+	return nil
+}
+
+func readPkh(buf *bytes.Buffer) (Address, error) {
+	b := buf.Next(21)
+	if len(b) < 21 {
+		return Address{}, io.ErrShortBuffer
+	}
+	a := NewAddress(ParseAddressTag(b[0]), b[1:])
+	if !a.IsValid() {
+		return a, ErrUnknownAddressType
+	}
+	return a, nil
+}
+
+func writeOptPkh(buf *bytes.Buffer, a *Address) error {
+	if a == nil {
+		buf.WriteByte(0)
+		return nil
+	}
+	buf.WriteByte(0xff)
+	return writePkh(buf, *a)
+}
+
+func readOptPkh(buf *bytes.Buffer) (*Address, error) {
+	ok, err := readBool(buf)
+	if err != nil || !ok {
+		return nil, err
+	}
+	a, err := readPkh(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
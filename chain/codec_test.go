@@ -0,0 +1,154 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+var babylonParams = &Params{OperationTagsVersion: 1}
+
+// Test vectors follow the v005+ wire layout for mainnet addresses and keys,
+// the branch is the mainnet genesis block.
+const (
+	testBranch = "8fcf233671b6a04fcf679d2a381c2544ea6c1ea29ba6157776ed8424c7ccd00b"
+	testSource = "0002298c03ed7d454a101eb7022bc95f7e5f41ac78" // tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx
+)
+
+func TestDecodeOpGroup_RevealTransaction(t *testing.T) {
+	raw := strings.Join([]string{
+		testBranch,
+		// reveal: source, fee 1268, counter 1, gas 10000, storage 0, edpkuBknW28nW72KG6RoHtYW7p12T6GKc7nAbwYX5m8Wd9sDVC9yav
+		"6b", testSource, "f409", "01", "904e", "00",
+		"004798d2cc98473d7e250c898885718afd2e4efbcb1a1595ab9730761ed830de0f",
+		// transaction: source, fee 1420, counter 2, gas 10600, storage 257, 1 tez to tz1gjaF81ZRRvdzjobyfVNsAeSC6PScjfQwN
+		"6c", testSource, "8c0b", "02", "e852", "8102", "c0843d",
+		"0000e7670f32038107a59a2b9cfefae36ea21f5aa63c", "00",
+		// signature
+		strings.Repeat("5a", 64),
+	}, "")
+	buf, _ := hex.DecodeString(raw)
+
+	g, err := DecodeOpGroup(buf, true, babylonParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2", g.Branch.String())
+	assert.Len(t, g.Contents, 2)
+	assert.True(t, g.Signature.IsValid())
+
+	reveal, ok := g.Contents[0].(*Reveal)
+	assert.True(t, ok)
+	assert.Equal(t, "tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx", reveal.Source.String())
+	assert.Equal(t, int64(1268), reveal.Fee)
+	assert.Equal(t, int64(1), reveal.Counter)
+	assert.Equal(t, int64(10000), reveal.GasLimit)
+	assert.Equal(t, "edpkuBknW28nW72KG6RoHtYW7p12T6GKc7nAbwYX5m8Wd9sDVC9yav", reveal.PublicKey.String())
+
+	tx, ok := g.Contents[1].(*Transaction)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1420), tx.Fee)
+	assert.Equal(t, int64(2), tx.Counter)
+	assert.Equal(t, int64(10600), tx.GasLimit)
+	assert.Equal(t, int64(257), tx.StorageLimit)
+	assert.Equal(t, int64(1000000), tx.Amount)
+	assert.Equal(t, "tz1gjaF81ZRRvdzjobyfVNsAeSC6PScjfQwN", tx.Destination.String())
+	assert.Nil(t, tx.Parameters)
+
+	enc, err := g.Encode(babylonParams)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, hex.EncodeToString(enc))
+}
+
+func TestDecodeOpGroup_ContractCallDelegationOrigination(t *testing.T) {
+	raw := strings.Join([]string{
+		testBranch,
+		// transaction: call %transfer on KT1LvAUw8xXH2X4WQRKUYvSiDuXkh15kNC1B with Unit
+		"6c", testSource, "a08d06", "03", "a0c21e", "00", "00",
+		"01874c8ae6885337cae788d2dcc80cae88b5a19bfc00",
+		"ff", "ff087472616e73666572", "00000002030b",
+		// delegation to tz3WXYtyDUNL91qfiCJtVUX746QpNv5i5ve5
+		"6e", testSource, "e80b", "04", "cc08", "00",
+		"ff026fde46af0356a0476dae4e4600172dc9309b3aa4",
+		// delegation withdrawal
+		"6e", testSource, "e80b", "05", "cc08", "00", "00",
+		// origination: balance 0, no delegate, empty code, Unit storage
+		"6d", testSource, "8c0b", "06", "e852", "c903", "00", "00",
+		"000000050200000000", "00000002030b",
+	}, "")
+	buf, _ := hex.DecodeString(raw)
+
+	g, err := DecodeOpGroup(buf, false, babylonParams)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, g.Signature.IsValid())
+	assert.Len(t, g.Contents, 4)
+
+	call := g.Contents[0].(*Transaction)
+	assert.Equal(t, int64(100000), call.Fee)
+	assert.Equal(t, int64(500000), call.GasLimit)
+	assert.Equal(t, "KT1LvAUw8xXH2X4WQRKUYvSiDuXkh15kNC1B", call.Destination.String())
+	// micheline.Parameters binary format
+	assert.Equal(t, "01ff087472616e7366657200000002030b", hex.EncodeToString(call.Parameters))
+
+	dlg := g.Contents[1].(*Delegation)
+	if assert.NotNil(t, dlg.Delegate) {
+		assert.Equal(t, "tz3WXYtyDUNL91qfiCJtVUX746QpNv5i5ve5", dlg.Delegate.String())
+	}
+	assert.Nil(t, g.Contents[2].(*Delegation).Delegate)
+
+	orig := g.Contents[3].(*Origination)
+	assert.Equal(t, int64(457), orig.StorageLimit)
+	assert.Nil(t, orig.Delegate)
+	assert.Equal(t, "00000005020000000000000002030b", hex.EncodeToString(orig.Script))
+
+	for i, op := range g.Contents {
+		assert.Equal(t, int64(3+i), op.Common().Counter)
+	}
+
+	enc, err := g.Encode(babylonParams)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, hex.EncodeToString(enc))
+}
+
+func TestOpGroupErrors(t *testing.T) {
+	buf, _ := hex.DecodeString(testBranch + "6c" + testSource + "8c0b")
+	_, err := DecodeOpGroup(buf, false, babylonParams)
+	assert.Error(t, err)
+
+	// pre-babylon tags
+	buf, _ = hex.DecodeString(testBranch + "08")
+	_, err = DecodeOpGroup(buf, false, babylonParams)
+	assert.Error(t, err)
+	_, err = DecodeOpGroup(buf, false, &Params{})
+	assert.Equal(t, ErrUnsupportedOpEncoding, err)
+
+	// tags not enabled by the protocol
+	buf, _ = hex.DecodeString(testBranch + "6f")
+	_, err = DecodeOpGroup(buf, false, babylonParams)
+	assert.Error(t, err)
+
+	g := OpGroup{
+		Branch:   NewBlockHash(make([]byte, 32)),
+		Contents: []ManagerOp{&Delegation{Manager: Manager{Source: MustParseAddress("tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx"), Fee: -1}}},
+	}
+	_, err = g.Encode(&Params{})
+	assert.Equal(t, ErrUnsupportedOpEncoding, err)
+	_, err = g.Encode(babylonParams)
+	assert.Error(t, err)
+}
+
+func TestReadN(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 1000000, 1<<62 + 12345} {
+		buf := bytes.NewBuffer(nil)
+		assert.NoError(t, writeN(buf, v))
+		n, err := readN(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, v, n)
+	}
+	_, err := readN(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}))
+	assert.Error(t, err)
+}
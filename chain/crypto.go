@@ -0,0 +1,268 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"tezos_index/base58"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// ErrSignature describes an error where a signature does not match
+	// the signed message and public key.
+	ErrSignature = errors.New("signature mismatch")
+
+	// ErrSignatureType describes an error where the signature curve does
+	// not match the key curve.
+	ErrSignatureType = errors.New("signature type mismatch")
+)
+
+// Watermarks are prepended to binary encoded data before it is hashed and
+// signed. They prevent a signature from being replayed in a different context.
+const (
+	WatermarkBlock       byte = 0x01
+	WatermarkEndorsement byte = 0x02
+	WatermarkOperation   byte = 0x03
+)
+
+// WatermarkOperationBytes returns the signing payload for a forged manager
+// operation group.
+func WatermarkOperationBytes(op []byte) []byte {
+	return append([]byte{WatermarkOperation}, op...)
+}
+
+// WatermarkBlockBytes returns the signing payload for a binary block header.
+func WatermarkBlockBytes(chainId ChainIdHash, header []byte) []byte {
+	buf := append([]byte{WatermarkBlock}, chainId.Hash.Hash...)
+	return append(buf, header...)
+}
+
+// WatermarkEndorsementBytes returns the signing payload for a forged endorsement.
+func WatermarkEndorsementBytes(chainId ChainIdHash, op []byte) []byte {
+	buf := append([]byte{WatermarkEndorsement}, chainId.Hash.Hash...)
+	return append(buf, op...)
+}
+
+// Digest returns the 32 byte blake2b hash of a watermarked message which is
+// what Tezos keys actually sign.
+func Digest(msg []byte) []byte {
+	h := blake2b.Sum256(msg)
+	return h[:]
+}
+
+// Verify checks that sig is a valid signature of the watermarked message msg
+// by this public key. Generic signatures are interpreted according to the key
+// curve.
+func (k Key) Verify(msg []byte, sig Signature) error {
+	if !k.IsValid() {
+		return ErrUnknownKeyType
+	}
+	if !sig.IsValid() {
+		return ErrUnknownSignatureType
+	}
+	if sig.Type != SignatureTypeGeneric && sig.Type != k.Type.SignatureType() {
+		return ErrSignatureType
+	}
+	digest := Digest(msg)
+	var ok bool
+	switch k.Type {
+	case KeyTypeEd25519:
+		ok = ed25519.Verify(ed25519.PublicKey(k.Data), digest, sig.Data)
+	case KeyTypeSecp256k1:
+		ok = secp256k1Verify(k.Data, digest, sig.Data)
+	case KeyTypeP256:
+		curve := elliptic.P256()
+		params := curve.Params()
+		x, y := decompressPoint(k.Data, params.P, big.NewInt(-3), params.B)
+		if x == nil {
+			return fmt.Errorf("invalid p256 public key")
+		}
+		r := new(big.Int).SetBytes(sig.Data[:32])
+		s := new(big.Int).SetBytes(sig.Data[32:])
+		ok = ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, digest, r, s)
+	default:
+		return ErrUnknownKeyType
+	}
+	if !ok {
+		return ErrSignature
+	}
+	return nil
+}
+
+// SignatureType returns the signature type produced by keys of this type.
+func (t KeyType) SignatureType() SignatureType {
+	switch t {
+	case KeyTypeEd25519, KeyTypeEd25519Sec:
+		return SignatureTypeEd25519
+	case KeyTypeSecp256k1, KeyTypeSecp256k1Sec:
+		return SignatureTypeSecp256k1
+	case KeyTypeP256, KeyTypeP256Sec:
+		return SignatureTypeP256
+	default:
+		return SignatureTypeInvalid
+	}
+}
+
+// PrivateKey is an unencrypted secret key for one of the three Tezos curves.
+// Ed25519 keys are stored in their 64 byte expanded form (seed || public key),
+// secp256k1 and P-256 keys as 32 byte scalars.
+type PrivateKey struct {
+	Type KeyType // one of the *Sec key types
+	Data []byte
+}
+
+func NewPrivateKey(typ KeyType, data []byte) PrivateKey {
+	return PrivateKey{
+		Type: typ,
+		Data: data,
+	}
+}
+
+// GenerateKey creates a new random private key for the curve of public key type typ.
+func GenerateKey(typ KeyType) (PrivateKey, error) {
+	switch typ {
+	case KeyTypeEd25519:
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return PrivateKey{}, err
+		}
+		return NewPrivateKey(KeyTypeEd25519Sec, []byte(sk)), nil
+	case KeyTypeSecp256k1:
+		sk, err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			return PrivateKey{}, err
+		}
+		return NewPrivateKey(KeyTypeSecp256k1Sec, sk.Serialize()), nil
+	case KeyTypeP256:
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return PrivateKey{}, err
+		}
+		buf := make([]byte, 32)
+		putBig(buf, sk.D)
+		return NewPrivateKey(KeyTypeP256Sec, buf), nil
+	default:
+		return PrivateKey{}, ErrUnknownKeyType
+	}
+}
+
+func (k PrivateKey) IsValid() bool {
+	switch k.Type {
+	case KeyTypeEd25519Sec, KeyTypeSecp256k1Sec, KeyTypeP256Sec:
+		return k.Type.Len() == len(k.Data)
+	default:
+		return false
+	}
+}
+
+func (k PrivateKey) String() string {
+	if !k.IsValid() {
+		return ""
+	}
+	return base58.CheckEncode(k.Data, k.Type.PrefixBytes())
+}
+
+func (k PrivateKey) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *PrivateKey) UnmarshalText(data []byte) error {
+	key, err := ParsePrivateKey(string(data))
+	if err != nil {
+		return err
+	}
+	*k = key
+	return nil
+}
+
+// ParsePrivateKey decodes an unencrypted edsk, spsk or p2sk secret key. Both
+// the 32 byte seed and 64 byte expanded forms of Ed25519 keys are accepted.
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	decoded, version, err := base58.CheckDecode(s, 4, nil)
+	if err != nil {
+		if err == base58.ErrChecksum {
+			return PrivateKey{}, ErrChecksumMismatch
+		}
+		return PrivateKey{}, fmt.Errorf("unknown format for private key: %v", err)
+	}
+	var k PrivateKey
+	switch true {
+	case bytes.Compare(version, ED25519_SEED_ID) == 0 && len(decoded) == ed25519.SeedSize:
+		return NewPrivateKey(KeyTypeEd25519Sec, ed25519.NewKeyFromSeed(decoded)), nil
+	case bytes.Compare(version, ED25519_SECRET_KEY_ID) == 0:
+		k.Type = KeyTypeEd25519Sec
+	case bytes.Compare(version, SECP256K1_SECRET_KEY_ID) == 0:
+		k.Type = KeyTypeSecp256k1Sec
+	case bytes.Compare(version, P256_SECRET_KEY_ID) == 0:
+		k.Type = KeyTypeP256Sec
+	default:
+		return k, fmt.Errorf("unknown version %v for private key", version)
+	}
+	if l := len(decoded); l != k.Type.Len() {
+		return k, fmt.Errorf("invalid length %d for %s private key data", l, k.Type.Prefix())
+	}
+	k.Data = decoded
+	return k, nil
+}
+
+// Public derives the public key.
+func (k PrivateKey) Public() Key {
+	if !k.IsValid() {
+		return Key{Type: KeyTypeInvalid}
+	}
+	switch k.Type {
+	case KeyTypeEd25519Sec:
+		pk := ed25519.PrivateKey(k.Data).Public().(ed25519.PublicKey)
+		return NewKey(KeyTypeEd25519, []byte(pk))
+	case KeyTypeSecp256k1Sec:
+		return NewKey(KeyTypeSecp256k1, secp256k1PublicKey(k.Data))
+	default:
+		x, y := elliptic.P256().ScalarBaseMult(k.Data)
+		return NewKey(KeyTypeP256, compressPoint(x, y))
+	}
+}
+
+// Address derives the implicit account address of the key.
+func (k PrivateKey) Address() Address {
+	return k.Public().Address()
+}
+
+// Sign signs the watermarked message msg.
+func (k PrivateKey) Sign(msg []byte) (Signature, error) {
+	if !k.IsValid() {
+		return Signature{}, ErrUnknownKeyType
+	}
+	digest := Digest(msg)
+	switch k.Type {
+	case KeyTypeEd25519Sec:
+		return NewSignature(SignatureTypeEd25519, ed25519.Sign(ed25519.PrivateKey(k.Data), digest)), nil
+	case KeyTypeSecp256k1Sec:
+		return NewSignature(SignatureTypeSecp256k1, secp256k1Sign(k.Data, digest)), nil
+	default:
+		curve := elliptic.P256()
+		sk := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(k.Data)}
+		sk.Curve = curve
+		sk.X, sk.Y = curve.ScalarBaseMult(k.Data)
+		r, s, err := ecdsa.Sign(rand.Reader, sk, digest)
+		if err != nil {
+			return Signature{}, err
+		}
+		// use lower-S form like tezos-client
+		if n := curve.Params().N; s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			s.Sub(n, s)
+		}
+		buf := make([]byte, 64)
+		putBig(buf[:32], r)
+		putBig(buf[32:], s)
+		return NewSignature(SignatureTypeP256, buf), nil
+	}
+}
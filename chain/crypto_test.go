@@ -0,0 +1,130 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/base58"
+)
+
+func TestSecp256k1Vector(t *testing.T) {
+	// well-known RFC 6979 vector: key 1, sha256("Satoshi Nakamoto")
+	d := make([]byte, 32)
+	d[31] = 1
+	assert.Equal(t,
+		"0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		hex.EncodeToString(secp256k1PublicKey(d)),
+	)
+	digest := sha256.Sum256([]byte("Satoshi Nakamoto"))
+	sig := secp256k1Sign(d, digest[:])
+	assert.Equal(t,
+		"934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8"+
+			"2442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5",
+		hex.EncodeToString(sig),
+	)
+	assert.True(t, secp256k1Verify(secp256k1PublicKey(d), digest[:], sig))
+	digest[0] ^= 1
+	assert.False(t, secp256k1Verify(secp256k1PublicKey(d), digest[:], sig))
+}
+
+// signatures of Digest(03 || "tezos_index") created with openssl from keys
+// unknown to this package; the secp256k1 signature is in lower-S form
+var verifyVectors = []struct {
+	Key string
+	Sig string
+}{
+	{
+		"edpkuDRgCpUJmJpDStcyPo7m7FyMJmkinDpoENMS9EiiFX3QbCuBji",
+		"edsigtceuZhZrfSmjXSdZVHjMpt4oQfdZbLrE5z3R56ReBjfvpPs69kgKLcN1Yb7TUy6Vvx5Q5F3fPUcNLwZFtEPvafrSRzJBzH",
+	},
+	{
+		"sppk7bZZgSAerQox6iXAdna68NcePSwCL3g366waFkw6ndPF2i9dhpn",
+		"spsig1dYNEFoT9CDnAnu7ppjkEcM8kcCtYXeT9DmBe6Gw827TrquTsyh8KMYFxhjtemjGb4wxE6K3yvodQmuNuf248MHcrxJZf2",
+	},
+	{
+		"p2pk67zkVzNNs8T33BuTnES2SezeBqfFBbDpuADEcVxbWCjrzSiA3sW",
+		"p2sigteJeb7YthTngDNkZzd1CL8ThKsJZwP2MCBr5QwND6qb4tkdvdG86yXA53s7yhsbW1gGP8LbXC4QS2aETmwgTSWCAb3ZQH",
+	},
+}
+
+func TestVerifyVectors(t *testing.T) {
+	msg := WatermarkOperationBytes([]byte("tezos_index"))
+	for _, v := range verifyVectors {
+		pk, err := ParseKey(v.Key)
+		if !assert.NoError(t, err, v.Key) {
+			continue
+		}
+		sig, err := ParseSignature(v.Sig)
+		if !assert.NoError(t, err, v.Sig) {
+			continue
+		}
+		assert.NoError(t, pk.Verify(msg, sig), v.Key)
+		assert.NoError(t, pk.Verify(msg, NewSignature(SignatureTypeGeneric, sig.Data)), v.Key)
+		assert.Equal(t, ErrSignature, pk.Verify(msg[1:], sig), v.Key)
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	msg := WatermarkOperationBytes([]byte("tezos"))
+	for _, typ := range []KeyType{KeyTypeEd25519, KeyTypeSecp256k1, KeyTypeP256} {
+		sk, err := GenerateKey(typ)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		pk := sk.Public()
+		assert.Equal(t, typ, pk.Type)
+		assert.True(t, pk.IsValid())
+		assert.Equal(t, typ.AddressType(), sk.Address().Type)
+
+		sig, err := sk.Sign(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, typ.SignatureType(), sig.Type)
+		assert.NoError(t, pk.Verify(msg, sig), typ.String())
+
+		// generic signatures are checked against the key curve
+		assert.NoError(t, pk.Verify(msg, NewSignature(SignatureTypeGeneric, sig.Data)))
+
+		// watermark is part of the signed message
+		assert.Equal(t, ErrSignature, pk.Verify([]byte("tezos"), sig))
+
+		// round-trip through base58
+		assert.Equal(t, sk.Type.Prefix(), sk.String()[:4])
+		sk2, err := ParsePrivateKey(sk.String())
+		assert.NoError(t, err)
+		assert.Equal(t, sk.Data, sk2.Data)
+		assert.True(t, pk.IsEqual(sk2.Public()))
+	}
+
+	ed, _ := GenerateKey(KeyTypeEd25519)
+	sp, _ := GenerateKey(KeyTypeSecp256k1)
+	sig, _ := ed.Sign(msg)
+	assert.Equal(t, ErrSignatureType, sp.Public().Verify(msg, sig))
+}
+
+func TestParsePrivateKeySeed(t *testing.T) {
+	seed := make([]byte, 32)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	sk, err := ParsePrivateKey(base58.CheckEncode(seed, ED25519_SEED_ID))
+	assert.NoError(t, err)
+	assert.Equal(t, KeyTypeEd25519Sec, sk.Type)
+	assert.Len(t, sk.Data, 64)
+	assert.Equal(t, seed, sk.Data[:32])
+}
+
+func TestSignatureUnmarshalBinary(t *testing.T) {
+	buf := make([]byte, 65)
+	buf[0] = 1
+	buf[1] = 0xaa
+	buf[64] = 0xbb
+	var s Signature
+	assert.NoError(t, s.UnmarshalBinary(buf))
+	assert.Equal(t, SignatureTypeSecp256k1, s.Type)
+	assert.Equal(t, buf[1:], s.Data)
+
+	assert.NoError(t, s.UnmarshalBinary(buf[1:]))
+	assert.Equal(t, SignatureTypeGeneric, s.Type)
+	assert.Equal(t, buf[1:], s.Data)
+}
@@ -88,6 +88,8 @@ const (
 	OpTypeAirdrop                                 // 14
 	OpTypeSeedSlash                               // 15
 	OpTypeEndorsementWithSlot                     // 16
+	OpTypeRegisterConstant                        // 17
+	OpTypeSetDepositsLimit                        // 18
 	OpTypeInvalid                   = 255
 )
 
@@ -144,6 +146,10 @@ func ParseOpType(s string) OpType {
 		return OpTypeSeedSlash
 	case "endorsement_with_slot":
 		return OpTypeEndorsementWithSlot
+	case "register_global_constant":
+		return OpTypeRegisterConstant
+	case "set_deposits_limit":
+		return OpTypeSetDepositsLimit
 	default:
 		return OpTypeInvalid
 	}
@@ -185,6 +191,10 @@ func (t OpType) String() string {
 		return "seed_slash"
 	case OpTypeEndorsementWithSlot:
 		return "endorsement_with_slot"
+	case OpTypeRegisterConstant:
+		return "register_global_constant"
+	case OpTypeSetDepositsLimit:
+		return "set_deposits_limit"
 	default:
 		return ""
 	}
@@ -204,6 +214,8 @@ var (
 		OpTypeTransaction:               8,
 		OpTypeOrigination:               9,
 		OpTypeDelegation:                10,
+		OpTypeRegisterConstant:          255, // invalid tag, not part of protocol
+		OpTypeSetDepositsLimit:          255, // invalid tag, not part of protocol
 		OpTypeBake:                      255, // invalid tag, not part of protocol
 		OpTypeUnfreeze:                  255, // invalid tag, not part of protocol
 		OpTypeInvoice:                   255, // invalid tag, not part of protocol
@@ -223,6 +235,8 @@ var (
 		OpTypeTransaction:               108,
 		OpTypeOrigination:               109,
 		OpTypeDelegation:                110,
+		OpTypeRegisterConstant:          255, // v011, set by protocol params
+		OpTypeSetDepositsLimit:          255, // v012, set by protocol params
 		OpTypeBake:                      255, // invalid tag, not part of protocol
 		OpTypeUnfreeze:                  255, // invalid tag, not part of protocol
 		OpTypeInvoice:                   255, // invalid tag, not part of protocol
@@ -231,17 +245,40 @@ var (
 	}
 )
 
+// opTags returns the tag table for the operation tags version of p.
+func opTags(p *Params) map[OpType]byte {
+	if p != nil && p.OperationTagsVersion == 1 {
+		return opTagV2
+	}
+	return opTagV1
+}
+
 func (t OpType) Tag(p *Params) byte {
-	v := 0
 	if p != nil {
-		v = p.OperationTagsVersion
+		if tag, ok := p.OperationTags[t.String()]; ok {
+			return tag
+		}
 	}
-	switch v {
-	case 1:
-		return opTagV2[t]
-	default:
-		return opTagV1[t]
+	return opTags(p)[t]
+}
+
+// ParseOpTagParams returns the op type encoded as tag t by protocol params p.
+// Unlike ParseOpTag it honours per-protocol tag overrides and rejects tags of
+// other tag versions.
+func ParseOpTagParams(t byte, p *Params) OpType {
+	if p != nil {
+		for name, tag := range p.OperationTags {
+			if tag == t {
+				return ParseOpType(name)
+			}
+		}
+	}
+	for typ, tag := range opTags(p) {
+		if tag == t && tag != 255 && typ.Tag(p) == t {
+			return typ
+		}
 	}
+	return OpTypeInvalid
 }
 
 func ParseOpTag(t byte) OpType {
@@ -268,6 +305,8 @@ func ParseOpTag(t byte) OpType {
 		return OpTypeOrigination
 	case 10, 110:
 		return OpTypeDelegation
+	case 111:
+		return OpTypeRegisterConstant
 	default:
 		return OpTypeInvalid
 	}
@@ -61,16 +61,27 @@ type Params struct {
 	// New in Delphi v007
 	MaxAnonOpsPerBlock int `json:"max_anon_ops_per_block"` // was max_revelations_per_block
 
+	// New in Granada v010
+	MinimalBlockDelay                 time.Duration `json:"minimal_block_delay"`
+	LiquidityBakingSubsidy            int64         `json:"liquidity_baking_subsidy"`
+	LiquidityBakingSunsetLevel        int64         `json:"liquidity_baking_sunset_level"`
+	LiquidityBakingEscapeEmaThreshold int64         `json:"liquidity_baking_escape_ema_threshold"`
+
 	// hidden invoice feature
 	Invoices map[string]int64 `json:"invoices,omitempty"`
 
 	// extra features to follow protocol upgrades
-	SilentSpendable      bool  `json:"silent_spendable"` // contracts are spendable/delegatable without flag set
-	HasOriginationBug    bool  `json:"has_origination_bug"`
-	ReactivateByTx       bool  `json:"reactivate_by_tx"`
-	OperationTagsVersion int   `json:"operation_tags_version"`
-	NumVotingPeriods     int   `json:"num_voting_periods"`
-	StartBlockOffset     int64 `json:"vote_block_offset"` // correct voting start/end detection
+	SilentSpendable      bool            `json:"silent_spendable"` // contracts are spendable/delegatable without flag set
+	HasOriginationBug    bool            `json:"has_origination_bug"`
+	ReactivateByTx       bool            `json:"reactivate_by_tx"`
+	OperationTagsVersion int             `json:"operation_tags_version"`
+	OperationTags        map[string]byte `json:"operation_tags,omitempty"` // tags by op kind, override the tag version
+	NumVotingPeriods     int             `json:"num_voting_periods"`
+	StartBlockOffset     int64           `json:"vote_block_offset"` // correct voting start/end detection
+
+	// cycle length changes (Granada) restart cycle counting at StartCycle
+	StartCycle       int64 `json:"start_cycle"`        // first cycle with the current length
+	StartCycleHeight int64 `json:"start_cycle_height"` // first block of StartCycle, 0 for genesis
 }
 
 func NewParams() *Params {
@@ -108,34 +119,35 @@ func (p *Params) ConvertValue(amount int64) float64 {
 	return float64(amount) / float64(p.Token)
 }
 
+// cycleBase returns the first block of StartCycle.
+func (p *Params) cycleBase() int64 {
+	if p.StartCycleHeight > 0 {
+		return p.StartCycleHeight
+	}
+	return 1
+}
+
 func (p *Params) IsCycleStart(height int64) bool {
-	return height > 0 && (height-1)%p.BlocksPerCycle == 0
+	return height > 0 && (height-p.cycleBase())%p.BlocksPerCycle == 0
 }
 
 func (p *Params) IsCycleEnd(height int64) bool {
-	return height > 0 && height%p.BlocksPerCycle == 0
+	return height > 0 && (height-p.cycleBase()+1)%p.BlocksPerCycle == 0
 }
 
 func (p *Params) CycleFromHeight(height int64) int64 {
 	if height == 0 {
 		return 0
 	}
-	return (height - 1) / p.BlocksPerCycle
+	return p.StartCycle + (height-p.cycleBase())/p.BlocksPerCycle
 }
 
 func (p *Params) CycleStartHeight(cycle int64) int64 {
-	return cycle*p.BlocksPerCycle + 1
+	return p.cycleBase() + (cycle-p.StartCycle)*p.BlocksPerCycle
 }
 
 func (p *Params) CycleEndHeight(cycle int64) int64 {
-	return (cycle + 1) * p.BlocksPerCycle
-}
-
-func (p *Params) SnapshotBlock(cycle, index int64) int64 {
-	if cycle < p.PreservedCycles+2 {
-		return 0
-	}
-	return p.CycleStartHeight(cycle-(p.PreservedCycles+2)) + (index+1)*p.BlocksPerRollSnapshot - 1
+	return p.CycleStartHeight(cycle+1) - 1
 }
 
 func (p *Params) VotingStartCycleFromHeight(height int64) int64 {
@@ -165,3 +177,44 @@ func (p *Params) ContainsHeight(height int64) bool {
 func (p *Params) IsMainnet() bool {
 	return p.ChainId.IsEqual(Mainnet)
 }
+
+// Deployments are protocol params in activation order. Cycle heights derived
+// from a single deployment are only valid for cycles with its cycle length,
+// Deployments computes them from the deployment active at each cycle.
+type Deployments []*Params
+
+// ByCycle returns the deployment active at the start of cycle or nil when
+// d is empty.
+func (d Deployments) ByCycle(cycle int64) *Params {
+	for i := len(d) - 1; i >= 0; i-- {
+		p := d[i]
+		if p.StartCycle <= cycle && p.CycleStartHeight(cycle) >= p.StartHeight {
+			return p
+		}
+	}
+	if len(d) == 0 {
+		return nil
+	}
+	return d[0]
+}
+
+func (d Deployments) CycleStartHeight(cycle int64) int64 {
+	return d.ByCycle(cycle).CycleStartHeight(cycle)
+}
+
+func (d Deployments) CycleEndHeight(cycle int64) int64 {
+	return d.CycleStartHeight(cycle+1) - 1
+}
+
+// SnapshotBlock returns the height of roll snapshot index taken for cycle.
+// The snapshot cycle precedes cycle by preserved_cycles+2 and may still use
+// the cycle and snapshot length of an earlier deployment.
+func (d Deployments) SnapshotBlock(cycle, index int64) int64 {
+	p := d.ByCycle(cycle)
+	if cycle < p.PreservedCycles+2 {
+		return 0
+	}
+	snap := cycle - (p.PreservedCycles + 2)
+	sp := d.ByCycle(snap)
+	return sp.CycleStartHeight(snap) + (index+1)*sp.BlocksPerRollSnapshot - 1
+}
@@ -0,0 +1,91 @@
+package chain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParamsCycles(t *testing.T) {
+	edo := NewParams().ForNetwork(Mainnet).ForProtocol(ProtoV008_2)
+	edo.BlocksPerCycle = 4096
+	assert.Equal(t, int64(387), edo.CycleFromHeight(1589248))
+	assert.True(t, edo.IsCycleEnd(1589248))
+	assert.True(t, edo.IsCycleStart(1585153))
+	assert.Equal(t, int64(1585153), edo.CycleStartHeight(387))
+
+	// Granada doubles cycle length from cycle 388
+	granada := NewParams().ForNetwork(Mainnet).ForProtocol(ProtoV010)
+	granada.BlocksPerCycle = 8192
+	granada.StartCycle, granada.StartCycleHeight = 388, 1589249
+	assert.Equal(t, int64(388), granada.CycleFromHeight(1589249))
+	assert.Equal(t, int64(388), granada.CycleFromHeight(1597440))
+	assert.Equal(t, int64(389), granada.CycleFromHeight(1597441))
+	assert.True(t, granada.IsCycleStart(1589249))
+	assert.True(t, granada.IsCycleEnd(1597440))
+	assert.True(t, granada.IsCycleStart(1597441))
+	assert.False(t, granada.IsCycleStart(1593345))
+	assert.Equal(t, int64(1597441), granada.CycleStartHeight(389))
+	assert.Equal(t, int64(1605632), granada.CycleEndHeight(389))
+}
+
+func TestOpTypeTag(t *testing.T) {
+	p := &Params{OperationTagsVersion: 1}
+	assert.Equal(t, byte(108), OpTypeTransaction.Tag(p))
+	assert.Equal(t, byte(255), OpTypeRegisterConstant.Tag(p))
+	assert.Equal(t, byte(255), OpTypeSetDepositsLimit.Tag(p))
+	p.OperationTags = map[string]byte{OpTypeRegisterConstant.String(): 111}
+	assert.Equal(t, byte(111), OpTypeRegisterConstant.Tag(p))
+	assert.Equal(t, byte(108), OpTypeTransaction.Tag(p))
+	assert.Equal(t, byte(8), OpTypeTransaction.Tag(nil))
+}
+
+func TestParseOpTagParams(t *testing.T) {
+	v1 := &Params{OperationTagsVersion: 1}
+	v11 := &Params{OperationTagsVersion: 1, OperationTags: map[string]byte{OpTypeRegisterConstant.String(): 111}}
+	for _, v := range []struct {
+		Tag    byte
+		Params *Params
+		Typ    OpType
+	}{
+		{8, nil, OpTypeTransaction},
+		{108, nil, OpTypeInvalid},
+		{108, v1, OpTypeTransaction},
+		{8, v1, OpTypeInvalid},
+		{0, v1, OpTypeEndorsement},
+		{111, v1, OpTypeInvalid},
+		{112, v11, OpTypeInvalid},
+		{111, v11, OpTypeRegisterConstant},
+		{110, v11, OpTypeDelegation},
+		{255, v11, OpTypeInvalid},
+	} {
+		assert.Equal(t, v.Typ, ParseOpTagParams(v.Tag, v.Params), "tag %d", v.Tag)
+	}
+}
+
+func TestDeploymentsCycles(t *testing.T) {
+	florence := NewParams().ForNetwork(Mainnet).ForProtocol(ProtoV009)
+	florence.StartHeight, florence.EndHeight = 1466369, 1589248
+	florence.BlocksPerCycle, florence.BlocksPerRollSnapshot, florence.PreservedCycles = 4096, 256, 5
+	granada := NewParams().ForNetwork(Mainnet).ForProtocol(ProtoV010)
+	granada.StartHeight, granada.EndHeight = 1589249, 1916928
+	granada.BlocksPerCycle, granada.BlocksPerRollSnapshot, granada.PreservedCycles = 8192, 512, 5
+	granada.StartCycle, granada.StartCycleHeight = 388, 1589249
+	hangzhou := NewParams().ForNetwork(Mainnet).ForProtocol(ProtoV011_2)
+	hangzhou.StartHeight = 1916929
+	hangzhou.BlocksPerCycle, hangzhou.BlocksPerRollSnapshot, hangzhou.PreservedCycles = 8192, 512, 5
+	hangzhou.StartCycle, hangzhou.StartCycleHeight = 388, 1589249
+	d := Deployments{florence, granada, hangzhou}
+
+	assert.Equal(t, florence, d.ByCycle(381))
+	assert.Equal(t, granada, d.ByCycle(388))
+	assert.Equal(t, hangzhou, d.ByCycle(428))
+	assert.Equal(t, int64(1560577), d.CycleStartHeight(381))
+	assert.Equal(t, int64(1589248), d.CycleEndHeight(387))
+	assert.Equal(t, int64(1589249), d.CycleStartHeight(388))
+	assert.Equal(t, int64(1916929), d.CycleStartHeight(428))
+
+	// snapshots for cycles 388-394 are taken in 4096 block cycles
+	assert.Equal(t, int64(1560577+256-1), d.SnapshotBlock(388, 0))
+	assert.Equal(t, int64(1585153+16*256-1), d.SnapshotBlock(394, 15))
+	assert.Equal(t, int64(1589249+512-1), d.SnapshotBlock(395, 0))
+}
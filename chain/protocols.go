@@ -16,6 +16,10 @@ var (
 	ProtoV007   = ParseProtocolHashSafe("PsDELPH1Kxsxt8f9eWbxQeRxkjfbxoqM52jvs5Y5fBxWWh4ifpo")
 	ProtoV008_1 = ParseProtocolHashSafe("PtEdoTezd3RHSC31mpxxo1npxFjoWWcFgQtxapi51Z8TLu6v6Uq")
 	ProtoV008_2 = ParseProtocolHashSafe("PtEdo2ZkT9oKpimTah6x2embF25oss54njMuPzkJTEi5RqfdZFA")
+	ProtoV009   = ParseProtocolHashSafe("PsFLorenaUUuikDWvMDr6fGBRG8kt3e3D3fHoXK1j1BFRxeSH4i")
+	ProtoV010   = ParseProtocolHashSafe("PtGRANADsDU8R9daYKAgWnQYAJ64omN1o3KMGVCykShA97vQbvV")
+	ProtoV011_1 = ParseProtocolHashSafe("PtHangzHogokSuiMHemCuowEavgYTP8J5qQ9fQS793MHYFpCY3r")
+	ProtoV011_2 = ParseProtocolHashSafe("PtHangz2aRngywmSRGGvrcTyMbbdpWdpFKuS4uMWxg2RaH9i1qx")
 
 	Mainnet     = MustParseChainIdHash("NetXdQprcVkpaWU")
 	Alphanet    = MustParseChainIdHash("NetXgtSLGNJvNye")
@@ -25,6 +29,9 @@ var (
 	Delphinet   = MustParseChainIdHash("NetXm8tYqnMWky1")
 	Edonet      = MustParseChainIdHash("NetXSp4gfdanies")
 	Edonet2     = MustParseChainIdHash("NetXSgo1ZT2DRUG")
+	Florencenet = MustParseChainIdHash("NetXxkAx4woPLyu")
+	Granadanet  = MustParseChainIdHash("NetXz969SFaFn8k")
+	Hangzhounet = MustParseChainIdHash("NetXZSsxBpMQeAT")
 
 	// maximum depth of branches for ops to be included on chain, also
 	// defines max depth of a possible reorg and max block priorities
@@ -52,12 +59,20 @@ func (p *Params) ForNetwork(net ChainIdHash) *Params {
 		pp.Network = "Edonet"
 	case Edonet2.IsEqual(net):
 		pp.Network = "Edonet2"
+	case Florencenet.IsEqual(net):
+		pp.Network = "Florencenet"
+	case Granadanet.IsEqual(net):
+		pp.Network = "Granadanet"
+	case Hangzhounet.IsEqual(net):
+		pp.Network = "Hangzhounet"
 	default:
 		pp.Network = "Sandbox"
 	}
 	return pp
 }
 
+// ForProtocol returns a copy of p with protocol features up to Edo v008.
+// Later protocols are configured by their protocol handler.
 func (p *Params) ForProtocol(proto ProtocolHash) *Params {
 	pp := &Params{}
 	*pp = *p
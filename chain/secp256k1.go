@@ -0,0 +1,82 @@
+package chain
+
+import (
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// secp256k1PublicKey returns the 33 byte compressed public key for the
+// secret scalar d.
+func secp256k1PublicKey(d []byte) []byte {
+	return secp256k1.PrivKeyFromBytes(d).PubKey().SerializeCompressed()
+}
+
+// secp256k1Verify checks a 64 byte r || s signature of digest against a
+// compressed public key.
+func secp256k1Verify(pub, digest, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	key, err := secp256k1.ParsePubKey(pub)
+	if err != nil {
+		return false
+	}
+	var r, s secp256k1.ModNScalar
+	if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) {
+		return false
+	}
+	return ecdsa.NewSignature(&r, &s).Verify(digest, key)
+}
+
+// secp256k1Sign returns a deterministic (RFC 6979) lower-S signature of
+// digest in 64 byte r || s form.
+func secp256k1Sign(d, digest []byte) []byte {
+	sk := secp256k1.PrivKeyFromBytes(d)
+	defer sk.Zero()
+	// compact signatures are prefixed with a public key recovery code
+	return ecdsa.SignCompact(sk, digest, true)[1:]
+}
+
+// putBig writes v big-endian and left-padded into buf.
+func putBig(buf []byte, v *big.Int) {
+	b := v.Bytes()
+	for i := range buf[:len(buf)-len(b)] {
+		buf[i] = 0
+	}
+	copy(buf[len(buf)-len(b):], b)
+}
+
+// compressPoint encodes an affine point in 33 byte SEC1 compressed form.
+func compressPoint(x, y *big.Int) []byte {
+	buf := make([]byte, 33)
+	buf[0] = 0x02 | byte(y.Bit(0))
+	putBig(buf[1:], x)
+	return buf
+}
+
+// decompressPoint decodes a 33 byte SEC1 compressed point on the curve
+// y^2 = x^3 + ax + b over GF(p). It returns nil when the point is invalid.
+func decompressPoint(buf []byte, p, a, b *big.Int) (*big.Int, *big.Int) {
+	if len(buf) != 33 || (buf[0] != 0x02 && buf[0] != 0x03) {
+		return nil, nil
+	}
+	x := new(big.Int).SetBytes(buf[1:])
+	if x.Cmp(p) >= 0 {
+		return nil, nil
+	}
+	y2 := new(big.Int).Mul(x, x)
+	y2.Add(y2, a)
+	y2.Mul(y2, x)
+	y2.Add(y2, b)
+	y2.Mod(y2, p)
+	y := new(big.Int).ModSqrt(y2, p)
+	if y == nil {
+		return nil, nil
+	}
+	if y.Bit(0) != uint(buf[0]&1) {
+		y.Sub(p, y)
+	}
+	return x, y
+}
@@ -3,10 +3,12 @@ module tezos_index
 go 1.14
 
 require (
-	blockwatch.cc/tzindex v0.0.0-20210402095526-71d5b19a0d80 // indirect
+	blockwatch.cc/tzindex v0.0.0-20210402095526-71d5b19a0d80
 	github.com/cespare/xxhash v1.1.0
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
 	github.com/echa/log v1.0.3
 	github.com/ericlagergren/decimal v0.0.0-20191206042408-88212e6cfca9
+	github.com/getsentry/sentry-go v0.11.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-bson/bson v0.0.0-20171017145622-6d291e839eca
 	github.com/go-redis/redis v6.15.9+incompatible
@@ -15,6 +17,8 @@ require (
 	github.com/onsi/gomega v1.10.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pressly/goose v2.6.0+incompatible
+	github.com/prometheus/client_golang v1.6.0
+	github.com/segmentio/kafka-go v0.4.8
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.4.0
@@ -2,15 +2,36 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/zyjblockchain/sandy_log/log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"tezos_index/chain"
 	"tezos_index/puller"
+	"tezos_index/reporting"
+	"time"
 )
 
+const usage = `usage: tezos_index [flags] <command>
+
+commands:
+  sync                      index new blocks (default)
+  rollback --to <height|-N> roll the index back to height or by N blocks
+  info                      print chain tip, index tips and deployments
+  migrate up                apply all schema migrations
+  migrate down-to <version> roll the schema back to version
+  verify --from <h> --to <h> check indexed blocks against the node
+  payout <baker> <cycle>    compute delegator payouts, see --payout-fee,
+                            --min-payout, --exclude and --format; --format forge
+                            prints unsigned transaction batches from --payout-source
+`
+
 func main() {
 	// 0. 初始化日志级别、格式、是否保存到文件
 	log.Setup(log.LevelDebug, false, true)
@@ -19,13 +40,44 @@ func main() {
 	// 1. env
 	env := puller.NewEnvironment()
 
+	cmd := "sync"
+	if len(env.Args) > 0 {
+		cmd = env.Args[0]
+	}
+	var err error
+	switch cmd {
+	case "sync":
+		err = runSync(ctx, env)
+	case "rollback":
+		err = runRollback(ctx, env)
+	case "info":
+		err = runInfo(ctx, env)
+	case "migrate":
+		err = runMigrate(env)
+	case "verify":
+		err = runVerify(ctx, env)
+	case "payout":
+		err = runPayout(ctx, env)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	// send pending error reports
+	reporting.Flush(5 * time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+func runSync(ctx context.Context, env *puller.Environment) error {
 	// migration database
 	env.UpgradeSchema()
 
 	crawler := env.NewPuller()
 	// init
 	if err := crawler.Init(ctx, puller.MODE_SYNC); err != nil {
-		panic(fmt.Errorf("init crawler error : %v", err))
+		return err
 	}
 	// puller
 	crawler.Start()
@@ -43,4 +95,166 @@ func main() {
 		syscall.SIGQUIT,
 	)
 	<-c
+	return nil
+}
+
+func runRollback(ctx context.Context, env *puller.Environment) error {
+	height, err := strconv.ParseInt(env.Conf.To, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid --to height %q", env.Conf.To)
+	}
+	crawler := env.NewPuller()
+	if err := crawler.Init(ctx, puller.MODE_ROLLBACK); err != nil {
+		return err
+	}
+	if err := crawler.Rollback(ctx, height, false); err != nil {
+		return err
+	}
+	if err := crawler.GetIndexer().Close(); err != nil {
+		return err
+	}
+	log.Infof("Rolled back to block %d.", crawler.Height())
+	return nil
+}
+
+func runInfo(ctx context.Context, env *puller.Environment) error {
+	crawler := env.NewPuller()
+	if err := crawler.Init(ctx, puller.MODE_INFO); err != nil {
+		return err
+	}
+	return printJSON(crawler.Info())
+}
+
+func runMigrate(env *puller.Environment) error {
+	var sub, version string
+	if len(env.Args) > 1 {
+		sub = env.Args[1]
+	}
+	if len(env.Args) > 2 {
+		version = env.Args[2]
+	} else {
+		version = env.Conf.To
+	}
+	switch sub {
+	case "up":
+		env.UpgradeSchema()
+	case "down-to":
+		if version == "" {
+			return fmt.Errorf("missing version")
+		}
+		env.RollbackSchema(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q, use up or down-to", sub)
+	}
+	return nil
+}
+
+func runVerify(ctx context.Context, env *puller.Environment) error {
+	var to int64
+	if env.Conf.To != "" {
+		var err error
+		if to, err = strconv.ParseInt(env.Conf.To, 10, 64); err != nil {
+			return fmt.Errorf("invalid --to height %q", env.Conf.To)
+		}
+	}
+	crawler := env.NewPuller()
+	if err := crawler.Init(ctx, puller.MODE_INFO); err != nil {
+		return err
+	}
+	errs, err := crawler.Verify(ctx, env.Conf.From, to)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(errs); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d inconsistent blocks", len(errs))
+	}
+	return nil
+}
+
+func runPayout(ctx context.Context, env *puller.Environment) error {
+	if len(env.Args) < 3 {
+		return fmt.Errorf("usage: payout <baker> <cycle>")
+	}
+	baker, err := chain.ParseAddress(env.Args[1])
+	if err != nil {
+		return fmt.Errorf("invalid baker %q", env.Args[1])
+	}
+	cfg := puller.PayoutConfig{MinPayout: env.Conf.MinPayout}
+	if cfg.Cycle, err = strconv.ParseInt(env.Args[2], 10, 64); err != nil {
+		return fmt.Errorf("invalid cycle %q", env.Args[2])
+	}
+	if env.Conf.PayoutFee != "" {
+		if cfg.Fee, err = strconv.ParseFloat(env.Conf.PayoutFee, 64); err != nil {
+			return fmt.Errorf("invalid --payout-fee %q", env.Conf.PayoutFee)
+		}
+	}
+	if env.Conf.Exclude != "" {
+		for _, v := range strings.Split(env.Conf.Exclude, ",") {
+			addr, err := chain.ParseAddress(v)
+			if err != nil {
+				return fmt.Errorf("invalid --exclude address %q", v)
+			}
+			cfg.Exclude = append(cfg.Exclude, addr)
+		}
+	}
+	crawler := env.NewPuller()
+	if err := crawler.Init(ctx, puller.MODE_INFO); err != nil {
+		return err
+	}
+	report, err := crawler.GetIndexer().Payouts(ctx, baker, cfg)
+	if err != nil {
+		return err
+	}
+	if !report.Complete {
+		log.Warnf("Cycle %d is not complete, payouts may change.", cfg.Cycle)
+	}
+	switch env.Conf.Format {
+	case "", "json":
+		return report.WriteJSON(os.Stdout)
+	case "csv":
+		return report.WriteCSV(os.Stdout)
+	case "forge":
+		return forgePayouts(ctx, env, crawler, report)
+	default:
+		return fmt.Errorf("unknown --format %q, use json, csv or forge", env.Conf.Format)
+	}
+}
+
+// forgePayouts prints one hex encoded unsigned operation group per line.
+func forgePayouts(ctx context.Context, env *puller.Environment, crawler *puller.Crawler, report *puller.PayoutReport) error {
+	src, err := chain.ParseAddress(env.Conf.PayoutSource)
+	if err != nil {
+		return fmt.Errorf("invalid --payout-source %q", env.Conf.PayoutSource)
+	}
+	head, err := env.Client.GetTipHeader(ctx)
+	if err != nil {
+		return err
+	}
+	if head.Hash == nil {
+		return fmt.Errorf("missing head block hash")
+	}
+	counter, err := env.Client.GetContractCounter(ctx, src)
+	if err != nil {
+		return err
+	}
+	groups, err := report.Forge(*head.Hash, puller.PayoutTxConfig{
+		Source:  src,
+		Counter: counter + 1,
+	}, crawler.ParamsByHeight(head.Level))
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		fmt.Println(hex.EncodeToString(g))
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
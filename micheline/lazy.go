@@ -0,0 +1,102 @@
+package micheline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// LazyStorageDiff is the v008+ replacement for big_map_diff. Big map diffs are
+// converted to the legacy BigMapDiff format, sapling state diffs are skipped.
+type LazyStorageDiff []LazyDiffElem
+
+type LazyDiffElem struct {
+	Kind string          `json:"kind"` // big_map, sapling_state
+	Id   int64           `json:"id,string"`
+	Diff json.RawMessage `json:"diff"`
+}
+
+type lazyBigMapDiff struct {
+	Action    string            `json:"action"`               // update, remove, copy, alloc
+	Source    string            `json:"source,omitempty"`     // copy
+	KeyType   json.RawMessage   `json:"key_type,omitempty"`   // alloc
+	ValueType json.RawMessage   `json:"value_type,omitempty"` // alloc
+	Updates   []json.RawMessage `json:"updates,omitempty"`    // update, copy, alloc
+}
+
+type lazyBigMapUpdate struct {
+	Key     json.RawMessage `json:"key"`
+	KeyHash string          `json:"key_hash"`
+	Value   json.RawMessage `json:"value,omitempty"` // missing on remove
+}
+
+// BigMapDiff converts all big map diffs to their legacy representation. Updates
+// follow the alloc or copy of the same big map. An update without value
+// removes the key.
+func (d LazyStorageDiff) BigMapDiff() (BigMapDiff, error) {
+	res := make(BigMapDiff, 0)
+	for _, v := range d {
+		if v.Kind != "big_map" {
+			continue
+		}
+		var diff lazyBigMapDiff
+		if err := json.Unmarshal(v.Diff, &diff); err != nil {
+			return nil, fmt.Errorf("micheline: decoding lazy big_map %d diff: %v", v.Id, err)
+		}
+		id := strconv.FormatInt(v.Id, 10)
+		legacy := make([]map[string]interface{}, 0, len(diff.Updates)+1)
+		switch diff.Action {
+		case "update":
+		case "remove":
+			legacy = append(legacy, map[string]interface{}{
+				"action":  "remove",
+				"big_map": id,
+			})
+		case "copy":
+			legacy = append(legacy, map[string]interface{}{
+				"action":              "copy",
+				"source_big_map":      diff.Source,
+				"destination_big_map": id,
+			})
+		case "alloc":
+			legacy = append(legacy, map[string]interface{}{
+				"action":     "alloc",
+				"big_map":    id,
+				"key_type":   diff.KeyType,
+				"value_type": diff.ValueType,
+			})
+		default:
+			return nil, fmt.Errorf("micheline: invalid lazy big_map %d action '%s'", v.Id, diff.Action)
+		}
+		for _, u := range diff.Updates {
+			var upd lazyBigMapUpdate
+			if err := json.Unmarshal(u, &upd); err != nil {
+				return nil, fmt.Errorf("micheline: decoding lazy big_map %d update: %v", v.Id, err)
+			}
+			elem := map[string]interface{}{
+				"action":   "update",
+				"big_map":  id,
+				"key":      upd.Key,
+				"key_hash": upd.KeyHash,
+			}
+			if len(upd.Value) > 0 && string(upd.Value) != "null" {
+				elem["value"] = upd.Value
+			} else {
+				elem["action"] = "remove"
+			}
+			legacy = append(legacy, elem)
+		}
+		for _, l := range legacy {
+			buf, err := json.Marshal(l)
+			if err != nil {
+				return nil, err
+			}
+			var e BigMapDiffElem
+			if err := json.Unmarshal(buf, &e); err != nil {
+				return nil, err
+			}
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,126 @@
+package micheline
+
+import (
+	"fmt"
+	"math/big"
+)
+
+const (
+	MetadataBigMap      = "metadata"       // TZIP-16 contract metadata
+	TokenMetadataBigMap = "token_metadata" // TZIP-12 token metadata
+)
+
+// NamedBigMap is a big_map declared in a contract's storage type.
+type NamedBigMap struct {
+	Name      string // field annotation, may be empty
+	KeyType   *Prim
+	ValueType *Prim
+}
+
+// BigMaps returns all big_maps in the storage type in declaration order.
+func (s *Script) BigMaps() []NamedBigMap {
+	if s.Code == nil || s.Code.Storage == nil || len(s.Code.Storage.Args) == 0 {
+		return nil
+	}
+	res := make([]NamedBigMap, 0)
+	var walk func(p *Prim)
+	walk = func(p *Prim) {
+		if p == nil {
+			return
+		}
+		if p.OpCode == T_BIG_MAP && len(p.Args) == 2 {
+			res = append(res, NamedBigMap{
+				Name:      p.GetVarAnno(),
+				KeyType:   p.Args[0],
+				ValueType: p.Args[1],
+			})
+			return
+		}
+		for _, v := range p.Args {
+			walk(v)
+		}
+	}
+	walk(s.Code.Storage.Args[0])
+	return res
+}
+
+// IsEqualType compares two type trees ignoring annotations. Right comb pairs
+// with more than two arguments equal their nested representation.
+func (p *Prim) IsEqualType(q *Prim) bool {
+	if p == nil || q == nil {
+		return p == q
+	}
+	if p.OpCode != q.OpCode {
+		return false
+	}
+	pa, qa := p.Args, q.Args
+	if p.OpCode == T_PAIR {
+		pa, qa = flattenTypePair(p), flattenTypePair(q)
+	}
+	if len(pa) != len(qa) {
+		return false
+	}
+	for i := range pa {
+		if !pa[i].IsEqualType(qa[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func flattenTypePair(p *Prim) []*Prim {
+	if p == nil || p.OpCode != T_PAIR || len(p.Args) < 2 {
+		return []*Prim{p}
+	}
+	res := append([]*Prim{}, p.Args[:len(p.Args)-1]...)
+	return append(res, flattenTypePair(p.Args[len(p.Args)-1])...)
+}
+
+// IsMetadataBigMap reports whether a big_map has the TZIP-16 metadata type
+// big_map string bytes.
+func IsMetadataBigMap(key, value *Prim) bool {
+	return key != nil && value != nil && key.OpCode == T_STRING && value.OpCode == T_BYTES
+}
+
+// IsTokenMetadataBigMap reports whether a big_map has the TZIP-12 token
+// metadata type big_map nat (pair nat (map string bytes)).
+func IsTokenMetadataBigMap(key, value *Prim) bool {
+	if key == nil || key.OpCode != T_NAT || value == nil {
+		return false
+	}
+	args := flattenTypePair(value)
+	if len(args) != 2 || args[0].OpCode != T_NAT || args[1].OpCode != T_MAP || len(args[1].Args) != 2 {
+		return false
+	}
+	return args[1].Args[0].OpCode == T_STRING && args[1].Args[1].OpCode == T_BYTES
+}
+
+// MetadataBytes returns the raw bytes value of a TZIP-16 metadata big_map
+// entry, i.e. a metadata URI or JSON content.
+func (e BigMapValue) MetadataBytes() ([]byte, error) {
+	if e.Value == nil || e.Value.Type != PrimBytes {
+		return nil, fmt.Errorf("micheline: invalid metadata value")
+	}
+	return e.Value.Bytes, nil
+}
+
+// TokenInfo decodes a TZIP-12 token_metadata big_map entry into token id and
+// the token_info map.
+func (e BigMapValue) TokenInfo() (*big.Int, map[string][]byte, error) {
+	args := flattenPair(e.Value)
+	if len(args) != 2 || args[1] == nil || args[1].Type != PrimSequence {
+		return nil, nil, fmt.Errorf("micheline: invalid token_metadata value")
+	}
+	id, err := decodeNat(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	info := make(map[string][]byte, len(args[1].Args))
+	for _, v := range args[1].Args {
+		if v.OpCode != D_ELT || len(v.Args) != 2 || v.Args[0].Type != PrimString || v.Args[1].Type != PrimBytes {
+			return nil, nil, fmt.Errorf("micheline: invalid token_info entry")
+		}
+		info[v.Args[0].String] = v.Args[1].Bytes
+	}
+	return id, info, nil
+}
@@ -71,8 +71,8 @@ func (p Parameters) Unwrap(ep Entrypoints) *Prim {
 
 // stay compatible with v005 transaction serialization
 func (p Parameters) MarshalBinary() ([]byte, error) {
-	// single Unit value
-	if p.Value != nil && p.Value.OpCode == D_UNIT {
+	// Unit sent to the default entrypoint is encoded as no parameters
+	if p.Value != nil && p.Value.OpCode == D_UNIT && (p.Entrypoint == "" || p.Entrypoint == "default") {
 		return []byte{0}, nil
 	}
 	// entrypoint format, compatible with v005
@@ -119,10 +119,12 @@ func (p *Parameters) UnmarshalJSON(data []byte) error {
 		return json.Unmarshal(data, &p.Value)
 	} else {
 		// try entrypoint calling convention
-		type alias *Parameters
-		if err := json.Unmarshal(data, alias(p)); err != nil {
+		type alias Parameters
+		a := alias(*p)
+		if err := json.Unmarshal(data, &a); err != nil {
 			return err
 		}
+		*p = Parameters(a)
 		if p.Value != nil {
 			return nil
 		}
@@ -0,0 +1,354 @@
+package micheline
+
+import (
+	"fmt"
+	"math/big"
+
+	"tezos_index/chain"
+)
+
+type TokenStandard byte
+
+const (
+	TokenStandardInvalid TokenStandard = iota
+	TokenStandardFA12                  // TZIP-7
+	TokenStandardFA2                   // TZIP-12
+)
+
+func (s TokenStandard) IsValid() bool {
+	return s != TokenStandardInvalid
+}
+
+func (s TokenStandard) String() string {
+	switch s {
+	case TokenStandardFA12:
+		return "fa1.2"
+	case TokenStandardFA2:
+		return "fa2"
+	default:
+		return ""
+	}
+}
+
+func (s TokenStandard) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// TokenStandard detects FA1.2 contracts from their transfer and approve
+// entrypoints and FA2 contracts from their transfer and update_operators
+// entrypoints.
+func (e Entrypoints) TokenStandard() TokenStandard {
+	transfer, ok := e["transfer"]
+	if !ok {
+		return TokenStandardInvalid
+	}
+	switch transfer.Type.OpCode {
+	case T_PAIR:
+		if _, ok := e["approve"]; ok {
+			return TokenStandardFA12
+		}
+	case T_LIST:
+		if _, ok := e["update_operators"]; ok {
+			return TokenStandardFA2
+		}
+	}
+	return TokenStandardInvalid
+}
+
+// TokenTransfer is a single token movement decoded from a transfer call.
+type TokenTransfer struct {
+	From    chain.Address
+	To      chain.Address
+	TokenId *big.Int // zero for FA1.2
+	Amount  *big.Int
+}
+
+// DecodeTokenTransfers decodes the unwrapped parameters of a transfer call.
+// FA1.2 transfers are (pair from (pair to value)), FA2 transfers are lists of
+// (pair from (list (pair to (pair token_id amount)))).
+func DecodeTokenTransfers(s TokenStandard, p *Prim) ([]TokenTransfer, error) {
+	if p == nil {
+		return nil, fmt.Errorf("micheline: missing transfer parameters")
+	}
+	switch s {
+	case TokenStandardFA12:
+		args := flattenPair(p)
+		if len(args) != 3 {
+			return nil, fmt.Errorf("micheline: invalid fa1.2 transfer with %d args", len(args))
+		}
+		from, err := decodeAddress(args[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := decodeAddress(args[1])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := decodeNat(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return []TokenTransfer{{From: from, To: to, TokenId: big.NewInt(0), Amount: amount}}, nil
+
+	case TokenStandardFA2:
+		if p.Type != PrimSequence {
+			return nil, fmt.Errorf("micheline: invalid fa2 transfer type %s", p.Type)
+		}
+		res := make([]TokenTransfer, 0, len(p.Args))
+		for _, batch := range p.Args {
+			args := flattenPair(batch)
+			if len(args) != 2 || args[1].Type != PrimSequence {
+				return nil, fmt.Errorf("micheline: invalid fa2 transfer batch")
+			}
+			from, err := decodeAddress(args[0])
+			if err != nil {
+				return nil, err
+			}
+			for _, tx := range args[1].Args {
+				txargs := flattenPair(tx)
+				if len(txargs) != 3 {
+					return nil, fmt.Errorf("micheline: invalid fa2 transfer with %d args", len(txargs))
+				}
+				to, err := decodeAddress(txargs[0])
+				if err != nil {
+					return nil, err
+				}
+				id, err := decodeNat(txargs[1])
+				if err != nil {
+					return nil, err
+				}
+				amount, err := decodeNat(txargs[2])
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, TokenTransfer{From: from, To: to, TokenId: id, Amount: amount})
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("micheline: unsupported token standard %d", s)
+}
+
+// flattenPair returns the members of a right comb pair. Pairs with more than
+// two arguments (v008+) are treated the same as nested pairs.
+func flattenPair(p *Prim) []*Prim {
+	if p == nil || p.OpCode != D_PAIR || p.Type == PrimSequence || len(p.Args) < 2 {
+		return []*Prim{p}
+	}
+	res := append([]*Prim{}, p.Args[:len(p.Args)-1]...)
+	return append(res, flattenPair(p.Args[len(p.Args)-1])...)
+}
+
+func decodeAddress(p *Prim) (chain.Address, error) {
+	if p == nil {
+		return chain.Address{}, fmt.Errorf("micheline: missing address")
+	}
+	switch p.Type {
+	case PrimString:
+		return chain.ParseAddress(p.String)
+	case PrimBytes:
+		// optimized encoding, may carry an entrypoint suffix
+		var a chain.Address
+		b := p.Bytes
+		if len(b) > 22 {
+			b = b[:22]
+		}
+		err := a.UnmarshalBinary(b)
+		return a, err
+	}
+	return chain.Address{}, fmt.Errorf("micheline: invalid address type %s", p.Type)
+}
+
+func decodeNat(p *Prim) (*big.Int, error) {
+	if p == nil || p.Type != PrimInt || p.Int == nil {
+		return nil, fmt.Errorf("micheline: invalid nat")
+	}
+	if p.Int.Sign() < 0 {
+		return nil, fmt.Errorf("micheline: negative nat %s", p.Int)
+	}
+	return new(big.Int).Set(p.Int), nil
+}
+
+// LedgerLayout describes how a token contract stores balances in its ledger
+// big_map.
+type LedgerLayout byte
+
+const (
+	LedgerLayoutInvalid      LedgerLayout = iota
+	LedgerLayoutAddress                   // big_map address nat
+	LedgerLayoutAddressPair               // big_map address (pair nat (map address nat)), FA1.2 with allowances
+	LedgerLayoutAddressToken              // big_map (pair address nat) nat, FA2 owner and token id
+	LedgerLayoutTokenAddress              // big_map (pair nat address) nat, FA2 token id and owner
+	LedgerLayoutNFT                       // big_map nat address, FA2 token id to single owner
+)
+
+func (l LedgerLayout) IsValid() bool {
+	return l != LedgerLayoutInvalid
+}
+
+// ledgerNames are field annotations of big_maps holding token balances.
+var ledgerNames = map[string]bool{
+	"ledger":   true,
+	"balances": true,
+}
+
+// LedgerBigMap is the big_map holding balances of a token contract.
+type LedgerBigMap struct {
+	Layout    LedgerLayout
+	KeyType   *Prim
+	ValueType *Prim
+}
+
+// Ledger returns the balance big_map declared in the storage type. Only
+// big_maps annotated %ledger or %balances with a known layout are detected.
+func (s *Script) Ledger() (LedgerBigMap, bool) {
+	var res LedgerBigMap
+	for _, v := range s.BigMaps() {
+		if !ledgerNames[v.Name] {
+			continue
+		}
+		l := DetectLedgerLayout(v.KeyType, v.ValueType)
+		if !l.IsValid() || res.Layout.IsValid() {
+			// ambiguous when more than one big_map matches
+			return LedgerBigMap{}, false
+		}
+		res = LedgerBigMap{Layout: l, KeyType: v.KeyType, ValueType: v.ValueType}
+	}
+	return res, res.Layout.IsValid()
+}
+
+// Matches reports whether an allocated big_map has the ledger type. Alloc
+// diffs only carry the key type opcode.
+func (l LedgerBigMap) Matches(keyType OpCode, valueType *Prim) bool {
+	return l.KeyType != nil && l.KeyType.OpCode == keyType && l.ValueType.IsEqualType(valueType)
+}
+
+// DetectLedgerLayout returns the layout of a ledger big_map type.
+func DetectLedgerLayout(key, value *Prim) LedgerLayout {
+	if key == nil || value == nil {
+		return LedgerLayoutInvalid
+	}
+	switch key.OpCode {
+	case T_ADDRESS:
+		if value.OpCode == T_NAT {
+			return LedgerLayoutAddress
+		}
+		if value.OpCode == T_PAIR {
+			// exactly one nat balance next to allowance maps
+			var nats int
+			for _, v := range flattenTypePair(value) {
+				switch v.OpCode {
+				case T_NAT:
+					nats++
+				case T_MAP:
+				default:
+					return LedgerLayoutInvalid
+				}
+			}
+			if nats == 1 {
+				return LedgerLayoutAddressPair
+			}
+		}
+	case T_PAIR:
+		args := flattenTypePair(key)
+		if len(args) != 2 || value.OpCode != T_NAT {
+			return LedgerLayoutInvalid
+		}
+		switch {
+		case args[0].OpCode == T_ADDRESS && args[1].OpCode == T_NAT:
+			return LedgerLayoutAddressToken
+		case args[0].OpCode == T_NAT && args[1].OpCode == T_ADDRESS:
+			return LedgerLayoutTokenAddress
+		}
+	case T_NAT:
+		if value.OpCode == T_ADDRESS {
+			return LedgerLayoutNFT
+		}
+	}
+	return LedgerLayoutInvalid
+}
+
+// LedgerBalance is a holder balance decoded from a ledger big_map update.
+// Holder is empty for removed NFT entries, Balance is zero for removed
+// entries.
+type LedgerBalance struct {
+	Holder  chain.Address
+	TokenId *big.Int
+	Balance *big.Int
+}
+
+// DecodeBalance decodes a ledger big_map update or remove diff.
+func (l LedgerLayout) DecodeBalance(e BigMapDiffElem) (LedgerBalance, error) {
+	res := LedgerBalance{TokenId: big.NewInt(0), Balance: big.NewInt(0)}
+	removed := e.Action == BigMapDiffActionRemove || e.Value == nil
+	var err error
+	switch l {
+	case LedgerLayoutAddress, LedgerLayoutAddressPair:
+		if res.Holder, err = decodeAddress(ledgerKey(e)); err != nil {
+			return res, err
+		}
+		if removed {
+			return res, nil
+		}
+		val := e.Value
+		if l == LedgerLayoutAddressPair {
+			val = nil
+			for _, v := range flattenPair(e.Value) {
+				if v != nil && v.Type == PrimInt {
+					val = v
+				}
+			}
+		}
+		res.Balance, err = decodeNat(val)
+
+	case LedgerLayoutAddressToken, LedgerLayoutTokenAddress:
+		key := &Prim{}
+		if err := key.UnmarshalBinary(e.BytesKey); err != nil {
+			return res, fmt.Errorf("micheline: invalid ledger key: %v", err)
+		}
+		args := flattenPair(key)
+		if len(args) != 2 {
+			return res, fmt.Errorf("micheline: invalid ledger key with %d args", len(args))
+		}
+		owner, id := args[0], args[1]
+		if l == LedgerLayoutTokenAddress {
+			owner, id = id, owner
+		}
+		if res.Holder, err = decodeAddress(owner); err != nil {
+			return res, err
+		}
+		if res.TokenId, err = decodeNat(id); err != nil {
+			return res, err
+		}
+		if !removed {
+			res.Balance, err = decodeNat(e.Value)
+		}
+
+	case LedgerLayoutNFT:
+		if res.TokenId, err = decodeNat(ledgerKey(e)); err != nil {
+			return res, err
+		}
+		if !removed {
+			if res.Holder, err = decodeAddress(e.Value); err != nil {
+				return res, err
+			}
+			res.Balance.SetInt64(1)
+		}
+
+	default:
+		return res, fmt.Errorf("micheline: unsupported ledger layout %d", l)
+	}
+	return res, err
+}
+
+// ledgerKey returns the scalar key of a big_map diff as primitive.
+func ledgerKey(e BigMapDiffElem) *Prim {
+	switch {
+	case e.IntKey != nil:
+		return &Prim{Type: PrimInt, Int: e.IntKey}
+	case e.BytesKey != nil:
+		return &Prim{Type: PrimBytes, Bytes: e.BytesKey}
+	default:
+		return &Prim{Type: PrimString, String: e.StringKey}
+	}
+}
@@ -13,9 +13,85 @@ import (
 	"tezos_index/micheline"
 	"tezos_index/puller/index"
 	"tezos_index/puller/models"
+	util "tezos_index/utils"
 	"time"
 )
 
+type OrderType byte
+
+const (
+	OrderAsc OrderType = iota
+	OrderDesc
+)
+
+func ParseOrderType(s string) OrderType {
+	switch s {
+	case "desc":
+		return OrderDesc
+	default:
+		return OrderAsc
+	}
+}
+
+func (o OrderType) String() string {
+	switch o {
+	case OrderDesc:
+		return "desc"
+	default:
+		return "asc"
+	}
+}
+
+// ListRequest describes a paginated list query. Cursor is the row id of the
+// last item of the previous page; when set it takes precedence over Offset.
+type ListRequest struct {
+	Account models.AccountID // account to list data for
+	Typ     *chain.OpType    // op type filter, nil lists all types
+	Since   int64            // min height (exclusive), zero for no limit
+	Until   int64            // max height (inclusive), zero for no limit
+	Offset  uint
+	Limit   uint // zero for no limit
+	Cursor  uint64
+	Order   OrderType
+}
+
+// WithType returns a copy of r that lists ops of type typ only.
+func (r ListRequest) WithType(typ chain.OpType) ListRequest {
+	r.Typ = &typ
+	return r
+}
+
+// apply adds type, height range, cursor, order and paging conditions to q.
+func (r ListRequest) apply(q *gorm.DB) *gorm.DB {
+	if r.Typ != nil {
+		q = q.Where("type = ?", int(*r.Typ))
+	}
+	if r.Since > 0 {
+		q = q.Where("height > ?", r.Since)
+	}
+	if r.Until > 0 {
+		q = q.Where("height <= ?", r.Until)
+	}
+	if r.Order == OrderDesc {
+		if r.Cursor > 0 {
+			q = q.Where("row_id < ?", r.Cursor)
+		}
+		q = q.Order("row_id desc")
+	} else {
+		if r.Cursor > 0 {
+			q = q.Where("row_id > ?", r.Cursor)
+		}
+		q = q.Order("row_id asc")
+	}
+	if r.Limit > 0 {
+		q = q.Limit(r.Limit)
+	}
+	if r.Offset > 0 && r.Cursor == 0 {
+		q = q.Offset(r.Offset)
+	}
+	return q
+}
+
 func (m *Indexer) ParamsByHeight(height int64) *chain.Params {
 	return m.reg.GetParamsByHeight(height)
 }
@@ -540,6 +616,51 @@ func (m *Indexer) LookupAccount(ctx context.Context, addr chain.Address) (*model
 	return acc, nil
 }
 
+// BalanceAt returns the balance of addr after block height, reconstructed
+// from flows.
+func (m *Indexer) BalanceAt(ctx context.Context, addr chain.Address, height int64) (*models.Balance, error) {
+	if height < 0 {
+		return nil, index.ErrInvalidBlockHeight
+	}
+	acc, err := m.LookupAccount(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	bal, err := index.LoadBalance(m.statedb, acc.RowId, height)
+	if err != nil {
+		return nil, err
+	}
+	bal.Timestamp = m.BlockTime(ctx, height)
+	return bal, nil
+}
+
+// BalanceAtTime returns the balance of addr after the last block at or before
+// tm.
+func (m *Indexer) BalanceAtTime(ctx context.Context, addr chain.Address, tm time.Time) (*models.Balance, error) {
+	return m.BalanceAt(ctx, addr, m.BlockHeightFromTime(ctx, tm))
+}
+
+// BalanceHistory returns the balance of addr at height from and after every
+// change up to height to. With a positive step one sample is returned every
+// step blocks instead.
+func (m *Indexer) BalanceHistory(ctx context.Context, addr chain.Address, from, to, step int64) ([]*models.Balance, error) {
+	if from < 0 || to < from {
+		return nil, index.ErrInvalidBlockHeight
+	}
+	acc, err := m.LookupAccount(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	hist, err := index.LoadBalanceHistory(m.statedb, acc.RowId, from, to, step)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range hist {
+		b.Timestamp = m.BlockTime(ctx, b.Height)
+	}
+	return hist, nil
+}
+
 // func (m *Indexer) LookupContract(ctx context.Context, addr chain.Address) (*models.Contract, error) {
 // 	if !addr.IsValid() {
 // 		return nil, ErrInvalidHash
@@ -643,9 +764,6 @@ func (m *Indexer) ListAllDelegates(ctx context.Context) ([]*models.Account, erro
 	if err != nil {
 		return nil, err
 	}
-	for _, acc := range accs {
-		accs = append(accs, acc)
-	}
 	return accs, nil
 }
 
@@ -723,41 +841,21 @@ func (m *Indexer) ListAllDelegates(ctx context.Context) ([]*models.Account, erro
 // 	return accs, nil
 // }
 
-// func (m *Indexer) LookupOp(ctx context.Context, ophash string) ([]*models.Op, error) {
-// 	oh, err := chain.ParseOperationHash(ophash)
-// 	if err != nil {
-// 		return nil, ErrInvalidHash
-// 	}
-// 	table, err := m.Table(index.OpTableKey)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	q := pack.Query{
-// 		Name: "api.search_tx_hash",
-// 		Conditions: pack.ConditionList{pack.Condition{
-// 			Field: table.Fields().Find("H"), // search for hash
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: oh.Hash.Hash[:],
-// 		}},
-// 	}
-// 	ops := make([]*model.Op, 0, 2)
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		op := model.AllocOp()
-// 		if err := r.Decode(op); err != nil {
-// 			op.Free()
-// 			return err
-// 		}
-// 		ops = append(ops, op)
-// 		return nil
-// 	})
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	if len(ops) == 0 {
-// 		return nil, index.ErrNoOpEntry
-// 	}
-// 	return ops, nil
-// }
+func (m *Indexer) LookupOp(ctx context.Context, ophash string) ([]*models.Op, error) {
+	oh, err := chain.ParseOperationHash(ophash)
+	if err != nil {
+		return nil, ErrInvalidHash
+	}
+	ops := make([]*models.Op, 0, 2)
+	err = m.statedb.Where("hash = ?", oh.String()).Order("row_id").Find(&ops).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return nil, index.ErrNoOpEntry
+	}
+	return ops, nil
+}
 
 // func (m *Indexer) FindActivatedAccount(ctx context.Context, addr chain.Address) (*models.Account, error) {
 // 	table, err := m.Table(index.OpTableKey)
@@ -868,313 +966,218 @@ func (m *Indexer) FindOrigination(ctx context.Context, id models.AccountID) (*mo
 // 	return ops, nil
 // }
 
-// Note: offset and limit count in transactions
-// func (m *Indexer) ListBlockOps(ctx context.Context, height int64, typ chain.OpType, offset, limit uint) ([]*models.Op, error) {
-// 	table, err := m.Table(index.OpTableKey)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	q := pack.Query{
-// 		Name: "api.list_block_ops",
-// 		Conditions: pack.ConditionList{
-// 			pack.Condition{
-// 				Field: table.Fields().Find("h"), // search for block height
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: height,
-// 			},
-// 		},
-// 		Limit: int(offset + limit),
-// 	}
-// 	if typ.IsValid() {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("t"), // search op type
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: int64(typ), // must be int64 type
-// 		})
-// 	}
-// 	ops := make([]*model.Op, 0)
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		if offset > 0 {
-// 			offset--
-// 			return nil
-// 		}
-// 		op := model.AllocOp()
-// 		if err := r.Decode(op); err != nil {
-// 			op.Free()
-// 			return err
-// 		}
-// 		ops = append(ops, op)
-// 		return nil
-// 	})
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ops, nil
-// }
+func (m *Indexer) ListBlockOps(ctx context.Context, height int64, r ListRequest) ([]*models.Op, error) {
+	r.Since, r.Until = 0, 0
+	q := r.apply(m.statedb.Where("height = ?", height))
+	ops := make([]*models.Op, 0)
+	if err := q.Find(&ops).Error; err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
 
 // Note:
-// - OR queries are not supported by pack table yet!
+// - OR queries can't use sender_idx and recv_idx at once, so we query both and merge
 // - order is defined by funding or spending operation
 // - offset and limit counts in ops
-// func (m *Indexer) ListAccountOps(ctx context.Context, accId model.AccountID, typ chain.OpType, since, until int64, offset, limit uint, order pack.OrderType) ([]*models.Op, error) {
-// 	table, err := m.Table(index.OpTableKey)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	// list all ops where this address is sender OR receiver (high traffic addresses
-// 	// may have many, so we use query limits)
-// 	q := pack.Query{
-// 		Name:   "api.list_account_ops_sent",
-// 		Order:  order,
-// 		Fields: table.Fields(),
-// 		Conditions: pack.ConditionList{pack.Condition{
-// 			Field: table.Fields().Find("S"), // search for sender account id
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: accId.Value(),
-// 		}},
-// 		Limit: int(offset + limit),
-// 	}
-// 	if since > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeGt,
-// 			Value: since,
-// 		})
-// 	}
-// 	if until > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeLte,
-// 			Value: until,
-// 		})
-// 	}
-// 	if typ.IsValid() {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("t"), // search op type
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: int64(typ), // must be int64 type
-// 		})
-// 	}
-// 	ops := make([]*model.Op, 0, util.NonZero(2*int(offset+limit), 512))
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		op := model.AllocOp()
-// 		if err := r.Decode(op); err != nil {
-// 			op.Free()
-// 			return err
-// 		}
-// 		ops = append(ops, op)
-// 		if len(ops) == int(limit+offset) {
-// 			return io.EOF
-// 		}
-// 		if len(ops)%512 == 0 {
-// 			if util.InterruptRequested(ctx) {
-// 				return ctx.Err()
-// 			}
-// 		}
-// 		return nil
-// 	})
-// 	if err != nil && err != io.EOF {
-// 		return nil, err
-// 	}
-// 	// same for receivers
-// 	q = pack.Query{
-// 		Name:   "api.list_account_ops_recv",
-// 		Fields: table.Fields(),
-// 		Order:  order,
-// 		Conditions: pack.ConditionList{pack.Condition{
-// 			Field: table.Fields().Find("R"), // search for receiver account id
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: accId.Value(),
-// 		}},
-// 		Limit: int(offset + limit),
-// 	}
-// 	if since > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeGt,
-// 			Value: since,
-// 		})
-// 	}
-// 	if until > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeLte,
-// 			Value: until,
-// 		})
-// 	}
-// 	if typ.IsValid() {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("t"), // search op type
-// 			Mode:  pack.FilterModeEqual,
-// 			Value: int64(typ), // must be int64 type
-// 		})
-// 	}
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		op := model.AllocOp()
-// 		if err := r.Decode(op); err != nil {
-// 			op.Free()
-// 			return err
-// 		}
-// 		ops = append(ops, op)
-// 		if len(ops) == 2*int(limit+offset) {
-// 			return io.EOF
-// 		}
-// 		if len(ops)%512 == 0 {
-// 			if util.InterruptRequested(ctx) {
-// 				return ctx.Err()
-// 			}
-// 		}
-// 		return nil
-// 	})
-// 	if err != nil && err != io.EOF {
-// 		return nil, err
-// 	}
-// 	// sort
-// 	if order == pack.OrderAsc {
-// 		sort.Slice(ops, func(i, j int) bool { return ops[i].RowId < ops[j].RowId })
-// 	} else {
-// 		sort.Slice(ops, func(i, j int) bool { return ops[i].RowId > ops[j].RowId })
-// 	}
-// 	// cut offset and limit
-// 	for i := 0; i < len(ops) && i < int(offset); i++ {
-// 		ops[i].Free()
-// 	}
-// 	for i := int(offset + limit); i < len(ops); i++ {
-// 		ops[i].Free()
-// 	}
-// 	ops = ops[util.Min(int(offset), len(ops)):util.Min(int(offset+limit), len(ops))]
-// 	return ops, nil
-// }
+func (m *Indexer) ListAccountOps(ctx context.Context, r ListRequest) ([]*models.Op, error) {
+	// list all ops where this address is sender OR receiver (high traffic addresses
+	// may have many, so we use query limits)
+	offset := 0
+	if r.Cursor == 0 {
+		offset = int(r.Offset)
+	}
+	sub := r
+	sub.Offset = 0
+	if r.Limit > 0 {
+		sub.Limit = uint(offset) + r.Limit
+	}
+	sent := make([]*models.Op, 0)
+	q := sub.apply(m.statedb.Where("sender_id = ?", r.Account.Value()))
+	if err := q.Find(&sent).Error; err != nil {
+		return nil, err
+	}
+	if util.InterruptRequested(ctx) {
+		return nil, ctx.Err()
+	}
 
-// func (m *Indexer) ListContractCalls(ctx context.Context, accId model.AccountID, since, until int64, offset, limit uint, order pack.OrderType) ([]*models.Op, error) {
-// 	table, err := m.Table(index.OpTableKey)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	// list all tx (calls) received by this address
-// 	q := pack.Query{
-// 		Name:   "api.list_contract_calls",
-// 		Fields: table.Fields(),
-// 		Order:  order,
-// 		Conditions: pack.ConditionList{
-// 			pack.Condition{
-// 				Field: table.Fields().Find("R"), // search for receiver account id
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: accId.Value(),
-// 			},
-// 			pack.Condition{
-// 				Field: table.Fields().Find("t"), // search op type
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: int64(chain.OpTypeTransaction), // must be int64 type
-// 			},
-// 			// list originations and non-parameter transactions
-// 			// pack.Condition{
-// 			// 	Field: table.Fields().Find("w"), // must have data to be a call
-// 			// 	Mode:  pack.FilterModeEqual,
-// 			// 	Value: true,
-// 			// },
-// 		},
-// 		Limit: int(offset + limit),
-// 	}
-// 	if since > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeGt,
-// 			Value: since,
-// 		})
-// 	}
-// 	if until > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeLte,
-// 			Value: until,
-// 		})
-// 	}
-// 	ops := make([]*model.Op, 0)
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		if offset > 0 {
-// 			offset--
-// 			return nil
-// 		}
-// 		op := model.AllocOp()
-// 		if err := r.Decode(op); err != nil {
-// 			op.Free()
-// 			return err
-// 		}
-// 		ops = append(ops, op)
-// 		return nil
-// 	})
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ops, nil
-// }
+	// same for receivers
+	recv := make([]*models.Op, 0)
+	q = sub.apply(m.statedb.Where("receiver_id = ? and sender_id <> ?", r.Account.Value(), r.Account.Value()))
+	if err := q.Find(&recv).Error; err != nil {
+		return nil, err
+	}
+	ops := append(sent, recv...)
 
-// func (m *Indexer) FindLastCall(ctx context.Context, acc model.AccountID, height int64) (*models.Op, error) {
-// 	// load account for last-seen optimization
-// 	a, err := m.LookupAccountId(ctx, acc)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	height = util.Min64(height, a.LastSeen)
-//
-// 	table, err := m.Table(index.OpTableKey)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	q := pack.Query{
-// 		Name:  "api.search_last_call",
-// 		Limit: 1,
-// 		Order: pack.OrderDesc,
-// 		Conditions: pack.ConditionList{
-// 			pack.Condition{
-// 				Field: table.Fields().Find("R"), // receiver_id
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: acc.Value(),
-// 			},
-// 			pack.Condition{
-// 				Field: table.Fields().Find("t"), // type
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: int64(chain.OpTypeTransaction),
-// 			},
-// 			pack.Condition{
-// 				Field: table.Fields().Find("C"), // is_contract
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: true,
-// 			},
-// 			pack.Condition{
-// 				Field: table.Fields().Find("!"), // is_success
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: true,
-// 			},
-// 			pack.Condition{
-// 				Field: table.Fields().Find("w"), // has_data
-// 				Mode:  pack.FilterModeEqual,
-// 				Value: true,
-// 			},
-// 		},
-// 	}
-// 	if height > 0 {
-// 		q.Conditions = append(q.Conditions, pack.Condition{
-// 			Field: table.Fields().Find("h"), // height
-// 			Mode:  pack.FilterModeLte,
-// 			Value: height,
-// 		})
-// 	}
-// 	op := model.AllocOp()
-// 	err = table.Stream(ctx, q, func(r pack.Row) error {
-// 		return r.Decode(op)
-// 	})
-// 	if err != nil {
-// 		op.Free()
-// 		return nil, err
-// 	}
-// 	if op.RowId == 0 {
-// 		op.Free()
-// 		return nil, index.ErrNoOpEntry
-// 	}
-// 	return op, nil
-// }
+	// sort
+	if r.Order == OrderAsc {
+		sort.Slice(ops, func(i, j int) bool { return ops[i].RowId < ops[j].RowId })
+	} else {
+		sort.Slice(ops, func(i, j int) bool { return ops[i].RowId > ops[j].RowId })
+	}
+
+	// cut offset and limit
+	end := len(ops)
+	if r.Limit > 0 {
+		end = util.Min(offset+int(r.Limit), len(ops))
+	}
+	return ops[util.Min(offset, len(ops)):end], nil
+}
+
+// ListPendingOps lists mempool ops sent or received by addr which are not
+// included in a block yet.
+func (m *Indexer) ListPendingOps(ctx context.Context, addr chain.Address, r ListRequest) ([]*models.PendingOp, error) {
+	r.Since, r.Until = 0, 0
+	a := addr.String()
+	q := r.apply(m.statedb.Where("state = ? and (sender = ? or receiver = ?)", models.PendingStatePending, a, a))
+	ops := make([]*models.PendingOp, 0)
+	if err := q.Find(&ops).Error; err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// ListReorgs lists chain reorganizations by fork point height.
+func (m *Indexer) ListReorgs(ctx context.Context, r ListRequest) ([]*models.Reorg, error) {
+	r.Typ = nil
+	reorgs := make([]*models.Reorg, 0)
+	if err := r.apply(m.statedb).Find(&reorgs).Error; err != nil {
+		return nil, err
+	}
+	return reorgs, nil
+}
+
+// ListOrphans lists orphaned blocks by height.
+func (m *Indexer) ListOrphans(ctx context.Context, r ListRequest) ([]*models.OrphanBlock, error) {
+	r.Typ = nil
+	blocks := make([]*models.OrphanBlock, 0)
+	if err := r.apply(m.statedb).Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// ListReorgOrphans returns the blocks orphaned by reorg id in height order.
+func (m *Indexer) ListReorgOrphans(ctx context.Context, id uint64) ([]*models.OrphanBlock, error) {
+	blocks := make([]*models.OrphanBlock, 0)
+	err := m.statedb.Where("reorg_id = ?", id).Order("height asc").Find(&blocks).Error
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// LookupOrphan returns the latest orphan record for block hash h.
+func (m *Indexer) LookupOrphan(ctx context.Context, h chain.BlockHash) (*models.OrphanBlock, error) {
+	o := &models.OrphanBlock{}
+	err := m.statedb.Where("hash = ?", h.String()).Order("row_id desc").First(o).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, index.ErrNoBlockEntry
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// LookupToken returns the token with id tokenId of a FA1.2 or FA2 contract.
+// FA1.2 tokens use id 0.
+func (m *Indexer) LookupToken(ctx context.Context, contract chain.Address, tokenId string) (*models.Token, error) {
+	t := &models.Token{}
+	err := m.statedb.Where("contract = ? and token_id = ?", contract.String(), tokenId).First(t).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, index.ErrNoTokenEntry
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTokens lists all tokens of a FA1.2 or FA2 contract seen in ledgers or transfers.
+func (m *Indexer) ListTokens(ctx context.Context, contract chain.Address) ([]*models.Token, error) {
+	tokens := make([]*models.Token, 0)
+	err := m.statedb.Where("contract = ?", contract.String()).Order("row_id asc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// LookupMetadata returns the metadata of a contract or, when tokenId is not
+// empty, of a single token.
+func (m *Indexer) LookupMetadata(ctx context.Context, contract chain.Address, tokenId string) (*models.Metadata, error) {
+	md := &models.Metadata{}
+	err := m.statedb.Where("contract = ? and token_id = ?", contract.String(), tokenId).First(md).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, index.ErrNoMetadataEntry
+	}
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// ListTokenBalances lists the non-zero token balances of holder addr.
+func (m *Indexer) ListTokenBalances(ctx context.Context, addr chain.Address, r ListRequest) ([]*models.TokenBalance, error) {
+	r.Typ = nil
+	bals := make([]*models.TokenBalance, 0)
+	if err := r.apply(m.statedb.Where("holder = ? and balance <> ?", addr.String(), "0")).Find(&bals).Error; err != nil {
+		return nil, err
+	}
+	return bals, nil
+}
+
+// ListTokenTransfers lists token transfers sent or received by addr.
+func (m *Indexer) ListTokenTransfers(ctx context.Context, addr chain.Address, r ListRequest) ([]*models.TokenTransfer, error) {
+	r.Typ = nil
+	a := addr.String()
+	q := r.apply(m.statedb.Where("sender = ? or receiver = ?", a, a))
+	transfers := make([]*models.TokenTransfer, 0)
+	if err := q.Find(&transfers).Error; err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func (m *Indexer) ListContractCalls(ctx context.Context, r ListRequest) ([]*models.Op, error) {
+	// list all tx (calls) received by this address
+	r = r.WithType(chain.OpTypeTransaction)
+	q := r.apply(m.statedb.Where("receiver_id = ?", r.Account.Value()))
+	ops := make([]*models.Op, 0)
+	if err := q.Find(&ops).Error; err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (m *Indexer) FindLastCall(ctx context.Context, acc models.AccountID, height int64) (*models.Op, error) {
+	// load account for last-seen optimization
+	a, err := m.LookupAccountId(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	if height > 0 {
+		height = util.Min64(height, a.LastSeen)
+	} else {
+		height = a.LastSeen
+	}
+
+	op := &models.Op{}
+	err = m.statedb.
+		Where("receiver_id = ? and type = ?", acc.Value(), int(chain.OpTypeTransaction)).
+		Where("is_contract = ? and is_success = ? and has_data = ?", true, true, true).
+		Where("height <= ?", height).
+		Order("row_id desc").
+		First(op).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, index.ErrNoOpEntry
+	}
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
 
 // func (m *Indexer) ListContractBigMapIds(ctx context.Context, acc models.AccountID) ([]int64, error) {
 // 	table, err := m.Table(index.BigMapTableKey)
@@ -1750,48 +1753,48 @@ func (m *Indexer) LookupBigmap(ctx context.Context, id int64, withLast bool) (*m
 // 	return items, nil
 // }
 
-// func (m *Indexer) LookupRanking(ctx context.Context, id model.AccountID) (*AccountRankingEntry, bool) {
-// 	if id == 0 {
-// 		return nil, false
-// 	}
-// 	ranks, err := m.GetRanking(ctx, time.Now().UTC())
-// 	if err != nil {
-// 		log.Errorf("ranking failed: %v", err)
-// 		return nil, false
-// 	}
-// 	r, ok := ranks.GetAccount(id)
-// 	return r, ok
-// }
+// LookupRanking returns the rich, flow and traffic rank of account id.
+func (m *Indexer) LookupRanking(ctx context.Context, id models.AccountID) (*AccountRankingEntry, error) {
+	row := &models.AccountRank{}
+	err := m.statedb.Where("account_id = ?", id.Value()).First(row).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return nil, index.ErrNoRankEntry
+	default:
+		return nil, err
+	}
+	e := newRankingEntry(row)
+	for _, t := range []RankType{RankRich, RankFlow, RankTraffic} {
+		rank, err := rankOf(m.statedb, t, t.value(row))
+		if err != nil {
+			return nil, err
+		}
+		e.setRank(t, rank)
+	}
+	if err := resolveRankingAddresses(m.statedb, []*AccountRankingEntry{e}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
 
-// func (m *Indexer) TopRich(ctx context.Context, n int) ([]*AccountRankingEntry, error) {
-// 	if n <= 0 {
-// 		return nil, fmt.Errorf("invalid negative top value %d", n)
-// 	}
-// 	ranks, err := m.GetRanking(ctx, time.Now().UTC())
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ranks.TopRich(n), nil
-// }
+// ListRanking returns a page of the ranking of type t using offset and limit
+// from r.
+func (m *Indexer) ListRanking(ctx context.Context, t RankType, r ListRequest) ([]*AccountRankingEntry, error) {
+	if !t.IsValid() {
+		return nil, errInvalidParam("rank")
+	}
+	return listRanking(m.statedb, t, r.Offset, r.Limit)
+}
 
-// func (m *Indexer) TopTraffic(ctx context.Context, n int) ([]*AccountRankingEntry, error) {
-// 	if n <= 0 {
-// 		return nil, fmt.Errorf("invalid negative top value %d", n)
-// 	}
-// 	ranks, err := m.GetRanking(ctx, time.Now().UTC())
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ranks.TopTraffic(n), nil
-// }
+func (m *Indexer) TopRich(ctx context.Context, r ListRequest) ([]*AccountRankingEntry, error) {
+	return m.ListRanking(ctx, RankRich, r)
+}
 
-// func (m *Indexer) TopFlows(ctx context.Context, n int) ([]*AccountRankingEntry, error) {
-// 	if n <= 0 {
-// 		return nil, fmt.Errorf("invalid negative top value %d", n)
-// 	}
-// 	ranks, err := m.GetRanking(ctx, time.Now().UTC())
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	return ranks.TopFlows(n), nil
-// }
+func (m *Indexer) TopTraffic(ctx context.Context, r ListRequest) ([]*AccountRankingEntry, error) {
+	return m.ListRanking(ctx, RankTraffic, r)
+}
+
+func (m *Indexer) TopFlows(ctx context.Context, r ListRequest) ([]*AccountRankingEntry, error) {
+	return m.ListRanking(ctx, RankFlow, r)
+}
@@ -0,0 +1,59 @@
+package puller
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+)
+
+func TestListAccountOps(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	m := NewIndexer(IndexerConfig{StateDB: db})
+
+	for _, op := range []*models.Op{
+		{Height: 10, Type: chain.OpTypeTransaction, SenderId: 1, ReceiverId: 2},
+		{Height: 11, Type: chain.OpTypeTransaction, SenderId: 2, ReceiverId: 1},
+		{Height: 12, Type: chain.OpTypeDelegation, SenderId: 1},
+		{Height: 13, Type: chain.OpTypeTransaction, SenderId: 1, ReceiverId: 1},
+		{Height: 14, Type: chain.OpTypeTransaction, SenderId: 3, ReceiverId: 4},
+		{Height: 15, Type: chain.OpTypeTransaction, SenderId: 2, ReceiverId: 1},
+	} {
+		if !assert.NoError(t, db.Create(op).Error) {
+			return
+		}
+	}
+
+	for _, v := range []struct {
+		Name     string
+		Request  ListRequest
+		Expected []models.OpID
+	}{
+		{"all", ListRequest{}, []models.OpID{1, 2, 3, 4, 6}},
+		{"desc", ListRequest{Order: OrderDesc}, []models.OpID{6, 4, 3, 2, 1}},
+		{"type", ListRequest{}.WithType(chain.OpTypeTransaction), []models.OpID{1, 2, 4, 6}},
+		{"bake", ListRequest{}.WithType(chain.OpTypeBake), []models.OpID{}},
+		{"range", ListRequest{Since: 11, Until: 14}, []models.OpID{3, 4}},
+		{"limit", ListRequest{Limit: 2}, []models.OpID{1, 2}},
+		{"offset", ListRequest{Offset: 2, Limit: 2}, []models.OpID{3, 4}},
+		{"offset desc", ListRequest{Offset: 1, Limit: 3, Order: OrderDesc}, []models.OpID{4, 3, 2}},
+		{"offset past end", ListRequest{Offset: 5, Limit: 2}, []models.OpID{}},
+		{"cursor", ListRequest{Cursor: 2, Limit: 2}, []models.OpID{3, 4}},
+		{"cursor desc", ListRequest{Cursor: 4, Limit: 2, Order: OrderDesc}, []models.OpID{3, 2}},
+		{"cursor ignores offset", ListRequest{Cursor: 3, Offset: 10}, []models.OpID{4, 6}},
+	} {
+		v.Request.Account = 1
+		ops, err := m.ListAccountOps(context.Background(), v.Request)
+		if !assert.NoError(t, err, v.Name) {
+			continue
+		}
+		ids := make([]models.OpID, 0, len(ops))
+		for _, op := range ops {
+			ids = append(ids, op.RowId)
+		}
+		assert.Equal(t, v.Expected, ids, v.Name)
+	}
+}
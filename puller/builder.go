@@ -34,11 +34,14 @@ func addressHashKey(a chain.Address) uint64 {
 }
 
 type Builder struct {
-	idx        *Indexer                             // storage reference
-	accHashMap map[uint64]*models.Account           // hash(acc_hash) -> *Account (both known and new accounts)
-	accMap     map[models.AccountID]*models.Account // id -> *Account (both known and new accounts)
-	dlgHashMap map[uint64]*models.Account           // delegates by hash
-	dlgMap     map[models.AccountID]*models.Account // delegates by id
+	idx        *Indexer                              // storage reference
+	accHashMap map[uint64]*models.Account            // hash(acc_hash) -> *Account (both known and new accounts)
+	accMap     map[models.AccountID]*models.Account  // id -> *Account (both known and new accounts)
+	dlgHashMap map[uint64]*models.Account            // delegates by hash
+	dlgMap     map[models.AccountID]*models.Account  // delegates by id
+	conMap     map[models.AccountID]*models.Contract // contracts originated in the current block
+	bigmaps    bool                                  // decode bigmap diffs
+	verifySigs bool                                  // check block and manager op signatures
 
 	// build state
 	block     *models.Block
@@ -55,6 +58,9 @@ func NewBuilder(idx *Indexer) *Builder {
 		accMap:     make(map[models.AccountID]*models.Account),
 		dlgMap:     make(map[models.AccountID]*models.Account),
 		dlgHashMap: make(map[uint64]*models.Account),
+		conMap:     make(map[models.AccountID]*models.Contract),
+		bigmaps:    idx.HasIndex(index.BigMapIndexKey),
+		verifySigs: idx.verifySigs,
 		baking:     make([]models.Right, 0, 64),
 		endorsing:  make([]models.Right, 0, 32),
 		branches:   make(map[string]*models.Block, 128), // more than max of 64
@@ -142,6 +148,26 @@ func (b *Builder) Delegates() map[models.AccountID]*models.Account {
 	return b.dlgMap
 }
 
+func (b *Builder) ContractByAccountId(id models.AccountID) (*models.Contract, bool) {
+	c, ok := b.conMap[id]
+	return c, ok
+}
+
+// RegisterContract keeps a contract originated in the current block so that
+// indexers can resolve it before it is stored.
+func (b *Builder) RegisterContract(c *models.Contract) {
+	b.conMap[c.AccountId] = c
+}
+
+// lookupContract resolves contracts originated in the current block first
+// and falls back to stored contracts.
+func (b *Builder) lookupContract(ctx context.Context, id models.AccountID) (*models.Contract, error) {
+	if c, ok := b.conMap[id]; ok {
+		return c, nil
+	}
+	return b.idx.LookupContractId(ctx, id)
+}
+
 func (b *Builder) Rights(typ chain.RightType) []models.Right {
 	switch typ {
 	case chain.RightTypeBaking:
@@ -153,6 +179,10 @@ func (b *Builder) Rights(typ chain.RightType) []models.Right {
 	}
 }
 
+func (b *Builder) Deployments() chain.Deployments {
+	return b.idx.reg.Deployments()
+}
+
 func (b *Builder) Init(ctx context.Context, tip *models.ChainTip, c *rpc.Client) error {
 	if tip.BestHeight < 0 {
 		return nil
@@ -164,7 +194,7 @@ func (b *Builder) Init(ctx context.Context, tip *models.ChainTip, c *rpc.Client)
 	if err != nil {
 		return err
 	}
-	if err := b.parent.FetchRPC(ctx, c); err != nil {
+	if err := b.parent.FetchRPC(ctx, c, b.idx.reg.BlockParams); err != nil {
 		return err
 	}
 	b.parent.Chain, err = b.idx.ChainByHeight(ctx, tip.BestHeight)
@@ -266,6 +296,7 @@ func (b *Builder) Clean() {
 	// clear build state
 	b.accHashMap = make(map[uint64]*models.Account)
 	b.accMap = make(map[models.AccountID]*models.Account)
+	b.conMap = make(map[models.AccountID]*models.Contract)
 	b.baking = b.baking[:0]
 	b.endorsing = b.endorsing[:0]
 
@@ -294,6 +325,8 @@ func (b *Builder) Purge() {
 	b.accHashMap = make(map[uint64]*models.Account)
 	b.accMap = make(map[models.AccountID]*models.Account)
 
+	b.conMap = make(map[models.AccountID]*models.Contract)
+
 	// clear delegate state
 	b.dlgHashMap = make(map[uint64]*models.Account)
 	b.dlgMap = make(map[models.AccountID]*models.Account)
@@ -363,6 +396,7 @@ func (b *Builder) CleanReorg() {
 	// clear build state
 	b.accHashMap = make(map[uint64]*models.Account)
 	b.accMap = make(map[models.AccountID]*models.Account)
+	b.conMap = make(map[models.AccountID]*models.Contract)
 	b.baking = b.baking[:0]
 	b.endorsing = b.endorsing[:0]
 
@@ -476,9 +510,12 @@ func (b *Builder) InitAccounts(ctx context.Context) error {
 				case chain.OpTypeDoubleEndorsementEvidence:
 					// empty
 
-				case chain.OpTypeEndorsement:
+				case chain.OpTypeEndorsement, chain.OpTypeEndorsementWithSlot:
 					// deactive delegates may not be in map
-					end := op.(*rpc.EndorsementOp)
+					end, ok := rpc.Endorsement(op)
+					if !ok {
+						continue
+					}
 					if _, ok := b.AccountByAddress(end.Metadata.Delegate); !ok {
 						addresses.AddUnique(end.Metadata.Delegate.String())
 					}
@@ -511,6 +548,12 @@ func (b *Builder) InitAccounts(ctx context.Context) error {
 				case chain.OpTypeReveal:
 					addresses.AddUnique(op.(*rpc.RevelationOp).Source.String())
 
+				case chain.OpTypeRegisterConstant:
+					addresses.AddUnique(op.(*rpc.ConstantRegistrationOp).Source.String())
+
+				case chain.OpTypeSetDepositsLimit:
+					addresses.AddUnique(op.(*rpc.SetDepositsLimitOp).Source.String())
+
 				case chain.OpTypeSeedNonceRevelation:
 					// not necessary because this is done by the baker
 
@@ -829,6 +872,9 @@ func (b *Builder) Decorate(ctx context.Context, rollback bool) error {
 		}
 		b.block.Baker = baker
 		b.block.BakerId = baker.RowId
+		if b.verifySigs && !rollback && !b.verifyBlockSignature() {
+			b.block.BadSignature = true
+		}
 		if baker.IsActiveDelegate {
 			// extend grace period
 			baker.UpdateGracePeriod(b.block.Cycle, b.block.Params)
@@ -900,6 +946,7 @@ func (b *Builder) Decorate(ctx context.Context, rollback bool) error {
 	for _, ol := range b.block.TZ.Block.Operations {
 		for _, oh := range ol {
 			// rpc.OperationHeader
+			nops := len(b.block.Ops)
 			for op_c, o := range oh.Contents {
 				switch kind := o.OpKind(); kind {
 				case chain.OpTypeActivateAccount:
@@ -922,7 +969,7 @@ func (b *Builder) Decorate(ctx context.Context, rollback bool) error {
 					if err := b.NewDoubleEndorsingOp(ctx, oh, op_n, op_c, rollback); err != nil {
 						return err
 					}
-				case chain.OpTypeEndorsement:
+				case chain.OpTypeEndorsement, chain.OpTypeEndorsementWithSlot:
 					if err := b.NewEndorsementOp(ctx, oh, op_n, op_c, rollback); err != nil {
 						return err
 					}
@@ -938,6 +985,14 @@ func (b *Builder) Decorate(ctx context.Context, rollback bool) error {
 					if err := b.NewRevealOp(ctx, oh, op_n, op_c, rollback); err != nil {
 						return err
 					}
+				case chain.OpTypeRegisterConstant:
+					if err := b.NewConstantRegistrationOp(ctx, oh, op_n, op_c, rollback); err != nil {
+						return err
+					}
+				case chain.OpTypeSetDepositsLimit:
+					if err := b.NewSetDepositsLimitOp(ctx, oh, op_n, op_c, rollback); err != nil {
+						return err
+					}
 				case chain.OpTypeSeedNonceRevelation:
 					if err := b.NewSeedNonceOp(ctx, oh, op_n, op_c, rollback); err != nil {
 						return err
@@ -948,6 +1003,11 @@ func (b *Builder) Decorate(ctx context.Context, rollback bool) error {
 					}
 				}
 			}
+			if b.verifySigs && !rollback && !b.verifyOpSignature(oh) {
+				for _, op := range b.block.Ops[nops:] {
+					op.BadSignature = true
+				}
+			}
 			op_n++
 		}
 	}
@@ -1075,7 +1135,10 @@ func (b *Builder) UpdateStats(ctx context.Context) error {
 			continue
 		}
 		o, _ := b.block.GetRPCOp(op.OpN, op.OpC)
-		eop := o.(*rpc.EndorsementOp)
+		eop, ok := rpc.Endorsement(o)
+		if !ok {
+			continue
+		}
 		acc, _ := b.AccountByAddress(eop.Metadata.Delegate)
 		num, _ := erights[acc.RowId]
 		erights[acc.RowId] = num - len(eop.Metadata.Slots)
@@ -1451,14 +1514,8 @@ func (b *Builder) FixUpgradeBugs(ctx context.Context, prevparams, nextparams *ch
 		}
 	}
 
-	// babylon airdrop
-	if nextparams.Protocol.IsEqual(chain.ProtoV005_2) && nextparams.ChainId.IsEqual(chain.Mainnet) {
-		if err := b.RunBabylonAirdrop(ctx, nextparams); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// protocol specific migrations like the babylon airdrop
+	return b.idx.reg.Handler(nextparams.Protocol).Migrate(ctx, b, prevparams, nextparams)
 }
 
 // v002 fixed an 'origination bug'
@@ -1510,170 +1567,6 @@ func (b *Builder) FixOriginationBug(ctx context.Context, params *chain.Params) e
 	return nil
 }
 
-// v005 airdrops 1 mutez to unfunded manager accounts to avoid origination burn
-func (b *Builder) RunBabylonAirdrop(ctx context.Context, params *chain.Params) error {
-	// collect all eligible addresses and inject airdrop flows
-
-	// The rules are:
-	// - process all originated accounts (KT1)
-	// - if it has code and is spendable allocate the manager contract (implicit account)
-	// - if it has code and is delegatble allocate the manager contract (implicit account)
-	// - if it has no code (delegation KT1) allocate the manager contract (implicit account)
-	// - (extra side condition) implicit account is not registered as delegate
-	//
-	// The above three cases are the cases where the manager contract (implicit account) is
-	// able to interact through the KT1 that it manages. For example, if the originated
-	// account has code but is neither spendable nor delegatable then the manager contract
-	// cannot act on behalf of the originated contract.
-
-	// HACK due to improperly documented v002 upgrade (i.e. origination bug fix),
-	// we do not precisely know which accounts are delegates and which are not;
-	// a manual QA inspection revealed that on mainnet there are 78 accounts
-	// that were not airdropped because they are delegates, so we exclude them
-	// here too
-	excludeList := make(map[string]struct{})
-	for _, v := range []string{
-		"tz1ajpiR5wkPXghYDdT4tizu3BG8iy4WJLz4",
-		"tz1NC7TTSyNwB5N7bQWXmafvJbCVrPKGNPcS",
-		"tz1hoFUMWpvRWy4fMUgLGZjwe3i5xxtN1Qci",
-		"tz1ZSr8MfNZsFQJ2Gt67rJfNFeJks2P7cgwr",
-		"tz1f4U4NUdnMgP8rkPHvUBVznZsgUG636nhz",
-		"tz1fntgFVaRT3jxaMyHaxVua7w2TaNcPKeZP",
-		"tz1RCpatyxtpTEzXYqQjsz6r2VrhMeF3pCY6",
-		"tz1TwzoBefS8PEbe91h3eTkYsA4QAQEBMcVL",
-		"tz1bVXGLBa8qhHaymZ3yEwgHjiAE7MDom13K",
-		"tz1S8ocaHL58fSrneqJeF6Ure4LSjarPcDDx",
-		"tz1XB7RRogXyqoDPVcRLd9LS2kJoQRGT4Eje",
-		"tz1LUWkTyB62ZFpvn8ZrqbaVDPekXzcVMuFd",
-		"tz1Ua95YukXAmcMbfUv67gEhxiJx1n9djMiU",
-		"tz1L6a3SsVqzvcxESxzqvEJpAcU8Hs4SSHEF",
-		"tz1QRKeabUMA4dExyk1y12v1MwqibWoczoZU",
-		"tz1Nthwqk6zjHei1tEGdj228Awt7VsN86c6b",
-		"tz1X4C6KvSAkavFAexxCJNpdyYtP8bftRcoe",
-		"tz1UVB4Yt8raLZq8AH9k386aqr7CG7qSMMjU",
-		"tz1Q3fqvAJmijgABnHbbNm1ou81rvFcmBipM",
-		"tz1cs4Q98YbsUfNpch7ijQHtEgMqvdzTvnhW",
-		"tz1LVHUSTmfNHn1NpDa8Mz8vq1Sh5CCMXX4V",
-		"tz1PPVuUuJR258nGtdHEsUSmBHHsvFeLrRTW",
-		"tz1PygG8dRGV5vev2DALRAqmdYAqReTD8987",
-		"tz1RQMjZjF2hg4ySfMCuZH5hAzNLziqTkazH",
-		"tz1UHQ7YYDaxSV4dY8boJRhUfmU7jKprEsZw",
-		"tz1cP3XjgyQ4xY3kCJbxXLbq2QzkeMFUFBoh",
-		"tz1NEV1TPAeF68AiyLBUG7CPBFNJ1txVYqu1",
-		"tz1XkRTJT7gn41VczW8dx1KQjPFxWYVei8Cs",
-		"tz1gJvShTiuxoaZtjcwMv3LHcGU2QFqx5dsE",
-		"tz1LmJsZuRyxswNV4YghF3q5fmLLxrKST3gp",
-		"tz1VayoLunKK13JkS6ZpLfHvB193VaZLnU3N",
-		"tz1W7roMZucBCjh8QgwwgJsjEazW2YgA7sJ5",
-		"tz1MRHkVE9zxbAgho7uNuqAcmct17d3Ej9VS",
-		"tz1QJVCDbrGkfEjcdWD1eXy71fXYtbNg93Gp",
-		"tz1Mz7ZZu5Rgg2LamJmu2dzozZ2KZ8Jb2rLP",
-		"tz1e9jBy9dEGER2dKrtzcWtCpDfbbLNPTQab",
-		"tz1UrBsKAUybPbqZHKaNp8ru4F8NcW2e1inG",
-		"tz1VDRt5NL44SEECAW7Qft8nSCjhDWvhYPrb",
-		"tz1VUunMWp6tfK7T7QQQTBcsrnp713CmCDYi",
-		"tz1eNUaSdwY7RJfb3aVXFwPc3tiG6HeCADnq",
-		"tz1duEr8qA9y2PUkRYnA7qE2nwmUpunANcQg",
-		"tz1dFhaP5bWLgBswYtBxpTFEXec7mmzBskNw",
-		"tz1NaujomKqcKKacopVcQtqh32DTNaLAdcNb",
-		"tz1PCPMQ7WC62WqGxgHB1G48wVUCmvTbmoAE",
-		"tz1foqx9ArpckkTvwbPiV4kjoYsxnbQdSE3o",
-		"tz1S3ucpKQrtkp8Bz7mw4LJ1zPVqmWufC5aS",
-		"tz1YVWh2g8Lne3RrJukx7bESXKWzryiXvyyV",
-		"tz1g9e5poiqG2V2SC7aya93MTKJt6pbyWrEk",
-		"tz1UcuaXouNppYnbJr3JWGV31Fa2fnzesmJ4",
-		"tz1P4CZSLSmD6VVUm9dqNFpy9eV3ZU1LwwbQ",
-		"tz1TJY3ouYwqdcyPQFWU9DEy5q4Y5qEusPqY",
-		"tz1e5NtW8mi6F6U8DfKaMwSeRaiPjrxKxT3V",
-		"tz1hE2bwMvNAJJuSnTLjxfLCdLbkuZwRumsW",
-		"tz1SQ3fSVjscp2vjmVSiyWQL9Yapt3y6FZHJ",
-		"tz1gkWnVtzqzavL8PJNsDTVYyP8mLhdwqF45",
-		"tz1fc7jqJ4YuJx9Diyb8b4iiWAto34p7pqRT",
-		"tz1Kvszu74tzrfjZRYW9d1r7ePK81rHxsZUB",
-		"tz1azWX5Ux5Hizb3qj1vHF5LZwwCMFA8b4mZ",
-		"tz1XymQfBfSJMDoeCAMmseR5SiHKMXCWMaNy",
-		"tz1P6nfhyAx8uUapcZSuFmYtBzv4RmwF6qvg",
-		"tz1Pk341z4zeN8rRTX1HwWXMfbzSsn6dwEYo",
-		"tz1LrFegiq14oByxgcS7vGFnorj9uYBed6bD",
-		"tz1bkhnnvrtmwcryKzHGbKp48yS2qNMRDehA",
-		"tz1NuXPd1qePQeMzsMTZQAqy8a8DSkqYUVcb",
-		"tz1Rctu7qNj3RyAyz7kdyJjYkbYxeTpNFQRF",
-		"tz1LS6oGf95DV7c2mSZ17C6RsuoEiD9EwGWc",
-		"tz1TWQmJTfosQPFGUXjbXUzV6Tj23s8zbXUs",
-		"tz1ffqW9CQ6aCD8zwcq5CLs8Gth335LWAEDJ",
-		"tz1Qsa82diwpvMbsyi3t57KVyV6dGZX5zkSg",
-		"tz1VQuud7J1kmBCrhcKYsYHU1FX5nkFjtLpu",
-		"tz1e1BgVt3DZgA1AuTMTRGS2cgS2vGP3hMRE",
-		"tz1Szcfqv3iTVSsTb11X8YCCnxRsFP6uK3v5",
-		"tz1bg9WkHYxigQ7J4n2sufKWcPn955UrF3Kb",
-		"tz1cQM6iWcptjU68FGfy1b7TNLr6aKUTQbTT",
-		"tz1Qk2Q8Ju3YCSqPv9QxCEafSYZM1ZwTTcCn",
-		"tz1WeuWTkfMaViHypSX7joYjWX8NApHHC2sq",
-		"tz1djECaHtJXhYP1kbK4KgJ2EHpgCVjvANnQ",
-		"tz1PAcQy7L3EqKLaYZjpJ7sUNRXWe4NNnmEc",
-	} {
-		excludeList[v] = struct{}{}
-	}
-
-	// find eligible KT1 contracts where we need to check the manager
-
-	managers := make([]uint64, 0)
-
-	var accs []*models.Account
-	err := b.idx.statedb.Where("address_type = ?", int64(chain.AddressTypeContract)).Find(&accs).Error
-	if err != nil {
-		return err
-	}
-	for _, acc := range accs {
-		// skip all excluded contracts that do not match the rules above
-		if acc.IsContract {
-			if !acc.IsSpendable && !acc.IsDelegatable {
-				return nil
-			}
-		}
-		managers = append(managers, acc.ManagerId.Value())
-		return nil
-	}
-
-	// find unfunded managers
-	var count int
-	var accss []*models.Account
-	err = b.idx.statedb.Where("is_funded = ? and row_id in (?)", false, util.UniqueUint64Slice(managers)).Find(&accss).Error
-	if err != nil {
-		return err
-	}
-	for _, acc := range accss {
-		// HACK: skip registered delegates unless they are v002 origination bug delegates
-		if acc.IsDelegate && !(acc.DelegateSince < 28083 && acc.NDelegation == 0) {
-			log.Debugf("airdrop: skipping delegate %s", acc)
-			return nil
-		}
-
-		// HACK; skip by address
-		if _, ok := excludeList[acc.String()]; ok {
-			log.Debugf("airdrop: skipping v002 delegate %s", acc)
-			return nil
-		}
-
-		flow := models.NewFlow(b.block, acc, nil)
-		flow.Category = models.FlowCategoryBalance
-		flow.Operation = models.FlowTypeAirdrop
-		flow.AmountIn = 1
-		b.block.Flows = append(b.block.Flows, flow)
-		count++
-		log.Debugf("airdrop: %s %f", acc, params.ConvertValue(flow.AmountIn))
-		// add account to builder map if not exist
-		if _, ok := b.accMap[acc.RowId]; !ok {
-			b.accMap[acc.RowId] = acc
-		} else {
-			acc.Free()
-		}
-	}
-
-	log.Infof("Upgrade to v%03d: executed %d airdrops", params.Version, count)
-	return nil
-}
-
 // big_map_diffs in proto < v005 lack id and action. Also allocs are not explicit.
 // In order to satisfy further processing logic we patch in an alloc when we see a
 // new contract using a bigmap.
@@ -1699,8 +1592,12 @@ func (b *Builder) PatchBigMapDiff(ctx context.Context, diff micheline.BigMapDiff
 
 	// log.Infof("Patching bigmap for account %d at height %d", accId, b.block.Height)
 
-	// load contract
-	contract, err := b.idx.LookupContractId(ctx, accId)
+	// origination diffs get the alloc, calls to contracts originated earlier
+	// in this block don't because their origination diff already has it
+	isOrigination := script != nil
+
+	// load contract, may have been originated in the current block
+	contract, err := b.lookupContract(ctx, accId)
 	if err != nil {
 		return nil, err
 	}
@@ -1741,7 +1638,8 @@ func (b *Builder) PatchBigMapDiff(ctx context.Context, diff micheline.BigMapDiff
 		if err != index.ErrNoBigMapEntry {
 			return nil, err
 		}
-		needAlloc = true
+		_, isNew := b.conMap[accId]
+		needAlloc = isOrigination || !isNew
 	}
 
 	// inject a synthetic alloc to satisfy processing logic
@@ -0,0 +1,119 @@
+package puller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+)
+
+// athensBigmapScript is a pre-v005 contract with a single bigmap
+const athensBigmapScript = `{"code":[
+{"prim":"parameter","args":[{"prim":"unit"}]},
+{"prim":"storage","args":[{"prim":"pair","args":[{"prim":"big_map","args":[{"prim":"string"},{"prim":"nat"}]},{"prim":"unit"}]}]},
+{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],
+"storage":{"prim":"Pair","args":[[],{"prim":"Unit"}]}}`
+
+func TestBuilderLookupContract(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	assert.NoError(t, db.Create(&models.Contract{AccountId: 5}).Error)
+
+	b := NewBuilder(NewIndexer(IndexerConfig{StateDB: db}))
+	b.block = &models.Block{}
+	b.RegisterContract(&models.Contract{RowId: 99, AccountId: 7})
+
+	for _, v := range []struct {
+		Name  string
+		Id    models.AccountID
+		RowId uint64
+		Err   bool
+	}{
+		{"originated in block", 7, 99, false},
+		{"stored", 5, 1, false},
+		{"missing", 8, 0, true},
+	} {
+		c, err := b.lookupContract(context.Background(), v.Id)
+		if v.Err {
+			assert.Error(t, err, v.Name)
+			continue
+		}
+		if assert.NoError(t, err, v.Name) {
+			assert.Equal(t, v.RowId, c.RowId, v.Name)
+		}
+		c, ok := b.ContractByAccountId(v.Id)
+		assert.Equal(t, v.RowId == 99, ok, v.Name)
+	}
+
+	// contracts originated in a block are dropped after the block
+	b.Clean()
+	_, err := b.lookupContract(context.Background(), 7)
+	assert.Error(t, err)
+}
+
+func TestBuilderPatchBigMapDiff(t *testing.T) {
+	script := micheline.NewScript()
+	if err := json.Unmarshal([]byte(athensBigmapScript), script); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := script.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Athens contract with static bigmap id 0
+	addr, _ := chain.ParseAddress("KT1LvAUw8xXH2X4WQRKUYvSiDuXkh15kNC1B")
+
+	for _, v := range []struct {
+		Name        string
+		Origination bool // called with the origination script
+		New         bool // originated in the current block
+		Allocated   bool // alloc stored by an earlier block
+		Alloc       bool // expect an injected alloc
+	}{
+		{"origination", true, true, false, true},
+		{"call to contract originated in block", false, true, false, false},
+		{"call to stored contract", false, false, false, true},
+		{"allocated", false, false, true, false},
+	} {
+		db := dbtest.Open(t)
+		b := NewBuilder(NewIndexer(IndexerConfig{StateDB: db}))
+		b.block = &models.Block{Params: &chain.Params{Version: 4}}
+		cc := &models.Contract{AccountId: 7, Hash: addr.Hash, Script: buf}
+		if v.New {
+			b.RegisterContract(cc)
+		} else {
+			assert.NoError(t, db.Create(cc).Error, v.Name)
+		}
+		if v.Allocated {
+			item := &models.BigMapItem{BigMapId: 0, Action: micheline.BigMapDiffActionAlloc}
+			assert.NoError(t, db.Create(item).Error, v.Name)
+		}
+		var s *micheline.Script
+		if v.Origination {
+			s = script
+		}
+
+		diff := micheline.BigMapDiff{{Action: micheline.BigMapDiffActionUpdate, Id: 42, StringKey: "a"}}
+		diff, err := b.PatchBigMapDiff(context.Background(), diff, 7, s)
+		if !assert.NoError(t, err, v.Name) {
+			db.Close()
+			continue
+		}
+		if v.Alloc {
+			if assert.Len(t, diff, 2, v.Name) {
+				assert.Equal(t, micheline.BigMapDiffActionAlloc, diff[0].Action, v.Name)
+				assert.Equal(t, micheline.T_STRING, diff[0].KeyType, v.Name)
+			}
+		} else {
+			assert.Len(t, diff, 1, v.Name)
+		}
+		for _, e := range diff {
+			assert.Equal(t, int64(0), e.Id, v.Name)
+		}
+		db.Close()
+	}
+}
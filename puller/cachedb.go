@@ -0,0 +1,176 @@
+package puller
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"sync"
+	"tezos_index/puller/models"
+)
+
+// CacheDB is the key-value store holding the chain tip, index tips and
+// protocol deployments. Get returns ErrNoData when a key does not exist.
+type CacheDB interface {
+	Get(key string) ([]byte, error)
+	Set(key string, val []byte) error
+}
+
+// Pinger is implemented by caches that can check their connection.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type redisCache struct {
+	client *redis.Client
+}
+
+// NewRedisCache wraps a redis client as CacheDB.
+func NewRedisCache(client *redis.Client) CacheDB {
+	return &redisCache{client: client}
+}
+
+func (r *redisCache) Get(key string) ([]byte, error) {
+	val, err := r.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNoData
+	}
+	return val, err
+}
+
+func (r *redisCache) Set(key string, val []byte) error {
+	return r.client.Set(key, val, 0).Err()
+}
+
+// Ping returns when the server answers or ctx is done. The client doesn't
+// take a context, a hanging ping keeps running in the background.
+func (r *redisCache) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- r.client.Ping().Err()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// MemCache is an in-memory CacheDB used for tests and single-shot runs that
+// don't need to keep state across restarts.
+type MemCache struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemCache() *MemCache {
+	return &MemCache{data: make(map[string][]byte)}
+}
+
+func (m *MemCache) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	val, ok := m.data[key]
+	if !ok {
+		return nil, ErrNoData
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (m *MemCache) Set(key string, val []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = append([]byte(nil), val...)
+	return nil
+}
+
+// StateDB keeps chain state in the chain_state table and mirrors it to an
+// optional cache. State is read from the table, keys missing there are taken
+// from the cache and copied over, which imports state kept in redis by
+// earlier versions.
+type StateDB struct {
+	db    *gorm.DB
+	cache CacheDB
+}
+
+func NewStateDB(db *gorm.DB, cache CacheDB) *StateDB {
+	return &StateDB{db: db, cache: cache}
+}
+
+func (s *StateDB) Get(key string) ([]byte, error) {
+	val, err := models.LoadState(s.db, key)
+	if err == nil {
+		return val, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	if s.cache == nil {
+		return nil, ErrNoData
+	}
+	val, err = s.cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.StoreState(s.db, key, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (s *StateDB) Set(key string, val []byte) error {
+	if err := models.StoreState(s.db, key, val); err != nil {
+		return err
+	}
+	s.setCache(key, val)
+	return nil
+}
+
+func (s *StateDB) setCache(key string, val []byte) {
+	if s.cache == nil {
+		return
+	}
+	// the table is authoritative, a stale cache is harmless
+	if err := s.cache.Set(key, val); err != nil {
+		log.Warnf("updating state cache key %s: %v", key, err)
+	}
+}
+
+// Begin returns a state store writing to tx. Writes reach the cache when
+// Commit is called after the transaction has been committed.
+func (s *StateDB) Begin(tx *gorm.DB) *TxState {
+	return &TxState{state: s, tx: tx, writes: make(map[string][]byte)}
+}
+
+type TxState struct {
+	state  *StateDB
+	tx     *gorm.DB
+	writes map[string][]byte
+}
+
+func (t *TxState) Get(key string) ([]byte, error) {
+	if val, ok := t.writes[key]; ok {
+		return val, nil
+	}
+	val, err := models.LoadState(t.tx, key)
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNoData
+	}
+	return val, err
+}
+
+func (t *TxState) Set(key string, val []byte) error {
+	if err := models.StoreState(t.tx, key, val); err != nil {
+		return err
+	}
+	t.writes[key] = val
+	return nil
+}
+
+// Commit copies all writes to the cache.
+func (t *TxState) Commit() {
+	for k, v := range t.writes {
+		t.state.setCache(k, v)
+	}
+}
@@ -11,10 +11,10 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/zyjblockchain/sandy_log/log"
 	"runtime/debug"
-	"strconv"
 	"sync"
 	"tezos_index/chain"
 	"tezos_index/puller/models"
+	"tezos_index/reporting"
 	"tezos_index/rpc"
 	util "tezos_index/utils"
 	"time"
@@ -30,6 +30,24 @@ const (
 
 var IntegrityHead string = "INTEGRITY_HEAD"
 
+// blocks below chain head that are always fetched one at a time
+const prefetchSafetyDepth = 64
+
+const (
+	// pollInterval is how often the node head is polled while the
+	// monitor is disabled or disconnected.
+	pollInterval = 20 * time.Second
+
+	// the monitor stream counts as stalled after no block was announced
+	// for monitorStallBlocks block times
+	monitorStallBlocks  = 4
+	defaultMonitorStall = 3 * time.Minute
+
+	monitorConnectTimeout = 30 * time.Second
+	monitorMinBackoff     = time.Second
+	monitorMaxBackoff     = time.Minute
+)
+
 type State string
 
 const (
@@ -50,7 +68,13 @@ type CrawlerConfig struct {
 	Queue     int
 	StopBlock int64
 	// Snapshot      *SnapshotConfig
-	EnableMonitor bool
+	EnableMonitor bool            // follow chain head via the node's monitor stream, poll otherwise
+	MonitorStall  time.Duration   // reconnect a silent monitor stream, derived from block time when zero
+	Listen        string          // API server address, disabled when empty
+	Prefetch      int             // number of blocks fetched in parallel while catching up
+	Mempool       bool            // track pending operations
+	Metadata      MetadataFetcher // fetches off-chain metadata, disabled when nil
+	ReadyLag      int64           // max blocks behind node head when ready, DefaultReadyLag when zero
 }
 
 type SnapshotConfig struct {
@@ -67,9 +91,13 @@ type Crawler struct {
 	state State
 	mode  Mode
 	// snap          *SnapshotConfig
-	useMonitor    bool
+	useMonitor    bool // caught up with chain head, new blocks come from the monitor
+	monitorUp     bool // monitor stream connected
 	enableMonitor bool
+	monitorStall  time.Duration
 	stopHeight    int64
+	prefetch      int
+	readyLag      int64
 
 	db      *gorm.DB
 	rpc     *rpc.Client
@@ -80,6 +108,9 @@ type Crawler struct {
 	params  *chain.Params
 	tip     *models.ChainTip
 	bchead  *rpc.BlockHeader
+	server  *Server
+	mempool *Mempool
+	meta    *MetadataResolver
 
 	// coordinated shutdown
 	quit   chan struct{}
@@ -92,13 +123,16 @@ type Crawler struct {
 }
 
 func NewCrawler(cfg CrawlerConfig) *Crawler {
-	return &Crawler{
+	c := &Crawler{
 		state: STATE_LOADING,
 		mode:  MODE_SYNC,
 		// snap:          cfg.Snapshot,
 		useMonitor:    false,
 		enableMonitor: cfg.EnableMonitor,
+		monitorStall:  cfg.MonitorStall,
 		stopHeight:    cfg.StopBlock,
+		prefetch:      util.Max(cfg.Prefetch, 1),
+		readyLag:      cfg.ReadyLag,
 		db:            cfg.DB,
 		rpc:           cfg.Client,
 		builder:       NewBuilder(cfg.Indexer),
@@ -108,6 +142,26 @@ func NewCrawler(cfg CrawlerConfig) *Crawler {
 		// plog:          NewBlockProgressLogger("Processed"),
 		quit: make(chan struct{}),
 	}
+	if c.readyLag <= 0 {
+		c.readyLag = DefaultReadyLag
+	}
+	if cfg.Listen != "" {
+		c.server = NewServer(cfg.Listen, c)
+	}
+	if cfg.Mempool {
+		c.mempool = NewMempool(MempoolConfig{
+			DB:     cfg.DB,
+			Client: cfg.Client,
+			Height: c.indexedHeight,
+		})
+	}
+	if cfg.Metadata != nil {
+		c.meta = NewMetadataResolver(MetadataResolverConfig{
+			DB:      cfg.DB,
+			Fetcher: cfg.Metadata,
+		})
+	}
+	return c
 }
 
 func (c *Crawler) Tip() *models.ChainTip {
@@ -118,6 +172,16 @@ func (c *Crawler) Height() int64 {
 	return c.tip.BestHeight
 }
 
+// indexedHeight is safe to call before the crawler is initialized.
+func (c *Crawler) indexedHeight() int64 {
+	c.RLock()
+	defer c.RUnlock()
+	if c.tip == nil {
+		return 0
+	}
+	return c.tip.BestHeight
+}
+
 func (c *Crawler) Time() time.Time {
 	return c.tip.BestTime
 }
@@ -162,6 +226,8 @@ type CrawlerStatus struct {
 }
 
 func (c *Crawler) Status() CrawlerStatus {
+	c.RLock()
+	defer c.RUnlock()
 	tip := c.Tip()
 	s := CrawlerStatus{
 		Status:  c.state,
@@ -208,6 +274,19 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 		if err = c.indexer.Init(ctx, tip); err != nil {
 			return err
 		}
+		// check stored state against indexed blocks
+		if !firstRun {
+			if firstRun, err = c.repairState(ctx); err != nil {
+				return err
+			}
+		}
+		if firstRun && c.tip.BestHeight >= 0 {
+			c.tip = &models.ChainTip{
+				BestHeight: -1,
+				Name:       c.params.Name,
+				Symbol:     c.params.Symbol,
+			}
+		}
 	}
 
 	// skip RPC init if not required
@@ -242,6 +321,7 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 		log.Info("Fetching genesis block.")
 		tzblock, err := c.fetchBlockByHeight(ctx, 0)
 		if err != nil {
+			reporting.Error(err, reporting.BlockTags(0, "", ""))
 			c.state = STATE_FAILED
 			return err
 		}
@@ -249,6 +329,7 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 		// build a new genesis block from rpc.Block
 		genesis, err := c.builder.Build(ctx, tzblock)
 		if err != nil {
+			reporting.Error(err, bundleTags(tzblock))
 			c.state = STATE_FAILED
 			return err
 		}
@@ -261,23 +342,28 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 			genesis.Params.Version = -1
 			c.indexer.ConnectProtocol(ctx, genesis.Params)
 
-			// add to all indexes
-			if err := c.indexer.ConnectBlock(ctx, genesis, c.builder); err != nil {
-				c.state = STATE_FAILED
-				return err
-			}
 			// keep as best block
 			cHash, err := chain.ParseBlockHash(genesis.Hash.String())
 			if err != nil {
 				log.Errorf("parse block hash error; err: %v", err)
 			}
-			c.tip.BestHash = cHash
-			c.tip.BestHeight = genesis.Height
-			c.tip.BestId = genesis.RowId
-			c.tip.BestTime = genesis.Timestamp
-			c.tip.GenesisTime = genesis.Timestamp
-			c.tip.ChainId = genesis.Params.ChainId
-			c.tip.AddDeployment(genesis.Params)
+			tip := &models.ChainTip{
+				Name:        c.tip.Name,
+				Symbol:      c.tip.Symbol,
+				ChainId:     genesis.Params.ChainId,
+				BestHash:    cHash,
+				BestHeight:  genesis.Height,
+				BestTime:    genesis.Timestamp,
+				GenesisTime: genesis.Timestamp,
+			}
+			tip.AddDeployment(genesis.Params)
+
+			// add to all indexes, failures are reported by the indexer
+			if err := c.indexer.ConnectBlock(ctx, genesis, c.builder, tip); err != nil {
+				c.state = STATE_FAILED
+				return err
+			}
+			c.tip = tip
 		}
 
 		c.builder.Clean()
@@ -287,7 +373,7 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 		log.Infof("Crawling %s %s.", p.Name, p.Network)
 
 		// init block builder state
-		if err = c.builder.Init(ctx, tip, c.rpc); err != nil {
+		if err = c.builder.Init(ctx, c.tip, c.rpc); err != nil {
 			return err
 		}
 
@@ -307,6 +393,15 @@ func (c *Crawler) Init(ctx context.Context, mode Mode) error {
 func (c *Crawler) Start() {
 	log.Info("Starting blockchain crawler.")
 	go c.syncBlockchain()
+	if c.server != nil {
+		c.server.Start()
+	}
+	if c.mempool != nil {
+		c.mempool.Start()
+	}
+	if c.meta != nil {
+		c.meta.Start()
+	}
 }
 
 // close quit channel
@@ -321,6 +416,19 @@ func (c *Crawler) Stop(ctx context.Context) {
 	// signal close to ingest thread
 	close(c.quit)
 
+	// stop serving API requests before indexes go away
+	if c.server != nil {
+		sctx, scancel := context.WithTimeout(ctx, 5*time.Second)
+		c.server.Stop(sctx)
+		scancel()
+	}
+	if c.mempool != nil {
+		c.mempool.Stop()
+	}
+	if c.meta != nil {
+		c.meta.Stop()
+	}
+
 	// convert wait group end into channel
 	done := make(chan struct{})
 	go func() {
@@ -359,93 +467,155 @@ func (c *Crawler) Stop(ctx context.Context) {
 	log.Info("Stopped blockchain crawler.")
 }
 
+// monitoring returns true when new blocks are announced by the monitor
+// stream, otherwise ingest polls the node.
+func (c *Crawler) monitoring() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.useMonitor && c.monitorUp
+}
+
+// setMonitorUp records whether the monitor stream is connected and logs
+// switches between monitor and poll mode.
+func (c *Crawler) setMonitorUp(up bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.monitorUp == up {
+		return
+	}
+	c.monitorUp = up
+	switch {
+	case !c.useMonitor:
+	case up:
+		log.Info("Monitor connected. Switching to monitor mode.")
+	default:
+		log.Warn("Monitor disconnected. Switching to poll mode.")
+	}
+}
+
+// monitorStallTimeout returns how long the monitor may stay silent before
+// the stream is considered stalled.
+func (c *Crawler) monitorStallTimeout() time.Duration {
+	if c.monitorStall > 0 {
+		return c.monitorStall
+	}
+	c.RLock()
+	p := c.params
+	c.RUnlock()
+	d := p.MinimalBlockDelay
+	if d <= 0 {
+		d = p.TimeBetweenBlocks[0]
+	}
+	if d <= 0 {
+		return defaultMonitorStall
+	}
+	return monitorStallBlocks * d
+}
+
+// runMonitor keeps a block header stream open and forwards new heads to
+// ingest once the crawler has caught up. Broken and stalled streams are
+// reconnected with exponential backoff, ingest polls in the meantime.
 func (c *Crawler) runMonitor(next chan<- chain.BlockHash) {
 	log.Infof("Starting blockchain monitor.")
 	c.wg.Add(1)
 	defer c.wg.Done()
-	var mon *rpc.BlockHeaderMonitor
-	defer func() {
-		c.useMonitor = false
-		if mon != nil {
-			mon.Close()
-		}
-	}()
+	defer c.setMonitorUp(false)
+
+	var backoff time.Duration
 	for {
-		log.Debugf("For runMonitor...")
-		// check context cancellation
+		received, err := c.monitorHeads(next)
+		c.setMonitorUp(false)
 		select {
 		case <-c.quit:
-			log.Errorf("Exiting monitor loop on quit.")
+			log.Info("Exiting monitor loop on quit.")
 			return
 		case <-c.ctx.Done():
-			log.Errorf("Exiting monitor loop on cancelled context.")
+			log.Info("Exiting monitor loop on cancelled context.")
 			return
 		default:
 		}
 
-		// (re)connect
-		if mon == nil {
-			mon = rpc.NewBlockHeaderMonitor()
-			// may block when no HTTP headers are sent
-			if err := c.rpc.MonitorBlockHeader(c.ctx, mon); err != nil {
-				if err != context.Canceled {
-					log.Errorf("monitor error: %v", err)
-				}
-				c.useMonitor = false
-				mon.Close()
-				mon = nil
-				// wait 5 sec, but also return on shutdown
-				select {
-				case <-c.quit:
-					log.Errorf("Exiting monitor loop on quit.")
-					return
-				case <-c.ctx.Done():
-					log.Errorf("Exiting monitor loop on cancelled context.")
-					return
-				case <-time.After(5 * time.Second):
-				}
-				continue
-			}
+		// reconnect at once after a stream that worked for a while
+		switch {
+		case received:
+			backoff = 0
+		case backoff == 0:
+			backoff = monitorMinBackoff
+		default:
+			backoff = util.MinDuration(2*backoff, monitorMaxBackoff)
+		}
+		log.Warnf("Monitor error: %v. Reconnecting in %s.", err, backoff)
+		select {
+		case <-c.quit:
+			log.Info("Exiting monitor loop on quit.")
+			return
+		case <-c.ctx.Done():
+			log.Info("Exiting monitor loop on cancelled context.")
+			return
+		case <-time.After(backoff):
 		}
+	}
+}
+
+// monitorHeads reads one header stream until it breaks or stalls. It
+// returns true when at least one header was received.
+func (c *Crawler) monitorHeads(next chan<- chain.BlockHash) (bool, error) {
+	// cancelling the request context aborts a blocked stream
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	mon := rpc.NewBlockHeaderMonitor()
+	defer mon.Close()
+
+	// the node may accept the connection without sending headers
+	timer := time.AfterFunc(monitorConnectTimeout, cancel)
+	err := c.rpc.MonitorBlockHeader(ctx, mon)
+	if !timer.Stop() {
+		return false, fmt.Errorf("connect timeout after %s", monitorConnectTimeout)
+	}
+	if err != nil {
+		return false, err
+	}
+	c.setMonitorUp(true)
 
-		// wait for message
-		head, err := mon.Recv(c.ctx)
-		// reconnect on error unless context was cancelled
+	var received bool
+	for {
+		stall := c.monitorStallTimeout()
+		rctx, rcancel := context.WithTimeout(ctx, stall)
+		head, err := mon.Recv(rctx)
+		rcancel()
+		if err == context.DeadlineExceeded {
+			return received, fmt.Errorf("stream stalled, no block for %s", stall)
+		}
 		if err != nil {
-			if err == context.Canceled {
-				log.Errorf("Exiting monitor loop on cancelled context")
-				return
-			}
-			// prepare for reconnect
-			mon.Close()
-			mon = nil
-			c.useMonitor = false
-			continue
+			return received, err
 		}
+		received = true
 
 		// skip messages until we have caught up with chain head
-		if !c.useMonitor {
+		c.RLock()
+		synced := c.useMonitor
+		c.RUnlock()
+		if !synced {
 			log.Debugf("Monitor skipping block %d %s (not synchronized)", head.Level, head.Hash)
 			continue
 		}
 
 		// in any case, update blockchain info, ignore error
-		c.fetchBlockchainInfo(c.ctx)
+		c.fetchBlockchainInfo(ctx)
 
-		// check for shutdown again
+		// check for shutdown again, then forward to avoid send on closed channel
 		select {
 		case <-c.quit:
-			return
+			return received, nil
 		case <-c.ctx.Done():
-			return
+			return received, c.ctx.Err()
 		default:
 		}
-
-		// then forward to avoid send on closed channel
 		select {
 		case next <- head.Hash:
 			log.Debugf("Monitor new block %d %s", head.Level, head.Hash)
 		default:
+			// ingest fills gaps by height
 			log.Debugf("Monitor send on full channel, skipping block")
 		}
 	}
@@ -464,7 +634,7 @@ func (c *Crawler) runIngest(next chan chain.BlockHash) {
 	lastblock := c.Tip().BestHeight
 
 	// setup periodic updates
-	tick := util.NewWallTicker(20*time.Second, 0)
+	tick := util.NewWallTicker(pollInterval, 0)
 	defer func() {
 		tick.Stop()
 	}()
@@ -473,10 +643,12 @@ func (c *Crawler) runIngest(next chan chain.BlockHash) {
 		log.Debugf("For runIngest...")
 		select {
 		case <-tick.C:
-			if !c.useMonitor {
+			if !c.monitoring() {
 				// this helps survive a broken monitoring channel
 				if err := c.fetchBlockchainInfo(c.ctx); err != nil {
+					c.Lock()
 					c.bchead = nil
+					c.Unlock()
 				}
 				select {
 				case next <- chain.BlockHash{}:
@@ -501,7 +673,9 @@ func (c *Crawler) runIngest(next chan chain.BlockHash) {
 						c.state = STATE_SYNCHRONIZED
 						if c.enableMonitor {
 							c.useMonitor = true
-							log.Info("Already synchronized. Starting in monitor mode.")
+							if c.monitorUp {
+								log.Info("Already synchronized. Starting in monitor mode.")
+							}
 						}
 					}
 				}
@@ -510,7 +684,7 @@ func (c *Crawler) runIngest(next chan chain.BlockHash) {
 		}
 
 		// on missing bchead, wait and retry
-		if c.bchead == nil {
+		if c.chainHead() == nil {
 			c.Lock()
 			c.state = STATE_CONNECTING
 			c.Unlock()
@@ -532,67 +706,95 @@ func (c *Crawler) runIngest(next chan chain.BlockHash) {
 		}
 
 		// update bchead when last block is higher
-		if lastblock > c.bchead.Level {
+		if lastblock > c.chainHead().Level {
 			if err := c.fetchBlockchainInfo(c.ctx); err != nil {
 				continue
 			}
 		}
 
 		// prefetch block
-		if lastblock < c.bchead.Level || nextHash.IsValid() {
+		if lastblock < c.chainHead().Level || nextHash.IsValid() {
 			if util.InterruptRequested(c.ctx) {
 				continue
 			}
 			// log.Tracef("Fetching next block %d %s", lastblock+1, nextHash)
 
 			var (
-				tzblock *models.Bundle
+				bundles []*models.Bundle
+				gapHash chain.BlockHash
 				err     error
 			)
 			if nextHash.IsValid() {
+				var tzblock *models.Bundle
 				tzblock, err = c.fetchBlockByHash(c.ctx, nextHash)
 				if err != nil {
 					log.Errorf("fetch block by hash error; err: %v", err)
+				} else if h := tzblock.Height(); h > lastblock+1 {
+					// blocks were missed while the monitor was down or
+					// behind, fill the gap by height up to the announced
+					// block, which completes the gap when all blocks link
+					log.Infof("Monitor announced block %d, filling gap from block %d.", h, lastblock+1)
+					n := int(h - lastblock - 1)
+					bundles, err = c.fetchBlocksByHeight(c.ctx, lastblock+1, util.Min(n, util.Max(c.prefetch, 1)))
+					if l := len(bundles); l == n && tzblock.Parent().IsEqual(bundles[l-1].Hash()) {
+						bundles = append(bundles, tzblock)
+					} else if err == nil {
+						// continue with the announced block after this batch
+						gapHash = nextHash
+					}
 				} else {
 					log.Debugf("fetch block by hash success; hash: %s", tzblock.Block.Hash.String())
+					bundles = append(bundles, tzblock)
 				}
 			} else {
-				tzblock, err = c.fetchBlockByHeight(c.ctx, lastblock+1)
+				bundles, err = c.fetchBlocksByHeight(c.ctx, lastblock+1, c.prefetchCount(lastblock))
 				if err != nil {
 					log.Errorf("fetch block by height error; err: %v", err)
-				} else {
-					log.Debugf("fetch block by height success; height: %d", tzblock.Block.Header.Level)
+				}
+				if l := len(bundles); l > 0 {
+					log.Debugf("fetch block by height success; height: %d-%d", bundles[0].Height(), bundles[l-1].Height())
 				}
 			}
 
-			// be resilient to network errors
-			if tzblock != nil {
-				// push block into queue; may block
-				// log.Tracef("Queuing block %d %s", tzblock.Height(), tzblock.Hash())
-				select {
-				case <-c.quit:
-					continue
-				case <-c.ctx.Done():
-					continue
-				case c.queue <- tzblock:
-				}
+			// be resilient to network errors, queue what we have and
+			// retry the remainder on the next round
+			if len(bundles) > 0 {
+				queued := true
+				for _, tzblock := range bundles {
+					// push block into queue in height order; may block
+					// log.Tracef("Queuing block %d %s", tzblock.Height(), tzblock.Hash())
+					select {
+					case <-c.quit:
+						queued = false
+					case <-c.ctx.Done():
+						queued = false
+					case c.queue <- tzblock:
+					}
+					if !queued {
+						break
+					}
 
-				// continue with next block (may be empty when at tip)
-				lastblock = tzblock.Height()
+					// continue with next block (may be empty when at tip)
+					lastblock = tzblock.Height()
 
-				// stop request
-				if c.stopHeight > 0 && lastblock >= c.stopHeight {
-					log.Infof("Stopping ingest at requested block %d", c.stopHeight)
-					tick.Stop()
-					return
+					// stop request
+					if c.stopHeight > 0 && lastblock >= c.stopHeight {
+						log.Infof("Stopping ingest at requested block %d", c.stopHeight)
+						tick.Stop()
+						return
+					}
+				}
+				if !queued {
+					continue
 				}
 
-				// continue with next block unless we used to be synchronized once;
+				// continue with next block until we reach chain head, then wait
+				// for the monitor unless it is down;
 				// Note that on Tezos there are no forward links to newer blocks,
 				// so we always fetch by height
-				if !c.useMonitor {
+				if !c.monitoring() || lastblock < c.chainHead().Level || gapHash.IsValid() {
 					select {
-					case next <- chain.BlockHash{}:
+					case next <- gapHash:
 					default:
 					}
 				}
@@ -714,6 +916,7 @@ func (c *Crawler) syncBlockchain() {
 			}
 			buf, _ := json.Marshal(js)
 			log.Error(string(buf))
+			reporting.Panic(e, trace, bundleTags(tzblock))
 			log.Infof("Stopping blockchain sync at height %d.", tip.BestHeight)
 			c.state = STATE_FAILED
 		}
@@ -725,12 +928,6 @@ func (c *Crawler) syncBlockchain() {
 			}
 		}
 
-		// store last chain state
-		err := dbStoreChainTip(c.indexer.cachedb, tip)
-		if err != nil {
-			log.Errorf("Updating database for block %d: %v", tip.BestHeight, err)
-		}
-
 		c.cancel()
 	}()
 
@@ -764,6 +961,8 @@ func (c *Crawler) syncBlockchain() {
 	again:
 		if errCount > 0 { // 原来为1
 			log.Errorf("Stopping blockchain sync due to too many errors at %d.", tip.BestHeight)
+			reporting.Error(fmt.Errorf("stopping blockchain sync due to too many errors at %d", tip.BestHeight),
+				bundleTags(tzblock))
 			c.Lock()
 			c.state = STATE_FAILED
 			c.Unlock()
@@ -796,6 +995,7 @@ func (c *Crawler) syncBlockchain() {
 			bestblock, err := models.NewBlock(tzblock, nil)
 			if err != nil {
 				log.Errorf("Reorg failed: %v", err)
+				reporting.Error(err, bundleTags(tzblock))
 				errCount++
 				goto again
 			}
@@ -803,6 +1003,7 @@ func (c *Crawler) syncBlockchain() {
 			// run reorg
 			if err = c.reorganize(ctx, tipblock, bestblock, false, false); err != nil {
 				log.Errorf("Reorg failed: %v", err)
+				reporting.Error(err, bundleTags(tzblock))
 				c.builder.Purge()
 				if err := c.builder.Init(ctx, tip, c.rpc); err != nil {
 					log.Errorf("Reinit failed: %v", err)
@@ -842,8 +1043,10 @@ func (c *Crawler) syncBlockchain() {
 		if err != nil {
 			// rollback inserted accounts, ops and flows here
 			log.Errorf("Processing block %d %s: %v", tzblock.Height(), tzblock.Hash(), err)
+			reporting.Error(err, bundleTags(tzblock))
 			if err = c.indexer.DeleteBlock(ctx, tzblock); err != nil {
 				log.Errorf("Rollback of data for failed block %d: %v", tzblock.Height(), err)
+				reporting.Error(err, bundleTags(tzblock))
 			}
 			// pruge and reinit builder state to last successful block
 			c.builder.Purge()
@@ -858,52 +1061,15 @@ func (c *Crawler) syncBlockchain() {
 		}
 
 		// update indexes; will insert or update rows & generate unique ids
-		// for blocks and flows
-		if err = c.indexer.ConnectBlock(ctx, block, c.builder); err != nil {
+		// for blocks and flows; the new chain tip is stored in the same tx,
+		// failures are reported by the indexer
+		newTip := nextTip(tip, block)
+		if err = c.indexer.ConnectBlock(ctx, block, c.builder, newTip); err != nil {
 			log.Errorf("Connecting block %d: %v", block.Height, err)
 			errCount++
 			goto again
 		}
 
-		cHash, err := chain.ParseBlockHash(block.Hash.String())
-		if err != nil {
-			log.Errorf("parse block hash error; er %v", err)
-		}
-
-		// update `INTEGRITY_HEAD` for table `harvester_status`
-		if err := models.UpdateHarvesterStatus(c.db, IntegrityHead, strconv.FormatInt(block.Height, 10)); err != nil {
-			log.Errorf("Update harvester_status table field `INTEGRITY_HEAD` error; error: %v, updateValue: %d", err, block.Height)
-		}
-
-		// update chain tip
-		newTip := &models.ChainTip{
-			Name:          tip.Name,
-			Symbol:        tip.Symbol,
-			ChainId:       tip.ChainId,
-			BestHash:      cHash,
-			BestId:        block.RowId,
-			BestHeight:    block.Height,
-			BestTime:      block.Timestamp,
-			GenesisTime:   tip.GenesisTime,
-			NYEveBlocks:   tip.NYEveBlocks,
-			QuarterBlocks: tip.QuarterBlocks,
-			Deployments:   tip.Deployments,
-		}
-
-		// update blockchain years
-		if newTip.GenesisTime.AddDate(0, 3*(len(newTip.QuarterBlocks)+1), 0).Before(block.Timestamp) {
-			newTip.QuarterBlocks = append(newTip.QuarterBlocks, block.Height)
-			log.Infof("Happy New Blockchain Quarter %d at block %d!", len(newTip.QuarterBlocks)+1, block.Height)
-		}
-		if newTip.GenesisTime.AddDate(len(newTip.NYEveBlocks)+1, 0, 0).Before(block.Timestamp) {
-			newTip.NYEveBlocks = append(newTip.NYEveBlocks, block.Height)
-			log.Infof("Happy New Blockchain Year %d at block %d!", len(newTip.NYEveBlocks)+1, block.Height)
-		}
-		// update deployments on protocol upgrade
-		if block.IsProtocolUpgrade() {
-			newTip.AddDeployment(block.Params)
-		}
-
 		// update chainstate with new version
 		c.Lock()
 		c.params = block.Params
@@ -931,7 +1097,7 @@ func (c *Crawler) syncBlockchain() {
 		if c.bchead != nil && block.Height >= c.bchead.Level {
 			c.state = STATE_SYNCHRONIZED
 			if c.enableMonitor {
-				if !c.useMonitor {
+				if !c.useMonitor && c.monitorUp {
 					log.Info("Fully synchronized. Switching to monitor mode.")
 				}
 				c.useMonitor = true
@@ -945,28 +1111,11 @@ func (c *Crawler) syncBlockchain() {
 			if err := c.indexer.FlushJournals(ctx); err != nil {
 				log.Errorf("flushing tables: %v", err)
 			}
-
-			// rebuild ranking data
-			// if err := c.indexer.UpdateRanking(ctx, block.Timestamp); err != nil {
-			// 	log.Errorf("updating ranking: %v", err)
-			// }
 		}
 
 		// log progress once every 10sec
 		// c.plog.LogBlockHeight(block, len(c.queue), state, time.Since(blockstart))
 
-		// update state every 256 blocks or every block when synchronized
-		if state == STATE_SYNCHRONIZED || block.Height&0xff == 0 {
-			err := dbStoreChainTip(c.indexer.cachedb, tip)
-			if err != nil {
-				log.Errorf("Updating state database for block %d: %v", tip.BestHeight, err)
-				c.Lock()
-				c.state = STATE_FAILED
-				c.Unlock()
-				return
-			}
-		}
-
 		// database snapshots
 		// if err := c.MaybeSnapshot(ctx); err != nil {
 		// 	log.Errorf("Snapshot failed at block %d: %v", tip.BestHeight, err)
@@ -1002,30 +1151,13 @@ func (c *Crawler) fetchBlockByHash(ctx context.Context, blockID chain.BlockHash)
 			b.Block.ChainId, c.tip.ChainId)
 	}
 	height := b.Block.Header.Level
-	b.Params, err = c.indexer.reg.GetParams(b.Block.Protocol)
-	needUpdate := b.Params != nil && b.Params.IsCycleStart(height)
-	if err != nil || needUpdate {
-		// fetch params from chain
-		if height > 0 {
-			cons, err := c.rpc.GetConstantsHeight(ctx, height)
-			if err != nil {
-				return nil, fmt.Errorf("block init: %v", err)
-			}
-			b.Params = cons.MapToChainParams()
-		} else {
-			b.Params = chain.NewParams()
-		}
-		// changes will be updated during build
-		b.Params = b.Params.
-			ForProtocol(b.Block.Protocol).
-			ForNetwork(b.Block.ChainId)
-		b.Params.Deployment = b.Block.Header.Proto
-		// adjust deployment number for genesis & bootstrap blocks
-		if height <= 1 {
-			b.Params.Deployment--
-		}
+	if b.Params, err = c.indexer.reg.BlockParams(ctx, c.rpc, b.Block); err != nil {
+		return nil, err
 	}
 	b.Cycle = b.Params.CycleFromHeight(height)
+	if err := c.fetchRawHeader(ctx, b); err != nil {
+		return nil, err
+	}
 
 	// in monitor mode we are live, so we don't have to check for early cycles
 	// still max look-ahead is 5 (e.g. PreservedCycles)
@@ -1050,6 +1182,63 @@ func (c *Crawler) fetchBlockByHash(ctx context.Context, blockID chain.BlockHash)
 	return b, nil
 }
 
+// prefetchCount returns how many blocks after lastblock can be fetched in
+// parallel. Near chain head, blocks are fetched one by one because they may
+// still be reorganized.
+func (c *Crawler) prefetchCount(lastblock int64) int {
+	head := c.chainHead()
+	if c.prefetch <= 1 || head == nil {
+		return 1
+	}
+	n := head.Level - prefetchSafetyDepth - lastblock
+	if c.stopHeight > 0 {
+		n = util.Min64(n, c.stopHeight-lastblock)
+	}
+	return util.Max(util.Min(int(n), c.prefetch), 1)
+}
+
+// fetchBlocksByHeight fetches n consecutive blocks starting at height in
+// parallel. Bundles are returned in height order and stop at the first
+// failed fetch or at the first block that does not link to its predecessor.
+func (c *Crawler) fetchBlocksByHeight(ctx context.Context, height int64, n int) ([]*models.Bundle, error) {
+	if n <= 1 {
+		b, err := c.fetchBlockByHeight(ctx, height)
+		if err != nil {
+			return nil, err
+		}
+		return []*models.Bundle{b}, nil
+	}
+
+	type result struct {
+		b   *models.Bundle
+		err error
+	}
+	res := make([]result, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i].b, res[i].err = c.fetchBlockByHeight(ctx, height+int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	bundles := make([]*models.Bundle, 0, n)
+	for i, r := range res {
+		if r.err != nil {
+			return bundles, r.err
+		}
+		if i > 0 && !r.b.Parent().IsEqual(bundles[i-1].Hash()) {
+			log.Warnf("Prefetched block %d %s does not link to parent %s, refetching",
+				r.b.Height(), r.b.Hash(), bundles[i-1].Hash())
+			break
+		}
+		bundles = append(bundles, r.b)
+	}
+	return bundles, nil
+}
+
 func (c *Crawler) fetchBlockByHeight(ctx context.Context, height int64) (*models.Bundle, error) {
 	b := &models.Bundle{}
 	var err error
@@ -1062,29 +1251,8 @@ func (c *Crawler) fetchBlockByHeight(ctx context.Context, height int64) (*models
 		return nil, fmt.Errorf("block init: invalid chain %s (expected %s)",
 			b.Block.ChainId, c.tip.ChainId)
 	}
-	b.Params, err = c.indexer.reg.GetParams(b.Block.Protocol)
-	needUpdate := b.Params != nil && b.Params.IsCycleStart(height)
-	if err != nil || needUpdate {
-		// fetch params from chain
-		if height > 0 {
-			log.Debugf("rpc GetConstantsHeight; height: %d", height)
-			cons, err := c.rpc.GetConstantsHeight(ctx, height)
-			if err != nil {
-				return nil, fmt.Errorf("block init: %v", err)
-			}
-			b.Params = cons.MapToChainParams()
-		} else {
-			b.Params = chain.NewParams()
-		}
-		// changes will be updated during build
-		b.Params = b.Params.
-			ForProtocol(b.Block.Protocol).
-			ForNetwork(b.Block.ChainId)
-		b.Params.Deployment = b.Block.Header.Proto
-		// adjust deployment number for genesis & bootstrap blocks
-		if height <= 1 {
-			b.Params.Deployment--
-		}
+	if b.Params, err = c.indexer.reg.BlockParams(ctx, c.rpc, b.Block); err != nil {
+		return nil, err
 	}
 	b.Cycle = b.Params.CycleFromHeight(height)
 
@@ -1106,6 +1274,10 @@ func (c *Crawler) fetchBlockByHeight(ctx context.Context, height int64) (*models
 		return b, nil
 	}
 
+	if err := c.fetchRawHeader(ctx, b); err != nil {
+		return nil, err
+	}
+
 	// // start fetching more rights after bootstrap (max look-ahead is 5 on mainnet)
 	// todo 临时屏蔽掉
 	if b.Cycle > 0 && b.Params.IsCycleStart(height) {
@@ -1129,6 +1301,20 @@ func (c *Crawler) fetchBlockByHeight(ctx context.Context, height int64) (*models
 	return b, nil
 }
 
+// fetchRawHeader loads the signed binary block header when block signatures
+// are checked. Genesis and activation blocks are not signed by a baker.
+func (c *Crawler) fetchRawHeader(ctx context.Context, b *models.Bundle) error {
+	if !c.indexer.verifySigs || b.Height() <= 1 {
+		return nil
+	}
+	raw, err := c.rpc.GetBlockHeaderRaw(ctx, b.Block.Hash)
+	if err != nil {
+		return fmt.Errorf("fetching raw header for block %d: %v", b.Height(), err)
+	}
+	b.RawHeader = raw
+	return nil
+}
+
 func (c *Crawler) fetchRightsByCycle(ctx context.Context, height, cycle int64) ([]rpc.BakingRight, []rpc.EndorsingRight, *rpc.SnapshotIndex, error) {
 	log.Debugf("start GetBakingRightsCycle...; height: %d, cycle: %d", height, cycle)
 	br, err := c.rpc.GetBakingRightsCycle(ctx, height, cycle)
@@ -1154,6 +1340,50 @@ func (c *Crawler) fetchRightsByCycle(ctx context.Context, height, cycle int64) (
 	return br, er, snap, nil
 }
 
+// nextTip returns the chain tip after block has been connected on top of tip.
+func nextTip(tip *models.ChainTip, block *models.Block) *models.ChainTip {
+	cHash, err := chain.ParseBlockHash(block.Hash.String())
+	if err != nil {
+		log.Errorf("parse block hash error; er %v", err)
+	}
+	newTip := &models.ChainTip{
+		Name:          tip.Name,
+		Symbol:        tip.Symbol,
+		ChainId:       tip.ChainId,
+		BestHash:      cHash,
+		BestId:        block.RowId,
+		BestHeight:    block.Height,
+		BestTime:      block.Timestamp,
+		GenesisTime:   tip.GenesisTime,
+		NYEveBlocks:   tip.NYEveBlocks,
+		QuarterBlocks: tip.QuarterBlocks,
+		Deployments:   tip.Deployments,
+	}
+
+	// update blockchain years
+	if newTip.GenesisTime.AddDate(0, 3*(len(newTip.QuarterBlocks)+1), 0).Before(block.Timestamp) {
+		newTip.QuarterBlocks = append(newTip.QuarterBlocks, block.Height)
+		log.Infof("Happy New Blockchain Quarter %d at block %d!", len(newTip.QuarterBlocks)+1, block.Height)
+	}
+	if newTip.GenesisTime.AddDate(len(newTip.NYEveBlocks)+1, 0, 0).Before(block.Timestamp) {
+		newTip.NYEveBlocks = append(newTip.NYEveBlocks, block.Height)
+		log.Infof("Happy New Blockchain Year %d at block %d!", len(newTip.NYEveBlocks)+1, block.Height)
+	}
+	// update deployments on protocol upgrade
+	if block.IsProtocolUpgrade() {
+		newTip.AddDeployment(block.Params)
+	}
+	return newTip
+}
+
+// chainHead returns the last known node head or nil when the node was
+// unreachable. The monitor updates it concurrently.
+func (c *Crawler) chainHead() *rpc.BlockHeader {
+	c.RLock()
+	defer c.RUnlock()
+	return c.bchead
+}
+
 func (c *Crawler) fetchBlockchainInfo(ctx context.Context) error {
 	head, err := c.rpc.GetTipHeader(ctx)
 	if err != nil {
@@ -0,0 +1,745 @@
+package puller
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-bson/bson"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+	"time"
+)
+
+const (
+	genesisHeader = `{"level":0,"proto":0,"predecessor":"BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2",
+"timestamp":"2018-06-30T16:07:32Z","validation_pass":0,"operations_hash":"LLoZS2LW3rEi7KYU4ouBQtorua37aWWCtpDmv1n2x3xoKi6sVXLWp",
+"fitness":[],"context":"CoV8SQumiVU9saiu3FVNeDNewJaJH8yWdsGF3WLdsRr2P9S7MzCj",
+"chain_id":"NetXdQprcVkpaWU","hash":"BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2"}`
+
+	genesisBlock = `{"protocol":"PrihK96nBAFSxVL1GLJTVhu9YnzkMFiBeuJRPA8NwuZVZCE1L6i","chain_id":"NetXdQprcVkpaWU",
+"hash":"BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2","header":` + genesisHeader + `,
+"metadata":{"protocol":"PrihK96nBAFSxVL1GLJTVhu9YnzkMFiBeuJRPA8NwuZVZCE1L6i",
+"next_protocol":"Ps9mPmXaRzmzk35gbAYNCAw6UXdE2qoABTHbN2oEEc1qM7CwT9P",
+"test_chain_status":{"status":"not_running"},"max_operations_ttl":0,"max_operation_data_length":0,
+"max_block_header_length":115,"max_operation_list_length":[]},"operations":[]}`
+)
+
+func newTestCrawler(db *gorm.DB, client *rpc.Client, stop int64) *Crawler {
+	indexer := NewIndexer(IndexerConfig{
+		StateDB: db,
+		CacheDB: NewMemCache(),
+		Indexes: NewIndexes(db, true, true),
+	})
+	return NewCrawler(CrawlerConfig{
+		DB:        db,
+		Indexer:   indexer,
+		Client:    client,
+		Queue:     20,
+		StopBlock: stop,
+	})
+}
+
+// newGenesisNode serves a node that only knows the mainnet genesis block.
+func newGenesisNode() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chains/main/blocks/head/header", "/chains/main/blocks/0/header":
+			w.Write([]byte(genesisHeader))
+		case "/chains/main/blocks/0":
+			w.Write([]byte(genesisBlock))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// newGenesisCrawler returns a crawler which has indexed the genesis block.
+func newGenesisCrawler(t *testing.T, db *gorm.DB, url string) *Crawler {
+	client, err := rpc.NewClient(nil, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCrawler(db, client, 0)
+	if err := c.Init(context.Background(), MODE_SYNC); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCrawlerGenesis(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	c := newGenesisCrawler(t, db, srv.URL)
+	assert.Equal(t, int64(0), c.Tip().BestHeight)
+	assert.Equal(t, "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2", c.Tip().BestHash.String())
+
+	block := &models.Block{}
+	if assert.NoError(t, db.Where("height = ?", 0).First(block).Error) {
+		assert.Equal(t, "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2", string(block.Hash))
+	}
+	for _, idx := range c.indexer.indexes {
+		tip, err := dbLoadIndexTip(c.indexer.cachedb, idx.Key())
+		if assert.NoError(t, err, idx.Key()) {
+			assert.Equal(t, int64(0), tip.Height, idx.Key())
+		}
+	}
+}
+
+// TestCrawlerReplay syncs recorded node replies into a SQLite database and
+// checks the indexed ops, balances, flows and bigmaps against the recorded
+// blocks. Fixtures in testdata/replay are recorded from the sandbox chain
+// served by newSandboxNode with
+//
+//	TZINDEX_RECORD_RPC=sandbox TZINDEX_RECORD_BLOCKS=300 go test ./puller -run TestCrawlerReplay
+//
+// Set TZINDEX_RECORD_RPC to the url of an archive node to record a real
+// network instead.
+func TestCrawlerReplay(t *testing.T) {
+	dir := filepath.Join("testdata", "replay")
+	stopFile := filepath.Join(dir, "stop_height")
+	var (
+		client *rpc.Client
+		stop   int64
+		err    error
+	)
+	if url := os.Getenv("TZINDEX_RECORD_RPC"); url != "" {
+		stop = 300
+		if n, err := strconv.ParseInt(os.Getenv("TZINDEX_RECORD_BLOCKS"), 10, 64); err == nil && n > 0 {
+			stop = n
+		}
+		if url == "sandbox" {
+			// the node head is 2 blocks ahead of the synced head
+			srv := newSandboxNode(stop + 2)
+			defer srv.Close()
+			url = srv.URL
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if client, err = rpc.NewRecordingClient(dir, url); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(stopFile, []byte(strconv.FormatInt(stop, 10)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		buf, err := ioutil.ReadFile(stopFile)
+		if err != nil {
+			t.Fatalf("missing fixtures in %s: %v", dir, err)
+		}
+		if stop, err = strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64); err != nil {
+			t.Fatal(err)
+		}
+		if client, err = rpc.NewFixtureClient(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := dbtest.Open(t)
+	defer db.Close()
+	ctx := context.Background()
+	c := newTestCrawler(db, client, stop)
+	if err = c.Init(ctx, MODE_SYNC); err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	deadline := time.Now().Add(10 * time.Minute)
+	for {
+		c.RLock()
+		height, state := c.tip.BestHeight, c.state
+		c.RUnlock()
+		if height >= stop || state == STATE_FAILED || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Stop(ctx)
+
+	// ingest may fetch a block before the protocol of its parent is
+	// registered, record constants for all blocks to replay any order
+	if os.Getenv("TZINDEX_RECORD_RPC") != "" {
+		for h := int64(1); h <= stop; h++ {
+			if _, err := client.GetConstantsHeight(ctx, h); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if !assert.Equal(t, stop, c.Tip().BestHeight) {
+		return
+	}
+	var count int64
+	assert.NoError(t, db.Model(&models.Block{}).Count(&count).Error)
+	assert.Equal(t, stop+1, count)
+	block := &models.Block{}
+	if assert.NoError(t, db.Where("height = ?", stop).First(block).Error) {
+		assert.Equal(t, c.Tip().BestHash.String(), string(block.Hash))
+	}
+
+	sum, err := newReplaySummary(ctx, client, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotZero(t, sum.Ops, "fixtures contain ops")
+	assert.NotZero(t, sum.BigMapDiffs, "fixtures contain bigmap updates")
+	sum.Check(t, db)
+}
+
+// replaySummary is the chain state expected after indexing recorded blocks,
+// it is derived from the raw block JSON independent of the indexer.
+type replaySummary struct {
+	Ops         int                       // op contents and internal results
+	Spendable   map[string]int64          // by address
+	Frozen      map[string]int64          // by delegate
+	Bootstrap   map[string]int64          // by address
+	BigMapDiffs int                       // Babylon+ big_map_diff elements
+	BigMapKeys  map[int64]map[string]bool // live key hashes by bigmap id
+}
+
+func newReplaySummary(ctx context.Context, client *rpc.Client, stop int64) (*replaySummary, error) {
+	s := &replaySummary{
+		Spendable:  make(map[string]int64),
+		Frozen:     make(map[string]int64),
+		Bootstrap:  make(map[string]int64),
+		BigMapKeys: make(map[int64]map[string]bool),
+	}
+	genesis, err := client.GetBlockHeight(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	if content := genesis.Header.Content; content != nil && content.Parameters != nil {
+		for _, v := range content.Parameters.Accounts {
+			addr := v.Addr
+			if !addr.IsValid() {
+				addr = v.Key.Address()
+			}
+			s.Bootstrap[addr.String()] += v.Value
+		}
+		for _, v := range content.Parameters.Contracts {
+			s.Bootstrap[v.Addr.String()] += v.Value
+		}
+	}
+	for k, v := range s.Bootstrap {
+		s.Spendable[k] = v
+	}
+	for h := int64(1); h <= stop; h++ {
+		var raw map[string]interface{}
+		if err := client.Get(ctx, fmt.Sprintf("chains/main/blocks/%d", h), &raw); err != nil {
+			return nil, fmt.Errorf("block %d: %v", h, err)
+		}
+		lists, _ := raw["operations"].([]interface{})
+		for _, list := range lists {
+			groups, _ := list.([]interface{})
+			for _, g := range groups {
+				contents, _ := g.(map[string]interface{})["contents"].([]interface{})
+				s.Ops += len(contents)
+				for _, op := range contents {
+					meta, _ := op.(map[string]interface{})["metadata"].(map[string]interface{})
+					internal, _ := meta["internal_operation_results"].([]interface{})
+					s.Ops += len(internal)
+				}
+			}
+		}
+		s.walk(raw)
+	}
+	return s, nil
+}
+
+// walk adds all balance updates and bigmap diffs found in v.
+func (s *replaySummary) walk(v interface{}) {
+	switch val := v.(type) {
+	case []interface{}:
+		for _, x := range val {
+			s.walk(x)
+		}
+	case map[string]interface{}:
+		for k, x := range val {
+			switch k {
+			case "balance_updates":
+				updates, _ := x.([]interface{})
+				for _, u := range updates {
+					s.addBalanceUpdate(u.(map[string]interface{}))
+				}
+			case "big_map_diff":
+				diffs, _ := x.([]interface{})
+				for _, d := range diffs {
+					s.addBigMapDiff(d.(map[string]interface{}))
+				}
+			default:
+				s.walk(x)
+			}
+		}
+	}
+}
+
+func (s *replaySummary) addBalanceUpdate(u map[string]interface{}) {
+	change, _ := strconv.ParseInt(fmt.Sprint(u["change"]), 10, 64)
+	switch u["kind"] {
+	case "contract":
+		s.Spendable[fmt.Sprint(u["contract"])] += change
+	case "freezer":
+		s.Frozen[fmt.Sprint(u["delegate"])] += change
+	}
+}
+
+func (s *replaySummary) addBigMapDiff(d map[string]interface{}) {
+	// pre-Babylon diffs have no action and no bigmap id
+	if _, ok := d["action"]; !ok {
+		return
+	}
+	s.BigMapDiffs++
+	id, _ := strconv.ParseInt(fmt.Sprint(d["big_map"]), 10, 64)
+	keys, ok := s.BigMapKeys[id]
+	if !ok {
+		keys = make(map[string]bool)
+		s.BigMapKeys[id] = keys
+	}
+	switch d["action"] {
+	case "update":
+		keys[fmt.Sprint(d["key_hash"])] = true
+	case "remove":
+		delete(keys, fmt.Sprint(d["key_hash"]))
+	}
+}
+
+// Check compares the indexed state in db with s.
+func (s *replaySummary) Check(t *testing.T, db *gorm.DB) {
+	var count int
+	assert.NoError(t, db.Model(&models.Op{}).Count(&count).Error)
+	assert.Equal(t, s.Ops, count, "ops")
+
+	for addr, bal := range s.Spendable {
+		acc := &models.Account{}
+		a, err := chain.ParseAddress(addr)
+		if !assert.NoError(t, err, addr) {
+			continue
+		}
+		if !assert.NoError(t, db.Where("hash = ? and address_type = ?", a.Hash, a.Type).First(acc).Error, addr) {
+			continue
+		}
+		assert.Equal(t, bal, acc.SpendableBalance, "spendable balance of %s", addr)
+		assert.Equal(t, s.Frozen[addr], acc.FrozenBalance(), "frozen balance of %s", addr)
+
+		// balance flows explain all changes including bootstrap
+		var flows struct{ In, Out int64 }
+		err = db.Model(&models.Flow{}).Select("coalesce(sum(amount_in),0) as `in`, coalesce(sum(amount_out),0) as `out`").
+			Where("account_id = ? and category = ?", acc.RowId, models.FlowCategoryBalance).Scan(&flows).Error
+		if assert.NoError(t, err, addr) {
+			assert.Equal(t, bal, flows.In-flows.Out, "balance flows of %s", addr)
+		}
+	}
+
+	assert.NoError(t, db.Model(&models.BigMapItem{}).Count(&count).Error)
+	assert.Equal(t, s.BigMapDiffs, count, "bigmap items")
+	for id, keys := range s.BigMapKeys {
+		var items []*models.BigMapItem
+		err := db.Where("bigmap_id = ? and action = ? and is_replaced = ? and is_deleted = ?",
+			id, micheline.BigMapDiffActionUpdate, false, false).Find(&items).Error
+		if !assert.NoError(t, err) {
+			continue
+		}
+		live := make(map[string]bool)
+		for _, item := range items {
+			live[chain.NewExprHash(item.KeyHash).String()] = true
+		}
+		assert.Equal(t, keys, live, "live keys of bigmap %d", id)
+	}
+}
+
+func TestCrawlerMonitorReconnect(t *testing.T) {
+	var conns int32
+	genesis := newGenesisNode()
+	defer genesis.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/monitor/heads/main" {
+			genesis.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		// announce one head, then stall until the client gives up
+		atomic.AddInt32(&conns, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Replace(genesisHeader, "\n", "", -1) + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	c := newGenesisCrawler(t, db, srv.URL)
+	c.monitorStall = 200 * time.Millisecond
+	c.useMonitor = true
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	next := make(chan chain.BlockHash, 1)
+	done := make(chan struct{})
+	go func() {
+		c.runMonitor(next)
+		close(done)
+	}()
+
+	select {
+	case h := <-next:
+		assert.Equal(t, "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2", h.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no block from monitor")
+	}
+	assert.True(t, c.monitoring())
+
+	// stalled streams are reconnected right away
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&conns) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt32(&conns) >= 3)
+
+	c.cancel()
+	<-done
+	assert.False(t, c.monitoring())
+}
+
+// testBlockHash returns a deterministic hash for test blocks above genesis.
+func testBlockHash(height int64) chain.BlockHash {
+	if height == 0 {
+		h, _ := chain.ParseBlockHash("BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2")
+		return h
+	}
+	buf := make([]byte, 32)
+	buf[0], buf[1] = byte(height>>8), byte(height)
+	return chain.NewBlockHash(buf)
+}
+
+// testBlock renders an empty Athens block at height.
+func testBlock(height int64) (string, string) {
+	var content string
+	if height == 1 {
+		content = testActivation()
+	}
+	header := fmt.Sprintf(`{"level":%d,"proto":1,"predecessor":"%s","timestamp":"%s","validation_pass":4,`+
+		`"operations_hash":"LLoZS2LW3rEi7KYU4ouBQtorua37aWWCtpDmv1n2x3xoKi6sVXLWp","fitness":["00","%016x"],`+
+		`"context":"CoV8SQumiVU9saiu3FVNeDNewJaJH8yWdsGF3WLdsRr2P9S7MzCj","chain_id":"NetXdQprcVkpaWU","hash":"%s"%s}`,
+		height, testBlockHash(height-1), time.Date(2018, 6, 30, 16, 7, 32, 0, time.UTC).Add(time.Duration(height)*time.Minute).Format(time.RFC3339),
+		height, testBlockHash(height), content)
+	block := fmt.Sprintf(`{"protocol":"%[1]s","chain_id":"NetXdQprcVkpaWU",`+
+		`"hash":"%[2]s","header":%[3]s,"metadata":{"protocol":"%[1]s","next_protocol":"%[1]s",`+
+		`"test_chain_status":{"status":"not_running"},"max_operations_ttl":60,"max_operation_data_length":16384,`+
+		`"max_block_header_length":238,"max_operation_list_length":[{"max_size":32768,"max_op":32},`+
+		`{"max_size":32768},{"max_size":135168,"max_op":132},{"max_size":524288}],`+
+		`"baker":"%[8]s","level":{"level":%[4]d,"level_position":%[5]d,"cycle":%[6]d,`+
+		`"cycle_position":%[7]d,"voting_period":0,"voting_period_position":%[5]d,"expected_commitment":false},`+
+		`"voting_period_kind":"proposal","nonce_hash":null,"consumed_gas":"0","deactivated":[],"balance_updates":[]},`+
+		`"operations":[[],[],[],[]]}`,
+		chain.ProtoV001, testBlockHash(height), header, height, height-1, (height-1)/testBlocksPerCycle, (height-1)%testBlocksPerCycle, testBaker)
+	return header, block
+}
+
+// testBlocksPerCycle is the cycle length of blocks served by newChainNode.
+const testBlocksPerCycle = 4096
+
+// testBakerKey is the only bootstrap baker of the chain served by
+// newChainNode, it bakes all blocks.
+var (
+	testBakerKey = chain.Key{Type: chain.KeyTypeEd25519, Data: make([]byte, 32)}
+	testBaker    = testBakerKey.Address()
+)
+
+// testActivation renders the block 1 header content which activates the
+// protocol with testBaker as bootstrap account.
+func testActivation() string {
+	doc := bson.M{"bootstrap_accounts": [][]interface{}{{testBakerKey.String(), "4000000000000"}}}
+	buf, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	// the node prefixes parameters with their length
+	params := append([]byte{0, 0, 0, 0}, buf...)
+	binary.BigEndian.PutUint32(params, uint32(len(buf)))
+	return fmt.Sprintf(`,"content":{"command":"activate","hash":"%s","fitness":["00","0000000000000000"],"protocol_parameters":"%s"}`,
+		chain.ProtoV001, hex.EncodeToString(params))
+}
+
+// newChainNode serves genesis and empty blocks up to height head by
+// height and by hash together with constants and rights.
+func newChainNode(head int64) *httptest.Server {
+	genesis := newGenesisNode()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/chains/main/blocks/")
+		switch {
+		case path == "head/header":
+			header, _ := testBlock(head)
+			w.Write([]byte(header))
+			return
+		case strings.HasSuffix(path, "/context/constants"):
+			w.Write([]byte(fmt.Sprintf(`{"proof_of_work_nonce_size":8,"nonce_length":32,"max_revelations_per_block":32,`+
+				`"max_operation_data_length":16384,"preserved_cycles":5,"blocks_per_cycle":%d,"blocks_per_commitment":32,`+
+				`"blocks_per_roll_snapshot":256,"blocks_per_voting_period":32768,"time_between_blocks":["60","75"],`+
+				`"endorsers_per_block":32,"hard_gas_limit_per_operation":"400000","hard_gas_limit_per_block":"4000000",`+
+				`"proof_of_work_threshold":"70368744177663","tokens_per_roll":"10000000000","michelson_maximum_type_size":1000,`+
+				`"seed_nonce_revelation_tip":"125000","origination_burn":"257000","block_security_deposit":"0",`+
+				`"endorsement_security_deposit":"0","block_reward":"0","endorsement_reward":"0","cost_per_byte":"1000",`+
+				`"hard_storage_limit_per_operation":"60000"}`, testBlocksPerCycle)))
+			return
+		case strings.HasSuffix(path, "/helpers/baking_rights"), strings.HasSuffix(path, "/helpers/endorsing_rights"):
+			// testBaker owns the first slot of every cycle
+			cycle, _ := strconv.ParseInt(r.URL.Query().Get("cycle"), 10, 64)
+			w.Write([]byte(fmt.Sprintf(`[{"delegate":"%s","level":%d,"priority":0,"slots":[0]}]`,
+				testBaker, cycle*testBlocksPerCycle+1)))
+			return
+		case strings.Contains(path, "/context/raw/json/cycle/"):
+			w.Write([]byte(`{"last_roll":[],"nonces":[],"random_seed":"","roll_snapshot":0}`))
+			return
+		}
+		for h := int64(1); h <= head; h++ {
+			header, block := testBlock(h)
+			switch path {
+			case strconv.FormatInt(h, 10), testBlockHash(h).String():
+				w.Write([]byte(block))
+				return
+			case strconv.FormatInt(h, 10) + "/header", testBlockHash(h).String() + "/header":
+				w.Write([]byte(header))
+				return
+			}
+		}
+		genesis.Config.Handler.ServeHTTP(w, r)
+	}))
+}
+
+func TestCrawlerGapFill(t *testing.T) {
+	srv := newChainNode(13)
+	defer srv.Close()
+
+	for _, prefetch := range []int{1, 4} {
+		db := dbtest.Open(t)
+
+		// pretend blocks up to 10 are indexed and the monitor announces 13
+		c := newGenesisCrawler(t, db, srv.URL)
+		c.prefetch = prefetch
+		c.tip.BestHeight = 10
+		c.tip.BestHash = testBlockHash(10)
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		c.enableMonitor = true
+		c.useMonitor = true
+		c.monitorUp = true
+		if err := c.fetchBlockchainInfo(c.ctx); err != nil {
+			t.Fatal(err)
+		}
+		next := make(chan chain.BlockHash, 1)
+		next <- testBlockHash(13)
+		go c.runIngest(next)
+
+		for h := int64(11); h <= 13; h++ {
+			select {
+			case b := <-c.queue:
+				if assert.NotNil(t, b, "prefetch %d", prefetch) {
+					assert.Equal(t, h, b.Height(), "prefetch %d", prefetch)
+					assert.Equal(t, testBlockHash(h).String(), b.Hash().String(), "prefetch %d", prefetch)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("prefetch %d: block %d not queued", prefetch, h)
+			}
+		}
+		c.cancel()
+		c.wg.Wait()
+		db.Close()
+	}
+}
+
+func TestCrawlerMonitorSwitch(t *testing.T) {
+	var down int32
+	genesis := newGenesisNode()
+	defer genesis.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chains/main/blocks/BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2":
+			w.Write([]byte(genesisBlock))
+		case "/monitor/heads/main":
+			if atomic.LoadInt32(&down) == 1 {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(strings.Replace(genesisHeader, "\n", "", -1) + "\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			genesis.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	c := newGenesisCrawler(t, db, srv.URL)
+	c.monitorStall = 100 * time.Millisecond
+	c.enableMonitor = true
+	c.state = STATE_CONNECTING
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err := c.fetchBlockchainInfo(c.ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := make(chan chain.BlockHash, 1)
+	go c.runMonitor(next)
+	eventually := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return cond()
+	}
+
+	// the stream is up, but heads are skipped until ingest is synchronized
+	assert.True(t, eventually(func() bool {
+		c.RLock()
+		defer c.RUnlock()
+		return c.monitorUp
+	}))
+	assert.False(t, c.monitoring())
+	time.Sleep(250 * time.Millisecond)
+	assert.Len(t, next, 0)
+
+	// ingest finds the tip at chain head and switches to monitor mode
+	go c.runIngest(next)
+	next <- chain.BlockHash{}
+	assert.True(t, eventually(c.monitoring))
+	select {
+	case b := <-c.queue:
+		if assert.NotNil(t, b) {
+			assert.Equal(t, int64(0), b.Height())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no block from monitor")
+	}
+
+	// a broken stream falls back to polling
+	atomic.StoreInt32(&down, 1)
+	assert.True(t, eventually(func() bool { return !c.monitoring() }))
+	c.cancel()
+	c.wg.Wait()
+}
+
+func TestCrawlerPrefetchCount(t *testing.T) {
+	for _, v := range []struct {
+		Name      string
+		Prefetch  int
+		Head      int64
+		Stop      int64
+		Lastblock int64
+		Expected  int
+	}{
+		{"disabled", 1, 1000, 0, 10, 1},
+		{"no head", 8, 0, 0, 10, 1},
+		{"full batch", 8, 1000, 0, 10, 8},
+		{"near head", 8, 1000, 0, 930, 1000 - prefetchSafetyDepth - 930},
+		{"at head", 8, 1000, 0, 990, 1},
+		{"stop height", 8, 1000, 13, 10, 3},
+	} {
+		c := &Crawler{prefetch: v.Prefetch, stopHeight: v.Stop}
+		if v.Head > 0 {
+			c.bchead = &rpc.BlockHeader{Level: v.Head}
+		}
+		assert.Equal(t, v.Expected, c.prefetchCount(v.Lastblock), v.Name)
+	}
+}
+
+func TestCrawlerFetchBlocksByHeight(t *testing.T) {
+	chainNode := newChainNode(12)
+	defer chainNode.Close()
+	// block 5 of this chain links to a block from another branch
+	forkNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chains/main/blocks/5" {
+			_, block := testBlock(5)
+			w.Write([]byte(strings.Replace(block, testBlockHash(4).String(), testBlockHash(99).String(), 1)))
+			return
+		}
+		chainNode.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer forkNode.Close()
+
+	for _, v := range []struct {
+		Name     string
+		URL      string
+		Height   int64
+		N        int
+		Expected []int64
+		Err      bool
+	}{
+		{"single", chainNode.URL, 2, 1, []int64{2}, false},
+		{"batch", chainNode.URL, 2, 4, []int64{2, 3, 4, 5}, false},
+		{"past head", chainNode.URL, 11, 4, []int64{11, 12}, true},
+		{"fork", forkNode.URL, 3, 4, []int64{3, 4}, false},
+	} {
+		db := dbtest.Open(t)
+		c := newGenesisCrawler(t, db, v.URL)
+		bundles, err := c.fetchBlocksByHeight(context.Background(), v.Height, v.N)
+		assert.Equal(t, v.Err, err != nil, v.Name)
+		heights := make([]int64, 0, len(bundles))
+		for i, b := range bundles {
+			heights = append(heights, b.Height())
+			if i > 0 {
+				assert.True(t, b.Parent().IsEqual(bundles[i-1].Hash()), v.Name)
+			}
+		}
+		assert.Equal(t, v.Expected, heights, v.Name)
+		db.Close()
+	}
+}
+
+func TestCrawlerPrefetchIngest(t *testing.T) {
+	srv := newChainNode(100)
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	// far behind chain head, batches are queued in order up to the stop height
+	c := newGenesisCrawler(t, db, srv.URL)
+	c.prefetch = 4
+	c.stopHeight = 20
+	c.tip.BestHeight = 10
+	c.tip.BestHash = testBlockHash(10)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err := c.fetchBlockchainInfo(c.ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := make(chan chain.BlockHash, 1)
+	next <- chain.BlockHash{}
+	done := make(chan struct{})
+	go func() {
+		c.runIngest(next)
+		close(done)
+	}()
+
+	for h := int64(11); h <= 20; h++ {
+		select {
+		case b := <-c.queue:
+			if assert.NotNil(t, b) {
+				assert.Equal(t, h, b.Height())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("block %d not queued", h)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ingest did not stop at stop height")
+	}
+	assert.Len(t, c.queue, 0)
+	c.cancel()
+}
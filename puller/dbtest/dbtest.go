@@ -0,0 +1,25 @@
+// Package dbtest provides the SQLite database used by indexer tests.
+package dbtest
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"testing"
+	"tezos_index/puller/migration"
+	"tezos_index/puller/models"
+)
+
+// Open returns an in-memory SQLite database with all migrations applied.
+func Open(t testing.TB) *gorm.DB {
+	db, err := gorm.Open(models.DialectSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to an in-memory database opens a new database
+	db.DB().SetMaxOpenConns(1)
+	db.LogMode(false)
+	if err := migration.Run(db.DB(), models.DialectSQLite, "up"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -5,6 +5,8 @@ package puller
 
 import (
 	"errors"
+	"tezos_index/puller/models"
+	"tezos_index/reporting"
 )
 
 var (
@@ -27,3 +29,20 @@ var (
 	// not exist.
 	ErrNoData = errors.New("no data")
 )
+
+// bundleTags returns error report tags for a fetched block, tz may be nil.
+func bundleTags(tz *models.Bundle) reporting.Tags {
+	if tz == nil || tz.Block == nil {
+		return nil
+	}
+	return reporting.BlockTags(tz.Height(), tz.Hash().String(), tz.Block.Protocol.String())
+}
+
+// blockTags returns error report tags for a built block.
+func blockTags(block *models.Block) reporting.Tags {
+	var proto string
+	if block.Params != nil {
+		proto = block.Params.Protocol.String()
+	}
+	return reporting.BlockTags(block.Height, block.Hash.String(), proto)
+}
@@ -0,0 +1,79 @@
+package puller
+
+import (
+	"context"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"tezos_index/reporting"
+	"tezos_index/rpc"
+)
+
+type failingIndex struct {
+	models.BlockIndexer
+}
+
+func (failingIndex) Key() string {
+	return "failing"
+}
+
+func (failingIndex) ConnectBlock(context.Context, *models.Block, models.BlockBuilder, *gorm.DB) error {
+	return errors.New("index failed")
+}
+
+func TestIndexerReportsConnectError(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	rec := reporting.NewRecorder()
+	reporting.SetReporter(rec)
+	defer reporting.SetReporter(nil)
+
+	m := NewIndexer(IndexerConfig{StateDB: db, CacheDB: NewMemCache(), Indexes: []models.BlockIndexer{failingIndex{}}})
+	ctx := context.Background()
+	if !assert.NoError(t, m.Init(ctx, &models.ChainTip{})) {
+		return
+	}
+	block := &models.Block{Hash: "BLnew", Height: 5, Params: &chain.Params{}}
+	assert.Error(t, m.ConnectBlock(ctx, block, nil, nil))
+	if ev := rec.Events(); assert.Len(t, ev, 1) {
+		assert.Equal(t, "index failed", ev[0].Message)
+		assert.Equal(t, "5", ev[0].Tags[reporting.TagHeight])
+		assert.Equal(t, "BLnew", ev[0].Tags[reporting.TagHash])
+		assert.Equal(t, "failing", ev[0].Tags[reporting.TagIndex])
+	}
+}
+
+func TestCrawlerReportsGenesisError(t *testing.T) {
+	// the node knows its head but cannot serve the genesis block
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chains/main/blocks/head/header", "/chains/main/blocks/0/header":
+			w.Write([]byte(genesisHeader))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	rec := reporting.NewRecorder()
+	reporting.SetReporter(rec)
+	defer reporting.SetReporter(nil)
+
+	client, err := rpc.NewClient(nil, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCrawler(db, client, 0)
+	assert.Error(t, c.Init(context.Background(), MODE_SYNC))
+	assert.Equal(t, STATE_FAILED, c.state)
+	if ev := rec.Events(); assert.Len(t, ev, 1) {
+		assert.Equal(t, "0", ev[0].Tags[reporting.TagHeight])
+	}
+}
@@ -19,7 +19,15 @@ func (b *Builder) NewBakerFlows() ([]*Flow, error) {
 	// Note: during chain bootstrap there used to be blocks without rewards
 	// and no balance updates were issued to bakers
 	flows := make([]*Flow, 0)
+	h := b.idx.reg.Handler(b.block.Params.Protocol)
 	for _, upd := range b.block.TZ.Block.Metadata.BalanceUpdates {
+		// protocol specific updates like subsidies
+		if f, ok, err := h.BalanceUpdate(b, upd); err != nil {
+			return nil, err
+		} else if ok {
+			flows = append(flows, f...)
+			continue
+		}
 		switch upd.BalanceUpdateKind() {
 		case "contract":
 			u := upd.(*rpc.ContractBalanceUpdate)
@@ -305,6 +313,71 @@ func (b *Builder) NewRevealFlows(src, dlg *Account, upd rpc.BalanceUpdates) ([]*
 	return flows, nil
 }
 
+// NewManagerFlows creates fee flows for manager operations without amount
+// like global constant registrations and deposit limits. Negative contract
+// updates in the operation result are storage burns.
+func (b *Builder) NewManagerFlows(src, dlg *Account, typ FlowType, fees, res rpc.BalanceUpdates) ([]*Flow, error) {
+	flows := make([]*Flow, 0)
+	// fees are optional
+	var feespaid int64
+	for _, v := range fees {
+		switch v.BalanceUpdateKind() {
+		case "contract":
+			// fees paid by src
+			u := v.(*rpc.ContractBalanceUpdate)
+			f := NewFlow(b.block, src, src)
+			f.Category = FlowCategoryBalance
+			f.Operation = typ
+			f.AmountOut = -u.Change // note the negation!
+			f.IsFee = true
+			feespaid -= u.Change
+			flows = append(flows, f)
+		case "freezer":
+			// fees received by baker
+			u := v.(*rpc.FreezerBalanceUpdate)
+			switch u.Category {
+			case "fees":
+				f := NewFlow(b.block, b.block.Baker, src)
+				f.Category = FlowCategoryFees
+				f.Operation = typ
+				f.AmountIn = u.Change
+				f.IsFrozen = true
+				flows = append(flows, f)
+			}
+		}
+	}
+
+	// storage burn paid by src
+	var burned int64
+	for _, v := range res {
+		if v.BalanceUpdateKind() != "contract" {
+			continue
+		}
+		u := v.(*rpc.ContractBalanceUpdate)
+		if u.Change >= 0 || !u.Contract.IsEqual(src.Address()) {
+			continue
+		}
+		f := NewFlow(b.block, src, src)
+		f.Category = FlowCategoryBalance
+		f.Operation = typ
+		f.AmountOut = -u.Change
+		f.IsBurned = true
+		burned -= u.Change
+		flows = append(flows, f)
+	}
+
+	// if src is delegated subtract paid fees and burn from delegated balance if not self delegate
+	if feespaid+burned > 0 && dlg != nil && dlg.RowId != src.RowId {
+		f := NewFlow(b.block, dlg, src)
+		f.Category = FlowCategoryDelegation
+		f.Operation = typ
+		f.AmountOut = feespaid + burned
+		flows = append(flows, f)
+	}
+	b.block.Flows = append(b.block.Flows, flows...)
+	return flows, nil
+}
+
 // injected by the baker only
 func (b *Builder) NewSeedNonceFlows(upd rpc.BalanceUpdates) ([]*Flow, error) {
 	flows := make([]*Flow, 0)
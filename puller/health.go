@@ -0,0 +1,112 @@
+package puller
+
+import (
+	"context"
+	"tezos_index/chain"
+	"tezos_index/rpc"
+	"time"
+)
+
+// DefaultReadyLag is the number of blocks the index may trail the node head
+// while still reporting ready.
+const DefaultReadyLag = 2
+
+// healthTimeout bounds database, cache and node requests of a single health
+// or status check.
+const healthTimeout = 5 * time.Second
+
+// HealthStatus reports whether the process can reach its database and RPC
+// node. The optional cache is reported but does not affect Healthy. Cache
+// is empty when no cache is configured, Node when no client is set.
+type HealthStatus struct {
+	Healthy  bool   `json:"healthy"`
+	Database string `json:"database"`
+	Node     string `json:"node,omitempty"`
+	Cache    string `json:"cache,omitempty"`
+}
+
+// ReadyStatus reports whether the index is in sync with the node. Lag is -1
+// while the node head is unknown.
+type ReadyStatus struct {
+	Ready  bool  `json:"ready"`
+	Status State `json:"status"`
+	Lag    int64 `json:"lag"`
+}
+
+// StatusInfo extends CrawlerStatus with index tips, the latest protocol
+// deployment and the state of RPC nodes. Head is queried from the node,
+// CachedHead is the last head seen by the crawler.
+type StatusInfo struct {
+	CrawlerStatus
+	Indexes    map[string]*IndexTip `json:"indexes"`
+	Params     *chain.Params        `json:"params"`
+	Head       *rpc.BlockHeader     `json:"rpc_head,omitempty"`
+	HeadError  string               `json:"rpc_head_error,omitempty"`
+	CachedHead *rpc.BlockHeader     `json:"cached_head"`
+	Nodes      []rpc.EndpointStatus `json:"rpc_nodes,omitempty"`
+}
+
+// Health pings the database, the RPC node and the cache. A failing cache
+// only degrades performance, it must not fail health probes and restart
+// the process.
+func (c *Crawler) Health(ctx context.Context) HealthStatus {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	s := HealthStatus{Healthy: true, Database: "ok"}
+	if err := c.db.DB().PingContext(ctx); err != nil {
+		s.Healthy = false
+		s.Database = err.Error()
+	}
+	if c.rpc != nil {
+		s.Node = "ok"
+		if _, err := c.rpc.GetTipHeader(ctx); err != nil {
+			s.Healthy = false
+			s.Node = err.Error()
+		}
+	}
+	if p, ok := c.indexer.cachedb.cache.(Pinger); ok {
+		s.Cache = "ok"
+		if err := p.Ping(ctx); err != nil {
+			s.Cache = err.Error()
+		}
+	}
+	return s
+}
+
+// Ready returns true when the crawler is synchronized and trails the node
+// head by at most readyLag blocks.
+func (c *Crawler) Ready() ReadyStatus {
+	c.RLock()
+	defer c.RUnlock()
+	s := ReadyStatus{Status: c.state, Lag: -1}
+	if c.tip != nil && c.bchead != nil {
+		s.Lag = c.bchead.Level - c.tip.BestHeight
+	}
+	s.Ready = s.Status == STATE_SYNCHRONIZED && s.Lag >= 0 && s.Lag <= c.readyLag
+	return s
+}
+
+// StatusInfo returns the crawler status together with index tips, the
+// latest deployment params and the node head.
+func (c *Crawler) StatusInfo(ctx context.Context) StatusInfo {
+	s := StatusInfo{
+		CrawlerStatus: c.Status(),
+		Indexes:       c.indexer.Tips(),
+		Params:        c.indexer.reg.GetParamsLatest(),
+	}
+	c.RLock()
+	s.CachedHead = c.bchead
+	c.RUnlock()
+	if c.rpc != nil {
+		ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+		defer cancel()
+		head, err := c.rpc.GetTipHeader(ctx)
+		if err != nil {
+			s.HeadError = err.Error()
+		} else {
+			s.Head = head
+		}
+		s.Nodes = c.rpc.Endpoints()
+	}
+	return s
+}
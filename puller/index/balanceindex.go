@@ -0,0 +1,190 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"sort"
+	"tezos_index/puller/models"
+)
+
+const (
+	BalanceIndexKey = "balance"
+
+	// DefaultCheckpointInterval is the number of blocks between balance
+	// checkpoints.
+	DefaultCheckpointInterval = 4096
+
+	// max number of samples returned by LoadBalanceHistory
+	MaxBalanceHistory = 10000
+)
+
+var (
+	// ErrBalanceHistoryLimit is returned when a balance history would
+	// contain more than MaxBalanceHistory samples.
+	ErrBalanceHistoryLimit = errors.New("balance history too long")
+)
+
+// BalanceIndex writes balance checkpoints for all accounts with flows since
+// the previous checkpoint every interval blocks. Checkpoints are optional,
+// balances are always reconstructed from the latest checkpoint at or below
+// the requested height and all later flows.
+type BalanceIndex struct {
+	db       *gorm.DB
+	interval int64
+}
+
+// NewBalanceIndex creates a balance checkpoint index, interval <= 0 disables
+// new checkpoints.
+func NewBalanceIndex(db *gorm.DB, interval int64) *BalanceIndex {
+	return &BalanceIndex{db, interval}
+}
+
+func (idx *BalanceIndex) DB() *gorm.DB {
+	return idx.db
+}
+
+func (idx *BalanceIndex) Key() string {
+	return BalanceIndexKey
+}
+
+// asumes flows are already stored (must run after FlowIndex)
+func (idx *BalanceIndex) ConnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	if idx.interval <= 0 || block.Height == 0 || block.Height%idx.interval != 0 {
+		return nil
+	}
+	prev := block.Height - idx.interval
+	sums, err := sumFlows(tx, "account_id, category", "", nil, prev, block.Height)
+	if err != nil {
+		return fmt.Errorf("balance checkpoint %d: %v", block.Height, err)
+	}
+	deltas := make(map[models.AccountID][]flowSum)
+	for _, s := range sums {
+		deltas[s.AccountId] = append(deltas[s.AccountId], s)
+	}
+	ids := make([]models.AccountID, 0, len(deltas))
+	for id := range deltas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		bal, err := LoadBalance(tx, id, prev)
+		if err != nil {
+			return fmt.Errorf("balance checkpoint %d account %d: %v", block.Height, id, err)
+		}
+		for _, s := range deltas[id] {
+			bal.Add(s.Category, s.AmountIn, s.AmountOut)
+		}
+		bal.Height = block.Height
+		if err := tx.Create(models.NewBalanceCheckpoint(bal)).Error; err != nil {
+			return err
+		}
+	}
+	log.Debugf("Stored %d balance checkpoints at height %d", len(ids), block.Height)
+	return nil
+}
+
+func (idx *BalanceIndex) DisconnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	return idx.DeleteBlock(ctx, block.Height, tx)
+}
+
+func (idx *BalanceIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.DB) error {
+	log.Debugf("Rollback deleting balance checkpoints at height %d", height)
+	return tx.Where("height = ?", height).Delete(&models.BalanceCheckpoint{}).Error
+}
+
+type flowSum struct {
+	AccountId models.AccountID
+	Height    int64
+	Category  models.FlowCategory
+	AmountIn  int64
+	AmountOut int64
+}
+
+// sumFlows aggregates flows in (from, to] grouped by the group columns.
+func sumFlows(db *gorm.DB, group, where string, args []interface{}, from, to int64) ([]flowSum, error) {
+	q := db.Model(&models.Flow{}).
+		Select(group+", sum(amount_in) as amount_in, sum(amount_out) as amount_out").
+		Where("height > ? and height <= ?", from, to)
+	if where != "" {
+		q = q.Where(where, args...)
+	}
+	sums := make([]flowSum, 0)
+	err := q.Group(group).Order(group).Scan(&sums).Error
+	return sums, err
+}
+
+// LoadBalance reconstructs the balance of account id at height from the
+// latest checkpoint and all later flows.
+func LoadBalance(db *gorm.DB, id models.AccountID, height int64) (*models.Balance, error) {
+	bal := &models.Balance{AccountId: id}
+	cp := &models.BalanceCheckpoint{}
+	err := db.Where("account_id = ? and height <= ?", id.Value(), height).Order("height desc").First(cp).Error
+	switch err {
+	case nil:
+		bal = cp.Balance()
+	case gorm.ErrRecordNotFound:
+	default:
+		return nil, err
+	}
+	if bal.Height < height {
+		sums, err := sumFlows(db, "category", "account_id = ?", []interface{}{id.Value()}, bal.Height, height)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sums {
+			bal.Add(s.Category, s.AmountIn, s.AmountOut)
+		}
+	}
+	bal.Height = height
+	return bal, nil
+}
+
+// LoadBalanceHistory returns the balance of account id at from followed by
+// the balance after each height in (from, to] where it changed or, when step
+// is positive, at every step blocks after from.
+func LoadBalanceHistory(db *gorm.DB, id models.AccountID, from, to, step int64) ([]*models.Balance, error) {
+	if to < from {
+		return nil, ErrInvalidBlockHeight
+	}
+	if step > 0 && (to-from)/step >= MaxBalanceHistory {
+		return nil, ErrBalanceHistoryLimit
+	}
+	bal, err := LoadBalance(db, id, from)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := sumFlows(db, "height, category", "account_id = ?", []interface{}{id.Value()}, from, to)
+	if err != nil {
+		return nil, err
+	}
+	res := []*models.Balance{bal}
+	next := *bal
+	if step > 0 {
+		for h := from + step; h <= to; h += step {
+			for len(sums) > 0 && sums[0].Height <= h {
+				next.Add(sums[0].Category, sums[0].AmountIn, sums[0].AmountOut)
+				sums = sums[1:]
+			}
+			b := next
+			b.Height = h
+			res = append(res, &b)
+		}
+		return res, nil
+	}
+	for i, s := range sums {
+		next.Add(s.Category, s.AmountIn, s.AmountOut)
+		if i+1 < len(sums) && sums[i+1].Height == s.Height {
+			continue
+		}
+		if len(res) >= MaxBalanceHistory {
+			return nil, ErrBalanceHistoryLimit
+		}
+		b := next
+		b.Height = s.Height
+		res = append(res, &b)
+	}
+	return res, nil
+}
@@ -0,0 +1,102 @@
+package index
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+)
+
+func TestBalanceIndex_Checkpoints(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	flows := []*models.Flow{
+		{Height: 3, AccountId: 1, Category: models.FlowCategoryBalance, AmountIn: 1000},
+		{Height: 5, AccountId: 1, Category: models.FlowCategoryBalance, AmountOut: 200},
+		{Height: 5, AccountId: 1, Category: models.FlowCategoryDeposits, AmountIn: 200},
+		{Height: 5, AccountId: 2, Category: models.FlowCategoryBalance, AmountIn: 50},
+		{Height: 12, AccountId: 1, Category: models.FlowCategoryRewards, AmountIn: 30},
+		{Height: 20, AccountId: 1, Category: models.FlowCategoryBalance, AmountIn: 7},
+	}
+	for _, f := range flows {
+		assert.NoError(t, db.Create(f).Error)
+	}
+
+	// without checkpoints balances are summed from genesis
+	bal, err := LoadBalance(db, 1, 12)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(800), bal.Spendable)
+	assert.Equal(t, int64(200), bal.FrozenDeposits)
+	assert.Equal(t, int64(30), bal.FrozenRewards)
+	assert.Equal(t, int64(1030), bal.Total())
+
+	idx := NewBalanceIndex(db, 10)
+	ctx := context.Background()
+	for h := int64(1); h <= 20; h++ {
+		assert.NoError(t, idx.ConnectBlock(ctx, &models.Block{Height: h}, nil, db))
+	}
+	var n int
+	assert.NoError(t, db.Model(&models.BalanceCheckpoint{}).Count(&n).Error)
+	assert.Equal(t, 3, n)
+
+	cp := &models.BalanceCheckpoint{}
+	assert.NoError(t, db.Where("account_id = ? and height = ?", 1, 20).First(cp).Error)
+	assert.Equal(t, int64(807), cp.Spendable)
+	assert.Equal(t, int64(30), cp.FrozenRewards)
+
+	// results match with checkpoints
+	for h, want := range map[int64]int64{0: 0, 4: 1000, 10: 1000, 15: 1030, 25: 1037} {
+		bal, err := LoadBalance(db, 1, h)
+		assert.NoError(t, err)
+		assert.Equal(t, want, bal.Total(), "height %d", h)
+		assert.Equal(t, h, bal.Height)
+	}
+
+	hist, err := LoadBalanceHistory(db, 1, 4, 20, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, hist, 4) {
+		assert.Equal(t, []int64{4, 5, 12, 20}, []int64{hist[0].Height, hist[1].Height, hist[2].Height, hist[3].Height})
+		assert.Equal(t, []int64{1000, 1000, 1030, 1037}, []int64{hist[0].Total(), hist[1].Total(), hist[2].Total(), hist[3].Total()})
+		assert.Equal(t, int64(800), hist[1].Spendable)
+	}
+
+	hist, err = LoadBalanceHistory(db, 1, 0, 20, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, hist, 3) {
+		assert.Equal(t, []int64{0, 1000, 1037}, []int64{hist[0].Total(), hist[1].Total(), hist[2].Total()})
+	}
+
+	_, err = LoadBalanceHistory(db, 1, 20, 10, 0)
+	assert.Equal(t, ErrInvalidBlockHeight, err)
+
+	// rollback removes checkpoints at the disconnected height only
+	assert.NoError(t, idx.DisconnectBlock(ctx, &models.Block{Height: 20}, nil, db))
+	assert.NoError(t, db.Model(&models.BalanceCheckpoint{}).Count(&n).Error)
+	assert.Equal(t, 2, n)
+}
+
+func TestBalanceIndex_QueryPlan(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	// checkpoint sums must not scan the flow table
+	var plan []struct {
+		Detail string
+	}
+	assert.NoError(t, db.Raw("EXPLAIN QUERY PLAN SELECT account_id, sum(amount_in) FROM flows "+
+		"WHERE height > 0 AND height <= 4096 GROUP BY account_id").Scan(&plan).Error)
+	if assert.NotEmpty(t, plan) {
+		assert.Contains(t, plan[0].Detail, "flow_height_idx")
+	}
+	for _, v := range []struct {
+		model interface{}
+		name  string
+	}{
+		{&models.Flow{}, "flow_account_height_idx"},
+		{&models.BalanceCheckpoint{}, "balance_cp_account_height_idx"},
+	} {
+		assert.True(t, db.Dialect().HasIndex(db.NewScope(v.model).TableName(), v.name), v.name)
+	}
+}
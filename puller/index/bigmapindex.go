@@ -41,7 +41,7 @@ func (idx *BigMapIndex) Key() string {
 // Note: zero is a valid bigmap id in all protocols
 func (idx *BigMapIndex) ConnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder, tx *gorm.DB) error {
 	needClear := false
-	contract := &models.Contract{}
+	var contract *models.Contract
 	for _, op := range block.Ops {
 		if len(op.BigMapDiff) == 0 || !op.IsSuccess {
 			continue
@@ -62,54 +62,21 @@ func (idx *BigMapIndex) ConnectBlock(ctx context.Context, block *models.Block, b
 		}
 
 		// extract deserialized bigmap diff
-		var bmd micheline.BigMapDiff
-		switch op.Type {
-		case chain.OpTypeTransaction:
-			if op.IsInternal {
-				// on internal tx, find corresponding internal op
-				top, ok := o.(*rpc.TransactionOp)
-				if !ok {
-					return fmt.Errorf("internal bigmap transaction op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-				}
-				bmd = top.Metadata.InternalResults[op.OpI].Result.BigMapDiff
-			} else {
-				top, ok := o.(*rpc.TransactionOp)
-				if !ok {
-					return fmt.Errorf("contract bigmap transaction op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-				}
-				bmd = top.Metadata.Result.BigMapDiff
-			}
-		case chain.OpTypeOrigination:
-			if op.IsInternal {
-				// on internal tx, find corresponding internal op
-				top, ok := o.(*rpc.TransactionOp)
-				if !ok {
-					return fmt.Errorf("internal bigmap origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-				}
-				bmd = top.Metadata.InternalResults[op.OpI].Result.BigMapDiff
-			} else {
-				oop, ok := o.(*rpc.OriginationOp)
-				if !ok {
-					return fmt.Errorf("contract bigmap origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-				}
-				bmd = oop.Metadata.Result.BigMapDiff
-			}
+		bmd, err := opBigMapDiff(o, op)
+		if err != nil {
+			return err
 		}
 
-		// load corresponding contract
-		if contract.AccountId != op.ReceiverId {
-			sql := `
-			SELECT
-				*
-			FROM
-				contracts
-			WHERE
-				account_id = ?
-			LIMIT 1
-			`
-			err := tx.Raw(sql, op.ReceiverId.Value()).Scan(contract).Error
-			if err != nil {
-				return fmt.Errorf("missing contract account %d: %v", op.ReceiverId, err)
+		// load corresponding contract, contracts originated in this block are
+		// resolved from the builder, older contracts from the database
+		if contract == nil || contract.AccountId != op.ReceiverId {
+			var ok bool
+			if contract, ok = builder.ContractByAccountId(op.ReceiverId); !ok {
+				contract = &models.Contract{}
+				err := tx.Where("account_id = ?", op.ReceiverId.Value()).First(contract).Error
+				if err != nil {
+					return fmt.Errorf("missing contract account %d: %v", op.ReceiverId, err)
+				}
 			}
 		}
 
@@ -123,12 +90,14 @@ func (idx *BigMapIndex) ConnectBlock(ctx context.Context, block *models.Block, b
 			case micheline.BigMapDiffActionUpdate, micheline.BigMapDiffActionRemove:
 				// find bigmap allocation (required for real key type)
 				if alloc.RowId == 0 || alloc.BigMapId != v.Id {
+					alloc = &models.BigMapItem{}
 					err := tx.Where("bigmap_id = ? and action = ? ", v.Id, uint64(micheline.BigMapDiffActionAlloc)).First(alloc).Error
 					if err != nil && err != gorm.ErrRecordNotFound {
 						return fmt.Errorf("etl.bigmap.alloc decode: %v", err)
 					}
 				}
-				if last.RowId == 0 || last.BigMapId != alloc.BigMapId {
+				if last.RowId == 0 || last.BigMapId != v.Id {
+					last = &models.BigMapItem{}
 					err := tx.Where("bigmap_id = ?", v.Id).Last(last).Error
 					if err != nil && err != gorm.ErrRecordNotFound {
 						return fmt.Errorf("etl.bigmap.last decode: %v", err)
@@ -146,7 +115,7 @@ func (idx *BigMapIndex) ConnectBlock(ctx context.Context, block *models.Block, b
 					prev.IsReplaced = true
 					prev.Updated = block.Height
 
-					if err := tx.Model(&models.BigMapItem{}).Updates(prev).Error; err != nil {
+					if err := models.UpdatesBigMapItem(prev, tx); err != nil {
 						return fmt.Errorf("etl.bigmap.update: %v", err)
 					}
 				}
@@ -251,7 +220,7 @@ func (idx *BigMapIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.
 		if !item.IsCopied {
 			ids = append(ids, item.PrevId)
 		}
-		del = append(ids, item.RowId)
+		del = append(del, item.RowId)
 	}
 
 	// load update items
@@ -288,3 +257,42 @@ func (idx *BigMapIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.
 	}
 	return nil
 }
+
+// opBigMapDiff returns the bigmap diff of a transaction or origination from
+// its rpc operation o.
+func opBigMapDiff(o rpc.Operation, op *models.Op) (micheline.BigMapDiff, error) {
+	var bmd micheline.BigMapDiff
+	switch op.Type {
+	case chain.OpTypeTransaction:
+		if op.IsInternal {
+			// on internal tx, find corresponding internal op
+			top, ok := o.(*rpc.TransactionOp)
+			if !ok {
+				return nil, fmt.Errorf("internal bigmap transaction op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
+			}
+			bmd = top.Metadata.InternalResults[op.OpI].Result.BigMapDiff
+		} else {
+			top, ok := o.(*rpc.TransactionOp)
+			if !ok {
+				return nil, fmt.Errorf("contract bigmap transaction op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
+			}
+			bmd = top.Metadata.Result.BigMapDiff
+		}
+	case chain.OpTypeOrigination:
+		if op.IsInternal {
+			// on internal tx, find corresponding internal op
+			top, ok := o.(*rpc.TransactionOp)
+			if !ok {
+				return nil, fmt.Errorf("internal bigmap origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
+			}
+			bmd = top.Metadata.InternalResults[op.OpI].Result.BigMapDiff
+		} else {
+			oop, ok := o.(*rpc.OriginationOp)
+			if !ok {
+				return nil, fmt.Errorf("contract bigmap origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
+			}
+			bmd = oop.Metadata.Result.BigMapDiff
+		}
+	}
+	return bmd, nil
+}
@@ -0,0 +1,148 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+const (
+	testBigmapAlloc = `{"action":"alloc","big_map":"17","key_type":{"prim":"string"},"value_type":{"prim":"nat"}}`
+	testBigmapKeyA  = `"big_map":"17","key_hash":"expruCfqu42i2pfETXAKoykEskXHxZgrudQoRy8LsZHnBr9VzXewHA","key":{"string":"a"}`
+)
+
+// bigmapBlock returns a block at height with a single successful contract
+// call to account id receiver that produces the bigmap diff in JSON.
+func bigmapBlock(t *testing.T, height int64, receiver models.AccountID, diff string) *models.Block {
+	var bmd micheline.BigMapDiff
+	if err := json.Unmarshal([]byte(diff), &bmd); err != nil {
+		t.Fatal(err)
+	}
+	tx := &rpc.TransactionOp{
+		GenericOp: rpc.GenericOp{Kind: chain.OpTypeTransaction},
+		Metadata: &rpc.TransactionOpMetadata{
+			Result: &rpc.TransactionResult{Status: chain.OpStatusApplied, BigMapDiff: bmd},
+		},
+	}
+	op := &models.Op{
+		RowId:      models.OpID(height),
+		Height:     height,
+		Type:       chain.OpTypeTransaction,
+		IsSuccess:  true,
+		ReceiverId: receiver,
+		BigMapDiff: []byte(diff),
+	}
+	return &models.Block{
+		Height: height,
+		Ops:    []*models.Op{op},
+		TZ: &models.Bundle{Block: &rpc.Block{
+			Operations: [][]*rpc.OperationHeader{{{Contents: rpc.Operations{tx}}}},
+		}},
+	}
+}
+
+func bigmapItems(t *testing.T, idx *BigMapIndex) []*models.BigMapItem {
+	var items []*models.BigMapItem
+	assert.NoError(t, idx.DB().Order("row_id").Find(&items).Error)
+	return items
+}
+
+func TestBigMapIndexContract(t *testing.T) {
+	for _, v := range []struct {
+		Name    string
+		Builder bool // contract originated in the current block
+		Stored  bool // contract stored by an earlier block
+		Err     bool
+	}{
+		{"originated in block", true, false, false},
+		{"stored", false, true, false},
+		{"builder first", true, true, false},
+		{"missing", false, false, true},
+	} {
+		db := dbtest.Open(t)
+		idx := NewBigMapIndex(db)
+		contract := models.Contract{AccountId: 7}
+		if v.Stored {
+			assert.NoError(t, db.Create(&contract).Error, v.Name)
+		}
+		builder := testBuilder{contracts: map[models.AccountID]*models.Contract{}}
+		if v.Builder {
+			builder.contracts[7] = &models.Contract{RowId: 99, AccountId: 7}
+		}
+
+		block := bigmapBlock(t, 10, 7, `[`+testBigmapAlloc+`,{"action":"update",`+testBigmapKeyA+`,"value":{"int":"1"}}]`)
+		err := idx.ConnectBlock(context.Background(), block, builder, db)
+		if v.Err {
+			assert.Error(t, err, v.Name)
+			db.Close()
+			continue
+		}
+		assert.NoError(t, err, v.Name)
+
+		items := bigmapItems(t, idx)
+		if assert.Len(t, items, 2, v.Name) {
+			want := contract.RowId
+			if v.Builder {
+				want = 99
+			}
+			for _, item := range items {
+				assert.Equal(t, models.AccountID(7), item.AccountId, v.Name)
+				assert.Equal(t, want, item.ContractId, v.Name)
+			}
+			assert.Equal(t, micheline.BigMapDiffActionAlloc, items[0].Action, v.Name)
+			assert.Equal(t, micheline.BigMapDiffActionUpdate, items[1].Action, v.Name)
+			// the key type is taken from the alloc in the same diff
+			assert.Equal(t, micheline.T_STRING, items[1].KeyType, v.Name)
+			assert.Equal(t, int64(1), items[1].NKeys, v.Name)
+		}
+		db.Close()
+	}
+}
+
+func TestBigMapIndexUpdateRollback(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	idx := NewBigMapIndex(db)
+	ctx := context.Background()
+
+	// contract and bigmap were created in block 9, block 10 replaces key a
+	cc := &models.Contract{AccountId: 7}
+	assert.NoError(t, db.Create(cc).Error)
+	builder := testBuilder{contracts: map[models.AccountID]*models.Contract{}}
+	block := bigmapBlock(t, 9, 7, `[`+testBigmapAlloc+`,{"action":"update",`+testBigmapKeyA+`,"value":{"int":"1"}}]`)
+	if !assert.NoError(t, idx.ConnectBlock(ctx, block, builder, db)) {
+		return
+	}
+	block = bigmapBlock(t, 10, 7, `[{"action":"update",`+testBigmapKeyA+`,"value":{"int":"2"}}]`)
+	if !assert.NoError(t, idx.ConnectBlock(ctx, block, builder, db)) {
+		return
+	}
+
+	items := bigmapItems(t, idx)
+	if assert.Len(t, items, 3) {
+		prev, next := items[1], items[2]
+		assert.True(t, prev.IsReplaced)
+		assert.Equal(t, int64(10), prev.Updated)
+		assert.Equal(t, prev.RowId, next.PrevId)
+		assert.False(t, next.IsReplaced)
+		assert.Equal(t, micheline.T_STRING, next.KeyType)
+		assert.Equal(t, int64(1), next.NKeys)
+		assert.Equal(t, prev.Counter+1, next.Counter)
+	}
+
+	// rollback removes block 10 items and restores the replaced entry
+	if !assert.NoError(t, idx.DeleteBlock(ctx, 10, db)) {
+		return
+	}
+	items = bigmapItems(t, idx)
+	if assert.Len(t, items, 2) {
+		assert.False(t, items[1].IsReplaced)
+		assert.Equal(t, int64(9), items[1].Height)
+	}
+}
@@ -53,9 +53,9 @@ func (idx *BlockIndex) ConnectBlock(ctx context.Context, block *models.Block, b
 
 	// fetch and update snapshot block
 	if snap := block.TZ.Snapshot; snap != nil {
-		snapHeight := block.Params.SnapshotBlock(snap.Cycle, snap.RollSnapshot)
+		snapHeight := b.Deployments().SnapshotBlock(snap.Cycle, snap.RollSnapshot)
 		log.Debugf("Marking block %d [%d] index %d as roll snapshot for cycle %d",
-			snapHeight, block.Params.CycleFromHeight(snapHeight), snap.RollSnapshot, snap.Cycle)
+			snapHeight, snap.Cycle-(block.Params.PreservedCycles+2), snap.RollSnapshot, snap.Cycle)
 
 		snapBlock := &models.Block{}
 		err := tx.Where("height = ?", snapHeight).First(snapBlock).Error
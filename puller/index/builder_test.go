@@ -0,0 +1,22 @@
+package index
+
+import (
+	"tezos_index/puller/models"
+)
+
+// testBuilder is a BlockBuilder fixture for index tests. Calls to methods
+// without a backing field panic on the nil embedded interface.
+type testBuilder struct {
+	models.BlockBuilder
+	accounts  map[models.AccountID]*models.Account
+	contracts map[models.AccountID]*models.Contract
+}
+
+func (b testBuilder) Accounts() map[models.AccountID]*models.Account {
+	return b.accounts
+}
+
+func (b testBuilder) ContractByAccountId(id models.AccountID) (*models.Contract, bool) {
+	c, ok := b.contracts[id]
+	return c, ok
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/zyjblockchain/sandy_log/log"
 	"tezos_index/chain"
 	"tezos_index/puller/models"
-	"tezos_index/rpc"
 )
 
 const ContractIndexKey = "contract"
@@ -35,8 +34,10 @@ func (idx *ContractIndex) Key() string {
 	return ContractIndexKey
 }
 
+// ConnectBlock stores contracts originated in this block. Contracts are built
+// by the block builder so other indexers can resolve them before they are
+// stored; inserting them here assigns their row ids.
 func (idx *ContractIndex) ConnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder, tx *gorm.DB) error {
-	ct := make([]*models.Contract, 0, block.NewContracts)
 	for _, op := range block.Ops {
 		if op.Type != chain.OpTypeOrigination {
 			continue
@@ -47,11 +48,6 @@ func (idx *ContractIndex) ConnectBlock(ctx context.Context, block *models.Block,
 		if !op.IsContract {
 			continue
 		}
-		// load rpc origination or transaction op
-		o, ok := block.GetRPCOp(op.OpN, op.OpC)
-		if !ok {
-			return fmt.Errorf("missing contract origination op [%d:%d]", op.OpN, op.OpC)
-		}
 		// load corresponding account
 		acc, ok := builder.AccountById(op.ReceiverId)
 		if !ok {
@@ -62,33 +58,16 @@ func (idx *ContractIndex) ConnectBlock(ctx context.Context, block *models.Block,
 		if !acc.IsNew {
 			continue
 		}
-		if op.IsInternal {
-			// on internal originations, find corresponding internal op
-			top, ok := o.(*rpc.TransactionOp)
-			if !ok {
-				return fmt.Errorf("internal contract origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-			}
-			iop := top.Metadata.InternalResults[op.OpI]
-			ct = append(ct, models.NewInternalContract(acc, iop))
-		} else {
-			oop, ok := o.(*rpc.OriginationOp)
-			if !ok {
-				return fmt.Errorf("contract origination op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
-			}
-			ct = append(ct, models.NewContract(acc, oop))
+		contract, ok := builder.ContractByAccountId(acc.RowId)
+		if !ok {
+			return fmt.Errorf("missing contract for origination op [%d:%d]", op.OpN, op.OpC)
 		}
-	}
-	// insert, will generate unique row ids
-	if len(ct) > 0 {
-		for _, contract := range ct {
-			if err := tx.Create(contract).Error; err != nil {
-				return err
-			}
+		// insert, will generate unique row ids
+		if err := tx.Create(contract).Error; err != nil {
+			return err
 		}
-		return nil
-	} else {
-		return nil
 	}
+	return nil
 }
 
 // func BatchInsertContracts(records []*models.Contract, db *gorm.DB) error {
@@ -171,8 +171,9 @@ func (idx *IncomeIndex) BootstrapIncome(ctx context.Context, block *models.Block
 		// set correct expectations about endorsement rewards for the last block in a cycle:
 		// endorsement income for a cycle is left-shifted by 1 (the last block in a cycle
 		// is endorsed in the next cycle and this shifts income from rights into this cycle too)
-		endorseStartBlock := p.CycleEndHeight(cycle - 1)
-		endorseEndBlock := p.CycleEndHeight(cycle) - 1
+		deps := builder.Deployments()
+		endorseStartBlock := deps.CycleEndHeight(cycle - 1)
+		endorseEndBlock := deps.CycleEndHeight(cycle) - 1
 		for _, v := range block.TZ.Endorsing {
 			if v.Level < endorseStartBlock || v.Level > endorseEndBlock {
 				continue
@@ -380,8 +381,9 @@ func (idx *IncomeIndex) CreateCycleIncome(ctx context.Context, block *models.Blo
 	// set correct expectations about endorsement rewards for the last block in a cycle:
 	// endorsement income for a cycle is left-shifted by 1 (the last block in a cycle
 	// is endorsed in the next cycle and this shifts income from rights into this cycle too)
-	endorseStartBlock := p.CycleEndHeight(sn.Cycle - 1)
-	endorseEndBlock := p.CycleEndHeight(sn.Cycle) - 1
+	deps := builder.Deployments()
+	endorseStartBlock := deps.CycleEndHeight(sn.Cycle - 1)
+	endorseEndBlock := deps.CycleEndHeight(sn.Cycle) - 1
 
 	for _, v := range block.TZ.Endorsing {
 		if v.Level > endorseEndBlock {
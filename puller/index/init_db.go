@@ -4,13 +4,30 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 	"github.com/zyjblockchain/sandy_log/log"
+	"strings"
+	"tezos_index/puller/models"
 )
 
 func InitDB(dsn string) *gorm.DB {
-	db, err := gorm.Open("mysql", dsn)
+	db, err := OpenDB("mysql", dsn)
 	if err != nil {
 		panic(err)
 	}
+	log.Infof("数据库连接成功")
+	return db
+}
+
+// OpenDB connects to a mysql or sqlite3 database. The sql driver for the
+// dialect must be imported by the caller.
+func OpenDB(dialect, dsn string) (*gorm.DB, error) {
+	db, err := gorm.Open(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// every connection to an in-memory SQLite database opens a new database
+	if dialect == models.DialectSQLite && (strings.Contains(dsn, ":memory:") || strings.Contains(dsn, "mode=memory")) {
+		db.DB().SetMaxOpenConns(1)
+	}
 
 	// 设置数据库的日志级别
 	if gin.Mode() == gin.ReleaseMode {
@@ -18,6 +35,5 @@ func InitDB(dsn string) *gorm.DB {
 	} else {
 		db.LogMode(true)
 	}
-	log.Infof("数据库连接成功")
-	return db
+	return db, nil
 }
@@ -0,0 +1,390 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"net/url"
+	"strings"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/models"
+	"time"
+)
+
+var (
+	ErrNoMetadataEntry = errors.New("metadata not indexed")
+)
+
+const MetadataIndexKey = "metadata"
+
+var metadataActions = []int{
+	int(micheline.BigMapDiffActionUpdate),
+	int(micheline.BigMapDiffActionRemove),
+}
+
+// MetadataIndex keeps TZIP-16 contract metadata and TZIP-12/TZIP-21 token
+// metadata in sync with the metadata and token_metadata bigmaps. URIs
+// pointing into contract storage are resolved here, off-chain URIs are
+// left pending for the metadata resolver.
+type MetadataIndex struct {
+	db    *gorm.DB
+	roles map[int64]*metadataBigMap // bigmap id cache, nil for other bigmaps
+}
+
+type metadataBigMap struct {
+	role       string // micheline.MetadataBigMap or micheline.TokenMetadataBigMap
+	contractId uint64
+	accountId  models.AccountID
+	address    string
+}
+
+func NewMetadataIndex(db *gorm.DB) *MetadataIndex {
+	return &MetadataIndex{
+		db:    db,
+		roles: make(map[int64]*metadataBigMap),
+	}
+}
+
+func (idx *MetadataIndex) DB() *gorm.DB {
+	return idx.db
+}
+
+func (idx *MetadataIndex) Key() string {
+	return MetadataIndexKey
+}
+
+// asumes bigmap updates are already stored (must run after BigMapIndex)
+func (idx *MetadataIndex) ConnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	var items []*models.BigMapItem
+	err := tx.Where("height = ? and bigmap_id >= ? and is_replaced = ? and action in (?)",
+		block.Height, 0, false, metadataActions).Order("row_id").Find(&items).Error
+	if err != nil {
+		return err
+	}
+	// any change to a metadata bigmap may change content referenced by
+	// tezos-storage URIs, so contract metadata is re-resolved once
+	contracts := make(map[int64]bool)
+	for _, item := range items {
+		bm, err := idx.lookupBigMap(item.BigMapId, tx)
+		if err != nil {
+			return err
+		}
+		if bm == nil {
+			continue
+		}
+		switch bm.role {
+		case micheline.MetadataBigMap:
+			contracts[item.BigMapId] = true
+		case micheline.TokenMetadataBigMap:
+			if err := idx.updateToken(item, bm, tx); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range contracts {
+		if err := idx.updateContract(id, idx.roles[id], tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *MetadataIndex) DisconnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	return idx.DeleteBlock(ctx, block.Height, tx)
+}
+
+// DeleteBlock re-derives all metadata updated at height from the bigmap
+// state, which must already be rolled back (must run after BigMapIndex).
+func (idx *MetadataIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.DB) error {
+	log.Debugf("Rollback metadata updates at height %d", height)
+	idx.roles = make(map[int64]*metadataBigMap)
+	var rows []*models.Metadata
+	if err := tx.Where("height = ?", height).Find(&rows).Error; err != nil {
+		return err
+	}
+	for _, row := range rows {
+		bm, err := idx.lookupBigMap(row.BigMapId, tx)
+		if err != nil {
+			return err
+		}
+		if bm == nil {
+			// bigmap allocated at height
+			if err := tx.Delete(row).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if bm.role == micheline.MetadataBigMap {
+			err = idx.updateContract(row.BigMapId, bm, tx)
+		} else {
+			item := &models.BigMapItem{}
+			err = tx.Where("bigmap_id = ? and key_hash = ? and is_replaced = ?", row.BigMapId, row.KeyHash, false).First(item).Error
+			switch err {
+			case nil:
+				err = idx.updateToken(item, bm, tx)
+			case gorm.ErrRecordNotFound:
+				err = tx.Delete(row).Error
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupBigMap detects metadata bigmaps from their type. The storage type of
+// the owning contract must declare exactly one bigmap of this type and its
+// field annotation must be %metadata or %token_metadata.
+func (idx *MetadataIndex) lookupBigMap(id int64, tx *gorm.DB) (*metadataBigMap, error) {
+	if bm, ok := idx.roles[id]; ok {
+		return bm, nil
+	}
+	alloc := &models.BigMapItem{}
+	err := tx.Where("bigmap_id = ? and action = ?", id, micheline.BigMapDiffActionAlloc).First(alloc).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	idx.roles[id] = nil
+	keyType := &micheline.Prim{OpCode: alloc.KeyType}
+	valueType := &micheline.Prim{}
+	if err := valueType.UnmarshalBinary(alloc.Value); err != nil {
+		return nil, nil
+	}
+	var role string
+	switch {
+	case micheline.IsMetadataBigMap(keyType, valueType):
+		role = micheline.MetadataBigMap
+	case micheline.IsTokenMetadataBigMap(keyType, valueType):
+		role = micheline.TokenMetadataBigMap
+	default:
+		return nil, nil
+	}
+	contract := &models.Contract{}
+	if err := tx.Where("row_id = ?", alloc.ContractId).First(contract).Error; err != nil {
+		return nil, fmt.Errorf("loading contract %d for bigmap %d: %v", alloc.ContractId, id, err)
+	}
+	script := micheline.NewScript()
+	if err := script.UnmarshalBinary(contract.Script); err != nil {
+		return nil, nil
+	}
+	var name string
+	var n int
+	for _, v := range script.BigMaps() {
+		if v.KeyType.OpCode == keyType.OpCode && v.ValueType.IsEqualType(valueType) {
+			name = v.Name
+			n++
+		}
+	}
+	if n != 1 || name != role {
+		return nil, nil
+	}
+	bm := &metadataBigMap{
+		role:       role,
+		contractId: contract.RowId,
+		accountId:  contract.AccountId,
+		address:    contract.String(),
+	}
+	idx.roles[id] = bm
+	return bm, nil
+}
+
+// updateContract applies the current state of a metadata bigmap.
+func (idx *MetadataIndex) updateContract(id int64, bm *metadataBigMap, tx *gorm.DB) error {
+	var items []*models.BigMapItem
+	err := tx.Where("bigmap_id = ? and is_replaced = ? and action in (?)", id, false, metadataActions).Find(&items).Error
+	if err != nil {
+		return err
+	}
+	row := &models.Metadata{}
+	err = tx.Where("bigmap_id = ?", id).First(row).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	var root *models.BigMapItem
+	var height int64
+	var ts time.Time
+	for _, item := range items {
+		if item.Height > height {
+			height, ts = item.Height, item.Timestamp
+		}
+		if !item.IsDeleted && len(item.Key) == 0 {
+			root = item
+		}
+	}
+	if root == nil && row.RowId == 0 {
+		return nil
+	}
+	row.Reset()
+	row.ContractId = bm.contractId
+	row.AccountId = bm.accountId
+	row.Contract = bm.address
+	row.BigMapId = id
+	row.Height = height
+	row.Timestamp = ts
+	if len(items) == 0 {
+		return tx.Delete(row).Error
+	}
+	if root == nil {
+		row.Status = models.MetadataStatusRemoved
+	} else {
+		row.KeyHash = root.KeyHash
+		uri, err := metadataBytes(root)
+		if err != nil {
+			row.Status = models.MetadataStatusFailed
+			row.Error = err.Error()
+		} else {
+			row.URI = string(uri)
+			idx.resolve(row, id, tx)
+		}
+	}
+	return tx.Save(row).Error
+}
+
+// updateToken applies a single token_metadata bigmap entry.
+func (idx *MetadataIndex) updateToken(item *models.BigMapItem, bm *metadataBigMap, tx *gorm.DB) error {
+	row := &models.Metadata{}
+	err := tx.Where("bigmap_id = ? and key_hash = ?", item.BigMapId, item.KeyHash).First(row).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	if item.IsDeleted && row.RowId == 0 {
+		return nil
+	}
+	row.Reset()
+	row.ContractId = bm.contractId
+	row.AccountId = bm.accountId
+	row.Contract = bm.address
+	row.BigMapId = item.BigMapId
+	row.KeyHash = item.KeyHash
+	row.Height = item.Height
+	row.Timestamp = item.Timestamp
+	if item.IsDeleted {
+		row.Status = models.MetadataStatusRemoved
+		return tx.Save(row).Error
+	}
+	val := micheline.NewBigMapValue()
+	if err := val.Value.UnmarshalBinary(item.Value); err != nil {
+		return fmt.Errorf("decoding token_metadata bigmap %d value: %v", item.BigMapId, err)
+	}
+	tokenId, info, err := val.TokenInfo()
+	if err != nil {
+		// keep the entry so a later update finds it
+		row.Status = models.MetadataStatusFailed
+		row.Error = err.Error()
+		return tx.Save(row).Error
+	}
+	row.TokenId = tokenId.Text(10)
+	row.SetTokenInfo(info)
+	row.Status = models.MetadataStatusResolved
+	if uri, ok := info[""]; ok && len(uri) > 0 {
+		row.URI = string(uri)
+		// tezos-storage URIs in token metadata refer to the contract's
+		// metadata bigmap
+		id, err := idx.findMetadataBigMap(bm.contractId, tx)
+		if err != nil {
+			return err
+		}
+		idx.resolve(row, id, tx)
+	}
+	return tx.Save(row).Error
+}
+
+// resolve loads tezos-storage content from bigmap id and queues off-chain
+// URIs. Resolve errors are stored with the row.
+func (idx *MetadataIndex) resolve(row *models.Metadata, id int64, tx *gorm.DB) {
+	var err error
+	switch scheme := strings.SplitN(row.URI, ":", 2)[0]; scheme {
+	case "tezos-storage":
+		var buf []byte
+		if buf, err = idx.loadStorage(row.URI, id, tx); err == nil {
+			err = row.SetContent(buf)
+		}
+	case "ipfs", "https", "http":
+		row.Status = models.MetadataStatusPending
+		row.NextRetry = row.Timestamp
+	default:
+		err = fmt.Errorf("unsupported metadata uri scheme %q", scheme)
+	}
+	if err != nil {
+		row.Status = models.MetadataStatusFailed
+		row.Error = err.Error()
+	}
+}
+
+// loadStorage resolves a TZIP-16 tezos-storage URI. Without host the key is
+// read from bigmap id, otherwise from the metadata bigmap of the host
+// contract.
+func (idx *MetadataIndex) loadStorage(uri string, id int64, tx *gorm.DB) ([]byte, error) {
+	key := strings.TrimPrefix(uri, "tezos-storage:")
+	if strings.HasPrefix(key, "//") {
+		parts := strings.SplitN(key[2:], "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tezos-storage uri %q", uri)
+		}
+		// host may carry a network suffix
+		addr, err := chain.ParseAddress(strings.SplitN(parts[0], ".", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid tezos-storage host in %q: %v", uri, err)
+		}
+		contract := &models.Contract{}
+		if err := tx.Where("hash = ?", addr.Hash).First(contract).Error; err != nil {
+			return nil, fmt.Errorf("tezos-storage contract %s: %v", addr, err)
+		}
+		if id, err = idx.findMetadataBigMap(contract.RowId, tx); err != nil {
+			return nil, err
+		}
+		key = parts[1]
+	}
+	if id < 0 {
+		return nil, fmt.Errorf("missing metadata bigmap for %q", uri)
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tezos-storage key in %q: %v", uri, err)
+	}
+	var items []*models.BigMapItem
+	err = tx.Where("bigmap_id = ? and is_replaced = ? and action = ?", id, false, micheline.BigMapDiffActionUpdate).Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if string(item.Key) == key {
+			return metadataBytes(item)
+		}
+	}
+	return nil, fmt.Errorf("missing tezos-storage key %q in bigmap %d", key, id)
+}
+
+// findMetadataBigMap returns the metadata bigmap id of a contract or -1.
+func (idx *MetadataIndex) findMetadataBigMap(contractId uint64, tx *gorm.DB) (int64, error) {
+	var allocs []*models.BigMapItem
+	err := tx.Select("bigmap_id").Where("contract_id = ? and action = ? and bigmap_id >= ?",
+		contractId, micheline.BigMapDiffActionAlloc, 0).Find(&allocs).Error
+	if err != nil {
+		return -1, err
+	}
+	for _, alloc := range allocs {
+		bm, err := idx.lookupBigMap(alloc.BigMapId, tx)
+		if err != nil {
+			return -1, err
+		}
+		if bm != nil && bm.role == micheline.MetadataBigMap {
+			return alloc.BigMapId, nil
+		}
+	}
+	return -1, nil
+}
+
+func metadataBytes(item *models.BigMapItem) ([]byte, error) {
+	val := micheline.NewBigMapValue()
+	if err := val.Value.UnmarshalBinary(item.Value); err != nil {
+		return nil, err
+	}
+	return val.MetadataBytes()
+}
@@ -0,0 +1,142 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/micheline"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"time"
+)
+
+const metadataScript = `{"code":[
+{"prim":"parameter","args":[{"prim":"unit"}]},
+{"prim":"storage","args":[{"prim":"pair","args":[
+  {"prim":"big_map","args":[{"prim":"string"},{"prim":"bytes"}],"annots":["%metadata"]},
+  {"prim":"big_map","args":[{"prim":"nat"},{"prim":"pair","args":[{"prim":"nat"},{"prim":"map","args":[{"prim":"string"},{"prim":"bytes"}]}]}],"annots":["%token_metadata"]}]}]},
+{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],
+"storage":{"prim":"Pair","args":[[],[]]}}`
+
+func mustPrimBinary(t *testing.T, s string) []byte {
+	p := &micheline.Prim{}
+	if err := json.Unmarshal([]byte(s), p); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// putBigMapItem replaces the current entry at key like the bigmap index does.
+func putBigMapItem(t *testing.T, db *gorm.DB, id, height int64, key []byte, value string) {
+	hash := append([]byte{byte(id)}, key...)
+	prev := &models.BigMapItem{}
+	err := db.Where("bigmap_id = ? and key_hash = ? and is_replaced = ?", id, hash, false).First(prev).Error
+	if err == nil {
+		assert.NoError(t, db.Model(prev).Update("is_replaced", true).Error)
+	}
+	item := &models.BigMapItem{
+		PrevId:     prev.RowId,
+		AccountId:  1,
+		ContractId: 1,
+		Height:     height,
+		Timestamp:  time.Unix(height*60, 0).UTC(),
+		BigMapId:   id,
+		Action:     micheline.BigMapDiffActionUpdate,
+		KeyHash:    hash,
+		Key:        key,
+		Value:      mustPrimBinary(t, value),
+	}
+	assert.NoError(t, db.Create(item).Error)
+}
+
+// rollbackBigMap mimics BigMapIndex.DeleteBlock.
+func rollbackBigMap(t *testing.T, db *gorm.DB, height int64) {
+	assert.NoError(t, NewBigMapIndex(db).DeleteBlock(context.Background(), height, db))
+}
+
+func bytesValue(s string) string {
+	return fmt.Sprintf(`{"bytes":"%s"}`, hex.EncodeToString([]byte(s)))
+}
+
+func TestMetadataIndex_ConnectDisconnect(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	script := micheline.NewScript()
+	assert.NoError(t, json.Unmarshal([]byte(metadataScript), script))
+	code, err := script.MarshalBinary()
+	assert.NoError(t, err)
+	contract := &models.Contract{RowId: 1, AccountId: 1, Hash: bytes.Repeat([]byte{0x02}, 20), Script: code}
+	assert.NoError(t, db.Create(contract).Error)
+	assert.NoError(t, db.Create(&models.BigMapItem{
+		ContractId: 1, BigMapId: 5, Height: 10, Action: micheline.BigMapDiffActionAlloc,
+		KeyType: micheline.T_STRING, Value: mustPrimBinary(t, `{"prim":"bytes"}`),
+	}).Error)
+	assert.NoError(t, db.Create(&models.BigMapItem{
+		ContractId: 1, BigMapId: 6, Height: 10, Action: micheline.BigMapDiffActionAlloc,
+		KeyType: micheline.T_NAT, Value: mustPrimBinary(t, `{"prim":"pair","args":[{"prim":"nat"},{"prim":"map","args":[{"prim":"string"},{"prim":"bytes"}]}]}`),
+	}).Error)
+
+	putBigMapItem(t, db, 5, 10, []byte{}, bytesValue("tezos-storage:contents"))
+	putBigMapItem(t, db, 5, 10, []byte("contents"), bytesValue(`{"name":"Test","description":"test contract"}`))
+	putBigMapItem(t, db, 6, 10, []byte{0}, fmt.Sprintf(`{"prim":"Pair","args":[{"int":"0"},[
+		{"prim":"Elt","args":[{"string":""},%s]},
+		{"prim":"Elt","args":[{"string":"symbol"},%s]},
+		{"prim":"Elt","args":[{"string":"decimals"},%s]}]]}`,
+		bytesValue("ipfs://QmTest"), bytesValue("TST"), bytesValue("6")))
+
+	idx := NewMetadataIndex(db)
+	ctx := context.Background()
+	assert.NoError(t, idx.ConnectBlock(ctx, &models.Block{Height: 10}, nil, db))
+
+	lookup := func(tokenId string) *models.Metadata {
+		md := &models.Metadata{}
+		if err := db.Where("contract = ? and token_id = ?", contract.String(), tokenId).First(md).Error; err != nil {
+			return nil
+		}
+		return md
+	}
+	md := lookup("")
+	if assert.NotNil(t, md) {
+		assert.Equal(t, models.MetadataStatusResolved, md.Status)
+		assert.Equal(t, "tezos-storage:contents", md.URI)
+		assert.Equal(t, "Test", md.Name)
+		assert.Equal(t, uint64(1), md.ContractId)
+	}
+	token := lookup("0")
+	if assert.NotNil(t, token) {
+		assert.Equal(t, models.MetadataStatusPending, token.Status)
+		assert.Equal(t, "ipfs://QmTest", token.URI)
+		assert.Equal(t, "TST", token.Symbol)
+		assert.Equal(t, 6, token.Decimals)
+	}
+
+	// content referenced by the root URI changes
+	putBigMapItem(t, db, 5, 11, []byte("contents"), bytesValue(`{"name":"Test2"}`))
+	assert.NoError(t, idx.ConnectBlock(ctx, &models.Block{Height: 11}, nil, db))
+	md = lookup("")
+	assert.Equal(t, "Test2", md.Name)
+	assert.Equal(t, int64(11), md.Height)
+
+	// rollback re-derives metadata from the previous bigmap state
+	rollbackBigMap(t, db, 11)
+	assert.NoError(t, idx.DisconnectBlock(ctx, &models.Block{Height: 11}, nil, db))
+	md = lookup("")
+	assert.Equal(t, "Test", md.Name)
+	assert.Equal(t, int64(10), md.Height)
+
+	rollbackBigMap(t, db, 10)
+	assert.NoError(t, idx.DisconnectBlock(ctx, &models.Block{Height: 10}, nil, db))
+	var n int
+	assert.NoError(t, db.Model(&models.Metadata{}).Count(&n).Error)
+	assert.Equal(t, 0, n)
+}
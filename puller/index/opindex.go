@@ -50,12 +50,17 @@ func (idx *OpIndex) ConnectBlock(ctx context.Context, block *models.Block, _ mod
 		ops = append(ops, op)
 	}
 	// todo batch insert
+	hashes := make([]string, 0, len(ops))
 	for _, op := range ops {
 		if err := tx.Create(op).Error; err != nil {
 			return err
 		}
+		if op.OpC == 0 && !op.IsInternal {
+			hashes = append(hashes, string(op.Hash))
+		}
 	}
-	return nil
+	// resolve ops seen in the mempool
+	return models.MarkPendingOpsIncluded(tx, hashes, block.Height)
 }
 
 func (idx *OpIndex) DisconnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
@@ -64,6 +69,9 @@ func (idx *OpIndex) DisconnectBlock(ctx context.Context, block *models.Block, _
 
 func (idx *OpIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.DB) error {
 	log.Debugf("Rollback deleting ops at height %d", height)
+	if err := models.RevertPendingOpsIncluded(tx, height); err != nil {
+		return err
+	}
 
 	return tx.Where("height = ?", height).Delete(&models.Op{}).Error
 }
@@ -0,0 +1,227 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"sort"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"time"
+)
+
+const (
+	RankIndexKey = "rank"
+
+	// RankWindow is the period transaction flow and traffic are summed over.
+	RankWindow = 24 * time.Hour
+)
+
+var (
+	// ErrNoRankEntry is an error that indicates a requested entry does
+	// not exist in the rank table.
+	ErrNoRankEntry = errors.New("rank not indexed")
+)
+
+// RankIndex keeps the balance and 24h transaction flow and traffic of all
+// accounts up to date. Accounts referenced in a block and accounts whose
+// transactions left the 24h window are refreshed on each block.
+type RankIndex struct {
+	db *gorm.DB
+}
+
+func NewRankIndex(db *gorm.DB) *RankIndex {
+	return &RankIndex{db}
+}
+
+func (idx *RankIndex) DB() *gorm.DB {
+	return idx.db
+}
+
+func (idx *RankIndex) Key() string {
+	return RankIndexKey
+}
+
+// asumes accounts and ops are already stored (must run after AccountIndex and OpIndex)
+func (idx *RankIndex) ConnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder, tx *gorm.DB) error {
+	ids := make(map[models.AccountID]struct{})
+	for id := range builder.Accounts() {
+		ids[id] = struct{}{}
+	}
+	// transactions that were inside the parent's window but are outside now
+	if prev, ok, err := blockTime(tx, block.Height-1); err != nil {
+		return err
+	} else if ok {
+		if err := windowAccounts(tx, prev.Add(-RankWindow), block.Timestamp.Add(-RankWindow), ids); err != nil {
+			return err
+		}
+	}
+	return refreshRanks(tx, ids, block.Height, block.Timestamp)
+}
+
+func (idx *RankIndex) DisconnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	return idx.DeleteBlock(ctx, block.Height, tx)
+}
+
+// DeleteBlock refreshes all rows updated at height against the parent block
+// together with accounts whose transactions re-enter the parent's window.
+func (idx *RankIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.DB) error {
+	log.Debugf("Rollback refreshing ranks at height %d", height)
+	var rows []*models.AccountRank
+	if err := tx.Select("account_id, time").Where("height = ?", height).Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	ids := make(map[models.AccountID]struct{}, len(rows))
+	for _, r := range rows {
+		ids[r.AccountId] = struct{}{}
+	}
+	prev, ok, err := blockTime(tx, height-1)
+	if err != nil || !ok {
+		return err
+	}
+	if err := windowAccounts(tx, prev.Add(-RankWindow), rows[0].Time.Add(-RankWindow), ids); err != nil {
+		return err
+	}
+	return refreshRanks(tx, ids, height-1, prev)
+}
+
+// Init creates rows for all funded accounts when the index is enabled on an
+// existing database. Seeded rows use height 0 so they are not touched by a
+// rollback.
+func (idx *RankIndex) Init(ctx context.Context, tx *gorm.DB) error {
+	err := tx.Select("account_id").First(&models.AccountRank{}).Error
+	if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	best := &models.Block{}
+	err = tx.Select("height, time").Order("height desc").First(best).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = tx.Exec(fmt.Sprintf("INSERT INTO %s (account_id, height, time, balance, tx_flow_24h, tx_traffic_24h) "+
+		"SELECT row_id, 0, ?, spendable_balance + frozen_deposits + frozen_fees + frozen_rewards, 0, 0 FROM %s WHERE is_funded = ?",
+		tx.NewScope(&models.AccountRank{}).TableName(), tx.NewScope(&models.Account{}).TableName()),
+		best.Timestamp, true).Error
+	if err != nil {
+		return err
+	}
+	ids := make(map[models.AccountID]struct{})
+	if err := windowAccounts(tx, best.Timestamp.Add(-RankWindow), best.Timestamp, ids); err != nil {
+		return err
+	}
+	if err := refreshRanks(tx, ids, 0, best.Timestamp); err != nil {
+		return err
+	}
+	log.Infof("Seeded account ranks at height %d", best.Height)
+	return nil
+}
+
+func blockTime(db *gorm.DB, height int64) (time.Time, bool, error) {
+	if height < 0 {
+		return time.Time{}, false, nil
+	}
+	b := &models.Block{}
+	err := db.Select("time").Where("height = ?", height).First(b).Error
+	switch err {
+	case nil:
+		return b.Timestamp, true, nil
+	case gorm.ErrRecordNotFound:
+		return time.Time{}, false, nil
+	default:
+		return time.Time{}, false, err
+	}
+}
+
+// windowAccounts adds senders and receivers of successful transactions in
+// (from, to] to ids.
+func windowAccounts(db *gorm.DB, from, to time.Time, ids map[models.AccountID]struct{}) error {
+	if !to.After(from) {
+		return nil
+	}
+	var ops []*models.Op
+	err := db.Select("sender_id, receiver_id").
+		Where("time > ? and time <= ? and type = ? and is_success = ?", from, to, int64(chain.OpTypeTransaction), true).
+		Find(&ops).Error
+	if err != nil {
+		return err
+	}
+	for _, o := range ops {
+		if o.SenderId > 0 {
+			ids[o.SenderId] = struct{}{}
+		}
+		if o.ReceiverId > 0 {
+			ids[o.ReceiverId] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// loadRank computes the rank values of account id at time now, it returns nil
+// when the account does not exist.
+func loadRank(db *gorm.DB, id models.AccountID, now time.Time) (*models.AccountRank, error) {
+	acc := &models.Account{}
+	err := db.Select("row_id, spendable_balance, frozen_deposits, frozen_fees, frozen_rewards").
+		Where("row_id = ?", id.Value()).First(acc).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	rank := &models.AccountRank{
+		AccountId: id,
+		Balance:   acc.SpendableBalance + acc.FrozenDeposits + acc.FrozenFees + acc.FrozenRewards,
+	}
+	// a transfer to self counts twice like for any other pair of accounts
+	for _, col := range []string{"sender_id", "receiver_id"} {
+		var sum struct {
+			N int64
+			V int64
+		}
+		err := db.Model(&models.Op{}).Select("count(*) as n, coalesce(sum(volume), 0) as v").
+			Where(col+" = ? and time > ? and time <= ? and type = ? and is_success = ?",
+				id.Value(), now.Add(-RankWindow), now, int64(chain.OpTypeTransaction), true).
+			Scan(&sum).Error
+		if err != nil {
+			return nil, err
+		}
+		rank.TxTraffic24h += sum.N
+		rank.TxFlow24h += sum.V
+	}
+	return rank, nil
+}
+
+// refreshRanks replaces the rows of all ids with values at height and time now.
+func refreshRanks(db *gorm.DB, ids map[models.AccountID]struct{}, height int64, now time.Time) error {
+	sorted := make([]models.AccountID, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, id := range sorted {
+		rank, err := loadRank(db, id, now)
+		if err != nil {
+			return fmt.Errorf("rank account %d: %v", id, err)
+		}
+		if err := db.Where("account_id = ?", id.Value()).Delete(&models.AccountRank{}).Error; err != nil {
+			return err
+		}
+		if rank == nil {
+			continue
+		}
+		rank.Height = height
+		rank.Time = now
+		if err := db.Create(rank).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
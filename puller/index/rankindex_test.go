@@ -0,0 +1,76 @@
+package index
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"time"
+)
+
+func TestRankIndex_ConnectDisconnect(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	start := time.Date(2021, 10, 25, 0, 0, 0, 0, time.UTC)
+	for id, bal := range map[models.AccountID]int64{1: 1000, 2: 500, 3: 500} {
+		assert.NoError(t, db.Create(&models.Account{RowId: id, SpendableBalance: bal, IsFunded: true}).Error)
+	}
+	idx := NewRankIndex(db)
+	ctx := context.Background()
+	// nothing to seed without blocks
+	assert.NoError(t, idx.Init(ctx, db))
+	var n int
+	assert.NoError(t, db.Model(&models.AccountRank{}).Count(&n).Error)
+	assert.Equal(t, 0, n)
+	connect := func(height int64, tm time.Time, op *models.Op) *models.Block {
+		block := &models.Block{Height: height, Timestamp: tm}
+		assert.NoError(t, db.Create(block).Error)
+		touched := make(map[models.AccountID]*models.Account)
+		if op != nil {
+			op.Height, op.Timestamp, op.Type, op.IsSuccess = height, tm, chain.OpTypeTransaction, true
+			assert.NoError(t, db.Create(op).Error)
+			touched[op.SenderId] = nil
+			touched[op.ReceiverId] = nil
+		}
+		assert.NoError(t, idx.ConnectBlock(ctx, block, testBuilder{accounts: touched}, db))
+		return block
+	}
+	load := func(id models.AccountID) *models.AccountRank {
+		r := &models.AccountRank{}
+		assert.NoError(t, db.Where("account_id = ?", id).First(r).Error)
+		return r
+	}
+
+	// init on an existing database seeds all funded accounts once
+	assert.NoError(t, db.Create(&models.Block{Height: 0, Timestamp: start.Add(-time.Hour)}).Error)
+	assert.NoError(t, idx.Init(ctx, db))
+	assert.Equal(t, int64(500), load(3).Balance)
+	assert.Equal(t, int64(0), load(3).Height)
+	assert.NoError(t, db.Model(&models.Account{}).Where("row_id = ?", 3).Update("spendable_balance", 700).Error)
+	assert.NoError(t, idx.Init(ctx, db))
+	assert.Equal(t, int64(500), load(3).Balance)
+
+	connect(1, start, &models.Op{SenderId: 1, ReceiverId: 2, Volume: 100})
+	assert.Equal(t, int64(1000), load(1).Balance)
+	assert.Equal(t, int64(100), load(2).TxFlow24h)
+	assert.Equal(t, int64(1), load(1).TxTraffic24h)
+
+	connect(2, start.Add(time.Hour), &models.Op{SenderId: 2, ReceiverId: 3, Volume: 50})
+	assert.Equal(t, int64(150), load(2).TxFlow24h)
+	assert.Equal(t, int64(2), load(2).TxTraffic24h)
+
+	// the first transaction leaves the window although no account is touched
+	b3 := connect(3, start.Add(24*time.Hour+30*time.Minute), nil)
+	assert.Equal(t, int64(0), load(1).TxFlow24h)
+	assert.Equal(t, int64(50), load(2).TxFlow24h)
+	assert.Equal(t, int64(3), load(1).Height)
+
+	// rollback brings it back
+	assert.NoError(t, idx.DisconnectBlock(ctx, b3, nil, db))
+	assert.Equal(t, int64(100), load(1).TxFlow24h)
+	assert.Equal(t, int64(150), load(2).TxFlow24h)
+	assert.Equal(t, int64(2), load(1).Height)
+}
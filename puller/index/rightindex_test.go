@@ -4,15 +4,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"math/rand"
 	"testing"
+	"tezos_index/puller/dbtest"
 	"tezos_index/puller/models"
 	"time"
 )
-import _ "github.com/jinzhu/gorm/dialects/mysql"
 
 func TestAccountIndex_DB(t *testing.T) {
-	dsn := "root:WcGsHDMBmcv7mc#QWkuR@tcp(127.0.0.1:3306)/sandy_test?charset=utf8mb4&parseTime=True&loc=Local"
-	db := InitDB(dsn)
-	db.AutoMigrate(&models.Right{})
+	db := dbtest.Open(t)
+	defer db.Close()
 	startTime := time.Now()
 	rights := make([]*models.Right, 0, 10000)
 	for i := 0; i < 100; i++ {
@@ -33,14 +32,17 @@ func TestAccountIndex_DB(t *testing.T) {
 	err := BatchInsertRights(rights, batch, db)
 	assert.NoError(t, err)
 
+	var count int
+	assert.NoError(t, db.Model(&models.Right{}).Count(&count).Error)
+	assert.Equal(t, len(rights), count)
+
 	spendTime := time.Since(startTime).Seconds()
 	t.Log(spendTime)
 }
 
 func TestAccountIndex_ConnectBlock(t *testing.T) {
-	dsn := "root:WcGsHDMBmcv7mc#QWkuR@tcp(127.0.0.1:3306)/sandy_test?charset=utf8mb4&parseTime=True&loc=Local"
-	db := InitDB(dsn)
-	db.AutoMigrate(&models.Right{})
+	db := dbtest.Open(t)
+	defer db.Close()
 	tx01 := db.Begin()
 
 	// err := tx01.Update(models.Right{RowId: 1, Height: 11}).Error
@@ -54,14 +56,17 @@ func TestAccountIndex_ConnectBlock(t *testing.T) {
 	t.Log(res.Height)
 	// tx01.Commit()
 
-	err = tx01.Model(&models.Right{}).Where("height = 9").First(res).Error
+	res = &models.Right{}
+	err = tx01.Model(&models.Right{}).Where("height = 222").First(res).Error
 	assert.NoError(t, err)
-	// tx01.Commit()
+	assert.Equal(t, newRight.RowId, res.RowId)
+	tx01.Rollback()
 }
 
 func TestBatchInsertRights(t *testing.T) {
-	dsn := "root:WcGsHDMBmcv7mc#QWkuR@tcp(127.0.0.1:3306)/tezos_index?charset=utf8mb4&parseTime=True&loc=Local"
-	tx := InitDB(dsn)
+	tx := dbtest.Open(t)
+	defer tx.Close()
+	assert.NoError(t, tx.Create(&models.Contract{AccountId: 10, Height: 7}).Error)
 
 	contract := &models.Contract{
 		RowId: 9,
@@ -78,8 +83,7 @@ func TestBatchInsertRights(t *testing.T) {
 			LIMIT 1
 			`
 	err := tx.Raw(sql, 10).Scan(contract).Error
-	if err != nil {
-		t.Log(err)
-	}
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), contract.Height)
 	t.Log(contract.RowId, contract.Height)
 }
@@ -116,7 +116,7 @@ func (idx *SnapshotIndex) ConnectBlock(ctx context.Context, block *models.Block,
 	for _, a := range accs {
 		// skip all self-delegations because the're already handled above
 		if a.RowId == a.DelegateId {
-			return nil
+			continue
 		}
 		snap := models.NewSnapshot()
 		snap.Height = block.Height
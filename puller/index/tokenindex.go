@@ -0,0 +1,566 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"strconv"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+	util "tezos_index/utils"
+)
+
+var (
+	ErrNoTokenEntry = errors.New("token not indexed")
+)
+
+const (
+	TokenIndexKey = "token"
+
+	// TokenCacheSize is the max number of contracts and bigmaps kept in the
+	// detection caches, caches are cleared when they grow beyond it.
+	TokenCacheSize = 1 << 14
+
+	// tokenBackfillKey is the harvester status key storing the height at
+	// which existing contracts were scanned for token ledgers.
+	tokenBackfillKey = "TOKEN_BACKFILL"
+
+	tokenBackfillBatch = 500
+)
+
+// TokenIndex detects FA1.2 and FA2 contracts from their entrypoints. Holder
+// balances are taken from updates to the contract's ledger big_map, calls to
+// the transfer entrypoint are indexed as transfers. Other entrypoints like
+// approve or update_operators are only used for detection. Ledgers of
+// contracts originated before the index was enabled are backfilled on Init.
+type TokenIndex struct {
+	db        *gorm.DB
+	contracts map[models.AccountID]*tokenContract // detection cache, bounded by TokenCacheSize
+	ledgers   map[int64]*models.TokenLedger       // bigmap id cache, nil for other bigmaps
+}
+
+type tokenContract struct {
+	address  string
+	standard micheline.TokenStandard
+	eps      micheline.Entrypoints
+	ledger   micheline.LedgerBigMap
+}
+
+func NewTokenIndex(db *gorm.DB) *TokenIndex {
+	return &TokenIndex{
+		db:        db,
+		contracts: make(map[models.AccountID]*tokenContract),
+		ledgers:   make(map[int64]*models.TokenLedger),
+	}
+}
+
+func (idx *TokenIndex) DB() *gorm.DB {
+	return idx.db
+}
+
+func (idx *TokenIndex) Key() string {
+	return TokenIndexKey
+}
+
+type tokenKey struct {
+	account models.AccountID
+	id      string
+}
+
+// asumes op ids are already set (must run after OpIndex)
+func (idx *TokenIndex) ConnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder, tx *gorm.DB) error {
+	tokens := make(map[tokenKey]*models.Token)
+	for _, op := range block.Ops {
+		if !op.IsSuccess || !op.HasData {
+			continue
+		}
+		if op.Type != chain.OpTypeTransaction && op.Type != chain.OpTypeOrigination {
+			continue
+		}
+		contract, err := idx.lookupContract(op.ReceiverId, builder, tx)
+		if err != nil {
+			return err
+		}
+		if !contract.standard.IsValid() {
+			continue
+		}
+		o, ok := block.GetRPCOp(op.OpN, op.OpC)
+		if !ok {
+			return fmt.Errorf("missing token op [%d:%d]", op.OpN, op.OpC)
+		}
+		if op.Type == chain.OpTypeTransaction {
+			if err := idx.connectTransfers(block, op, o, contract, tokens, tx); err != nil {
+				return err
+			}
+		}
+		bmd, err := opBigMapDiff(o, op)
+		if err != nil {
+			return err
+		}
+		if err := idx.connectLedger(block, op, contract, bmd, tokens, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectTransfers stores transfers from a call to the transfer entrypoint.
+func (idx *TokenIndex) connectTransfers(block *models.Block, op *models.Op, o rpc.Operation, contract *tokenContract, tokens map[tokenKey]*models.Token, tx *gorm.DB) error {
+	top, ok := o.(*rpc.TransactionOp)
+	if !ok {
+		return fmt.Errorf("token transaction op [%d:%d]: unexpected type %T ", op.OpN, op.OpC, o)
+	}
+	params := top.Parameters
+	if op.IsInternal {
+		params = top.Metadata.InternalResults[op.OpI].Parameters
+	}
+	if params == nil {
+		return nil
+	}
+	name, val := tokenCall(params, contract.eps)
+	if name != "transfer" {
+		return nil
+	}
+	transfers, err := micheline.DecodeTokenTransfers(contract.standard, val)
+	if err != nil {
+		// don't fail the block on non-standard contracts
+		log.Warnf("Skipping token transfer op [%d:%d] %s: %v", op.OpN, op.OpC, contract.address, err)
+		return nil
+	}
+	for _, t := range transfers {
+		token, err := idx.getToken(block, op.ReceiverId, contract, t.TokenId.Text(10), tokens, tx)
+		if err != nil {
+			return err
+		}
+		row := &models.TokenTransfer{
+			TokenRowId: token.RowId,
+			OpId:       op.RowId,
+			OpN:        op.OpN,
+			OpC:        op.OpC,
+			OpI:        op.OpI,
+			Height:     block.Height,
+			Timestamp:  block.Timestamp,
+			Sender:     t.From.String(),
+			Receiver:   t.To.String(),
+			Amount:     t.Amount.Text(10),
+		}
+		if err := tx.Create(row).Error; err != nil {
+			return fmt.Errorf("creating token transfer: %v", err)
+		}
+	}
+	return nil
+}
+
+// connectLedger registers the ledger big_map when it is allocated and
+// applies updates to holder balances.
+func (idx *TokenIndex) connectLedger(block *models.Block, op *models.Op, contract *tokenContract, bmd micheline.BigMapDiff, tokens map[tokenKey]*models.Token, tx *gorm.DB) error {
+	for _, v := range bmd {
+		switch v.Action {
+		case micheline.BigMapDiffActionAlloc:
+			// temporary bigmaps have negative ids
+			if v.Id < 0 || !contract.ledger.Matches(v.KeyType, v.ValueType) {
+				continue
+			}
+			ledger := &models.TokenLedger{
+				BigMapId:  v.Id,
+				AccountId: op.ReceiverId,
+				Contract:  contract.address,
+				Standard:  contract.standard,
+				Layout:    contract.ledger.Layout,
+				Height:    block.Height,
+			}
+			if err := tx.Create(ledger).Error; err != nil {
+				return fmt.Errorf("creating token ledger %s %d: %v", contract.address, v.Id, err)
+			}
+			idx.cacheLedger(v.Id, ledger)
+
+		case micheline.BigMapDiffActionCopy:
+			if ledger, err := idx.lookupLedger(v.SourceId, tx); err != nil {
+				return err
+			} else if ledger != nil && v.DestId >= 0 {
+				log.Warnf("Token ledger %d of %s copied to bigmap %d, balances of the copy are not indexed.",
+					v.SourceId, ledger.Contract, v.DestId)
+			}
+
+		case micheline.BigMapDiffActionUpdate, micheline.BigMapDiffActionRemove:
+			ledger, err := idx.lookupLedger(v.Id, tx)
+			if err != nil {
+				return err
+			}
+			if ledger == nil {
+				continue
+			}
+			bal, err := ledger.Layout.DecodeBalance(v)
+			if err != nil {
+				log.Warnf("Skipping token ledger %d update op [%d:%d] %s: %v", v.Id, op.OpN, op.OpC, ledger.Contract, err)
+				continue
+			}
+			token, err := idx.getToken(block, ledger.AccountId, contract, bal.TokenId.Text(10), tokens, tx)
+			if err != nil {
+				return err
+			}
+			if ledger.Layout == micheline.LedgerLayoutNFT {
+				// a single owner per token, the previous owner is not part
+				// of the diff
+				if err := idx.clearBalances(token, bal.Holder, block.Height, op.RowId, tx); err != nil {
+					return err
+				}
+				if !bal.Holder.IsValid() {
+					continue
+				}
+			}
+			err = idx.setBalance(token, bal.Holder.String(), bal.Balance.Text(10), block.Height, op.RowId, tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (idx *TokenIndex) DisconnectBlock(ctx context.Context, block *models.Block, _ models.BlockBuilder, tx *gorm.DB) error {
+	return idx.DeleteBlock(ctx, block.Height, tx)
+}
+
+// DeleteBlock restores balances changed at height and removes transfers,
+// balances, ledgers and tokens first seen at height.
+func (idx *TokenIndex) DeleteBlock(ctx context.Context, height int64, tx *gorm.DB) error {
+	log.Debugf("Rollback deleting token updates at height %d", height)
+	var updates []*models.TokenBalanceUpdate
+	if err := tx.Where("height = ?", height).Order("row_id desc").Find(&updates).Error; err != nil {
+		return err
+	}
+	for _, u := range updates {
+		err := tx.Model(&models.TokenBalance{}).
+			Where("token_row_id = ? and holder = ?", u.TokenRowId, u.Holder).
+			Updates(map[string]interface{}{"balance": u.Prev, "updated": u.PrevHeight}).Error
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range []interface{}{
+		&models.TokenBalanceUpdate{},
+		&models.TokenBalance{},
+		&models.TokenTransfer{},
+		&models.TokenLedger{},
+		&models.Token{},
+	} {
+		if err := tx.Where("height = ?", height).Delete(m).Error; err != nil {
+			return err
+		}
+	}
+	// contracts and bigmaps allocated at height may be gone
+	idx.contracts = make(map[models.AccountID]*tokenContract)
+	idx.ledgers = make(map[int64]*models.TokenLedger)
+	return nil
+}
+
+// Init detects token ledgers of contracts originated before the index was
+// enabled and loads holder balances from their stored bigmaps. Balances
+// can only be backfilled when the bigmap index is enabled. The scan runs
+// once per database.
+func (idx *TokenIndex) Init(ctx context.Context, tx *gorm.DB) error {
+	err := tx.Where("`key` = ?", tokenBackfillKey).First(&models.HarvesterStatus{}).Error
+	if err != gorm.ErrRecordNotFound {
+		return err
+	}
+	best := &models.Block{}
+	err = tx.Select("height").Where("is_orphan = ?", false).Order("height desc").First(best).Error
+	switch err {
+	case nil:
+		if err := idx.backfill(ctx, tx); err != nil {
+			return err
+		}
+	case gorm.ErrRecordNotFound:
+		// new database, all contracts are seen by ConnectBlock
+		best.Height = -1
+	default:
+		return err
+	}
+	return models.UpdateHarvesterStatus(tx, tokenBackfillKey, strconv.FormatInt(best.Height, 10))
+}
+
+// backfill scans all stored contracts for token ledgers.
+func (idx *TokenIndex) backfill(ctx context.Context, tx *gorm.DB) error {
+	var (
+		last              uint64
+		ntokens, nledgers int
+	)
+	for {
+		if util.InterruptRequested(ctx) {
+			return ctx.Err()
+		}
+		var contracts []*models.Contract
+		err := tx.Where("row_id > ?", last).Order("row_id asc").Limit(tokenBackfillBatch).Find(&contracts).Error
+		if err != nil {
+			return err
+		}
+		if len(contracts) == 0 {
+			break
+		}
+		for _, cc := range contracts {
+			last = cc.RowId
+			c := detectContract(cc)
+			if !c.standard.IsValid() {
+				continue
+			}
+			ntokens++
+			n, err := idx.backfillLedgers(cc, c, tx)
+			if err != nil {
+				return err
+			}
+			nledgers += n
+		}
+	}
+	log.Infof("Backfilled %d token ledgers of %d token contracts.", nledgers, ntokens)
+	return nil
+}
+
+// backfillLedgers registers ledger bigmaps allocated by contract and sets
+// holder balances from their live keys. Ledgers already indexed are skipped.
+func (idx *TokenIndex) backfillLedgers(cc *models.Contract, contract *tokenContract, tx *gorm.DB) (int, error) {
+	if contract.ledger.KeyType == nil {
+		return 0, nil
+	}
+	var allocs []*models.BigMapItem
+	err := tx.Where("account_id = ? and action = ? and bigmap_id >= ?", cc.AccountId.Value(), micheline.BigMapDiffActionAlloc, 0).
+		Order("row_id asc").
+		Find(&allocs).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(allocs) == 0 {
+		log.Warnf("Token ledger of %s not backfilled, bigmaps are not indexed.", contract.address)
+		return 0, nil
+	}
+	var n int
+	for _, a := range allocs {
+		alloc := a.BigMapDiff()
+		if !contract.ledger.Matches(alloc.KeyType, alloc.ValueType) {
+			continue
+		}
+		if ledger, err := idx.lookupLedger(a.BigMapId, tx); err != nil {
+			return n, err
+		} else if ledger != nil {
+			continue
+		}
+		ledger := &models.TokenLedger{
+			BigMapId:  a.BigMapId,
+			AccountId: cc.AccountId,
+			Contract:  contract.address,
+			Standard:  contract.standard,
+			Layout:    contract.ledger.Layout,
+			Height:    a.Height,
+		}
+		if err := tx.Create(ledger).Error; err != nil {
+			return n, fmt.Errorf("creating token ledger %s %d: %v", contract.address, a.BigMapId, err)
+		}
+		idx.cacheLedger(a.BigMapId, ledger)
+		n++
+
+		var items []*models.BigMapItem
+		err := tx.Where("bigmap_id = ? and action = ? and is_replaced = ? and is_deleted = ?",
+			a.BigMapId, micheline.BigMapDiffActionUpdate, false, false).
+			Order("row_id asc").
+			Find(&items).Error
+		if err != nil {
+			return n, err
+		}
+		tokens := make(map[tokenKey]*models.Token)
+		for _, item := range items {
+			bal, err := ledger.Layout.DecodeBalance(item.BigMapDiff())
+			if err != nil {
+				log.Warnf("Skipping token ledger %d key %x %s: %v", a.BigMapId, item.KeyHash, ledger.Contract, err)
+				continue
+			}
+			if !bal.Holder.IsValid() {
+				continue
+			}
+			// balances keep the height of the last ledger update
+			block := &models.Block{Height: item.Height, Timestamp: item.Timestamp}
+			token, err := idx.getToken(block, cc.AccountId, contract, bal.TokenId.Text(10), tokens, tx)
+			if err != nil {
+				return n, err
+			}
+			err = idx.setBalance(token, bal.Holder.String(), bal.Balance.Text(10), item.Height, item.OpId, tx)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// lookupContract returns the detected token standard, entrypoints and ledger
+// of a called contract. Results are cached, including non-token contracts.
+func (idx *TokenIndex) lookupContract(id models.AccountID, builder models.BlockBuilder, tx *gorm.DB) (*tokenContract, error) {
+	if c, ok := idx.contracts[id]; ok {
+		return c, nil
+	}
+	contract, ok := builder.ContractByAccountId(id)
+	if !ok {
+		contract = &models.Contract{}
+		err := tx.Where("account_id = ?", id.Value()).First(contract).Error
+		if err == gorm.ErrRecordNotFound {
+			// not cached, the contract may be originated later in this block
+			return &tokenContract{}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("loading contract account %d: %v", id, err)
+		}
+	}
+	c := detectContract(contract)
+	if len(idx.contracts) >= TokenCacheSize {
+		idx.contracts = make(map[models.AccountID]*tokenContract)
+	}
+	idx.contracts[id] = c
+	return c, nil
+}
+
+// detectContract returns the token standard, entrypoints and ledger of a
+// contract from its script.
+func detectContract(contract *models.Contract) *tokenContract {
+	c := &tokenContract{address: contract.String()}
+	if len(contract.Script) == 0 {
+		return c
+	}
+	script := micheline.NewScript()
+	if err := script.UnmarshalBinary(contract.Script); err != nil {
+		log.Warnf("Decoding script for contract %s: %v", c.address, err)
+		return c
+	}
+	eps, err := script.Entrypoints(false)
+	if err != nil {
+		log.Warnf("Decoding entrypoints for contract %s: %v", c.address, err)
+		return c
+	}
+	c.standard = eps.TokenStandard()
+	c.eps = eps
+	c.ledger, _ = script.Ledger()
+	return c
+}
+
+// lookupLedger returns the token ledger stored in bigmap id or nil when the
+// bigmap is not a ledger.
+func (idx *TokenIndex) lookupLedger(id int64, tx *gorm.DB) (*models.TokenLedger, error) {
+	if l, ok := idx.ledgers[id]; ok {
+		return l, nil
+	}
+	ledger := &models.TokenLedger{}
+	err := tx.Where("bigmap_id = ?", id).First(ledger).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		ledger = nil
+	default:
+		return nil, err
+	}
+	idx.cacheLedger(id, ledger)
+	return ledger, nil
+}
+
+// cacheLedger caches the ledger stored in bigmap id, nil for other bigmaps.
+func (idx *TokenIndex) cacheLedger(id int64, ledger *models.TokenLedger) {
+	if len(idx.ledgers) >= TokenCacheSize {
+		idx.ledgers = make(map[int64]*models.TokenLedger)
+	}
+	idx.ledgers[id] = ledger
+}
+
+// getToken loads or creates the token row of a contract and token id.
+func (idx *TokenIndex) getToken(block *models.Block, id models.AccountID, contract *tokenContract, tokenId string, tokens map[tokenKey]*models.Token, tx *gorm.DB) (*models.Token, error) {
+	key := tokenKey{id, tokenId}
+	if token, ok := tokens[key]; ok {
+		return token, nil
+	}
+	token := &models.Token{}
+	err := tx.Where("account_id = ? and token_id = ?", id.Value(), tokenId).First(token).Error
+	if err == gorm.ErrRecordNotFound {
+		token = &models.Token{
+			AccountId: id,
+			Contract:  contract.address,
+			Standard:  contract.standard,
+			TokenId:   tokenId,
+			Height:    block.Height,
+			Timestamp: block.Timestamp,
+		}
+		if err := tx.Create(token).Error; err != nil {
+			return nil, fmt.Errorf("creating token %s %s: %v", contract.address, tokenId, err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	tokens[key] = token
+	return token, nil
+}
+
+// setBalance stores the ledger balance of holder and records the change.
+func (idx *TokenIndex) setBalance(token *models.Token, holder, balance string, height int64, opId models.OpID, tx *gorm.DB) error {
+	bal := &models.TokenBalance{}
+	err := tx.Where("token_row_id = ? and holder = ?", token.RowId, holder).First(bal).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	if bal.RowId > 0 && bal.Balance == balance {
+		return nil
+	}
+	upd := &models.TokenBalanceUpdate{
+		TokenRowId: token.RowId,
+		OpId:       opId,
+		Height:     height,
+		Holder:     holder,
+		Balance:    balance,
+		Prev:       bal.Balance,
+		PrevHeight: bal.Updated,
+	}
+	if err := tx.Create(upd).Error; err != nil {
+		return err
+	}
+	if bal.RowId == 0 {
+		bal = &models.TokenBalance{
+			TokenRowId: token.RowId,
+			Holder:     holder,
+			Balance:    balance,
+			Height:     height,
+			Updated:    height,
+		}
+		return tx.Create(bal).Error
+	}
+	return tx.Model(bal).Updates(map[string]interface{}{"balance": balance, "updated": height}).Error
+}
+
+// clearBalances sets all non-zero balances of token to zero except the one
+// of owner.
+func (idx *TokenIndex) clearBalances(token *models.Token, owner chain.Address, height int64, opId models.OpID, tx *gorm.DB) error {
+	var bals []*models.TokenBalance
+	if err := tx.Where("token_row_id = ? and balance <> ?", token.RowId, "0").Find(&bals).Error; err != nil {
+		return err
+	}
+	for _, b := range bals {
+		if owner.IsValid() && b.Holder == owner.String() {
+			continue
+		}
+		if err := idx.setBalance(token, b.Holder, "0", height, opId, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenCall returns the called entrypoint and its unwrapped value. Calls to
+// the default entrypoint are resolved from the Left/Right branch.
+func tokenCall(p *micheline.Parameters, eps micheline.Entrypoints) (string, *micheline.Prim) {
+	if p.Entrypoint != "" && p.Entrypoint != "default" {
+		return p.Entrypoint, p.Value
+	}
+	branch := p.Branch(eps)
+	for name, ep := range eps {
+		if ep.Branch == branch {
+			return name, p.Unwrap(eps)
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,342 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+	"time"
+)
+
+const fa12Script = `{"code":[
+{"prim":"parameter","args":[{"prim":"or","args":[
+  {"prim":"pair","args":[{"prim":"address"},{"prim":"pair","args":[{"prim":"address"},{"prim":"nat"}]}],"annots":["%%transfer"]},
+  {"prim":"pair","args":[{"prim":"address"},{"prim":"nat"}],"annots":["%%approve"]}]}]},
+{"prim":"storage","args":[{"prim":"pair","args":[
+  {"prim":"big_map","args":[%s],"annots":["%%ledger"]},
+  {"prim":"big_map","args":[{"prim":"string"},{"prim":"bytes"}],"annots":["%%metadata"]}]}]},
+{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],
+"storage":{"prim":"Pair","args":[[],[]]}}`
+
+const fa2Script = `{"code":[
+{"prim":"parameter","args":[{"prim":"or","args":[
+  {"prim":"list","args":[{"prim":"pair","args":[{"prim":"address"},{"prim":"list","args":[
+    {"prim":"pair","args":[{"prim":"address"},{"prim":"pair","args":[{"prim":"nat"},{"prim":"nat"}]}]}]}]}],"annots":["%%transfer"]},
+  {"prim":"list","args":[{"prim":"address"}],"annots":["%%update_operators"]}]}]},
+{"prim":"storage","args":[{"prim":"big_map","args":[%s],"annots":["%%ledger"]}]},
+{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],
+"storage":[]}`
+
+const (
+	addressNat      = `{"prim":"address"},{"prim":"nat"}`
+	addressTokenNat = `{"prim":"pair","args":[{"prim":"address"},{"prim":"nat"}]},{"prim":"nat"}`
+	natAddress      = `{"prim":"nat"},{"prim":"address"}`
+)
+
+func newTokenTestContract(t *testing.T, id models.AccountID, script string) *models.Contract {
+	s := micheline.NewScript()
+	if err := json.Unmarshal([]byte(script), s); err != nil {
+		t.Fatal(err)
+	}
+	code, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.Contract{AccountId: id, Hash: bytes.Repeat([]byte{byte(id)}, 20), Script: code}
+}
+
+// tokenTestOp is a successful contract call or origination with optional
+// parameters and big_map diffs in JSON.
+type tokenTestOp struct {
+	typ      chain.OpType
+	receiver models.AccountID
+	params   string
+	diff     string
+}
+
+func tokenTestBlock(t *testing.T, height int64, ops ...tokenTestOp) *models.Block {
+	b := &models.Block{
+		Height:    height,
+		Timestamp: time.Unix(height*60, 0).UTC(),
+		TZ:        &models.Bundle{Block: &rpc.Block{Operations: [][]*rpc.OperationHeader{{}}}},
+	}
+	for i, v := range ops {
+		var diff micheline.BigMapDiff
+		if v.diff != "" {
+			if err := json.Unmarshal([]byte(v.diff), &diff); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var o rpc.Operation
+		switch v.typ {
+		case chain.OpTypeOrigination:
+			o = &rpc.OriginationOp{Metadata: &rpc.OriginationOpMetadata{
+				Result: &rpc.OriginationResult{BigMapDiff: diff},
+			}}
+		default:
+			var p *micheline.Parameters
+			if v.params != "" {
+				p = &micheline.Parameters{}
+				if err := json.Unmarshal([]byte(v.params), p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			o = &rpc.TransactionOp{Parameters: p, Metadata: &rpc.TransactionOpMetadata{
+				Result: &rpc.TransactionResult{BigMapDiff: diff},
+			}}
+		}
+		b.TZ.Block.Operations[0] = append(b.TZ.Block.Operations[0], &rpc.OperationHeader{Contents: rpc.Operations{o}})
+		b.Ops = append(b.Ops, &models.Op{
+			RowId:      models.OpID(height*10 + int64(i)),
+			Type:       v.typ,
+			OpN:        i,
+			Height:     height,
+			ReceiverId: v.receiver,
+			IsContract: true,
+			IsSuccess:  true,
+			HasData:    true,
+		})
+	}
+	return b
+}
+
+func tokenTestAddr(b byte) string {
+	return chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{b}, 20)).String()
+}
+
+// tokenTestBalances returns all balances keyed by token id and holder.
+func tokenTestBalances(t *testing.T, db *gorm.DB) map[string]string {
+	var bals []*models.TokenBalance
+	if err := db.Find(&bals).Error; err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]string)
+	for _, b := range bals {
+		token := &models.Token{}
+		if err := db.Where("row_id = ?", b.TokenRowId).First(token).Error; err != nil {
+			t.Fatal(err)
+		}
+		res[token.TokenId+":"+b.Holder] = b.Balance
+	}
+	return res
+}
+
+func TestTokenIndex_FA12Ledger(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	contract := newTokenTestContract(t, 1, fmt.Sprintf(fa12Script, addressNat))
+	builder := testBuilder{contracts: map[models.AccountID]*models.Contract{1: contract}}
+	alice, bob := tokenTestAddr(0xa), tokenTestAddr(0xb)
+
+	// origination allocates ledger and metadata, minting to alice
+	b1 := tokenTestBlock(t, 10, tokenTestOp{typ: chain.OpTypeOrigination, receiver: 1, diff: fmt.Sprintf(`[
+		{"action":"alloc","big_map":"5","key_type":{"prim":"address"},"value_type":{"prim":"nat"}},
+		{"action":"update","big_map":"5","key":{"string":"%s"},"value":{"int":"100"}},
+		{"action":"alloc","big_map":"6","key_type":{"prim":"string"},"value_type":{"prim":"bytes"}},
+		{"action":"update","big_map":"6","key":{"string":""},"value":{"bytes":"00"}}]`, alice)})
+	// default entrypoint call resolved from the Left branch
+	b2 := tokenTestBlock(t, 11, tokenTestOp{typ: chain.OpTypeTransaction, receiver: 1,
+		params: fmt.Sprintf(`{"entrypoint":"default","value":{"prim":"Left","args":[
+			{"prim":"Pair","args":[{"string":"%s"},{"prim":"Pair","args":[{"string":"%s"},{"int":"30"}]}]}]}}`, alice, bob),
+		diff: fmt.Sprintf(`[
+			{"action":"update","big_map":"5","key":{"string":"%s"},"value":{"int":"70"}},
+			{"action":"update","big_map":"5","key":{"string":"%s"},"value":{"int":"30"}}]`, alice, bob)})
+	// bob burns everything, the entry is removed
+	b3 := tokenTestBlock(t, 12, tokenTestOp{typ: chain.OpTypeTransaction, receiver: 1,
+		params: fmt.Sprintf(`{"entrypoint":"approve","value":{"prim":"Pair","args":[{"string":"%s"},{"int":"5"}]}}`, alice),
+		diff:   fmt.Sprintf(`[{"action":"remove","big_map":"5","key":{"string":"%s"}}]`, bob)})
+
+	idx := NewTokenIndex(db)
+	ctx := context.Background()
+	for _, b := range []*models.Block{b1, b2, b3} {
+		assert.NoError(t, idx.ConnectBlock(ctx, b, builder, db))
+	}
+
+	ledger := &models.TokenLedger{}
+	assert.NoError(t, db.First(ledger).Error)
+	assert.Equal(t, int64(5), ledger.BigMapId)
+	assert.Equal(t, micheline.LedgerLayoutAddress, ledger.Layout)
+	assert.Equal(t, micheline.TokenStandardFA12, ledger.Standard)
+	assert.Equal(t, map[string]string{"0:" + alice: "70", "0:" + bob: "0"}, tokenTestBalances(t, db))
+	var n int
+	assert.NoError(t, db.Model(&models.TokenTransfer{}).Count(&n).Error)
+	assert.Equal(t, 1, n)
+
+	// rollback restores balances and removes rows created at that height
+	assert.NoError(t, idx.DisconnectBlock(ctx, b3, builder, db))
+	assert.Equal(t, map[string]string{"0:" + alice: "70", "0:" + bob: "30"}, tokenTestBalances(t, db))
+	assert.NoError(t, idx.DisconnectBlock(ctx, b2, builder, db))
+	assert.Equal(t, map[string]string{"0:" + alice: "100"}, tokenTestBalances(t, db))
+	assert.NoError(t, db.Model(&models.TokenTransfer{}).Count(&n).Error)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, idx.DisconnectBlock(ctx, b1, builder, db))
+	for _, m := range []interface{}{&models.TokenBalance{}, &models.TokenBalanceUpdate{}, &models.TokenLedger{}, &models.Token{}} {
+		assert.NoError(t, db.Model(m).Count(&n).Error)
+		assert.Equal(t, 0, n)
+	}
+}
+
+func TestTokenIndex_FA2Ledger(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	contract := newTokenTestContract(t, 1, fmt.Sprintf(fa2Script, addressTokenNat))
+	builder := testBuilder{contracts: map[models.AccountID]*models.Contract{1: contract}}
+	alice, bob := tokenTestAddr(0xa), tokenTestAddr(0xb)
+	bobBytes, _ := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0xb}, 20)).MarshalBinary()
+
+	b1 := tokenTestBlock(t, 10, tokenTestOp{typ: chain.OpTypeOrigination, receiver: 1, diff: fmt.Sprintf(`[
+		{"action":"alloc","big_map":"7","key_type":{"prim":"pair","args":[{"prim":"address"},{"prim":"nat"}]},"value_type":{"prim":"nat"}},
+		{"action":"update","big_map":"7","key":{"prim":"Pair","args":[{"string":"%s"},{"int":"1"}]},"value":{"int":"5"}},
+		{"action":"update","big_map":"7","key":{"prim":"Pair","args":[{"bytes":"%x"},{"int":"2"}]},"value":{"int":"7"}}]`, alice, bobBytes)})
+	b2 := tokenTestBlock(t, 11, tokenTestOp{typ: chain.OpTypeTransaction, receiver: 1,
+		params: fmt.Sprintf(`{"entrypoint":"transfer","value":[{"prim":"Pair","args":[{"string":"%s"},[
+			{"prim":"Pair","args":[{"string":"%s"},{"prim":"Pair","args":[{"int":"1"},{"int":"2"}]}]}]]}]}`, alice, bob),
+		diff: fmt.Sprintf(`[
+			{"action":"update","big_map":"7","key":{"prim":"Pair","args":[{"string":"%s"},{"int":"1"}]},"value":{"int":"3"}},
+			{"action":"update","big_map":"7","key":{"prim":"Pair","args":[{"string":"%s"},{"int":"1"}]},"value":{"int":"2"}}]`, alice, bob)})
+
+	idx := NewTokenIndex(db)
+	ctx := context.Background()
+	assert.NoError(t, idx.ConnectBlock(ctx, b1, builder, db))
+	assert.NoError(t, idx.ConnectBlock(ctx, b2, builder, db))
+	assert.Equal(t, map[string]string{"1:" + alice: "3", "1:" + bob: "2", "2:" + bob: "7"}, tokenTestBalances(t, db))
+	var n int
+	assert.NoError(t, db.Model(&models.Token{}).Count(&n).Error)
+	assert.Equal(t, 2, n)
+
+	assert.NoError(t, idx.DisconnectBlock(ctx, b2, builder, db))
+	assert.Equal(t, map[string]string{"1:" + alice: "5", "2:" + bob: "7"}, tokenTestBalances(t, db))
+}
+
+func TestTokenIndex_NFTLedger(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	contract := newTokenTestContract(t, 1, fmt.Sprintf(fa2Script, natAddress))
+	builder := testBuilder{contracts: map[models.AccountID]*models.Contract{1: contract}}
+	alice, bob := tokenTestAddr(0xa), tokenTestAddr(0xb)
+
+	b1 := tokenTestBlock(t, 10, tokenTestOp{typ: chain.OpTypeOrigination, receiver: 1, diff: fmt.Sprintf(`[
+		{"action":"alloc","big_map":"8","key_type":{"prim":"nat"},"value_type":{"prim":"address"}},
+		{"action":"update","big_map":"8","key":{"int":"0"},"value":{"string":"%s"}}]`, alice)})
+	b2 := tokenTestBlock(t, 11, tokenTestOp{typ: chain.OpTypeTransaction, receiver: 1,
+		diff: fmt.Sprintf(`[{"action":"update","big_map":"8","key":{"int":"0"},"value":{"string":"%s"}}]`, bob)})
+	b3 := tokenTestBlock(t, 12, tokenTestOp{typ: chain.OpTypeTransaction, receiver: 1,
+		diff: `[{"action":"remove","big_map":"8","key":{"int":"0"}}]`})
+
+	idx := NewTokenIndex(db)
+	ctx := context.Background()
+	assert.NoError(t, idx.ConnectBlock(ctx, b1, builder, db))
+	assert.NoError(t, idx.ConnectBlock(ctx, b2, builder, db))
+	assert.Equal(t, map[string]string{"0:" + alice: "0", "0:" + bob: "1"}, tokenTestBalances(t, db))
+	assert.NoError(t, idx.ConnectBlock(ctx, b3, builder, db))
+	assert.Equal(t, map[string]string{"0:" + alice: "0", "0:" + bob: "0"}, tokenTestBalances(t, db))
+
+	assert.NoError(t, idx.DisconnectBlock(ctx, b3, builder, db))
+	assert.NoError(t, idx.DisconnectBlock(ctx, b2, builder, db))
+	assert.Equal(t, map[string]string{"0:" + alice: "1"}, tokenTestBalances(t, db))
+}
+
+func TestTokenIndex_Backfill(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	// a token contract and its bigmaps indexed before the token index
+	contract := newTokenTestContract(t, 1, fmt.Sprintf(fa12Script, addressNat))
+	assert.NoError(t, db.Create(contract).Error)
+	assert.NoError(t, db.Create(&models.Block{Height: 12}).Error)
+	alice, bob := tokenTestAddr(0xa), tokenTestAddr(0xb)
+	var diff micheline.BigMapDiff
+	err := json.Unmarshal([]byte(fmt.Sprintf(`[
+		{"action":"alloc","big_map":"5","key_type":{"prim":"address"},"value_type":{"prim":"nat"}},
+		{"action":"update","big_map":"5","key":{"string":"%s"},"value":{"int":"70"}},
+		{"action":"update","big_map":"5","key":{"string":"%s"},"value":{"int":"30"}},
+		{"action":"remove","big_map":"5","key":{"string":"%s"}},
+		{"action":"alloc","big_map":"6","key_type":{"prim":"string"},"value_type":{"prim":"bytes"}}]`, alice, bob, bob)), &diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range diff {
+		op := &models.Op{RowId: models.OpID(100 + i), Height: int64(10 + i)}
+		item := models.NewBigMapItem(op, contract, v, 0, micheline.T_ADDRESS, 0, 0)
+		// bob's update is removed later
+		item.IsReplaced = i == 2
+		assert.NoError(t, db.Create(item).Error)
+	}
+
+	idx := NewTokenIndex(db)
+	ctx := context.Background()
+	assert.NoError(t, idx.Init(ctx, db))
+	var ledgers []*models.TokenLedger
+	assert.NoError(t, db.Find(&ledgers).Error)
+	if assert.Len(t, ledgers, 1) {
+		assert.Equal(t, int64(5), ledgers[0].BigMapId)
+		assert.Equal(t, int64(10), ledgers[0].Height)
+	}
+	assert.Equal(t, map[string]string{"0:" + alice: "70"}, tokenTestBalances(t, db))
+
+	// the scan runs once
+	assert.NoError(t, db.Delete(&models.TokenLedger{}).Error)
+	assert.NoError(t, NewTokenIndex(db).Init(ctx, db))
+	var n int
+	assert.NoError(t, db.Model(&models.TokenLedger{}).Count(&n).Error)
+	assert.Equal(t, 0, n)
+}
+
+func TestDetectLedgerLayout(t *testing.T) {
+	prim := func(s string) *micheline.Prim {
+		p := &micheline.Prim{}
+		if err := json.Unmarshal([]byte(s), p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		key, value string
+		layout     micheline.LedgerLayout
+	}{
+		{`{"prim":"address"}`, `{"prim":"nat"}`, micheline.LedgerLayoutAddress},
+		{`{"prim":"address"}`, `{"prim":"pair","args":[{"prim":"map","args":[{"prim":"address"},{"prim":"nat"}]},{"prim":"nat"}]}`, micheline.LedgerLayoutAddressPair},
+		{`{"prim":"address"}`, `{"prim":"pair","args":[{"prim":"nat"},{"prim":"nat"}]}`, micheline.LedgerLayoutInvalid},
+		{`{"prim":"pair","args":[{"prim":"address"},{"prim":"nat"}]}`, `{"prim":"nat"}`, micheline.LedgerLayoutAddressToken},
+		{`{"prim":"pair","args":[{"prim":"nat"},{"prim":"address"}]}`, `{"prim":"nat"}`, micheline.LedgerLayoutTokenAddress},
+		{`{"prim":"nat"}`, `{"prim":"address"}`, micheline.LedgerLayoutNFT},
+		{`{"prim":"string"}`, `{"prim":"bytes"}`, micheline.LedgerLayoutInvalid},
+	}
+	for _, v := range tests {
+		assert.Equal(t, v.layout, micheline.DetectLedgerLayout(prim(v.key), prim(v.value)), v.key+" "+v.value)
+	}
+}
+
+func TestDecodeFA2Transfers(t *testing.T) {
+	from := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0xa}, 20))
+	to := chain.NewAddress(chain.AddressTypeContract, bytes.Repeat([]byte{0xb}, 20))
+	toBytes, _ := to.MarshalBinary()
+	p := &micheline.Prim{}
+	assert.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`[{"prim":"Pair","args":[{"string":"%s"},[
+		{"prim":"Pair","args":[{"bytes":"%x"},{"prim":"Pair","args":[{"int":"7"},{"int":"42"}]}]},
+		{"prim":"Pair","args":[{"string":"%s"},{"int":"8"},{"int":"1"}]}]]}]`, from, toBytes, from)), p))
+	res, err := micheline.DecodeTokenTransfers(micheline.TokenStandardFA2, p)
+	assert.NoError(t, err)
+	if assert.Len(t, res, 2) {
+		assert.True(t, res[0].From.IsEqual(from))
+		assert.True(t, res[0].To.IsEqual(to))
+		assert.Equal(t, "7", res[0].TokenId.String())
+		assert.Equal(t, "42", res[0].Amount.String())
+		assert.True(t, res[1].To.IsEqual(from))
+		assert.Equal(t, "8", res[1].TokenId.String())
+	}
+	_, err = micheline.DecodeTokenTransfers(micheline.TokenStandardFA12, p)
+	assert.Error(t, err)
+}
@@ -5,69 +5,93 @@ package puller
 
 import (
 	"context"
-	"github.com/go-redis/redis"
+	"fmt"
 	"github.com/jinzhu/gorm"
 	"github.com/zyjblockchain/sandy_log/log"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"tezos_index/chain"
 	. "tezos_index/puller/models"
+	"tezos_index/reporting"
 	util "tezos_index/utils"
+	"time"
 )
 
 type IndexerConfig struct {
-	StateDB *gorm.DB
-	CacheDB *redis.Client
-	Indexes []BlockIndexer
+	StateDB   *gorm.DB
+	CacheDB   CacheDB // optional cache mirroring chain state, e.g. redis
+	Indexes   []BlockIndexer
+	Publisher *Publisher // optional
+
+	// flag manager operations whose signature does not verify
+	VerifySignatures bool
 }
 
 // Indexer defines an index manager that manages and stores multiple indexes.
 type Indexer struct {
 	mu      sync.Mutex
 	times   atomic.Value
-	ranks   atomic.Value
 	dbpath  string
 	dbopts  interface{}
 	statedb *gorm.DB
-	cachedb *redis.Client
+	cachedb *StateDB
 	reg     *Registry
 	indexes []BlockIndexer
 	tips    map[string]*IndexTip
+	deps    []*chain.Params // deployments to store with the next block
+	pub     *Publisher
+
+	verifySigs bool
 }
 
 func NewIndexer(cfg IndexerConfig) *Indexer {
 	return &Indexer{
 		statedb: cfg.StateDB,
-		cachedb: cfg.CacheDB,
+		cachedb: NewStateDB(cfg.StateDB, cfg.CacheDB),
 		indexes: cfg.Indexes,
 		reg:     NewRegistry(),
 		tips:    make(map[string]*IndexTip),
+		pub:     cfg.Publisher,
+
+		verifySigs: cfg.VerifySignatures,
 	}
 }
 
+// HasIndex returns true when the index identified by key is enabled.
+func (m *Indexer) HasIndex(key string) bool {
+	for _, t := range m.indexes {
+		if t.Key() == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Indexer) Init(ctx context.Context, tip *ChainTip) error {
 	// Nothing to do when no indexes are enabled.
 	if len(m.indexes) == 0 {
 		return nil
 	}
 
-	// load tips
-	var needCreate bool
+	// load tips, indexes added to an existing database get a new tip
 	for _, t := range m.indexes {
-		// load index tip
 		key := t.Key()
-		tip, err := dbLoadIndexTip(m.cachedb, key)
+		itip, err := dbLoadIndexTip(m.cachedb, key)
 		if err == ErrNoTable {
-			needCreate = true
-			break
+			if itip, err = m.createIndexTip(key, tip); err != nil {
+				return err
+			}
 		} else if err != nil {
 			return err
-		} else {
-			m.tips[key] = tip
 		}
+		m.mu.Lock()
+		m.tips[key] = itip
+		m.mu.Unlock()
 	}
+
 	// load known protocol deployment parameters
-	if !needCreate {
+	if tip != nil {
 		deps, err := dbLoadDeployments(m.cachedb, tip)
 		if err != nil {
 			return err
@@ -77,19 +101,24 @@ func (m *Indexer) Init(ctx context.Context, tip *ChainTip) error {
 		}
 	}
 
-	// Create the initial state for the indexes as needed.
-	if needCreate {
-		// create buckets for index tips in the respecive databases
-		for _, t := range m.indexes {
-			if err := m.maybeCreateIndex(ctx, m.cachedb, t); err != nil {
-				return err
-			}
-			key := t.Key()
-			ttip, err := dbLoadIndexTip(m.cachedb, key)
-			if err != nil {
-				return err
-			}
-			m.tips[key] = ttip
+	for _, t := range m.indexes {
+		init, ok := t.(IndexInitializer)
+		if !ok {
+			continue
+		}
+		tx := m.statedb.Begin()
+		if err := init.Init(ctx, tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("init %s index: %v", t.Key(), err)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+
+	if m.pub != nil {
+		if err := m.pub.Init(m.statedb, m.cachedb, tip); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -102,87 +131,119 @@ func (m *Indexer) Close() error {
 			return err
 		}
 	}
+	if m.pub != nil {
+		if err := m.pub.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ConnectProtocol registers params for a new protocol deployment. Params are
+// stored together with the next connected block.
 func (m *Indexer) ConnectProtocol(ctx context.Context, params *chain.Params) error {
 	prev := m.reg.GetParamsLatest()
 	if prev != nil {
 		// update previous protocol end height
 		prev.EndHeight = params.StartHeight - 1
-		if err := dbStoreDeployment(m.cachedb, prev); err != nil {
-			return err
-		}
+		m.deps = append(m.deps, prev)
 	}
-	// save new params
-	if err := dbStoreDeployment(m.cachedb, params); err != nil {
-		return err
-	}
-
+	m.deps = append(m.deps, params)
 	return m.reg.Register(params)
 }
 
-func (m *Indexer) ConnectBlock(ctx context.Context, block *Block, builder BlockBuilder) error {
+// ConnectBlock adds block to all indexes. Index tips, the chain tip with block
+// as best block and new protocol deployments are written in the same
+// transaction, the chain tip's BestId is set from the block row id.
+func (m *Indexer) ConnectBlock(ctx context.Context, block *Block, builder BlockBuilder, tip *ChainTip) error {
 	// update block time when synchronized
 	if err := m.updateBlockTime(block); err != nil {
 		return err
 	}
 
-	var err error
+	var (
+		err    error
+		failed string // key of the failed index
+	)
+	txStart := time.Now()
 	tx := m.statedb.Begin()
 	for _, t := range m.indexes {
 		key := t.Key()
-		tip, ok := m.tips[string(key)]
+		itip, ok := m.tips[string(key)]
 		if !ok {
 			log.Errorf("missing tip for table %s", string(key))
 			continue
 		}
 
 		// skip when the block is already known
-		if tip.Hash != nil && tip.Hash.String() == block.Hash.String() {
+		if itip.Hash != nil && itip.Hash.String() == block.Hash.String() {
 			continue
 		}
 
+		start := time.Now()
 		err = t.ConnectBlock(ctx, block, builder, tx)
+		observeSince(metricConnect.WithLabelValues(key), start)
 		if err != nil {
+			failed = key
 			break
 		}
 	}
 
+	cHash, _ := chain.ParseBlockHash(block.Hash.String())
+	st := m.cachedb.Begin(tx)
+	if err == nil {
+		if tip != nil {
+			tip.BestId = block.RowId
+		}
+		err = m.storeState(st, block.Height, cHash, tip, m.deps)
+	}
+
 	// 获取indexer 的事务，统一处理connectBlock 中的tx, 保证写入操作一致
 	if err != nil {
 		tx.Rollback()
+		observeSince(metricDBTx.WithLabelValues("connect"), txStart)
+		tags := blockTags(block)
+		if failed != "" {
+			tags = tags.With(reporting.TagIndex, failed)
+		}
+		reporting.Error(err, tags)
 		return err
-	} else {
-		tx.Commit()
-		// 修改indexer 的tip
-		for _, t := range m.indexes {
-			key := t.Key()
-			tip, ok := m.tips[string(key)]
-			if !ok {
-				continue
-			}
-			// Update the current tip.
-			cHash, _ := chain.ParseBlockHash(block.Hash.String())
-			cloned := cHash.Clone()
-			tip.Hash = &cloned
-			tip.Height = block.Height
+	}
+	err = tx.Commit().Error
+	observeSince(metricDBTx.WithLabelValues("connect"), txStart)
+	if err != nil {
+		reporting.Error(err, blockTags(block))
+		return err
+	}
+	st.Commit()
+	metricBlocks.Inc()
+	m.deps = nil
+	// 修改indexer 的tip
+	m.setTips(block.Height, cHash)
+
+	// publish after commit; failed blocks are replayed on next connect
+	if m.pub != nil {
+		if err := m.pub.ConnectBlock(ctx, block, builder); err != nil {
+			log.Errorf("publishing block %d: %v", block.Height, err)
 		}
 	}
 	return nil
 }
 
-func (m *Indexer) DisconnectBlock(ctx context.Context, block *Block, builder BlockBuilder, ignoreErrors bool) error {
+// DisconnectBlock removes block from all indexes and stores index tips and
+// the chain tip, which must point to the parent block, in the same transaction.
+func (m *Indexer) DisconnectBlock(ctx context.Context, block *Block, builder BlockBuilder, tip *ChainTip, ignoreErrors bool) error {
 	var errs error
+	txStart := time.Now()
 	tx := m.statedb.Begin()
 	for _, t := range m.indexes {
 		key := t.Key()
-		tip, ok := m.tips[string(key)]
+		itip, ok := m.tips[string(key)]
 		if !ok {
 			log.Errorf("missing tip for table %s", string(key))
 			continue
 		}
-		if block.Height > 0 && (tip.Hash.String() != block.Hash.String()) {
+		if block.Height > 0 && (itip.Hash.String() != block.Hash.String()) {
 			continue
 		}
 		if err := t.DisconnectBlock(ctx, block, builder, tx); err != nil && !ignoreErrors {
@@ -191,23 +252,30 @@ func (m *Indexer) DisconnectBlock(ctx context.Context, block *Block, builder Blo
 		}
 	}
 
+	parent := block.TZ.Parent()
+	st := m.cachedb.Begin(tx)
+	if errs == nil {
+		errs = m.storeState(st, block.Height-1, parent, tip, nil)
+	}
+
 	// 获取indexer 的事务，统一处理connectBlock 中的tx, 保证写入操作一致
 	if errs != nil {
 		tx.Rollback()
+		observeSince(metricDBTx.WithLabelValues("disconnect"), txStart)
 		return errs
-	} else {
-		tx.Commit()
-		// 修改indexer 的tip
-		for _, t := range m.indexes {
-			key := t.Key()
-			tip, ok := m.tips[string(key)]
-			if !ok {
-				continue
-			}
-			// Update the current tip.
-			cloned := block.TZ.Parent().Clone()
-			tip.Hash = &cloned
-			tip.Height = block.Height - 1
+	}
+	err := tx.Commit().Error
+	observeSince(metricDBTx.WithLabelValues("disconnect"), txStart)
+	if err != nil {
+		return err
+	}
+	st.Commit()
+	// 修改indexer 的tip
+	m.setTips(block.Height-1, parent)
+
+	if m.pub != nil {
+		if err := m.pub.DisconnectBlock(ctx, block, builder); err != nil {
+			log.Errorf("publishing revert for block %d: %v", block.Height, err)
 		}
 	}
 	return nil
@@ -215,6 +283,7 @@ func (m *Indexer) DisconnectBlock(ctx context.Context, block *Block, builder Blo
 
 func (m *Indexer) DeleteBlock(ctx context.Context, tz *Bundle) error {
 	var errs error
+	txStart := time.Now()
 	tx := m.statedb.Begin()
 	for _, t := range m.indexes {
 		key := t.Key()
@@ -232,46 +301,145 @@ func (m *Indexer) DeleteBlock(ctx context.Context, tz *Bundle) error {
 		}
 	}
 
+	parent := tz.Parent()
+	st := m.cachedb.Begin(tx)
+	if errs == nil {
+		errs = m.storeState(st, tz.Height()-1, parent, nil, nil)
+	}
+
 	// 获取indexer 的事务，统一处理connectBlock 中的tx, 保证写入操作一致
 	if errs != nil {
 		tx.Rollback()
+		observeSince(metricDBTx.WithLabelValues("delete"), txStart)
 		return errs
-	} else {
-		tx.Commit()
-		// 修改indexer 的tip
-		for _, t := range m.indexes {
-			key := t.Key()
-			tip, ok := m.tips[string(key)]
-			if !ok {
-				continue
-			}
-			// Update the current tip.
-			cloned := tz.Parent().Clone()
-			tip.Hash = &cloned
-			tip.Height = tz.Height() - 1
-		}
 	}
+	err := tx.Commit().Error
+	observeSince(metricDBTx.WithLabelValues("delete"), txStart)
+	if err != nil {
+		return err
+	}
+	st.Commit()
+	// 修改indexer 的tip
+	m.setTips(tz.Height()-1, parent)
 	return nil
 }
 
-// maybeCreateIndex determines if each of the enabled index indexes has already
-// been created and creates them if not.
-func (m *Indexer) maybeCreateIndex(ctx context.Context, db *redis.Client, idx BlockIndexer) error {
-	// Nothing to do if the tip already exists.
-	key := idx.Key()
-	if err := db.Get(key).Err(); err != redis.Nil {
-		return nil
+// newOrphan copies a detached block. Blocks loaded from the database only
+// carry the baker id, so the baker address is resolved here.
+func (m *Indexer) newOrphan(ctx context.Context, b *Block) *OrphanBlock {
+	o := NewOrphanBlock(b)
+	if o.Baker != "" || o.BakerId == 0 {
+		return o
+	}
+	baker, err := m.LookupAccountId(ctx, o.BakerId)
+	if err != nil {
+		log.Warnf("Resolving baker %d of orphan block %d %s: %v", o.BakerId, o.Height, o.Hash, err)
+		return o
 	}
-	// start with zero hash on create (genesis is inserted next)
-	return dbStoreIndexTip(db, key, &IndexTip{
-		Hash:   nil,
-		Height: 0,
-	})
+	o.Baker = baker.String()
+	return o
+}
+
+// StoreReorg writes a reorg log entry and the blocks it orphaned.
+func (m *Indexer) StoreReorg(ctx context.Context, reorg *Reorg, orphans []*OrphanBlock) error {
+	tx := m.statedb.Begin()
+	if err := tx.Create(reorg).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, o := range orphans {
+		o.ReorgId = reorg.RowId
+		if err := tx.Create(o).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// storeState writes index tips at height and hash, the chain tip and
+// deployments when set and the integrity head to st.
+func (m *Indexer) storeState(st *TxState, height int64, hash chain.BlockHash, tip *ChainTip, deps []*chain.Params) error {
+	for _, t := range m.indexes {
+		cloned := hash.Clone()
+		itip := &IndexTip{Hash: &cloned, Height: height}
+		if prev, ok := m.tips[t.Key()]; ok {
+			itip.StartHeight = prev.StartHeight
+		}
+		if err := dbStoreIndexTip(st, t.Key(), itip); err != nil {
+			return err
+		}
+	}
+	for _, p := range deps {
+		if err := dbStoreDeployment(st, p); err != nil {
+			return err
+		}
+	}
+	if tip != nil {
+		if err := dbStoreChainTip(st, tip); err != nil {
+			return err
+		}
+	}
+	// update `INTEGRITY_HEAD` for table `harvester_status`
+	return UpdateHarvesterStatus(st.tx, IntegrityHead, strconv.FormatInt(height, 10))
+}
+
+// setTips moves all in-memory index tips to height and hash.
+func (m *Indexer) setTips(height int64, hash chain.BlockHash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.indexes {
+		tip, ok := m.tips[t.Key()]
+		if !ok {
+			continue
+		}
+		cloned := hash.Clone()
+		tip.Hash = &cloned
+		tip.Height = height
+	}
+}
+
+// Tips returns a copy of all index tips.
+func (m *Indexer) Tips() map[string]*IndexTip {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tips := make(map[string]*IndexTip, len(m.tips))
+	for k, v := range m.tips {
+		tip := *v
+		tips[k] = &tip
+	}
+	return tips
+}
+
+// createIndexTip stores the initial tip of an index. On a new database the
+// tip starts before genesis. An index added to an existing database starts
+// at the chain tip, blocks up to the tip are not indexed and StartHeight
+// records the first indexed block.
+func (m *Indexer) createIndexTip(key string, tip *ChainTip) (*IndexTip, error) {
+	itip := &IndexTip{}
+	if tip != nil && tip.BestHeight >= 0 {
+		hash := tip.BestHash.Clone()
+		itip.Hash = &hash
+		itip.Height = tip.BestHeight
+		itip.StartHeight = tip.BestHeight + 1
+		log.Warnf("Creating %s index at height %d, blocks before %d are not indexed.",
+			key, tip.BestHeight, itip.StartHeight)
+	}
+	if err := dbStoreIndexTip(m.cachedb, key, itip); err != nil {
+		return nil, err
+	}
+	return itip, nil
 }
 
 // Store idx tip
 func (m *Indexer) storeTip(key string) error {
+	m.mu.Lock()
 	tip, ok := m.tips[key]
+	if ok {
+		cp := *tip
+		tip = &cp
+	}
+	m.mu.Unlock()
 	if !ok {
 		return nil
 	}
@@ -0,0 +1,176 @@
+package puller
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	util "tezos_index/utils"
+)
+
+// verifyBatchSize is the number of blocks loaded from the database at once.
+const verifyBatchSize = 500
+
+// VerifyError describes an inconsistency found at a block height.
+type VerifyError struct {
+	Height int64  `json:"height"`
+	Reason string `json:"reason"`
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("block %d: %s", e.Height, e.Reason)
+}
+
+// CrawlerInfo is the stored chain state as shown by the info command.
+type CrawlerInfo struct {
+	Tip         *models.ChainTip     `json:"tip"`
+	Indexes     map[string]*IndexTip `json:"indexes"`
+	Deployments []*chain.Params      `json:"deployments"`
+}
+
+// Info returns chain tip, index tips and known protocol deployments. The
+// crawler must be initialized.
+func (c *Crawler) Info() CrawlerInfo {
+	return CrawlerInfo{
+		Tip:         c.Tip(),
+		Indexes:     c.indexer.Tips(),
+		Deployments: c.indexer.reg.GetAllParams(),
+	}
+}
+
+// Verify checks indexed blocks in [from, to] for gaps, duplicate heights,
+// broken parent links and hashes that differ from the node's main chain. A to height <= 0 is
+// relative to the current chain tip.
+func (c *Crawler) Verify(ctx context.Context, from, to int64) ([]VerifyError, error) {
+	tip := c.Tip()
+	if to <= 0 {
+		to = tip.BestHeight + to
+	}
+	from, to = util.Max64(from, 0), util.Min64(to, tip.BestHeight)
+	if from > to {
+		return nil, fmt.Errorf("invalid height range %d..%d", from, to)
+	}
+	log.Infof("Verifying blocks %d..%d.", from, to)
+
+	errs := make([]VerifyError, 0)
+	var parent *models.Block
+	if from > 0 {
+		parent, _ = c.indexer.BlockByHeight(ctx, from-1)
+	}
+	for start := from; start <= to; start += verifyBatchSize {
+		end := util.Min64(start+verifyBatchSize-1, to)
+		blocks := make([]*models.Block, 0, end-start+1)
+		err := c.db.Where("height >= ? AND height <= ? AND is_orphan = ?", start, end, false).
+			Order("height asc, row_id asc").
+			Find(&blocks).Error
+		if err != nil {
+			return errs, err
+		}
+		next := 0
+		for height := start; height <= end; height++ {
+			if util.InterruptRequested(ctx) {
+				return errs, ctx.Err()
+			}
+			if next >= len(blocks) || blocks[next].Height != height {
+				errs = append(errs, VerifyError{height, "missing block"})
+				parent = nil
+				continue
+			}
+			block := blocks[next]
+			next++
+			// skip duplicates so later heights stay in sync, the first
+			// row is checked against its parent and the node
+			for ; next < len(blocks) && blocks[next].Height == height; next++ {
+				errs = append(errs, VerifyError{height, fmt.Sprintf("duplicate block %s row %d, first is %s row %d",
+					blocks[next].Hash, blocks[next].RowId, block.Hash, block.RowId)})
+			}
+			if parent != nil && block.ParentId != parent.RowId {
+				errs = append(errs, VerifyError{height, fmt.Sprintf("parent id %d does not link to block %d", block.ParentId, parent.RowId)})
+			}
+			parent = block
+			if c.rpc == nil {
+				continue
+			}
+			head, err := c.rpc.GetBlockHeader(ctx, height)
+			if err != nil {
+				return errs, fmt.Errorf("fetching block %d: %v", height, err)
+			}
+			if head.Hash == nil || head.Hash.String() != block.Hash.String() {
+				errs = append(errs, VerifyError{height, fmt.Sprintf("hash %s is not on the main chain, node has %s", block.Hash, head.Hash)})
+			}
+		}
+		log.Infof("Verified blocks %d..%d, %d errors.", start, end, len(errs))
+	}
+	return errs, nil
+}
+
+// repairState checks chain and index tips against the highest indexed block
+// and resets mismatching tips to that block. State written by versions that
+// kept tips outside the block transaction may be ahead of or behind the
+// block table after a crash. Returns true when no block has been indexed.
+func (c *Crawler) repairState(ctx context.Context) (bool, error) {
+	best := &models.Block{}
+	err := c.db.Where("is_orphan = ?", false).Order("height desc").First(best).Error
+	if err == gorm.ErrRecordNotFound {
+		log.Warnf("Found chain tip at height %d without indexed blocks, starting from genesis.", c.tip.BestHeight)
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	hash, err := chain.ParseBlockHash(best.Hash.String())
+	if err != nil {
+		return false, err
+	}
+
+	cp := *c.Tip()
+	tip := &cp
+	repaired := tip.BestHeight != best.Height || !tip.BestHash.IsEqual(hash)
+	if repaired {
+		log.Warnf("Repairing chain tip %d %s, highest indexed block is %d %s.",
+			tip.BestHeight, tip.BestHash, best.Height, hash)
+		tip.BestHash = hash
+		tip.BestId = best.RowId
+		tip.BestHeight = best.Height
+		tip.BestTime = best.Timestamp
+		tip.NYEveBlocks = trimHeights(tip.NYEveBlocks, best.Height)
+		tip.QuarterBlocks = trimHeights(tip.QuarterBlocks, best.Height)
+	}
+	for key, t := range c.indexer.tips {
+		if t.Height == best.Height && t.Hash != nil && t.Hash.IsEqual(hash) {
+			continue
+		}
+		log.Warnf("Repairing %s index tip at height %d, highest indexed block is %d.", key, t.Height, best.Height)
+		repaired = true
+	}
+	if !repaired {
+		return false, nil
+	}
+
+	tx := c.db.Begin()
+	st := c.indexer.cachedb.Begin(tx)
+	if err := c.indexer.storeState(st, best.Height, hash, tip, nil); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+	st.Commit()
+	c.indexer.setTips(best.Height, hash)
+	c.Lock()
+	c.tip = tip
+	c.Unlock()
+	return false, nil
+}
+
+// trimHeights drops all heights above height.
+func trimHeights(heights []int64, height int64) []int64 {
+	for i, h := range heights {
+		if h > height {
+			return heights[:i]
+		}
+	}
+	return heights
+}
@@ -0,0 +1,169 @@
+package puller
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+)
+
+func TestCrawlerVerify(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+	ctx := context.Background()
+
+	errs, err := c.Verify(ctx, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, errs, 0)
+
+	err = db.Model(&models.Block{}).Where("height = ?", 0).
+		Update("hash", "BKiHLREqU3JkXfzEDYAkmmfX48gBDtYhMrpA98s7Aq4SzbUAB6M").Error
+	assert.NoError(t, err)
+	errs, err = c.Verify(ctx, 0, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, int64(0), errs[0].Height)
+	}
+
+	_, err = c.Verify(ctx, 5, 3)
+	assert.Error(t, err)
+
+	info := c.Info()
+	assert.Equal(t, int64(0), info.Tip.BestHeight)
+	assert.Len(t, info.Indexes, len(c.indexer.indexes))
+	assert.Len(t, info.Deployments, 1)
+}
+
+func TestCrawlerRepairState(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+
+	// chain state is written with the genesis block
+	var count int
+	assert.NoError(t, db.Model(&models.ChainState{}).Count(&count).Error)
+	assert.Equal(t, len(c.indexer.indexes)+2, count, "index tips, chain tip and deployment")
+
+	// move stored tips past the highest block
+	tip := *c.Tip()
+	tip.BestHeight = 5
+	assert.NoError(t, dbStoreChainTip(c.indexer.cachedb, &tip))
+	key := c.indexer.indexes[0].Key()
+	assert.NoError(t, dbStoreIndexTip(c.indexer.cachedb, key, &IndexTip{Height: 3}))
+
+	c = newTestCrawler(db, nil, 0)
+	if !assert.NoError(t, c.Init(context.Background(), MODE_INFO)) {
+		return
+	}
+	assert.Equal(t, int64(0), c.Tip().BestHeight)
+	assert.Equal(t, "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2", c.Tip().BestHash.String())
+	assert.Equal(t, int64(0), c.indexer.Tips()[key].Height)
+
+	stored, err := dbLoadChainTip(c.indexer.cachedb)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(0), stored.BestHeight)
+	}
+	itip, err := dbLoadIndexTip(c.indexer.cachedb, key)
+	if assert.NoError(t, err) && assert.NotNil(t, itip.Hash) {
+		assert.Equal(t, int64(0), itip.Height)
+		assert.Equal(t, tip.BestHash.String(), itip.Hash.String())
+	}
+}
+
+func TestCrawlerAddIndex(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	newGenesisCrawler(t, db, srv.URL)
+
+	// a database written before the token, balance and rank indexes existed
+	added := []string{index.TokenIndexKey, index.BalanceIndexKey, index.RankIndexKey}
+	assert.NoError(t, db.Where("`key` IN (?)", added).Delete(&models.ChainState{}).Error)
+
+	c := newTestCrawler(db, nil, 0)
+	if !assert.NoError(t, c.Init(context.Background(), MODE_INFO)) {
+		return
+	}
+	assert.NotNil(t, c.indexer.ParamsByHeight(-1), "deployments are loaded")
+	tips := c.indexer.Tips()
+	for _, key := range added {
+		itip, err := dbLoadIndexTip(c.indexer.cachedb, key)
+		if assert.NoError(t, err, key) && assert.NotNil(t, itip.Hash, key) {
+			assert.Equal(t, int64(0), itip.Height, key)
+			assert.Equal(t, int64(1), itip.StartHeight, key)
+			assert.Equal(t, c.Tip().BestHash.String(), itip.Hash.String(), key)
+		}
+		assert.Equal(t, int64(1), tips[key].StartHeight, key)
+	}
+	assert.Equal(t, int64(0), tips[index.AccountIndexKey].StartHeight)
+
+	// start heights survive tip updates
+	tx := db.Begin()
+	st := c.indexer.cachedb.Begin(tx)
+	assert.NoError(t, c.indexer.storeState(st, 0, c.Tip().BestHash, nil, nil))
+	assert.NoError(t, tx.Commit().Error)
+	itip, err := dbLoadIndexTip(c.indexer.cachedb, index.TokenIndexKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), itip.StartHeight)
+	}
+}
+
+func TestCrawlerVerifyDuplicate(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+	c.rpc = nil
+
+	genesis := &models.Block{}
+	if !assert.NoError(t, db.Where("height = ?", 0).First(genesis).Error) {
+		return
+	}
+	// drop the unique height constraint, databases written by earlier
+	// versions may contain duplicate heights
+	var table struct{ Sql string }
+	if !assert.NoError(t, db.Raw("SELECT sql FROM sqlite_master WHERE name = 'blocks'").Scan(&table).Error) {
+		return
+	}
+	for _, q := range []string{
+		"ALTER TABLE blocks RENAME TO blocks_unique",
+		strings.Replace(table.Sql, `"height" bigint UNIQUE`, `"height" bigint`, 1),
+		"INSERT INTO blocks SELECT * FROM blocks_unique",
+		"DROP TABLE blocks_unique",
+	} {
+		if !assert.NoError(t, db.Exec(q).Error, q) {
+			return
+		}
+	}
+	g := genesis.RowId
+	for _, b := range []*models.Block{
+		{RowId: g + 1, Height: 1, ParentId: g},
+		{RowId: g + 2, Height: 1, ParentId: g},
+		{RowId: g + 3, Height: 2, ParentId: g + 1},
+		{RowId: g + 4, Height: 3, ParentId: g + 3},
+	} {
+		b.Hash = chain.StrBHash(testBlockHash(b.Height).String())
+		if !assert.NoError(t, db.Create(b).Error) {
+			return
+		}
+	}
+	c.tip.BestHeight = 3
+
+	errs, err := c.Verify(context.Background(), 0, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, int64(1), errs[0].Height)
+		assert.Contains(t, errs[0].Reason, "duplicate block")
+	}
+}
@@ -0,0 +1,72 @@
+package puller
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KafkaProducer is a synchronous Producer that waits for acknowledgement of
+// all in-sync replicas before returning.
+type KafkaProducer struct {
+	mu      sync.Mutex
+	brokers []string
+	writers map[string]*kafka.Writer
+}
+
+// NewKafkaProducer creates a producer for a comma separated list of brokers.
+func NewKafkaProducer(brokers string) *KafkaProducer {
+	return &KafkaProducer{
+		brokers: strings.Split(brokers, ","),
+		writers: make(map[string]*kafka.Writer),
+	}
+}
+
+func (k *KafkaProducer) writer(topic string) *kafka.Writer {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w, ok := k.writers[topic]
+	if !ok {
+		w = &kafka.Writer{
+			Addr:         kafka.TCP(k.brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+		}
+		k.writers[topic] = w
+	}
+	return w
+}
+
+func (k *KafkaProducer) Produce(ctx context.Context, msgs []Message) error {
+	// group by topic, keeping message order within each topic
+	topics := make([]string, 0, 3)
+	byTopic := make(map[string][]kafka.Message)
+	for _, m := range msgs {
+		if _, ok := byTopic[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		byTopic[m.Topic] = append(byTopic[m.Topic], kafka.Message{Key: m.Key, Value: m.Value})
+	}
+	for _, topic := range topics {
+		if err := k.writer(topic).WriteMessages(ctx, byTopic[topic]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KafkaProducer) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var err error
+	for _, w := range k.writers {
+		if e := w.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package puller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"sync"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+	"time"
+)
+
+const defaultMempoolInterval = 5 * time.Second
+
+type MempoolConfig struct {
+	DB       *gorm.DB
+	Client   *rpc.Client
+	Interval time.Duration // poll interval, defaults to 5s
+	Height   func() int64  // indexed chain height used to expire ops, optional
+}
+
+// Mempool polls the node's pending operations and keeps track of them in the
+// pending op table until they are either included in a block (which is done
+// by the op index) or expire because their branch is too old.
+type Mempool struct {
+	db       *gorm.DB
+	rpc      *rpc.Client
+	interval time.Duration
+	height   func() int64
+
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMempool(cfg MempoolConfig) *Mempool {
+	m := &Mempool{
+		db:       cfg.DB,
+		rpc:      cfg.Client,
+		interval: cfg.Interval,
+		height:   cfg.Height,
+		quit:     make(chan struct{}),
+	}
+	if m.interval <= 0 {
+		m.interval = defaultMempoolInterval
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+func (m *Mempool) Start() {
+	log.Info("Starting mempool watcher.")
+	m.wg.Add(1)
+	go m.run()
+}
+
+func (m *Mempool) Stop() {
+	select {
+	case <-m.quit:
+		return
+	default:
+	}
+	log.Info("Stopping mempool watcher.")
+	close(m.quit)
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *Mempool) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		if err := m.poll(m.ctx); err != nil && m.ctx.Err() == nil {
+			log.Warnf("mempool: %v", err)
+		}
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll loads the current mempool and updates the pending op table.
+func (m *Mempool) poll(ctx context.Context) error {
+	head, err := m.rpc.GetTipHeader(ctx)
+	if err != nil {
+		return err
+	}
+	mem, err := m.rpc.GetMempoolPendingOperations(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	ops := make([]*models.PendingOp, 0, len(mem.Applied)+len(mem.Refused)+len(mem.BranchDelayed))
+	for _, oh := range mem.Applied {
+		ops = append(ops, newPendingOp(oh, nil, models.PendingStatusApplied, now))
+	}
+	for _, oh := range mem.Refused {
+		ops = append(ops, newPendingOp(&oh.OperationHeader, oh.Error, models.PendingStatusRefused, now))
+	}
+	for _, oh := range mem.BranchDelayed {
+		ops = append(ops, newPendingOp(&oh.OperationHeader, oh.Error, models.PendingStatusBranchDelayed, now))
+	}
+
+	height := head.Level
+	if m.height != nil {
+		height = m.height()
+	}
+	return m.store(ops, head.Level, height)
+}
+
+// store inserts ops seen for the first time, updates the mempool status of
+// known ops and drops all ops which expired before the indexed height.
+func (m *Mempool) store(ops []*models.PendingOp, headHeight, height int64) error {
+	tx := m.db.Begin()
+	added, dropped, err := m.update(tx, ops, headHeight, height)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	if added > 0 || dropped > 0 {
+		log.Debugf("mempool: %d new, %d dropped ops", added, dropped)
+	}
+	return nil
+}
+
+func (m *Mempool) update(tx *gorm.DB, ops []*models.PendingOp, headHeight, height int64) (int, int64, error) {
+	known := make(map[chain.StrOpHash]*models.PendingOp)
+	if len(ops) > 0 {
+		hashes := make([]string, len(ops))
+		for i, op := range ops {
+			hashes[i] = string(op.Hash)
+		}
+		rows := make([]*models.PendingOp, 0)
+		if err := tx.Where("hash IN (?)", hashes).Find(&rows).Error; err != nil {
+			return 0, 0, err
+		}
+		for _, row := range rows {
+			known[row.Hash] = row
+		}
+	}
+
+	var added int
+	for _, op := range ops {
+		row, ok := known[op.Hash]
+		if !ok {
+			op.ExpiryHeight = m.branchHeight(tx, op.Branch, headHeight) + chain.MaxBranchDepth
+			if err := tx.Create(op).Error; err != nil {
+				return 0, 0, err
+			}
+			known[op.Hash] = op
+			added++
+			continue
+		}
+		if row.State != models.PendingStatePending {
+			continue
+		}
+		err := tx.Model(&models.PendingOp{}).Where("row_id = ?", row.RowId).Updates(map[string]interface{}{
+			"status":    op.Status,
+			"errors":    op.Errors,
+			"last_seen": op.LastSeen,
+		}).Error
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	dropped, err := models.DropExpiredPendingOps(tx, height)
+	if err != nil {
+		return 0, 0, err
+	}
+	return added, dropped, nil
+}
+
+// branchHeight returns the height of an op's branch block. Branches that are
+// not indexed yet can't be higher than the current chain head.
+func (m *Mempool) branchHeight(tx *gorm.DB, branch chain.StrBHash, headHeight int64) int64 {
+	block := &models.Block{}
+	if err := tx.Select("height").Where("hash = ?", string(branch)).First(block).Error; err != nil {
+		return headHeight
+	}
+	return block.Height
+}
+
+func newPendingOp(oh *rpc.OperationHeader, errs rpc.Errors, status string, now time.Time) *models.PendingOp {
+	op := &models.PendingOp{
+		Hash:      chain.StrOpHash(oh.Hash.String()),
+		Branch:    chain.StrBHash(oh.Branch.String()),
+		Type:      chain.OpTypeInvalid,
+		Status:    status,
+		State:     models.PendingStatePending,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	if len(errs) > 0 {
+		buf, _ := json.Marshal(errs)
+		op.Errors = string(buf)
+	}
+	if len(oh.Contents) == 0 {
+		return op
+	}
+	op.Type = oh.Contents[0].OpKind()
+	switch o := oh.Contents[0].(type) {
+	case *rpc.TransactionOp:
+		op.Sender, op.Receiver = o.Source.String(), o.Destination.String()
+		op.Amount, op.Fee, op.Counter = o.Amount, o.Fee, o.Counter
+	case *rpc.RevelationOp:
+		op.Sender = o.Source.String()
+		op.Fee, op.Counter = o.Fee, o.Counter
+	case *rpc.DelegationOp:
+		op.Sender = o.Source.String()
+		if o.Delegate.IsValid() {
+			op.Receiver = o.Delegate.String()
+		}
+		op.Fee, op.Counter = o.Fee, o.Counter
+	case *rpc.OriginationOp:
+		op.Sender = o.Source.String()
+		op.Amount, op.Fee, op.Counter = o.Balance, o.Fee, o.Counter
+	}
+	// a reveal is usually followed by the op the user cares about
+	if op.Type == chain.OpTypeReveal && len(oh.Contents) > 1 {
+		if tx, ok := oh.Contents[1].(*rpc.TransactionOp); ok {
+			op.Type = tx.Kind
+			op.Receiver = tx.Destination.String()
+			op.Amount, op.Fee, op.Counter = tx.Amount, tx.Fee, tx.Counter
+		}
+	}
+	return op
+}
@@ -0,0 +1,195 @@
+package puller
+
+import (
+	"bytes"
+	"context"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+	"time"
+)
+
+func TestNewPendingOp(t *testing.T) {
+	src := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x11}, 20))
+	dst := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x22}, 20))
+	oh := &rpc.OperationHeader{
+		Hash:   chain.NewOperationHash(bytes.Repeat([]byte{0x33}, 32)),
+		Branch: chain.NewBlockHash(bytes.Repeat([]byte{0x44}, 32)),
+		Contents: rpc.Operations{
+			&rpc.RevelationOp{GenericOp: rpc.GenericOp{Kind: chain.OpTypeReveal}, Source: src, Fee: 1, Counter: 7},
+			&rpc.TransactionOp{GenericOp: rpc.GenericOp{Kind: chain.OpTypeTransaction}, Source: src, Destination: dst, Fee: 2, Amount: 100, Counter: 8},
+		},
+	}
+	now := time.Now().UTC()
+	errs := rpc.Errors{&rpc.GenericError{ID: "proto.counter_in_the_past", Kind: "temporary"}}
+
+	op := newPendingOp(oh, errs, models.PendingStatusRefused, now)
+	assert.Equal(t, oh.Hash.String(), string(op.Hash))
+	assert.Equal(t, oh.Branch.String(), string(op.Branch))
+	assert.Equal(t, chain.OpTypeTransaction, op.Type)
+	assert.Equal(t, src.String(), op.Sender)
+	assert.Equal(t, dst.String(), op.Receiver)
+	assert.Equal(t, int64(100), op.Amount)
+	assert.Equal(t, int64(8), op.Counter)
+	assert.Equal(t, models.PendingStatusRefused, op.Status)
+	assert.Equal(t, models.PendingStatePending, op.State)
+	assert.Equal(t, now, op.FirstSeen)
+	assert.Contains(t, op.Errors, "proto.counter_in_the_past")
+
+	oh.Contents = oh.Contents[:1]
+	op = newPendingOp(oh, nil, models.PendingStatusApplied, now)
+	assert.Equal(t, chain.OpTypeReveal, op.Type)
+	assert.Equal(t, "", op.Receiver)
+	assert.Equal(t, "", op.Errors)
+}
+
+func testPendingOp(hash, branch, status string) *models.PendingOp {
+	now := time.Now().UTC()
+	return &models.PendingOp{
+		Hash:      chain.StrOpHash(hash),
+		Branch:    chain.StrBHash(branch),
+		Type:      chain.OpTypeTransaction,
+		Status:    status,
+		State:     models.PendingStatePending,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+}
+
+func loadPendingOp(t *testing.T, db *gorm.DB, hash string) *models.PendingOp {
+	op := &models.PendingOp{}
+	if err := db.Where("hash = ?", hash).First(op).Error; err != nil {
+		t.Fatal(err)
+	}
+	return op
+}
+
+func TestMempoolStore(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	assert.NoError(t, db.Create(&models.Block{Height: 90, Hash: "BLbranch"}).Error)
+	m := NewMempool(MempoolConfig{DB: db})
+
+	// first sighting sets the expiry from the branch height, unknown
+	// branches expire relative to the chain head
+	assert.NoError(t, m.store([]*models.PendingOp{
+		testPendingOp("oo1", "BLbranch", models.PendingStatusApplied),
+		testPendingOp("oo2", "BLunknown", models.PendingStatusApplied),
+	}, 100, 100))
+	assert.Equal(t, int64(90+chain.MaxBranchDepth), loadPendingOp(t, db, "oo1").ExpiryHeight)
+	assert.Equal(t, int64(100+chain.MaxBranchDepth), loadPendingOp(t, db, "oo2").ExpiryHeight)
+
+	// later sightings update the mempool status of pending ops only
+	assert.NoError(t, db.Model(&models.PendingOp{}).Where("hash = ?", "oo2").Update("state", models.PendingStateIncluded).Error)
+	first := loadPendingOp(t, db, "oo1").FirstSeen
+	upd := []*models.PendingOp{
+		testPendingOp("oo1", "BLbranch", models.PendingStatusRefused),
+		testPendingOp("oo2", "BLunknown", models.PendingStatusRefused),
+	}
+	upd[0].Errors = `[{"id":"proto.counter_in_the_past"}]`
+	upd[0].LastSeen = upd[0].LastSeen.Add(time.Minute)
+	assert.NoError(t, m.store(upd, 101, 101))
+
+	op := loadPendingOp(t, db, "oo1")
+	assert.Equal(t, models.PendingStatusRefused, op.Status)
+	assert.Equal(t, models.PendingStatePending, op.State)
+	assert.Equal(t, upd[0].Errors, op.Errors)
+	assert.True(t, op.LastSeen.After(first))
+	assert.True(t, op.FirstSeen.Equal(first))
+	assert.Equal(t, int64(90+chain.MaxBranchDepth), op.ExpiryHeight)
+	assert.Equal(t, models.PendingStatusApplied, loadPendingOp(t, db, "oo2").Status)
+
+	var count int
+	assert.NoError(t, db.Model(&models.PendingOp{}).Count(&count).Error)
+	assert.Equal(t, 2, count)
+}
+
+func TestMempoolExpiry(t *testing.T) {
+	for _, v := range []struct {
+		Name   string
+		State  string
+		Height int64
+		Expect string
+	}{
+		{"before expiry", models.PendingStatePending, 100, models.PendingStatePending},
+		{"at expiry", models.PendingStatePending, 110, models.PendingStatePending},
+		{"after expiry", models.PendingStatePending, 111, models.PendingStateDropped},
+		{"included", models.PendingStateIncluded, 111, models.PendingStateIncluded},
+	} {
+		db := dbtest.Open(t)
+		op := testPendingOp("oo1", "BLbranch", models.PendingStatusApplied)
+		op.State, op.ExpiryHeight = v.State, 110
+		assert.NoError(t, db.Create(op).Error, v.Name)
+
+		// expiry uses the indexed height, not the chain head
+		m := NewMempool(MempoolConfig{DB: db})
+		assert.NoError(t, m.store(nil, v.Height+10, v.Height), v.Name)
+		assert.Equal(t, v.Expect, loadPendingOp(t, db, "oo1").State, v.Name)
+		db.Close()
+	}
+}
+
+func TestMempoolInclusion(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	for _, op := range []*models.PendingOp{
+		testPendingOp("oo1", "BLbranch", models.PendingStatusApplied),
+		testPendingOp("oo2", "BLbranch", models.PendingStatusApplied),
+		testPendingOp("oo3", "BLbranch", models.PendingStatusApplied),
+		testPendingOp("oo4", "BLbranch", models.PendingStatusApplied),
+	} {
+		assert.NoError(t, db.Create(op).Error)
+	}
+	// the mempool may drop ops against a head the index has not reached yet
+	assert.NoError(t, db.Model(&models.PendingOp{}).Where("hash = ?", "oo2").Update("state", models.PendingStateDropped).Error)
+
+	idx := index.NewOpIndex(db)
+	block := &models.Block{Height: 100, Ops: []*models.Op{
+		{Hash: "oo1", Type: chain.OpTypeTransaction},
+		{Hash: "oo2", Type: chain.OpTypeTransaction},
+		// internal and non-first ops of other groups don't resolve them
+		{Hash: "oo3", Type: chain.OpTypeTransaction, OpC: 1},
+		{Hash: "oo4", Type: chain.OpTypeTransaction, IsInternal: true},
+	}}
+	tx := db.Begin()
+	assert.NoError(t, idx.ConnectBlock(context.Background(), block, nil, tx))
+	assert.NoError(t, tx.Commit().Error)
+
+	for _, v := range []struct {
+		Hash     string
+		State    string
+		Included int64
+	}{
+		{"oo1", models.PendingStateIncluded, 100},
+		{"oo2", models.PendingStateIncluded, 100},
+		{"oo3", models.PendingStatePending, 0},
+		{"oo4", models.PendingStatePending, 0},
+	} {
+		op := loadPendingOp(t, db, v.Hash)
+		assert.Equal(t, v.State, op.State, v.Hash)
+		assert.Equal(t, v.Included, op.IncludedHeight, v.Hash)
+	}
+
+	// a reorg returns included ops to the pending state
+	tx = db.Begin()
+	assert.NoError(t, idx.DisconnectBlock(context.Background(), block, nil, tx))
+	assert.NoError(t, tx.Commit().Error)
+	for _, hash := range []string{"oo1", "oo2", "oo3", "oo4"} {
+		op := loadPendingOp(t, db, hash)
+		assert.Equal(t, models.PendingStatePending, op.State, hash)
+		assert.Equal(t, int64(0), op.IncludedHeight, hash)
+	}
+	var count int
+	assert.NoError(t, db.Model(&models.Op{}).Where("height = ?", 100).Count(&count).Error)
+	assert.Equal(t, 0, count)
+
+	// ops included at other heights stay included on rollback
+	assert.NoError(t, models.MarkPendingOpsIncluded(db, []string{"oo1"}, 99))
+	assert.NoError(t, idx.DeleteBlock(context.Background(), 100, db))
+	assert.Equal(t, models.PendingStateIncluded, loadPendingOp(t, db, "oo1").State)
+}
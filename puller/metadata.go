@@ -0,0 +1,318 @@
+package puller
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"tezos_index/puller/models"
+	"time"
+)
+
+const (
+	defaultMetadataInterval    = 10 * time.Second
+	defaultMetadataBatch       = 50
+	defaultMetadataMaxAttempts = 8
+	defaultMetadataBackoff     = time.Minute
+	maxMetadataBackoff         = 24 * time.Hour
+	maxMetadataSize            = 1 << 20
+	maxMetadataRedirects       = 3
+
+	DefaultIPFSGateway = "https://ipfs.io"
+)
+
+// MetadataFetcher loads off-chain metadata documents from ipfs:// and
+// http(s):// URIs.
+type MetadataFetcher interface {
+	Fetch(ctx context.Context, uri string) ([]byte, error)
+}
+
+// HTTPFetcher fetches metadata over HTTP, ipfs:// URIs are loaded through
+// an IPFS gateway. URIs are taken from chain data, so Client refuses to
+// connect to loopback, private and link-local addresses. GatewayClient is
+// used for the configured gateway only, which may run on a local node.
+type HTTPFetcher struct {
+	Client        *http.Client
+	GatewayClient *http.Client
+	Gateway       string
+}
+
+func NewHTTPFetcher(gateway string) *HTTPFetcher {
+	if gateway == "" {
+		gateway = DefaultIPFSGateway
+	}
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: dialPublicOnly,
+	}
+	return &HTTPFetcher{
+		Client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:               nil, // a proxy would dial on our behalf
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			CheckRedirect: checkMetadataRedirect,
+		},
+		GatewayClient: &http.Client{
+			Timeout:       30 * time.Second,
+			CheckRedirect: checkMetadataRedirect,
+		},
+		Gateway: strings.TrimSuffix(gateway, "/"),
+	}
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	client := f.Client
+	if strings.HasPrefix(uri, "ipfs://") {
+		uri = f.Gateway + "/ipfs/" + strings.TrimPrefix(uri, "ipfs://")
+		client = f.GatewayClient
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("fetching %s: unsupported scheme %q", uri, u.Scheme)
+	}
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", uri, resp.Status)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxMetadataSize {
+		return nil, fmt.Errorf("fetching %s: document exceeds %d bytes", uri, maxMetadataSize)
+	}
+	return buf, nil
+}
+
+func checkMetadataRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxMetadataRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxMetadataRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+// dialPublicOnly runs after name resolution, so it also catches hostnames
+// resolving to internal addresses.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{
+		"0.0.0.0/8",     // this network
+		"10.0.0.0/8",    // private
+		"100.64.0.0/10", // carrier-grade NAT
+		"172.16.0.0/12", // private
+		"192.168.0.0/16",
+		"198.18.0.0/15", // benchmarking
+		"fc00::/7",      // unique local
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+type MetadataResolverConfig struct {
+	DB          *gorm.DB
+	Fetcher     MetadataFetcher
+	Interval    time.Duration // poll interval, defaults to 10s
+	Batch       int           // max documents per poll, defaults to 50
+	MaxAttempts int           // fetch attempts before a row fails, defaults to 8
+	Backoff     time.Duration // first retry delay, doubled on every attempt, defaults to 1m
+}
+
+// MetadataResolver fetches metadata documents left pending by the metadata
+// index. Failed fetches are retried with exponential backoff until
+// MaxAttempts is reached.
+type MetadataResolver struct {
+	db          *gorm.DB
+	fetcher     MetadataFetcher
+	interval    time.Duration
+	batch       int
+	maxAttempts int
+	backoff     time.Duration
+
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMetadataResolver(cfg MetadataResolverConfig) *MetadataResolver {
+	r := &MetadataResolver{
+		db:          cfg.DB,
+		fetcher:     cfg.Fetcher,
+		interval:    cfg.Interval,
+		batch:       cfg.Batch,
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     cfg.Backoff,
+		quit:        make(chan struct{}),
+	}
+	if r.interval <= 0 {
+		r.interval = defaultMetadataInterval
+	}
+	if r.batch <= 0 {
+		r.batch = defaultMetadataBatch
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = defaultMetadataMaxAttempts
+	}
+	if r.backoff <= 0 {
+		r.backoff = defaultMetadataBackoff
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+func (r *MetadataResolver) Start() {
+	log.Info("Starting metadata resolver.")
+	r.wg.Add(1)
+	go r.run()
+}
+
+func (r *MetadataResolver) Stop() {
+	select {
+	case <-r.quit:
+		return
+	default:
+	}
+	log.Info("Stopping metadata resolver.")
+	close(r.quit)
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *MetadataResolver) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.poll(r.ctx, time.Now().UTC()); err != nil && r.ctx.Err() == nil {
+			log.Warnf("metadata: %v", err)
+		}
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches all pending documents due at now and returns the number of
+// rows it updated.
+func (r *MetadataResolver) poll(ctx context.Context, now time.Time) (int, error) {
+	rows := make([]*models.Metadata, 0)
+	err := r.db.Where("status = ? and next_retry <= ?", models.MetadataStatusPending, now).
+		Order("next_retry").
+		Limit(r.batch).
+		Find(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		uri := row.URI
+		buf, err := r.fetcher.Fetch(ctx, uri)
+		if err == nil {
+			err = row.SetContent(buf)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			row.Attempts++
+			row.Error = err.Error()
+			if row.Attempts >= r.maxAttempts {
+				row.Status = models.MetadataStatusFailed
+			} else {
+				row.NextRetry = now.Add(r.retryDelay(row.Attempts))
+			}
+		}
+		// skip rows the indexer changed while fetching
+		res := r.db.Model(&models.Metadata{}).
+			Where("row_id = ? and uri = ? and status = ?", row.RowId, uri, models.MetadataStatusPending).
+			Updates(map[string]interface{}{
+				"status":        row.Status,
+				"name":          row.Name,
+				"symbol":        row.Symbol,
+				"decimals":      row.Decimals,
+				"description":   row.Description,
+				"artifact_uri":  row.ArtifactURI,
+				"display_uri":   row.DisplayURI,
+				"thumbnail_uri": row.ThumbnailURI,
+				"content":       row.Content,
+				"attempts":      row.Attempts,
+				"next_retry":    row.NextRetry,
+				"error":         row.Error,
+			})
+		if res.Error != nil {
+			return n, res.Error
+		}
+		n += int(res.RowsAffected)
+	}
+	return n, nil
+}
+
+func (r *MetadataResolver) retryDelay(attempts int) time.Duration {
+	d := r.backoff
+	for i := 1; i < attempts && d < maxMetadataBackoff; i++ {
+		d *= 2
+	}
+	if d > maxMetadataBackoff {
+		d = maxMetadataBackoff
+	}
+	return d
+}
@@ -0,0 +1,169 @@
+package puller
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+	"time"
+)
+
+type testFetcher struct {
+	docs  map[string]string
+	calls int
+}
+
+func (f *testFetcher) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	f.calls++
+	if doc, ok := f.docs[uri]; ok {
+		return []byte(doc), nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestMetadataResolverRetry(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	now := time.Date(2021, 10, 23, 0, 0, 0, 0, time.UTC)
+	row := &models.Metadata{
+		Contract:  "KT1",
+		TokenId:   "0",
+		URI:       "ipfs://QmTest",
+		Symbol:    "TST",
+		Status:    models.MetadataStatusPending,
+		NextRetry: now,
+	}
+	assert.NoError(t, db.Create(row).Error)
+
+	f := &testFetcher{docs: make(map[string]string)}
+	r := NewMetadataResolver(MetadataResolverConfig{
+		DB:          db,
+		Fetcher:     f,
+		MaxAttempts: 3,
+		Backoff:     time.Minute,
+	})
+	load := func() *models.Metadata {
+		md := &models.Metadata{}
+		assert.NoError(t, db.First(md, row.RowId).Error)
+		return md
+	}
+
+	// failed fetches are retried with backoff
+	n, err := r.poll(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	md := load()
+	assert.Equal(t, models.MetadataStatusPending, md.Status)
+	assert.Equal(t, 1, md.Attempts)
+	assert.Equal(t, "not found", md.Error)
+	assert.True(t, md.NextRetry.Equal(now.Add(time.Minute)))
+
+	n, err = r.poll(context.Background(), now.Add(30*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, f.calls)
+
+	n, err = r.poll(context.Background(), now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	md = load()
+	assert.Equal(t, 2, md.Attempts)
+	assert.True(t, md.NextRetry.Equal(now.Add(3*time.Minute)))
+
+	// success keeps on-chain fields and clears the error
+	f.docs["ipfs://QmTest"] = `{"name":"Test","symbol":"XXX","decimals":"8","artifactUri":"ipfs://QmArt"}`
+	_, err = r.poll(context.Background(), now.Add(3*time.Minute))
+	assert.NoError(t, err)
+	md = load()
+	assert.Equal(t, models.MetadataStatusResolved, md.Status)
+	assert.Equal(t, "Test", md.Name)
+	assert.Equal(t, "TST", md.Symbol)
+	assert.Equal(t, 8, md.Decimals)
+	assert.Equal(t, "ipfs://QmArt", md.ArtifactURI)
+	assert.Equal(t, "", md.Error)
+
+	// retries are exhausted
+	row2 := &models.Metadata{URI: "https://example.com/missing", Status: models.MetadataStatusPending, NextRetry: now}
+	assert.NoError(t, db.Create(row2).Error)
+	for i := 0; i < 3; i++ {
+		_, err = r.poll(context.Background(), now.Add(24*time.Hour*time.Duration(i)))
+		assert.NoError(t, err)
+	}
+	md2 := &models.Metadata{}
+	assert.NoError(t, db.First(md2, row2.RowId).Error)
+	assert.Equal(t, models.MetadataStatusFailed, md2.Status)
+	assert.Equal(t, 3, md2.Attempts)
+}
+
+func TestHTTPFetcherPublicOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	f := NewHTTPFetcher(srv.URL)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for _, uri := range []string{
+		srv.URL,
+		"http://localhost:" + port,
+		"http://169.254.169.254/latest/meta-data/",
+		"file:///etc/passwd",
+	} {
+		_, err := f.Fetch(context.Background(), uri)
+		assert.Error(t, err, uri)
+	}
+	// the configured gateway is trusted
+	buf, err := f.Fetch(context.Background(), "ipfs://QmTest")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(buf))
+
+	for _, v := range []struct {
+		ip     string
+		public bool
+	}{
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+	} {
+		assert.Equal(t, v.public, isPublicIP(net.ParseIP(v.ip)), v.ip)
+	}
+}
+
+func TestHTTPFetcherRedirects(t *testing.T) {
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: "example.com"}}
+	via := make([]*http.Request, maxMetadataRedirects-1)
+	assert.NoError(t, checkMetadataRedirect(req, via))
+	assert.Error(t, checkMetadataRedirect(req, append(via, req)))
+	assert.Error(t, checkMetadataRedirect(&http.Request{URL: &url.URL{Scheme: "file"}}, nil))
+}
+
+func TestNewIndexesMetadata(t *testing.T) {
+	has := func(indexes []models.BlockIndexer, key string) bool {
+		for _, v := range indexes {
+			if v.Key() == key {
+				return true
+			}
+		}
+		return false
+	}
+	assert.False(t, has(NewIndexes(nil, true, false), index.MetadataIndexKey))
+	assert.False(t, has(NewIndexes(nil, false, true), index.MetadataIndexKey))
+	assert.True(t, has(NewIndexes(nil, true, true), index.MetadataIndexKey))
+}
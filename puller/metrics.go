@@ -0,0 +1,118 @@
+package puller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var allStates = []State{
+	STATE_LOADING,
+	STATE_CONNECTING,
+	STATE_STOPPING,
+	STATE_STOPPED,
+	STATE_WAITING,
+	STATE_SYNCHRONIZING,
+	STATE_SYNCHRONIZED,
+	STATE_FAILED,
+}
+
+var (
+	metricState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tezos_crawler_state",
+		Help: "Current crawler state, 1 for the active state.",
+	}, []string{"state"})
+	metricChainHeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tezos_chain_height",
+		Help: "Height of the RPC node head.",
+	})
+	metricIndexedHeight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tezos_indexed_height",
+		Help: "Height of the last indexed block.",
+	})
+	metricSyncLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tezos_sync_lag_blocks",
+		Help: "Blocks between RPC node head and last indexed block.",
+	})
+	metricMonitor = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tezos_crawler_monitor",
+		Help: "1 when new blocks come from the monitor stream, 0 while polling.",
+	})
+	metricQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tezos_crawler_queue_depth",
+		Help: "Blocks fetched and waiting to be indexed.",
+	})
+	metricBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tezos_blocks_connected_total",
+		Help: "Blocks connected to all indexes, rate() yields blocks per second.",
+	})
+	metricConnect = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tezos_index_connect_duration_seconds",
+		Help:    "Duration of ConnectBlock by index.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"index"})
+	metricDBTx = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tezos_db_tx_duration_seconds",
+		Help:    "Duration of database transactions from begin to commit or rollback.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+	metricReorgs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tezos_reorgs_total",
+		Help: "Chain reorganizations.",
+	})
+	metricReorgDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tezos_reorg_depth_blocks",
+		Help:    "Number of blocks orphaned by a reorganization.",
+		Buckets: []float64{1, 2, 3, 5, 10, 20, 50, 100},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricState,
+		metricChainHeight,
+		metricIndexedHeight,
+		metricSyncLag,
+		metricMonitor,
+		metricQueueDepth,
+		metricBlocks,
+		metricConnect,
+		metricDBTx,
+		metricReorgs,
+		metricReorgDepth,
+	)
+}
+
+// updateMetrics sets gauges from current crawler state, it runs before
+// each scrape.
+func (c *Crawler) updateMetrics() {
+	c.RLock()
+	state, tip, head := c.state, c.tip, c.bchead
+	monitor := c.useMonitor && c.monitorUp
+	c.RUnlock()
+	for _, s := range allStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		metricState.WithLabelValues(string(s)).Set(v)
+	}
+	if monitor {
+		metricMonitor.Set(1)
+	} else {
+		metricMonitor.Set(0)
+	}
+	metricQueueDepth.Set(float64(len(c.queue)))
+	if tip != nil {
+		metricIndexedHeight.Set(float64(tip.BestHeight))
+	}
+	if head != nil {
+		metricChainHeight.Set(float64(head.Level))
+	}
+	if tip != nil && head != nil {
+		metricSyncLag.Set(float64(head.Level - tip.BestHeight))
+	}
+}
+
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
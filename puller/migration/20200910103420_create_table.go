@@ -2,7 +2,6 @@ package migration
 
 import (
 	"database/sql"
-	"github.com/jinzhu/gorm"
 	"github.com/pressly/goose"
 	"tezos_index/puller/models"
 )
@@ -13,7 +12,7 @@ func init() {
 
 func Up20200910103420(tx *sql.Tx) error {
 	// This code is executed when the migration is applied.
-	db, err := gorm.Open("mysql", tx)
+	db, err := openDB(tx)
 	if err != nil {
 		return err
 	}
@@ -27,7 +26,7 @@ func Up20200910103420(tx *sql.Tx) error {
 
 func Down20200910103420(tx *sql.Tx) error {
 	// This code is executed when the migration is rolled back.
-	db, err := gorm.Open("mysql", tx)
+	db, err := openDB(tx)
 	if err != nil {
 		return err
 	}
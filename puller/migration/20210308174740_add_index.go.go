@@ -2,7 +2,6 @@ package migration
 
 import (
 	"database/sql"
-	"github.com/jinzhu/gorm"
 	"github.com/pressly/goose"
 	"tezos_index/puller/models"
 )
@@ -13,7 +12,7 @@ func init() {
 
 func Up20210308174740(tx *sql.Tx) error {
 	// This code is executed when the migration is applied.
-	db, err := gorm.Open("mysql", tx)
+	db, err := openDB(tx)
 	if err != nil {
 		return err
 	}
@@ -34,7 +33,7 @@ func Up20210308174740(tx *sql.Tx) error {
 
 func Down20210308174740(tx *sql.Tx) error {
 	// This code is executed when the migration is rolled back.
-	db, err := gorm.Open("mysql", tx)
+	db, err := openDB(tx)
 	if err != nil {
 		return err
 	}
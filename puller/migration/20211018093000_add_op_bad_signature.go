@@ -0,0 +1,34 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211018093000, Down20211018093000)
+}
+
+func Up20211018093000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	// adds the missing bad_signature column
+	return db.AutoMigrate(&models.Op{}).Error
+}
+
+func Down20211018093000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	// SQLite can't drop columns, the unused column is left in place
+	if models.IsSQLite(db) {
+		return nil
+	}
+	return db.Model(&models.Op{}).DropColumn("bad_signature").Error
+}
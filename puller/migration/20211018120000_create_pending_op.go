@@ -0,0 +1,29 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211018120000, Down20211018120000)
+}
+
+func Up20211018120000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.AutoMigrate(&models.PendingOp{}).Error
+}
+
+func Down20211018120000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.DropTableIfExists(&models.PendingOp{}).Error
+}
@@ -0,0 +1,29 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211020090000, Down20211020090000)
+}
+
+func Up20211020090000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.AutoMigrate(&models.Reorg{}, &models.OrphanBlock{}).Error
+}
+
+func Down20211020090000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.DropTableIfExists(&models.OrphanBlock{}, &models.Reorg{}).Error
+}
@@ -0,0 +1,34 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211021090000, Down20211021090000)
+}
+
+func Up20211021090000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	// adds the liquidity baking minted_subsidy column
+	return db.AutoMigrate(&models.Supply{}).Error
+}
+
+func Down20211021090000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	// SQLite can't drop columns, the unused column is left in place
+	if models.IsSQLite(db) {
+		return nil
+	}
+	return db.Model(&models.Supply{}).DropColumn("minted_subsidy").Error
+}
@@ -0,0 +1,41 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211022090000, Down20211022090000)
+}
+
+func Up20211022090000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.AutoMigrate(
+		&models.Token{},
+		&models.TokenLedger{},
+		&models.TokenBalance{},
+		&models.TokenBalanceUpdate{},
+		&models.TokenTransfer{},
+	).Error
+}
+
+func Down20211022090000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	return db.DropTableIfExists(
+		&models.TokenTransfer{},
+		&models.TokenBalanceUpdate{},
+		&models.TokenBalance{},
+		&models.TokenLedger{},
+		&models.Token{},
+	).Error
+}
@@ -0,0 +1,45 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211024090000, Down20211024090000)
+}
+
+func Up20211024090000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&models.BalanceCheckpoint{}).Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.BalanceCheckpoint{}).AddIndex("balance_cp_account_height_idx", "account_id", "height").Error; err != nil {
+		return err
+	}
+	// checkpoints sum flows by height range, history by account and height
+	if err := db.Model(&models.Flow{}).AddIndex("flow_height_idx", "height").Error; err != nil {
+		return err
+	}
+	return db.Model(&models.Flow{}).AddIndex("flow_account_height_idx", "account_id", "height").Error
+}
+
+func Down20211024090000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&models.Flow{}).RemoveIndex("flow_account_height_idx").Error; err != nil {
+		return err
+	}
+	if err := db.Model(&models.Flow{}).RemoveIndex("flow_height_idx").Error; err != nil {
+		return err
+	}
+	return db.DropTableIfExists(&models.BalanceCheckpoint{}).Error
+}
@@ -0,0 +1,36 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/pressly/goose"
+	"tezos_index/puller/models"
+)
+
+func init() {
+	goose.AddMigration(Up20211025090000, Down20211025090000)
+}
+
+func Up20211025090000(tx *sql.Tx) error {
+	// This code is executed when the migration is applied.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	// the rank index looks up transactions leaving the 24h window by time
+	if err := db.Model(&models.Op{}).AddIndex("op_time_idx", "time").Error; err != nil {
+		return err
+	}
+	return db.AutoMigrate(&models.AccountRank{}).Error
+}
+
+func Down20211025090000(tx *sql.Tx) error {
+	// This code is executed when the migration is rolled back.
+	db, err := openDB(tx)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(&models.Op{}).RemoveIndex("op_time_idx").Error; err != nil {
+		return err
+	}
+	return db.DropTableIfExists(&models.AccountRank{}).Error
+}
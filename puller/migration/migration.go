@@ -0,0 +1,25 @@
+package migration
+
+import (
+	"database/sql"
+	"github.com/jinzhu/gorm"
+	"github.com/pressly/goose"
+)
+
+// Dialect is the gorm dialect migrations open their transaction with, it is
+// set by Run.
+var Dialect = "mysql"
+
+// Run executes the goose command (up, down, down-to, ...) against db. Dialect
+// must name both a goose and a gorm dialect, i.e. mysql or sqlite3.
+func Run(db *sql.DB, dialect, command string, args ...string) error {
+	if err := goose.SetDialect(dialect); err != nil {
+		return err
+	}
+	Dialect = dialect
+	return goose.Run(command, db, ".", args...)
+}
+
+func openDB(tx *sql.Tx) (*gorm.DB, error) {
+	return gorm.Open(Dialect, tx)
+}
@@ -0,0 +1,18 @@
+package migration_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/migration"
+	"tezos_index/puller/models"
+)
+
+func TestMigrationRollback(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	assert.NoError(t, migration.Run(db.DB(), models.DialectSQLite, "down-to", "0"))
+	assert.False(t, db.HasTable(&models.Block{}))
+	assert.NoError(t, migration.Run(db.DB(), models.DialectSQLite, "up"))
+	assert.True(t, db.HasTable(&models.Block{}))
+}
@@ -302,7 +302,7 @@ func (a *Account) UpdateBalance(f *Flow) error {
 			a.TotalBurned += f.AmountOut
 		}
 		switch f.Operation {
-		case FlowTypeTransaction, FlowTypeOrigination, FlowTypeAirdrop:
+		case FlowTypeTransaction, FlowTypeOrigination, FlowTypeAirdrop, FlowTypeSubsidy:
 			// both transactions and originations can send funds
 			// count send/received only for non-fee and non-burn flows
 			if !f.IsBurned && !f.IsFee {
@@ -422,7 +422,7 @@ func (a *Account) RollbackBalance(f *Flow) error {
 			a.TotalBurned -= f.AmountOut
 		}
 		switch f.Operation {
-		case FlowTypeTransaction, FlowTypeOrigination, FlowTypeAirdrop:
+		case FlowTypeTransaction, FlowTypeOrigination, FlowTypeAirdrop, FlowTypeSubsidy:
 			a.TotalReceived -= f.AmountIn
 			a.TotalSent -= f.AmountOut
 			// FIXME: reverse generation update for in-flows lacks previous info
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"time"
+)
+
+// Balance is the balance of an account by category at a block height as
+// reconstructed from flows. Unclaimed (not activated) balances are not
+// covered by flows.
+type Balance struct {
+	AccountId      AccountID `json:"account_id"`
+	Height         int64     `json:"height"`
+	Timestamp      time.Time `json:"time"`
+	Spendable      int64     `json:"spendable"`
+	FrozenDeposits int64     `json:"frozen_deposits"`
+	FrozenRewards  int64     `json:"frozen_rewards"`
+	FrozenFees     int64     `json:"frozen_fees"`
+	Delegated      int64     `json:"delegated"`
+}
+
+// Add applies an aggregated in- and out-flow of category c.
+func (b *Balance) Add(c FlowCategory, in, out int64) {
+	switch c {
+	case FlowCategoryRewards:
+		b.FrozenRewards += in - out
+	case FlowCategoryDeposits:
+		b.FrozenDeposits += in - out
+	case FlowCategoryFees:
+		b.FrozenFees += in - out
+	case FlowCategoryBalance:
+		b.Spendable += in - out
+	case FlowCategoryDelegation:
+		b.Delegated += in - out
+	}
+}
+
+func (b Balance) Frozen() int64 {
+	return b.FrozenDeposits + b.FrozenRewards + b.FrozenFees
+}
+
+// Total is the own balance, i.e. spendable and frozen.
+func (b Balance) Total() int64 {
+	return b.Spendable + b.Frozen()
+}
+
+// BalanceCheckpoint stores an account balance at a checkpoint height so
+// balance queries only sum flows after the latest checkpoint.
+type BalanceCheckpoint struct {
+	RowId          uint64    `gorm:"primary_key;column:row_id"   json:"row_id"`
+	AccountId      AccountID `gorm:"column:account_id"   json:"account_id"`
+	Height         int64     `gorm:"column:height;index:balance_cp_height_idx"   json:"height"`
+	Spendable      int64     `gorm:"column:spendable"   json:"spendable"`
+	FrozenDeposits int64     `gorm:"column:frozen_deposits"   json:"frozen_deposits"`
+	FrozenRewards  int64     `gorm:"column:frozen_rewards"   json:"frozen_rewards"`
+	FrozenFees     int64     `gorm:"column:frozen_fees"   json:"frozen_fees"`
+	Delegated      int64     `gorm:"column:delegated"   json:"delegated"`
+}
+
+func NewBalanceCheckpoint(b *Balance) *BalanceCheckpoint {
+	return &BalanceCheckpoint{
+		AccountId:      b.AccountId,
+		Height:         b.Height,
+		Spendable:      b.Spendable,
+		FrozenDeposits: b.FrozenDeposits,
+		FrozenRewards:  b.FrozenRewards,
+		FrozenFees:     b.FrozenFees,
+		Delegated:      b.Delegated,
+	}
+}
+
+func (c BalanceCheckpoint) Balance() *Balance {
+	return &Balance{
+		AccountId:      c.AccountId,
+		Height:         c.Height,
+		Spendable:      c.Spendable,
+		FrozenDeposits: c.FrozenDeposits,
+		FrozenRewards:  c.FrozenRewards,
+		FrozenFees:     c.FrozenFees,
+		Delegated:      c.Delegated,
+	}
+}
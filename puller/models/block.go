@@ -85,6 +85,7 @@ type Block struct {
 	GasPrice            float64                `gorm:"column:gas_price"      json:"gas_price"`                                         // stats: gas price in tezos per unit gas
 	StorageSize         int64                  `gorm:"column:storage_size"      json:"storage_size"`                                   // stats: total new storage size allocated
 	TDD                 float64                `gorm:"column:days_destroyed"  json:"days_destroyed"`                                   // stats: token days destroyed (from last-in time to spend)
+	BadSignature        bool                   `gorm:"column:bad_signature"      json:"bad_signature"`                                 // internal: block header signature did not verify
 
 	// other tz or extracted/translated data for processing
 	TZ     *Bundle       `gorm:"-" json:"-"`
@@ -151,6 +152,7 @@ func UpdateBlock(b *Block, db *gorm.DB) error {
 	data["gas_price"] = b.GasPrice
 	data["storage_size"] = b.StorageSize
 	data["days_destroyed"] = b.TDD
+	data["bad_signature"] = b.BadSignature
 
 	return db.Model(&Block{}).Where("row_id = ?", b.RowId).Updates(data).Error
 }
@@ -232,7 +234,11 @@ func NewBlock(tz *Bundle, parent *Block) (*Block, error) {
 	return b, nil
 }
 
-func (b *Block) FetchRPC(ctx context.Context, c *rpc.Client) error {
+// ParamsFunc returns the chain params for a block fetched from the node.
+type ParamsFunc func(ctx context.Context, c *rpc.Client, block *rpc.Block) (*chain.Params, error)
+
+// FetchRPC loads the block's RPC bundle and resolves missing params.
+func (b *Block) FetchRPC(ctx context.Context, c *rpc.Client, params ParamsFunc) error {
 	bHash, _ := chain.ParseBlockHash(b.Hash.String())
 	if !bHash.IsValid() {
 		return fmt.Errorf("invalid block hash on block id %d", b.RowId)
@@ -248,20 +254,9 @@ func (b *Block) FetchRPC(ctx context.Context, c *rpc.Client) error {
 		}
 	}
 	if b.Params == nil {
-		// fetch params from chain
-		if b.Height > 0 {
-			cons, err := c.GetConstantsHeight(ctx, b.Height)
-			if err != nil {
-				return fmt.Errorf("block init: %v", err)
-			}
-			b.Params = cons.MapToChainParams()
-		} else {
-			b.Params = chain.NewParams()
+		if b.Params, err = params(ctx, c, b.TZ.Block); err != nil {
+			return err
 		}
-		b.Params = b.Params.
-			ForProtocol(b.TZ.Block.Protocol).
-			ForNetwork(b.TZ.Block.ChainId)
-		b.Params.Deployment = b.TZ.Block.Header.Proto
 	}
 	b.TZ.Params = b.Params
 	// start fetching more rights at cycle 2 (look-ahead is 5)
@@ -335,8 +330,10 @@ func (b *Block) BlockReward(p *chain.Params) int64 {
 		if op.Type != chain.OpTypeEndorsement {
 			continue
 		}
-		eop, _ := b.GetRPCOp(op.OpN, op.OpC)
-		nEndorsements += len(eop.(*rpc.EndorsementOp).Metadata.Slots)
+		o, _ := b.GetRPCOp(op.OpN, op.OpC)
+		if eop, ok := rpc.Endorsement(o); ok {
+			nEndorsements += len(eop.Metadata.Slots)
+		}
 	}
 
 	if p.Version == 5 {
@@ -420,6 +417,7 @@ func (b *Block) Reset() {
 	b.GasPrice = 0
 	b.StorageSize = 0
 	b.TDD = 0
+	b.BadSignature = false
 	b.TZ = nil
 	b.Params = nil
 	b.Chain = nil
@@ -519,9 +517,11 @@ func (b *Block) Update(accounts, delegates map[AccountID]*Account) {
 			b.NReveal++
 		case chain.OpTypeEndorsement:
 			b.NEndorsement++
-			eop, _ := b.GetRPCOp(op.OpN, op.OpC)
-			for _, v := range eop.(*rpc.EndorsementOp).Metadata.Slots {
-				slotsEndorsed |= 1 << uint(v)
+			o, _ := b.GetRPCOp(op.OpN, op.OpC)
+			if eop, ok := rpc.Endorsement(o); ok {
+				for _, v := range eop.Metadata.Slots {
+					slotsEndorsed |= 1 << uint(v)
+				}
 			}
 		case chain.OpTypeProposals:
 			b.NProposal++
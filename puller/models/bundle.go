@@ -15,6 +15,7 @@ type Bundle struct {
 	Baking    []rpc.BakingRight
 	Endorsing []rpc.EndorsingRight
 	Snapshot  *rpc.SnapshotIndex
+	RawHeader []byte // signed binary header, only fetched for signature checks
 }
 
 func (b *Bundle) Height() int64 {
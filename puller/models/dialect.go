@@ -0,0 +1,44 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"reflect"
+)
+
+// DialectSQLite is the gorm dialect used to run the index without a database
+// server, e.g. in tests. The sqlite3 driver must be imported by the caller.
+const DialectSQLite = "sqlite3"
+
+// IsSQLite returns true when db talks to a SQLite database.
+func IsSQLite(db *gorm.DB) bool {
+	return db.Dialect().GetName() == DialectSQLite
+}
+
+var sqliteBase gorm.Dialect
+
+func init() {
+	// SQLite index names are global to the database while our models reuse
+	// index names across tables (acc, hash, ...). Wrap the stock dialect so
+	// auto migration skips indexes whose name is already taken instead of
+	// failing. Skipped indexes only cost lookup speed, except for unique
+	// indexes which are not enforced on SQLite.
+	sqliteBase, _ = gorm.GetDialect(DialectSQLite)
+	gorm.RegisterDialect(DialectSQLite, &sqliteDialect{})
+}
+
+type sqliteDialect struct {
+	gorm.Dialect
+	db gorm.SQLCommon
+}
+
+func (s *sqliteDialect) SetDB(db gorm.SQLCommon) {
+	s.Dialect = reflect.New(reflect.TypeOf(sqliteBase).Elem()).Interface().(gorm.Dialect)
+	s.Dialect.SetDB(db)
+	s.db = db
+}
+
+func (s *sqliteDialect) HasIndex(tableName string, indexName string) bool {
+	var count int
+	s.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'index' AND name = ?", indexName).Scan(&count)
+	return count > 0
+}
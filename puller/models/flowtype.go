@@ -55,20 +55,23 @@ func (c FlowCategory) String() string {
 type FlowType int
 
 const (
-	FlowTypeActivation      FlowType = iota // 0
-	FlowTypeDenounciation                   // 1
-	FlowTypeTransaction                     // 2
-	FlowTypeOrigination                     // 3
-	FlowTypeDelegation                      // 4
-	FlowTypeReveal                          // 5
-	FlowTypeEndorsement                     // 6
-	FlowTypeBaking                          // 7
-	FlowTypeNonceRevelation                 // 8
-	FlowTypeInternal                        // 9 - used for unfreeze
-	FlowTypeVest                            // 10 - vests amount into same account (ready to spend)
-	FlowTypePour                            // 11 - pours vested amount into other account
-	FlowTypeInvoice                         // 12 - invoice feature
-	FlowTypeAirdrop                         // 13 - Babylon Airdrop
+	FlowTypeActivation       FlowType = iota // 0
+	FlowTypeDenounciation                    // 1
+	FlowTypeTransaction                      // 2
+	FlowTypeOrigination                      // 3
+	FlowTypeDelegation                       // 4
+	FlowTypeReveal                           // 5
+	FlowTypeEndorsement                      // 6
+	FlowTypeBaking                           // 7
+	FlowTypeNonceRevelation                  // 8
+	FlowTypeInternal                         // 9 - used for unfreeze
+	FlowTypeVest                             // 10 - vests amount into same account (ready to spend)
+	FlowTypePour                             // 11 - pours vested amount into other account
+	FlowTypeInvoice                          // 12 - invoice feature
+	FlowTypeAirdrop                          // 13 - Babylon Airdrop
+	FlowTypeSubsidy                          // 14 - Granada liquidity baking subsidy
+	FlowTypeRegisterConstant                 // 15 - Hangzhou global constants
+	FlowTypeDepositsLimit                    // 16
 	FlowTypeInvalid
 )
 
@@ -102,6 +105,12 @@ func ParseFlowType(s string) FlowType {
 		return FlowTypeInvoice
 	case "airdrop":
 		return FlowTypeAirdrop
+	case "subsidy":
+		return FlowTypeSubsidy
+	case "register_constant":
+		return FlowTypeRegisterConstant
+	case "deposits_limit":
+		return FlowTypeDepositsLimit
 	default:
 		return FlowTypeInvalid
 	}
@@ -141,6 +150,12 @@ func (t FlowType) String() string {
 		return "invoice"
 	case FlowTypeAirdrop:
 		return "airdrop"
+	case FlowTypeSubsidy:
+		return "subsidy"
+	case FlowTypeRegisterConstant:
+		return "register_constant"
+	case FlowTypeDepositsLimit:
+		return "deposits_limit"
 	default:
 		return "invalid"
 	}
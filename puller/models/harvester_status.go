@@ -13,6 +13,10 @@ func (HarvesterStatus) TableName() string {
 }
 
 func UpdateHarvesterStatus(db *gorm.DB, key, value string) error {
+	if IsSQLite(db) {
+		sql := "INSERT INTO harvester_status (`key`, `value`) VALUES(?, ?) ON CONFLICT(`key`) DO UPDATE SET `value` = ?"
+		return db.Exec(sql, key, value, value).Error
+	}
 	sql := "INSERT INTO harvester_status (`key`, `value`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `value` = ?"
 	return db.Exec(sql, key, value, value).Error
 }
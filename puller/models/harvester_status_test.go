@@ -2,7 +2,7 @@ package models
 
 import (
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/stretchr/testify/assert"
 	"strconv"
 	"strings"
@@ -10,14 +10,23 @@ import (
 )
 
 func TestHarvesterStatus_TableName(t *testing.T) {
-	dsn := "root:WcGsHDMBmcv7mc#QWkuR@tcp(127.0.0.1:3306)/tezos_index?charset=utf8mb4&parseTime=True&loc=Local"
-	db, err := gorm.Open("mysql", dsn)
+	db, err := gorm.Open(DialectSQLite, ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
 	defer db.Close()
-	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&HarvesterStatus{}).Error)
 	key := "AAAaaa"
 	val := "13eed"
 	err = UpdateHarvesterStatus(db, key, val)
 	assert.NoError(t, err)
+
+	// second update replaces the value
+	err = UpdateHarvesterStatus(db, key, "14eed")
+	assert.NoError(t, err)
+	st := &HarvesterStatus{}
+	assert.NoError(t, db.Where("`key` = ?", key).First(st).Error)
+	assert.Equal(t, "14eed", st.Value)
 }
 
 func TestUpdateHarvesterStatus(t *testing.T) {
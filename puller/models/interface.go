@@ -50,8 +50,15 @@ type BlockBuilder interface {
 	// returns a map of all delegates referenced in the current block
 	Delegates() map[AccountID]*Account
 
+	// resolves a contract originated in the current block from its account id,
+	// returns nil and false when not found
+	ContractByAccountId(AccountID) (*Contract, bool)
+
 	// returns block rights
 	Rights(chain.RightType) []Right
+
+	// returns all known protocol deployments in activation order
+	Deployments() chain.Deployments
 }
 
 // BlockIndexer provides a generic interface for an indexer that is managed by an
@@ -76,3 +83,9 @@ type BlockIndexer interface {
 	// returns the database storing all indexer tables
 	DB() *gorm.DB
 }
+
+// IndexInitializer is implemented by indexes that prepare their tables once
+// on startup, e.g. when they are added to an existing database.
+type IndexInitializer interface {
+	Init(ctx context.Context, tx *gorm.DB) error
+}
@@ -0,0 +1,129 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+type MetadataStatus byte
+
+const (
+	MetadataStatusPending  MetadataStatus = iota // off-chain content not fetched yet
+	MetadataStatusResolved                       // content decoded
+	MetadataStatusFailed                         // invalid content or fetch retries exhausted
+	MetadataStatusRemoved                        // metadata entry removed from the contract
+)
+
+func (s MetadataStatus) String() string {
+	switch s {
+	case MetadataStatusPending:
+		return "pending"
+	case MetadataStatusResolved:
+		return "resolved"
+	case MetadataStatusFailed:
+		return "failed"
+	case MetadataStatusRemoved:
+		return "removed"
+	default:
+		return ""
+	}
+}
+
+func (s MetadataStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Metadata is the TZIP-16 metadata of a contract (empty token id) or the
+// TZIP-12/TZIP-21 metadata of a single token. Rows are updated in place when
+// the underlying bigmap entry changes.
+type Metadata struct {
+	RowId        uint64         `gorm:"primary_key;column:row_id"   json:"row_id"`
+	ContractId   uint64         `gorm:"column:contract_id;index:metadata_contract_idx"   json:"contract_id"` // Contract.RowId
+	AccountId    AccountID      `gorm:"column:account_id"   json:"account_id"`
+	Contract     string         `gorm:"column:contract;index:metadata_address_idx"   json:"contract"`
+	TokenId      string         `gorm:"column:token_id"   json:"token_id,omitempty"` // decimal nat, empty for contract metadata
+	BigMapId     int64          `gorm:"column:bigmap_id"   json:"bigmap_id"`
+	KeyHash      []byte         `gorm:"column:key_hash"   json:"-"` // source bigmap entry
+	URI          string         `gorm:"column:uri"   json:"uri,omitempty"`
+	Status       MetadataStatus `gorm:"column:status;index:metadata_status_idx"   json:"status"`
+	Name         string         `gorm:"column:name"   json:"name,omitempty"`
+	Symbol       string         `gorm:"column:symbol"   json:"symbol,omitempty"`
+	Decimals     int            `gorm:"column:decimals"   json:"decimals"`
+	Description  string         `gorm:"column:description;type:text"   json:"description,omitempty"`
+	ArtifactURI  string         `gorm:"column:artifact_uri"   json:"artifact_uri,omitempty"`
+	DisplayURI   string         `gorm:"column:display_uri"   json:"display_uri,omitempty"`
+	ThumbnailURI string         `gorm:"column:thumbnail_uri"   json:"thumbnail_uri,omitempty"`
+	Content      string         `gorm:"column:content;type:text"   json:"content,omitempty"` // raw JSON
+	Attempts     int            `gorm:"column:attempts"   json:"attempts"`
+	NextRetry    time.Time      `gorm:"column:next_retry;index:metadata_retry_idx"   json:"next_retry"`
+	Error        string         `gorm:"column:error"   json:"error,omitempty"`
+	Height       int64          `gorm:"column:height"   json:"height"` // last bigmap update
+	Timestamp    time.Time      `gorm:"column:time"   json:"time"`
+}
+
+// tzip is the subset of TZIP-16 and TZIP-21 fields we keep in columns.
+type tzip struct {
+	Name         string          `json:"name"`
+	Symbol       string          `json:"symbol"`
+	Decimals     json.RawMessage `json:"decimals"` // number or string
+	Description  string          `json:"description"`
+	ArtifactURI  string          `json:"artifactUri"`
+	DisplayURI   string          `json:"displayUri"`
+	ThumbnailURI string          `json:"thumbnailUri"`
+}
+
+// SetContent decodes a TZIP-16/TZIP-21 JSON document and marks the row
+// resolved. Fields already set from on-chain token_info are kept.
+func (m *Metadata) SetContent(buf []byte) error {
+	var t tzip
+	if err := json.Unmarshal(buf, &t); err != nil {
+		return err
+	}
+	set := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	set(&m.Name, t.Name)
+	set(&m.Symbol, t.Symbol)
+	set(&m.Description, t.Description)
+	set(&m.ArtifactURI, t.ArtifactURI)
+	set(&m.DisplayURI, t.DisplayURI)
+	set(&m.ThumbnailURI, t.ThumbnailURI)
+	if m.Decimals == 0 && len(t.Decimals) > 0 {
+		s := string(t.Decimals)
+		if uq, err := strconv.Unquote(s); err == nil {
+			s = uq
+		}
+		m.Decimals, _ = strconv.Atoi(s)
+	}
+	m.Content = string(buf)
+	m.Status = MetadataStatusResolved
+	m.Error = ""
+	return nil
+}
+
+// SetTokenInfo sets fields from an on-chain TZIP-12 token_info map.
+func (m *Metadata) SetTokenInfo(info map[string][]byte) {
+	m.Name = string(info["name"])
+	m.Symbol = string(info["symbol"])
+	m.Decimals, _ = strconv.Atoi(string(info["decimals"]))
+	m.Description = string(info["description"])
+	m.ArtifactURI = string(info["artifactUri"])
+	m.DisplayURI = string(info["displayUri"])
+	m.ThumbnailURI = string(info["thumbnailUri"])
+}
+
+// Reset clears all content before a bigmap update is applied.
+func (m *Metadata) Reset() {
+	*m = Metadata{
+		RowId:      m.RowId,
+		ContractId: m.ContractId,
+		AccountId:  m.AccountId,
+		Contract:   m.Contract,
+		TokenId:    m.TokenId,
+		BigMapId:   m.BigMapId,
+		KeyHash:    m.KeyHash,
+	}
+}
@@ -22,7 +22,7 @@ func (id OpID) Value() uint64 {
 
 type Op struct {
 	RowId        OpID            `gorm:"primary_key;column:row_id"   json:"row_id"`                 // internal: unique row id
-	Timestamp    time.Time       `gorm:"column:time"      json:"time"`                              // bc: op block time
+	Timestamp    time.Time       `gorm:"column:time;index:op_time_idx"      json:"time"`            // bc: op block time
 	Height       int64           `gorm:"column:height"      json:"height"`                          // bc: block height op was mined at
 	Cycle        int64           `gorm:"column:cycle"      json:"cycle"`                            // bc: block cycle (tezos specific)
 	Hash         chain.StrOpHash `gorm:"column:hash;index:hash"             json:"hash"`            // bc: unique op_id (op hash)
@@ -60,6 +60,7 @@ type Op struct {
 	BranchId     uint64          `gorm:"column:branch_id"      json:"branch_id"`                    // bc: branch block the op is based on
 	BranchHeight int64           `gorm:"column:branch_height"      json:"branch_height"`            // bc: height of the branch block
 	BranchDepth  int64           `gorm:"column:branch_depth"      json:"branch_depth"`              // stats: diff between branch block and current block
+	BadSignature bool            `gorm:"column:bad_signature"      json:"bad_signature"`            // internal: op group signature did not verify
 }
 
 func AllocOp() *Op {
@@ -138,5 +139,6 @@ func (o *Op) Reset() {
 	o.TDD = 0
 	o.BranchId = 0
 	o.BranchHeight = 0
+	o.BadSignature = false
 	o.BranchDepth = 0
 }
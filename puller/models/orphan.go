@@ -0,0 +1,56 @@
+package models
+
+import (
+	"tezos_index/chain"
+	"time"
+)
+
+// Reorg logs a chain reorganization. Height and hash are the fork point shared
+// by the old and the new main chain.
+type Reorg struct {
+	RowId        uint64         `gorm:"primary_key;column:row_id"   json:"row_id"`
+	Height       int64          `gorm:"column:height;index:reorg_height_idx"   json:"height"` // fork point height
+	Hash         chain.StrBHash `gorm:"column:hash"   json:"hash"`                            // fork point hash
+	Depth        int            `gorm:"column:depth"   json:"depth"`                          // number of detached blocks
+	NAttached    int            `gorm:"column:n_attached"   json:"n_attached"`                // number of attached blocks
+	OldTipHash   chain.StrBHash `gorm:"column:old_tip_hash"   json:"old_tip_hash"`
+	OldTipHeight int64          `gorm:"column:old_tip_height"   json:"old_tip_height"`
+	NewTipHash   chain.StrBHash `gorm:"column:new_tip_hash"   json:"new_tip_hash"`
+	NewTipHeight int64          `gorm:"column:new_tip_height"   json:"new_tip_height"`
+	Timestamp    time.Time      `gorm:"column:time"   json:"time"` // time the reorg was processed
+}
+
+// OrphanBlock keeps a block that was detached from the main chain during a
+// reorg. The same block may be orphaned more than once when the chain flips
+// back and forth.
+type OrphanBlock struct {
+	RowId      uint64         `gorm:"primary_key;column:row_id"   json:"row_id"`
+	ReorgId    uint64         `gorm:"column:reorg_id;index:orphan_reorg_idx"   json:"reorg_id"`
+	Hash       chain.StrBHash `gorm:"column:hash;index:orphan_hash_idx"   json:"hash"`
+	ParentHash chain.StrBHash `gorm:"column:parent_hash"   json:"parent_hash"`
+	Height     int64          `gorm:"column:height;index:orphan_height_idx"   json:"height"`
+	Timestamp  time.Time      `gorm:"column:time"   json:"time"`
+	BakerId    AccountID      `gorm:"column:baker_id"   json:"baker_id"`
+	Baker      string         `gorm:"column:baker"   json:"baker,omitempty"`
+	Priority   int            `gorm:"column:priority"   json:"priority"`
+	NOps       int            `gorm:"column:n_ops"   json:"n_ops"`
+}
+
+// NewOrphanBlock copies identity and summary fields of a detached block.
+func NewOrphanBlock(b *Block) *OrphanBlock {
+	o := &OrphanBlock{
+		Hash:      b.Hash,
+		Height:    b.Height,
+		Timestamp: b.Timestamp,
+		BakerId:   b.BakerId,
+		Priority:  b.Priority,
+		NOps:      b.NOps,
+	}
+	if b.TZ != nil && b.TZ.Block != nil {
+		o.ParentHash = chain.StrBHash(b.TZ.Parent().String())
+	}
+	if b.Baker != nil {
+		o.Baker = b.Baker.String()
+	}
+	return o
+}
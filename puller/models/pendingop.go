@@ -0,0 +1,77 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"tezos_index/chain"
+	"time"
+)
+
+// mempool classification of a pending op
+const (
+	PendingStatusApplied       = "applied"
+	PendingStatusRefused       = "refused"
+	PendingStatusBranchDelayed = "branch_delayed"
+)
+
+// lifecycle of a pending op
+const (
+	PendingStatePending  = "pending"
+	PendingStateIncluded = "included"
+	PendingStateDropped  = "dropped"
+)
+
+// PendingOp is an operation group seen in the node's mempool. One row is kept
+// per op hash, summary fields are taken from the first operation in the group.
+type PendingOp struct {
+	RowId          uint64          `gorm:"primary_key;column:row_id"   json:"row_id"`
+	Hash           chain.StrOpHash `gorm:"column:hash;unique_index:hash"   json:"hash"`
+	Branch         chain.StrBHash  `gorm:"column:branch"   json:"branch"`
+	Type           chain.OpType    `gorm:"column:type"   json:"type"`
+	Sender         string          `gorm:"column:sender;index:sender_idx"   json:"sender,omitempty"`
+	Receiver       string          `gorm:"column:receiver;index:recv_idx"   json:"receiver,omitempty"`
+	Amount         int64           `gorm:"column:amount"   json:"amount"`
+	Fee            int64           `gorm:"column:fee"   json:"fee"`
+	Counter        int64           `gorm:"column:counter"   json:"counter"`
+	Status         string          `gorm:"column:status"   json:"status"` // mempool classification
+	Errors         string          `gorm:"column:errors;type:BLOB"   json:"errors,omitempty"`
+	State          string          `gorm:"column:state;index:state_idx"   json:"state"`
+	FirstSeen      time.Time       `gorm:"column:first_seen"   json:"first_seen"`
+	LastSeen       time.Time       `gorm:"column:last_seen"   json:"last_seen"`
+	ExpiryHeight   int64           `gorm:"column:expiry_height"   json:"expiry_height"` // last height the op can be included at
+	IncludedHeight int64           `gorm:"column:included_height"   json:"included_height,omitempty"`
+}
+
+// MarkPendingOpsIncluded flags pending ops as included at height. Dropped ops
+// are included as well because the mempool may expire ops against a chain head
+// the index has not reached yet.
+func MarkPendingOpsIncluded(db *gorm.DB, hashes []string, height int64) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	return db.Model(&PendingOp{}).
+		Where("hash IN (?) AND state <> ?", hashes, PendingStateIncluded).
+		Updates(map[string]interface{}{
+			"state":           PendingStateIncluded,
+			"included_height": height,
+		}).Error
+}
+
+// RevertPendingOpsIncluded returns ops included at height to the pending state,
+// used when a block is disconnected during a reorg.
+func RevertPendingOpsIncluded(db *gorm.DB, height int64) error {
+	return db.Model(&PendingOp{}).
+		Where("state = ? AND included_height = ?", PendingStateIncluded, height).
+		Updates(map[string]interface{}{
+			"state":           PendingStatePending,
+			"included_height": 0,
+		}).Error
+}
+
+// DropExpiredPendingOps marks all pending ops which can no longer be included
+// after height as dropped.
+func DropExpiredPendingOps(db *gorm.DB, height int64) (int64, error) {
+	res := db.Model(&PendingOp{}).
+		Where("state = ? AND expiry_height < ?", PendingStatePending, height).
+		Update("state", PendingStateDropped)
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// AccountRank holds the values accounts are ranked by. Ranks are derived at
+// query time so a single row update never shifts other rows.
+type AccountRank struct {
+	AccountId    AccountID `gorm:"primary_key;auto_increment:false;column:account_id"   json:"account_id"`
+	Height       int64     `gorm:"column:height;index:rank_height_idx"   json:"height"`                  // last refresh
+	Time         time.Time `gorm:"column:time"   json:"time"`                                            // block time of last refresh
+	Balance      int64     `gorm:"column:balance;index:rank_balance_idx"   json:"balance"`               // spendable and frozen
+	TxFlow24h    int64     `gorm:"column:tx_flow_24h;index:rank_flow_idx"   json:"tx_flow_24h"`          // tx volume in+out
+	TxTraffic24h int64     `gorm:"column:tx_traffic_24h;index:rank_traffic_idx"   json:"tx_traffic_24h"` // number of tx in+out
+}
@@ -0,0 +1,33 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// ChainState is a key-value row holding the chain tip, index tips and protocol
+// deployments as JSON. State rows are written in the same transaction as the
+// block data they describe.
+type ChainState struct {
+	Key   string `gorm:"column:key;primary_key" json:"key"`
+	Value string `gorm:"column:value;type:TEXT" json:"value"`
+}
+
+func (ChainState) TableName() string {
+	return "chain_state"
+}
+
+// LoadState returns the value stored under key or gorm.ErrRecordNotFound.
+func LoadState(db *gorm.DB, key string) ([]byte, error) {
+	s := &ChainState{}
+	if err := db.Where("`key` = ?", key).First(s).Error; err != nil {
+		return nil, err
+	}
+	return []byte(s.Value), nil
+}
+
+func StoreState(db *gorm.DB, key string, value []byte) error {
+	if IsSQLite(db) {
+		sql := "INSERT INTO chain_state (`key`, `value`) VALUES(?, ?) ON CONFLICT(`key`) DO UPDATE SET `value` = ?"
+		return db.Exec(sql, key, string(value), string(value)).Error
+	}
+	sql := "INSERT INTO chain_state (`key`, `value`) VALUES(?, ?) ON DUPLICATE KEY UPDATE `value` = ?"
+	return db.Exec(sql, key, string(value), string(value)).Error
+}
@@ -31,6 +31,7 @@ type Supply struct {
 	MintedEndorsing     int64     `gorm:"column:minted_endorsing"    json:"minted_endorsing"`
 	MintedSeeding       int64     `gorm:"column:minted_seeding"    json:"minted_seeding"`
 	MintedAirdrop       int64     `gorm:"column:minted_airdrop"    json:"minted_airdrop"`
+	MintedSubsidy       int64     `gorm:"column:minted_subsidy"    json:"minted_subsidy"` // v010 liquidity baking
 	Burned              int64     `gorm:"column:burned"    json:"burned"`
 	BurnedDoubleBaking  int64     `gorm:"column:burned_double_baking"    json:"burned_double_baking"`
 	BurnedDoubleEndorse int64     `gorm:"column:burned_double_endorse"    json:"burned_double_endorse"`
@@ -64,7 +65,7 @@ func (s *Supply) Update(b *Block, delegates map[AccountID]*Account) {
 	s.FrozenFees += b.Fees - b.UnfrozenFees
 	s.Frozen = s.FrozenDeposits + s.FrozenFees + s.FrozenRewards
 
-	// activated/unclaimed, vested/unvested, invoice/airdrop from flows
+	// activated/unclaimed, vested/unvested, invoice/airdrop/subsidy from flows
 	for _, f := range b.Flows {
 		switch f.Operation {
 		case FlowTypeActivation:
@@ -91,6 +92,10 @@ func (s *Supply) Update(b *Block, delegates map[AccountID]*Account) {
 			s.Total += f.AmountIn
 			s.MintedAirdrop += f.AmountIn
 			s.Minted += f.AmountIn
+		case FlowTypeSubsidy:
+			s.Total += f.AmountIn
+			s.MintedSubsidy += f.AmountIn
+			s.Minted += f.AmountIn
 		}
 	}
 
@@ -133,7 +138,7 @@ func (s *Supply) Update(b *Block, delegates map[AccountID]*Account) {
 
 	// we don't explicitly count baking and there's also no explicit op, but
 	// we can calculate total baking rewards as difference to total rewards
-	s.MintedBaking = s.Minted - s.MintedSeeding - s.MintedEndorsing - s.MintedAirdrop
+	s.MintedBaking = s.Minted - s.MintedSeeding - s.MintedEndorsing - s.MintedAirdrop - s.MintedSubsidy
 
 	// unanimous consent that unclaimed can move at next block and frozen is
 	// generally considered as part of circulating
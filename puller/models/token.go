@@ -0,0 +1,81 @@
+package models
+
+import (
+	"math/big"
+	"tezos_index/micheline"
+	"time"
+)
+
+// Token is a single FA1.2 or FA2 token, i.e. a token contract and token id.
+// FA1.2 tokens use token id 0.
+type Token struct {
+	RowId     uint64                  `gorm:"primary_key;column:row_id"   json:"row_id"`
+	AccountId AccountID               `gorm:"column:account_id;index:token_account_idx"   json:"account_id"` // token contract
+	Contract  string                  `gorm:"column:contract;index:token_contract_idx"   json:"contract"`
+	Standard  micheline.TokenStandard `gorm:"column:standard"   json:"standard"`
+	TokenId   string                  `gorm:"column:token_id"   json:"token_id"` // decimal nat
+	Height    int64                   `gorm:"column:height"   json:"height"`     // first seen
+	Timestamp time.Time               `gorm:"column:time"   json:"time"`
+}
+
+// TokenLedger is the big_map holding balances of a token contract. It is
+// detected when the big_map is allocated.
+type TokenLedger struct {
+	RowId     uint64                  `gorm:"primary_key;column:row_id"   json:"row_id"`
+	BigMapId  int64                   `gorm:"column:bigmap_id;index:token_ledger_bigmap_idx"   json:"bigmap_id"`
+	AccountId AccountID               `gorm:"column:account_id"   json:"account_id"` // token contract
+	Contract  string                  `gorm:"column:contract"   json:"contract"`
+	Standard  micheline.TokenStandard `gorm:"column:standard"   json:"standard"`
+	Layout    micheline.LedgerLayout  `gorm:"column:layout"   json:"layout"`
+	Height    int64                   `gorm:"column:height"   json:"height"`
+}
+
+// TokenBalance is the current balance of a token holder as stored in the
+// contract's ledger big_map.
+type TokenBalance struct {
+	RowId      uint64 `gorm:"primary_key;column:row_id"   json:"row_id"`
+	TokenRowId uint64 `gorm:"column:token_row_id;index:token_balance_token_idx"   json:"token_row_id"`
+	Holder     string `gorm:"column:holder;index:token_balance_holder_idx"   json:"holder"`
+	Balance    string `gorm:"column:balance"   json:"balance"` // decimal nat
+	Height     int64  `gorm:"column:height"   json:"height"`   // first seen
+	Updated    int64  `gorm:"column:updated"   json:"updated"` // last change
+}
+
+// TokenBalanceUpdate records a single ledger change. Prev is the balance
+// before the change and is empty when the holder had no balance row. It is
+// used to restore balances on rollback.
+type TokenBalanceUpdate struct {
+	RowId      uint64 `gorm:"primary_key;column:row_id"   json:"row_id"`
+	TokenRowId uint64 `gorm:"column:token_row_id"   json:"token_row_id"`
+	OpId       OpID   `gorm:"column:op_id"   json:"op_id"`
+	Height     int64  `gorm:"column:height;index:token_balance_update_height_idx"   json:"height"`
+	Holder     string `gorm:"column:holder"   json:"holder"`
+	Balance    string `gorm:"column:balance"   json:"balance"`
+	Prev       string `gorm:"column:prev"   json:"prev"`
+	PrevHeight int64  `gorm:"column:prev_height"   json:"prev_height"` // last change before
+}
+
+// TokenTransfer is a single token movement from a transfer call. Calls with
+// multiple transfers create one row per transfer.
+type TokenTransfer struct {
+	RowId      uint64    `gorm:"primary_key;column:row_id"   json:"row_id"`
+	TokenRowId uint64    `gorm:"column:token_row_id;index:token_transfer_token_idx"   json:"token_row_id"`
+	OpId       OpID      `gorm:"column:op_id"   json:"op_id"`
+	OpN        int       `gorm:"column:op_n"   json:"op_n"`
+	OpC        int       `gorm:"column:op_c"   json:"op_c"`
+	OpI        int       `gorm:"column:op_i"   json:"op_i"`
+	Height     int64     `gorm:"column:height;index:token_transfer_height_idx"   json:"height"`
+	Timestamp  time.Time `gorm:"column:time"   json:"time"`
+	Sender     string    `gorm:"column:sender;index:token_transfer_sender_idx"   json:"sender"`
+	Receiver   string    `gorm:"column:receiver;index:token_transfer_receiver_idx"   json:"receiver"`
+	Amount     string    `gorm:"column:amount"   json:"amount"` // decimal nat
+}
+
+// Value returns the balance as integer, zero when unset or invalid.
+func (b *TokenBalance) Value() *big.Int {
+	v, ok := new(big.Int).SetString(b.Balance, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return v
+}
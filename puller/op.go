@@ -142,7 +142,7 @@ func (b *Builder) NewActivationOp(ctx context.Context, oh *rpc.OperationHeader,
 
 func (b *Builder) NewEndorsementOp(ctx context.Context, oh *rpc.OperationHeader, op_n, op_c int, rollback bool) error {
 	o := oh.Contents[op_c]
-	eop, ok := o.(*rpc.EndorsementOp)
+	eop, ok := rpc.Endorsement(o)
 	if !ok {
 		return fmt.Errorf("endorsement op [%d:%d]: unexpected type %T ", op_n, op_c, o)
 	}
@@ -163,6 +163,7 @@ func (b *Builder) NewEndorsementOp(ctx context.Context, oh *rpc.OperationHeader,
 
 	// build op
 	op := NewOp(b.block, branch, oh, op_n, op_c, 0)
+	op.Type = chain.OpTypeEndorsement // also for endorsements with slot
 	op.Status = chain.OpStatusApplied
 	op.IsSuccess = true
 	op.SenderId = acc.RowId
@@ -628,17 +629,16 @@ func (b *Builder) NewTransactionOp(ctx context.Context, oh *rpc.OperationHeader,
 			return fmt.Errorf("transaction op [%d:%d]: marshal storage: %v", op_n, op_c, err)
 		}
 	}
-	// todo 屏蔽 bigMap
-	// if len(res.BigMapDiff) > 0 {
-	// 	top.Metadata.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, nil)
-	// 	if err != nil {
-	// 		return fmt.Errorf("transaction op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
-	// 	}
-	// 	op.BigMapDiff, err = top.Metadata.Result.BigMapDiff.MarshalBinary()
-	// 	if err != nil {
-	// 		return fmt.Errorf("transaction op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
-	// 	}
-	// }
+	if b.bigmaps && !rollback && len(res.BigMapDiff) > 0 {
+		top.Metadata.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, nil)
+		if err != nil {
+			return fmt.Errorf("transaction op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
+		}
+		op.BigMapDiff, err = top.Metadata.Result.BigMapDiff.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("transaction op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
+		}
+	}
 
 	var flows []*Flow
 
@@ -839,17 +839,16 @@ func (b *Builder) NewInternalTransactionOp(ctx context.Context, origsrc, origdlg
 			return fmt.Errorf("internal transaction op [%d:%d]: marshal storage: %v", op_n, op_c, err)
 		}
 	}
-	// todo 屏蔽 bigMap
-	// if len(res.BigMapDiff) > 0 {
-	// 	iop.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, nil)
-	// 	if err != nil {
-	// 		return fmt.Errorf("internal transaction op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
-	// 	}
-	// 	op.BigMapDiff, err = iop.Result.BigMapDiff.MarshalBinary()
-	// 	if err != nil {
-	// 		return fmt.Errorf("internal transaction op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
-	// 	}
-	// }
+	if b.bigmaps && !rollback && len(res.BigMapDiff) > 0 {
+		iop.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, nil)
+		if err != nil {
+			return fmt.Errorf("internal transaction op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
+		}
+		op.BigMapDiff, err = iop.Result.BigMapDiff.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("internal transaction op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
+		}
+	}
 
 	var flows []*Flow
 
@@ -1068,21 +1067,6 @@ func (b *Builder) NewOriginationOp(ctx context.Context, oh *rpc.OperationHeader,
 			// convert seconds to days and volume from atomic units to coins
 			op.TDD += float64(diffsec) / 86400 * b.block.Params.ConvertValue(op.Volume)
 		}
-
-		// create or extend bigmap diff to inject alloc for proto < v005
-		// todo 屏蔽bigMap
-		// oop.Metadata.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, oop.Script)
-		// if err != nil {
-		// 	return fmt.Errorf("origination op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
-		// }
-		// if len(oop.Metadata.Result.BigMapDiff) > 0 {
-		// 	op.BigMapDiff, err = oop.Metadata.Result.BigMapDiff.MarshalBinary()
-		// 	if err != nil {
-		// 		return fmt.Errorf("origination op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
-		// 	}
-		// 	op.HasData = true
-		// }
-
 	} else {
 		// handle errors
 		if len(res.Errors) > 0 {
@@ -1154,6 +1138,26 @@ func (b *Builder) NewOriginationOp(ctx context.Context, oh *rpc.OperationHeader,
 				}
 				newdlg.IsDirty = true
 			}
+
+			// keep new contracts for indexers running in the same block
+			if op.IsContract && dst.IsNew {
+				b.RegisterContract(NewContract(dst, oop))
+			}
+
+			// create or extend bigmap diff to inject alloc for proto < v005
+			if b.bigmaps {
+				oop.Metadata.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, oop.Script)
+				if err != nil {
+					return fmt.Errorf("origination op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
+				}
+				if len(oop.Metadata.Result.BigMapDiff) > 0 {
+					op.BigMapDiff, err = oop.Metadata.Result.BigMapDiff.MarshalBinary()
+					if err != nil {
+						return fmt.Errorf("origination op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
+					}
+					op.HasData = true
+				}
+			}
 		}
 	} else {
 		if !op.IsSuccess {
@@ -1265,21 +1269,6 @@ func (b *Builder) NewInternalOriginationOp(ctx context.Context, origsrc, origdlg
 			// convert seconds to days and volume from atomic units to coins
 			op.TDD += float64(diffsec) / 86400 * b.block.Params.ConvertValue(op.Volume)
 		}
-
-		// create or extend bigmap diff to inject alloc for proto < v005
-		// todo 屏蔽 bigMap
-		// iop.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, iop.Script)
-		// if err != nil {
-		// 	return fmt.Errorf("internal origination op [%d:%d]: patch bigmap: %v", op_n, op_c, err)
-		// }
-		// if len(iop.Result.BigMapDiff) > 0 {
-		// 	op.BigMapDiff, err = iop.Result.BigMapDiff.MarshalBinary()
-		// 	if err != nil {
-		// 		return fmt.Errorf("internal origination op [%d:%d]: marshal bigmap: %v", op_n, op_c, err)
-		// 	}
-		// 	op.HasData = true
-		// }
-
 	} else {
 		// handle errors
 		if len(res.Errors) > 0 {
@@ -1315,6 +1304,26 @@ func (b *Builder) NewInternalOriginationOp(ctx context.Context, origsrc, origdlg
 			// internal originations have no manager, delegate and flags (in protocol v5)
 			// but we still keep the original caller as manager to track contract ownership
 			dst.ManagerId = origsrc.RowId
+
+			// keep new contracts for indexers running in the same block
+			if op.IsContract && dst.IsNew {
+				b.RegisterContract(NewInternalContract(dst, iop))
+			}
+
+			// create or extend bigmap diff to inject alloc for proto < v005
+			if b.bigmaps {
+				iop.Result.BigMapDiff, err = b.PatchBigMapDiff(ctx, res.BigMapDiff, op.ReceiverId, iop.Script)
+				if err != nil {
+					return fmt.Errorf("internal origination op [%d:%d:%d]: patch bigmap: %v", op_n, op_c, op_i, err)
+				}
+				if len(iop.Result.BigMapDiff) > 0 {
+					op.BigMapDiff, err = iop.Result.BigMapDiff.MarshalBinary()
+					if err != nil {
+						return fmt.Errorf("internal origination op [%d:%d:%d]: marshal bigmap: %v", op_n, op_c, op_i, err)
+					}
+					op.HasData = true
+				}
+			}
 		}
 	} else {
 		if !op.IsSuccess {
@@ -1734,3 +1743,157 @@ func (b *Builder) NewInternalDelegationOp(ctx context.Context, origsrc, origdlg
 
 	return nil
 }
+
+func (b *Builder) NewConstantRegistrationOp(ctx context.Context, oh *rpc.OperationHeader, op_n, op_c int, rollback bool) error {
+	o := oh.Contents[op_c]
+	cop, ok := o.(*rpc.ConstantRegistrationOp)
+	if !ok {
+		return fmt.Errorf("register constant op [%d:%d]: unexpected type %T ", op_n, op_c, o)
+	}
+	branch, ok := b.BranchByHash(oh.Branch)
+	if !ok {
+		return fmt.Errorf("register constant op [%d:%d]: missing branch %s", op_n, op_c, oh.Branch)
+	}
+	src, ok := b.AccountByAddress(cop.Source)
+	if !ok {
+		return fmt.Errorf("register constant op [%d:%d]: missing account %s", op_n, op_c, cop.Source)
+	}
+	var dlg *Account
+	if src.DelegateId != 0 {
+		if dlg, ok = b.AccountById(src.DelegateId); !ok {
+			return fmt.Errorf("register constant op [%d:%d]: missing delegate %d for source account %d",
+				op_n, op_c, src.DelegateId, src.RowId)
+		}
+	}
+
+	// build op
+	op := NewOp(b.block, branch, oh, op_n, op_c, 0)
+	op.SenderId = src.RowId
+	op.Counter = cop.Counter
+	op.Fee = cop.Fee
+	op.GasLimit = cop.GasLimit
+	op.StorageLimit = cop.StorageLimit
+	res := cop.Metadata.Result
+	op.GasUsed = res.ConsumedGas
+	if op.GasUsed > 0 && op.Fee > 0 {
+		op.GasPrice = float64(op.Fee) / float64(op.GasUsed)
+	}
+	op.Status = res.Status
+	op.IsSuccess = op.Status.IsSuccess()
+	if op.IsSuccess {
+		// data is the global constant's expression hash
+		op.HasData = true
+		op.Data = res.GlobalAddress.String()
+		op.StorageSize = res.StorageSize
+	}
+	flows, err := b.NewManagerFlows(src, dlg, FlowTypeRegisterConstant, cop.Metadata.BalanceUpdates, res.BalanceUpdates)
+	if err != nil {
+		return err
+	}
+	for _, f := range flows {
+		if f.IsBurned {
+			op.Burned += f.AmountOut
+		}
+	}
+	// extend grace period for delegates
+	if src.IsActiveDelegate {
+		src.UpdateGracePeriod(b.block.Cycle, b.block.Params)
+	}
+
+	// update accounts
+	if !rollback {
+		src.NOps++
+		if !op.IsSuccess {
+			src.NOpsFailed++
+			if len(res.Errors) > 0 {
+				if buf, err := json.Marshal(res.Errors); err == nil {
+					op.Errors = string(buf)
+				} else {
+					log.Errorf("register constant op [%d:%d]: marshal op errors: %v", op_n, op_c, err)
+				}
+			}
+		}
+	} else {
+		src.NOps--
+		if !op.IsSuccess {
+			src.NOpsFailed--
+		}
+	}
+	src.IsDirty = true
+	b.block.Ops = append(b.block.Ops, op)
+	return nil
+}
+
+func (b *Builder) NewSetDepositsLimitOp(ctx context.Context, oh *rpc.OperationHeader, op_n, op_c int, rollback bool) error {
+	o := oh.Contents[op_c]
+	lop, ok := o.(*rpc.SetDepositsLimitOp)
+	if !ok {
+		return fmt.Errorf("set deposits limit op [%d:%d]: unexpected type %T ", op_n, op_c, o)
+	}
+	branch, ok := b.BranchByHash(oh.Branch)
+	if !ok {
+		return fmt.Errorf("set deposits limit op [%d:%d]: missing branch %s", op_n, op_c, oh.Branch)
+	}
+	src, ok := b.AccountByAddress(lop.Source)
+	if !ok {
+		return fmt.Errorf("set deposits limit op [%d:%d]: missing account %s", op_n, op_c, lop.Source)
+	}
+	var dlg *Account
+	if src.DelegateId != 0 {
+		if dlg, ok = b.AccountById(src.DelegateId); !ok {
+			return fmt.Errorf("set deposits limit op [%d:%d]: missing delegate %d for source account %d",
+				op_n, op_c, src.DelegateId, src.RowId)
+		}
+	}
+
+	// build op
+	op := NewOp(b.block, branch, oh, op_n, op_c, 0)
+	op.SenderId = src.RowId
+	op.Counter = lop.Counter
+	op.Fee = lop.Fee
+	op.GasLimit = lop.GasLimit
+	op.StorageLimit = lop.StorageLimit
+	// data is the new limit, empty when the limit was removed
+	if lop.Limit != nil {
+		op.HasData = true
+		op.Data = strconv.FormatInt(*lop.Limit, 10)
+	}
+	res := lop.Metadata.Result
+	op.GasUsed = res.ConsumedGas
+	if op.GasUsed > 0 && op.Fee > 0 {
+		op.GasPrice = float64(op.Fee) / float64(op.GasUsed)
+	}
+	op.Status = res.Status
+	op.IsSuccess = op.Status.IsSuccess()
+	_, err := b.NewManagerFlows(src, dlg, FlowTypeDepositsLimit, lop.Metadata.BalanceUpdates, nil)
+	if err != nil {
+		return err
+	}
+	// extend grace period for delegates
+	if src.IsActiveDelegate {
+		src.UpdateGracePeriod(b.block.Cycle, b.block.Params)
+	}
+
+	// update accounts
+	if !rollback {
+		src.NOps++
+		if !op.IsSuccess {
+			src.NOpsFailed++
+			if len(res.Errors) > 0 {
+				if buf, err := json.Marshal(res.Errors); err == nil {
+					op.Errors = string(buf)
+				} else {
+					log.Errorf("set deposits limit op [%d:%d]: marshal op errors: %v", op_n, op_c, err)
+				}
+			}
+		}
+	} else {
+		src.NOps--
+		if !op.IsSuccess {
+			src.NOpsFailed--
+		}
+	}
+	src.IsDirty = true
+	b.block.Ops = append(b.block.Ops, op)
+	return nil
+}
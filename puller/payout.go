@@ -0,0 +1,325 @@
+package puller
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"tezos_index/chain"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+const (
+	// payout transaction defaults, storage covers allocating a new account
+	DefaultPayoutTxFee        = 1420
+	DefaultPayoutGasLimit     = 10600
+	DefaultPayoutStorageLimit = 300
+	DefaultPayoutBatchSize    = 200
+
+	PayoutSkipExcluded = "excluded"
+	PayoutSkipMinimum  = "below_minimum"
+)
+
+// PayoutConfig controls how a baker shares the rewards of one cycle.
+type PayoutConfig struct {
+	Cycle     int64           // income cycle to pay out
+	Fee       float64         // baker fee as fraction of delegator rewards, e.g. 0.05
+	MinPayout int64           // payouts below this amount (mutez) are skipped
+	Exclude   []chain.Address // delegators that receive no payout
+}
+
+// Payout is the share of a single delegator. Skipped payouts are listed for
+// completeness and not paid.
+type Payout struct {
+	AccountId models.AccountID `json:"-"`
+	Address   string           `json:"address"`
+	Balance   int64            `json:"balance"`
+	Share     float64          `json:"share"`
+	Gross     int64            `json:"gross"`
+	Fee       int64            `json:"fee"`
+	Amount    int64            `json:"amount"`
+	Skipped   string           `json:"skipped,omitempty"`
+}
+
+// PayoutReport lists all delegator payouts of a baker for one cycle. Rewards
+// are the cycle's baking, endorsing and seed income plus fees minus losses,
+// shares are taken from the selected roll snapshot. The report only depends
+// on indexed data and the config, so it can be recomputed at any time.
+type PayoutReport struct {
+	Baker          string    `json:"baker"`
+	Cycle          int64     `json:"cycle"`
+	Complete       bool      `json:"complete"` // cycle has ended, rewards are final
+	SnapshotCycle  int64     `json:"snapshot_cycle"`
+	SnapshotIndex  int64     `json:"snapshot_index"`
+	SnapshotHeight int64     `json:"snapshot_height"`
+	StakingBalance int64     `json:"staking_balance"`
+	BakerBalance   int64     `json:"baker_balance"`
+	Rewards        int64     `json:"rewards"`
+	Fee            float64   `json:"fee"`
+	MinPayout      int64     `json:"min_payout"`
+	TotalPaid      int64     `json:"total_paid"`
+	TotalFees      int64     `json:"total_fees"`
+	BakerRewards   int64     `json:"baker_rewards"` // rewards not paid out
+	Payouts        []*Payout `json:"payouts"`
+}
+
+// Payouts computes the payout report of baker for cfg.Cycle.
+func (m *Indexer) Payouts(ctx context.Context, baker chain.Address, cfg PayoutConfig) (*PayoutReport, error) {
+	if cfg.Cycle < 0 {
+		return nil, errInvalidParam("cycle")
+	}
+	acc, err := m.LookupAccount(ctx, baker)
+	if err != nil {
+		return nil, err
+	}
+	deps := m.reg.Deployments()
+	p := deps.ByCycle(cfg.Cycle)
+	if p == nil {
+		return nil, errInvalidParam("cycle")
+	}
+	exclude := make(map[models.AccountID]bool)
+	for _, addr := range cfg.Exclude {
+		if a, err := m.LookupAccount(ctx, addr); err == nil {
+			exclude[a.RowId] = true
+		}
+	}
+	r, err := calculatePayouts(m.statedb, p, acc.RowId, exclude, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.Baker = acc.String()
+	if tip, ok := m.Tips()[index.IncomeIndexKey]; ok {
+		r.Complete = tip.Height >= deps.CycleEndHeight(cfg.Cycle)
+	}
+	return r, nil
+}
+
+func calculatePayouts(db *gorm.DB, p *chain.Params, baker models.AccountID, exclude map[models.AccountID]bool, cfg PayoutConfig) (*PayoutReport, error) {
+	if cfg.Fee < 0 || cfg.Fee > 1 {
+		return nil, errInvalidParam("fee")
+	}
+	income := &models.Income{}
+	err := db.Where("cycle = ? and account_id = ?", cfg.Cycle, baker.Value()).First(income).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return nil, index.ErrNoIncomeEntry
+	default:
+		return nil, err
+	}
+
+	// the baker's own row is the staking balance at the selected snapshot
+	snapCycle := cfg.Cycle - (p.PreservedCycles + 2)
+	own := &models.Snapshot{}
+	err = db.Where("cycle = ? and is_selected = ? and account_id = ?", snapCycle, true, baker.Value()).First(own).Error
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return nil, index.ErrNoSnapshotEntry
+	default:
+		return nil, err
+	}
+	var snaps []*models.Snapshot
+	err = db.Where("cycle = ? and s_index = ? and delegate_id = ? and account_id <> ?",
+		snapCycle, own.Index, baker.Value(), baker.Value()).Find(&snaps).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := &PayoutReport{
+		Cycle:          cfg.Cycle,
+		SnapshotCycle:  snapCycle,
+		SnapshotIndex:  own.Index,
+		SnapshotHeight: own.Height,
+		StakingBalance: own.Balance + own.Delegated,
+		BakerBalance:   own.Balance,
+		Rewards:        income.TotalIncome + income.FeesIncome - income.TotalLost,
+		Fee:            cfg.Fee,
+		MinPayout:      cfg.MinPayout,
+		Payouts:        make([]*Payout, 0, len(snaps)),
+	}
+	if r.Rewards < 0 {
+		r.Rewards = 0
+	}
+	if err := resolvePayoutAddresses(db, snaps, r); err != nil {
+		return nil, err
+	}
+
+	// integer math in mutez keeps results identical across runs, the fee is
+	// rounded to basis points
+	feeBps := big.NewInt(int64(math.Round(cfg.Fee * 10000)))
+	for _, v := range r.Payouts {
+		if r.StakingBalance > 0 {
+			v.Share = float64(v.Balance) / float64(r.StakingBalance)
+			gross := new(big.Int).Mul(big.NewInt(r.Rewards), big.NewInt(v.Balance))
+			v.Gross = gross.Quo(gross, big.NewInt(r.StakingBalance)).Int64()
+		}
+		fee := new(big.Int).Mul(big.NewInt(v.Gross), feeBps)
+		v.Fee = fee.Quo(fee, big.NewInt(10000)).Int64()
+		v.Amount = v.Gross - v.Fee
+		switch {
+		case exclude[v.AccountId]:
+			v.Skipped = PayoutSkipExcluded
+		case v.Amount <= 0 || v.Amount < cfg.MinPayout:
+			v.Skipped = PayoutSkipMinimum
+		default:
+			r.TotalPaid += v.Amount
+			r.TotalFees += v.Fee
+		}
+	}
+	r.BakerRewards = r.Rewards - r.TotalPaid
+	return r, nil
+}
+
+// resolvePayoutAddresses adds one payout per delegator snapshot sorted by
+// balance and address.
+func resolvePayoutAddresses(db *gorm.DB, snaps []*models.Snapshot, r *PayoutReport) error {
+	if len(snaps) == 0 {
+		return nil
+	}
+	ids := make([]uint64, len(snaps))
+	for i, s := range snaps {
+		ids[i] = s.AccountId.Value()
+	}
+	var accs []*models.Account
+	err := db.Select("row_id, hash, address_type").Where("row_id in (?)", ids).Find(&accs).Error
+	if err != nil {
+		return err
+	}
+	addrs := make(map[models.AccountID]string, len(accs))
+	for _, a := range accs {
+		addrs[a.RowId] = a.String()
+	}
+	for _, s := range snaps {
+		addr, ok := addrs[s.AccountId]
+		if !ok {
+			return fmt.Errorf("payout: missing delegator account %d", s.AccountId)
+		}
+		r.Payouts = append(r.Payouts, &Payout{
+			AccountId: s.AccountId,
+			Address:   addr,
+			Balance:   s.Balance,
+		})
+	}
+	sort.Slice(r.Payouts, func(i, j int) bool {
+		if r.Payouts[i].Balance != r.Payouts[j].Balance {
+			return r.Payouts[i].Balance > r.Payouts[j].Balance
+		}
+		return r.Payouts[i].Address < r.Payouts[j].Address
+	})
+	return nil
+}
+
+func (r *PayoutReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes one line per payout.
+func (r *PayoutReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"address", "balance", "share", "gross", "fee", "amount", "skipped"})
+	for _, v := range r.Payouts {
+		_ = cw.Write([]string{
+			v.Address,
+			strconv.FormatInt(v.Balance, 10),
+			strconv.FormatFloat(v.Share, 'f', 8, 64),
+			strconv.FormatInt(v.Gross, 10),
+			strconv.FormatInt(v.Fee, 10),
+			strconv.FormatInt(v.Amount, 10),
+			v.Skipped,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// PayoutTxConfig sets the source and limits of payout transactions.
+type PayoutTxConfig struct {
+	Source       chain.Address
+	Counter      int64 // first counter to use, i.e. the source's current counter + 1
+	Fee          int64
+	GasLimit     int64
+	StorageLimit int64
+	BatchSize    int // max transactions per operation group
+}
+
+func (c PayoutTxConfig) withDefaults() PayoutTxConfig {
+	if c.Fee <= 0 {
+		c.Fee = DefaultPayoutTxFee
+	}
+	if c.GasLimit <= 0 {
+		c.GasLimit = DefaultPayoutGasLimit
+	}
+	if c.StorageLimit <= 0 {
+		c.StorageLimit = DefaultPayoutStorageLimit
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultPayoutBatchSize
+	}
+	return c
+}
+
+// Transactions returns one transaction per payout that is not skipped, split
+// into batches with consecutive counters.
+func (r *PayoutReport) Transactions(cfg PayoutTxConfig) ([]rpc.Operations, error) {
+	cfg = cfg.withDefaults()
+	if !cfg.Source.IsValid() {
+		return nil, fmt.Errorf("payout: invalid source address")
+	}
+	batches := make([]rpc.Operations, 0)
+	var ops rpc.Operations
+	counter := cfg.Counter
+	for _, v := range r.Payouts {
+		if v.Skipped != "" {
+			continue
+		}
+		dst, err := chain.ParseAddress(v.Address)
+		if err != nil {
+			return nil, fmt.Errorf("payout: %s: %v", v.Address, err)
+		}
+		ops = append(ops, &rpc.TransactionOp{
+			GenericOp:    rpc.GenericOp{Kind: chain.OpTypeTransaction},
+			Source:       cfg.Source,
+			Destination:  dst,
+			Fee:          cfg.Fee,
+			Amount:       v.Amount,
+			Counter:      counter,
+			GasLimit:     cfg.GasLimit,
+			StorageLimit: cfg.StorageLimit,
+		})
+		counter++
+		if len(ops) == cfg.BatchSize {
+			batches = append(batches, ops)
+			ops = nil
+		}
+	}
+	if len(ops) > 0 {
+		batches = append(batches, ops)
+	}
+	return batches, nil
+}
+
+// Forge encodes all payout batches as unsigned operation groups on branch.
+func (r *PayoutReport) Forge(branch chain.BlockHash, cfg PayoutTxConfig, p *chain.Params) ([][]byte, error) {
+	batches, err := r.Transactions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	res := make([][]byte, len(batches))
+	for i, ops := range batches {
+		if res[i], err = rpc.Forge(branch, ops, p); err != nil {
+			return nil, fmt.Errorf("payout: batch %d: %v", i, err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,88 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func TestCalculatePayouts(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	addr := func(b byte) chain.Address {
+		return chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{b}, 20))
+	}
+	for id := 1; id <= 5; id++ {
+		a := addr(byte(id))
+		assert.NoError(t, db.Create(&models.Account{RowId: models.AccountID(id), Hash: a.Hash, Type: a.Type}).Error)
+	}
+	p := &chain.Params{PreservedCycles: 5, OperationTagsVersion: 1}
+	assert.NoError(t, db.Create(&models.Income{
+		Cycle: 17, AccountId: 1, TotalIncome: 1000000, FeesIncome: 5000, TotalLost: 5000,
+	}).Error)
+	snaps := []*models.Snapshot{
+		{Cycle: 10, Index: 3, IsSelected: true, AccountId: 1, DelegateId: 1, IsDelegate: true, Balance: 6000, Delegated: 4000},
+		{Cycle: 10, Index: 3, IsSelected: true, AccountId: 2, DelegateId: 1, Balance: 2000},
+		{Cycle: 10, Index: 3, IsSelected: true, AccountId: 3, DelegateId: 1, Balance: 1000},
+		{Cycle: 10, Index: 3, IsSelected: true, AccountId: 4, DelegateId: 1, Balance: 990},
+		{Cycle: 10, Index: 3, IsSelected: true, AccountId: 5, DelegateId: 1, Balance: 10},
+		// other snapshot of the same cycle
+		{Cycle: 10, Index: 2, AccountId: 2, DelegateId: 1, Balance: 9999},
+	}
+	for _, s := range snaps {
+		assert.NoError(t, db.Create(s).Error)
+	}
+
+	cfg := PayoutConfig{Cycle: 17, Fee: 0.1, MinPayout: 1000}
+	r, err := calculatePayouts(db, p, 1, map[models.AccountID]bool{4: true}, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10000), r.StakingBalance)
+	assert.Equal(t, int64(1000000), r.Rewards)
+	if assert.Len(t, r.Payouts, 4) {
+		assert.Equal(t, addr(2).String(), r.Payouts[0].Address)
+		assert.Equal(t, int64(200000), r.Payouts[0].Gross)
+		assert.Equal(t, int64(20000), r.Payouts[0].Fee)
+		assert.Equal(t, int64(180000), r.Payouts[0].Amount)
+		assert.Equal(t, int64(90000), r.Payouts[1].Amount)
+		assert.Equal(t, PayoutSkipExcluded, r.Payouts[2].Skipped)
+		assert.Equal(t, int64(900), r.Payouts[3].Amount)
+		assert.Equal(t, PayoutSkipMinimum, r.Payouts[3].Skipped)
+	}
+	assert.Equal(t, int64(270000), r.TotalPaid)
+	assert.Equal(t, int64(30000), r.TotalFees)
+	assert.Equal(t, int64(730000), r.BakerRewards)
+
+	// reports are reproducible
+	r2, err := calculatePayouts(db, p, 1, map[models.AccountID]bool{4: true}, cfg)
+	assert.NoError(t, err)
+	var buf1, buf2 bytes.Buffer
+	assert.NoError(t, r.WriteCSV(&buf1))
+	assert.NoError(t, r2.WriteCSV(&buf2))
+	assert.Equal(t, buf1.String(), buf2.String())
+	lines := strings.Split(strings.TrimSpace(buf1.String()), "\n")
+	assert.Len(t, lines, 5)
+	assert.Equal(t, addr(2).String()+",2000,0.20000000,200000,20000,180000,", lines[1])
+
+	_, err = calculatePayouts(db, p, 1, nil, PayoutConfig{Cycle: 18})
+	assert.Error(t, err)
+
+	// unsigned batches skip excluded and small payouts
+	src := addr(9)
+	batches, err := r.Transactions(PayoutTxConfig{Source: src, Counter: 7, BatchSize: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, batches, 2) {
+		assert.Equal(t, int64(8), batches[1][0].(*rpc.TransactionOp).Counter)
+	}
+	groups, err := r.Forge(chain.NewBlockHash(bytes.Repeat([]byte{0xaa}, 32)), PayoutTxConfig{Source: src, Counter: 7}, p)
+	assert.NoError(t, err)
+	if assert.Len(t, groups, 1) {
+		assert.True(t, strings.HasPrefix(hex.EncodeToString(groups[0]), strings.Repeat("aa", 32)+"6c"))
+	}
+}
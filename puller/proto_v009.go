@@ -0,0 +1,26 @@
+package puller
+
+import (
+	"tezos_index/chain"
+)
+
+func init() {
+	registerHandler(florenceHandler{BaseHandler{Proto: chain.ProtoV009}})
+}
+
+// florenceHandler sets Florence protocol params, v009 removed the test chain.
+type florenceHandler struct {
+	BaseHandler
+}
+
+func (h florenceHandler) Params(p *chain.Params) *chain.Params {
+	pp := *p
+	pp.Version = 9
+	pp.OperationTagsVersion = 1
+	pp.NumVotingPeriods = 5
+	if pp.ChainId.IsEqual(chain.Mainnet) {
+		pp.StartBlockOffset = 1466368
+	}
+	// no invoice
+	return &pp
+}
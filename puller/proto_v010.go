@@ -0,0 +1,67 @@
+package puller
+
+import (
+	"fmt"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func init() {
+	registerHandler(granadaHandler{BaseHandler{Proto: chain.ProtoV010}})
+}
+
+// granadaHandler sets Granada protocol params and books the liquidity
+// baking subsidy and migration credits which v010 and later mark by balance
+// update origin.
+type granadaHandler struct {
+	BaseHandler
+}
+
+func (h granadaHandler) Params(p *chain.Params) *chain.Params {
+	pp := *p
+	pp.Version = 10
+	pp.OperationTagsVersion = 1
+	pp.NumVotingPeriods = 5
+	if pp.ChainId.IsEqual(chain.Mainnet) {
+		pp.StartBlockOffset = 1589248
+		// cycles double to 8192 blocks starting at cycle 388
+		pp.StartCycle = 388
+		pp.StartCycleHeight = 1589249
+	}
+	// no invoice, liquidity baking subsidy is paid per block
+	return &pp
+}
+
+func (h granadaHandler) BalanceUpdate(b *Builder, upd rpc.BalanceUpdate) ([]*models.Flow, bool, error) {
+	u, ok := upd.(*rpc.ContractBalanceUpdate)
+	if !ok {
+		return nil, false, nil
+	}
+	switch u.Origin {
+	case rpc.BalanceUpdateOriginSubsidy:
+		// subsidy minted into the liquidity baking contract
+		acc, ok := b.AccountByAddress(u.Contract)
+		if !ok {
+			return nil, false, fmt.Errorf("missing account %s", u.Contract)
+		}
+		f := models.NewFlow(b.block, acc, acc)
+		f.Category = models.FlowCategoryBalance
+		f.Operation = models.FlowTypeSubsidy
+		f.AmountIn = u.Change
+		f.TokenGenMin = 1
+		return []*models.Flow{f}, true, nil
+	case rpc.BalanceUpdateOriginMigration:
+		// protocol migration credit, invoices from params are applied
+		// separately
+		if _, ok := b.block.Params.Invoices[u.Contract.String()]; ok {
+			return nil, true, nil
+		}
+		acc, ok := b.AccountByAddress(u.Contract)
+		if !ok {
+			return nil, false, fmt.Errorf("missing account %s", u.Contract)
+		}
+		return []*models.Flow{b.NewInvoiceFlow(acc, u.Change)}, true, nil
+	}
+	return nil, false, nil
+}
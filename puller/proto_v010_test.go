@@ -0,0 +1,53 @@
+package puller
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func TestGranadaBalanceUpdate(t *testing.T) {
+	lb := chain.NewAddress(chain.AddressTypeContract, bytes.Repeat([]byte{0x11}, 20))
+	acc := models.NewAccount(lb)
+	acc.RowId = 7
+	b := &Builder{
+		accHashMap: map[uint64]*models.Account{accountHashKey(acc): acc},
+		dlgHashMap: make(map[uint64]*models.Account),
+		block:      &models.Block{Height: 1589249, Params: chain.NewParams()},
+	}
+	h := granadaHandler{BaseHandler{Proto: chain.ProtoV010}}
+
+	upd := &rpc.ContractBalanceUpdate{
+		GenericBalanceUpdate: rpc.GenericBalanceUpdate{Kind: "contract", Change: 2500000, Origin: rpc.BalanceUpdateOriginSubsidy},
+		Contract:             lb,
+	}
+	flows, ok, err := h.BalanceUpdate(b, upd)
+	if assert.NoError(t, err) && assert.True(t, ok) && assert.Len(t, flows, 1) {
+		assert.Equal(t, models.FlowTypeSubsidy, flows[0].Operation)
+		assert.Equal(t, models.FlowCategoryBalance, flows[0].Category)
+		assert.Equal(t, int64(2500000), flows[0].AmountIn)
+		assert.Equal(t, acc.RowId, flows[0].AccountId)
+	}
+
+	upd.Origin = rpc.BalanceUpdateOriginMigration
+	flows, ok, err = h.BalanceUpdate(b, upd)
+	if assert.NoError(t, err) && assert.True(t, ok) && assert.Len(t, flows, 1) {
+		assert.Equal(t, models.FlowTypeInvoice, flows[0].Operation)
+	}
+
+	// invoices from params are booked separately
+	b.block.Params.Invoices = map[string]int64{lb.String(): 2500000}
+	flows, ok, err = h.BalanceUpdate(b, upd)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, flows, 0)
+
+	// regular block rewards use the generic logic
+	upd.Origin = rpc.BalanceUpdateOriginBlock
+	_, ok, err = h.BalanceUpdate(b, upd)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
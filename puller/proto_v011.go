@@ -0,0 +1,29 @@
+package puller
+
+import (
+	"tezos_index/chain"
+)
+
+func init() {
+	registerHandler(hangzhouHandler{granadaHandler{BaseHandler{Proto: chain.ProtoV011_1}}})
+	registerHandler(hangzhouHandler{granadaHandler{BaseHandler{Proto: chain.ProtoV011_2}}})
+}
+
+// hangzhouHandler sets Hangzhou protocol params and books balance updates
+// like Granada. v011 adds global constants.
+type hangzhouHandler struct {
+	granadaHandler
+}
+
+func (h hangzhouHandler) Params(p *chain.Params) *chain.Params {
+	pp := h.granadaHandler.Params(p)
+	pp.Version = 11
+	pp.OperationTags = map[string]byte{
+		chain.OpTypeRegisterConstant.String(): 111,
+	}
+	if pp.ChainId.IsEqual(chain.Mainnet) {
+		pp.StartBlockOffset = 1916928
+	}
+	// no invoice
+	return pp
+}
@@ -0,0 +1,62 @@
+package puller
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func TestHangzhouParams(t *testing.T) {
+	h, err := chain.ParseProtocolHash("PtHangz2aRngywmSRGGvrcTyMbbdpWdpFKuS4uMWxg2RaH9i1qx")
+	if !assert.NoError(t, err) {
+		return
+	}
+	p := chain.NewParams().ForNetwork(chain.Mainnet).ForProtocol(h)
+	p = NewRegistry().Handler(h).Params(p)
+	assert.Equal(t, 11, p.Version)
+	assert.Equal(t, int64(388), p.StartCycle)
+	assert.Equal(t, int64(1916928), p.StartBlockOffset)
+	assert.Equal(t, byte(111), chain.OpTypeRegisterConstant.Tag(p))
+	assert.Equal(t, byte(108), chain.OpTypeTransaction.Tag(p))
+	p.BlocksPerCycle = 8192
+	assert.Equal(t, int64(428), p.CycleFromHeight(1916929))
+}
+
+func TestBlockFetchRPCParams(t *testing.T) {
+	hash := testBlockHash(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chains/main/blocks/" + hash.String():
+			w.Write([]byte(`{"protocol":"` + chain.ProtoV011_2.String() + `","chain_id":"NetXdQprcVkpaWU",` +
+				`"hash":"` + hash.String() + `","header":{"level":1916930,"proto":11,` +
+				`"predecessor":"BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2","timestamp":"2021-12-04T11:56:44Z"},` +
+				`"metadata":{"protocol":"` + chain.ProtoV011_2.String() + `"},"operations":[]}`))
+		case "/chains/main/blocks/1916930/context/constants":
+			w.Write([]byte(`{"preserved_cycles":5,"blocks_per_cycle":8192,"blocks_per_roll_snapshot":512}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client, err := rpc.NewClient(nil, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blocks loaded for reorgs get params from the protocol handler
+	b := &models.Block{Height: 1916930, Hash: chain.StrBHash(hash.String())}
+	reg := NewRegistry()
+	if !assert.NoError(t, b.FetchRPC(context.Background(), client, reg.BlockParams)) {
+		return
+	}
+	assert.Equal(t, 11, b.Params.Version)
+	assert.Equal(t, 11, b.Params.Deployment)
+	assert.Equal(t, int64(8192), b.Params.BlocksPerCycle)
+	assert.Equal(t, int64(428), b.Params.CycleFromHeight(b.Height))
+	assert.Equal(t, byte(111), chain.OpTypeRegisterConstant.Tag(b.Params))
+}
@@ -4,22 +4,148 @@
 package puller
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
 )
 
+// ProtocolHandler implements behaviour that is specific to a single protocol.
+// Protocols without a handler use BaseHandler, i.e. params from
+// chain.Params.ForProtocol and the generic builder logic. Protocols from
+// Florence v009 on are described by their handler alone, a new protocol
+// adds one proto_vNNN.go file.
+type ProtocolHandler interface {
+	// Protocol returns the hash of the handled protocol.
+	Protocol() chain.ProtocolHash
+
+	// Params adjusts params derived from node constants, network and
+	// protocol, e.g. version, voting offsets and op tags. It must return a
+	// copy when p is changed.
+	Params(p *chain.Params) *chain.Params
+
+	// Operations returns constructors for op kinds that are new or changed
+	// in this protocol. They are registered with the rpc decoder and used
+	// for blocks of this protocol only.
+	Operations() map[chain.OpType]func() rpc.Operation
+
+	// Migrate runs on the first block of the protocol before invoices are
+	// applied. It is not called on rollback.
+	Migrate(ctx context.Context, b *Builder, prev, next *chain.Params) error
+
+	// BalanceUpdate interprets a balance update from block metadata. When
+	// ok is false the generic baker flow logic handles the update.
+	BalanceUpdate(b *Builder, upd rpc.BalanceUpdate) (flows []*models.Flow, ok bool, err error)
+}
+
+// BaseHandler implements ProtocolHandler without protocol specific behaviour.
+// Handlers embed it and override what they need.
+type BaseHandler struct {
+	Proto chain.ProtocolHash
+}
+
+func (h BaseHandler) Protocol() chain.ProtocolHash {
+	return h.Proto
+}
+
+func (h BaseHandler) Params(p *chain.Params) *chain.Params {
+	return p
+}
+
+func (h BaseHandler) Operations() map[chain.OpType]func() rpc.Operation {
+	return nil
+}
+
+func (h BaseHandler) Migrate(ctx context.Context, b *Builder, prev, next *chain.Params) error {
+	return nil
+}
+
+func (h BaseHandler) BalanceUpdate(b *Builder, upd rpc.BalanceUpdate) ([]*models.Flow, bool, error) {
+	return nil, false, nil
+}
+
+// knownHandlers are added to every new registry, handler files register
+// themselves from init.
+var knownHandlers = make([]ProtocolHandler, 0)
+
+func registerHandler(h ProtocolHandler) {
+	knownHandlers = append(knownHandlers, h)
+}
+
+// Registry is safe for concurrent use by block prefetchers.
 type Registry struct {
+	mu           sync.RWMutex
 	byProtocol   map[string]*chain.Params
 	byDeployment map[int]*chain.Params
 	inOrder      []*chain.Params
+	handlers     map[string]ProtocolHandler
 }
 
 func NewRegistry() *Registry {
-	return &Registry{
+	r := &Registry{
 		byProtocol:   make(map[string]*chain.Params),
 		byDeployment: make(map[int]*chain.Params),
 		inOrder:      make([]*chain.Params, 0),
+		handlers:     make(map[string]ProtocolHandler),
+	}
+	for _, h := range knownHandlers {
+		r.RegisterHandler(h)
+	}
+	return r
+}
+
+// RegisterHandler registers h for its protocol and its op decoders with the
+// rpc package. A later handler for the same protocol replaces the former.
+func (r *Registry) RegisterHandler(h ProtocolHandler) {
+	r.mu.Lock()
+	r.handlers[h.Protocol().String()] = h
+	r.mu.Unlock()
+	for kind, fn := range h.Operations() {
+		rpc.RegisterOperation(h.Protocol(), kind, fn)
+	}
+}
+
+// Handler returns the handler for protocol h or a BaseHandler when none is
+// registered.
+func (r *Registry) Handler(h chain.ProtocolHash) ProtocolHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if v, ok := r.handlers[h.String()]; ok {
+		return v
 	}
+	return BaseHandler{Proto: h}
+}
+
+// BlockParams returns params for block. Params of known protocols are
+// reused, at cycle starts and for new protocols they are built from node
+// constants and the protocol handler.
+func (r *Registry) BlockParams(ctx context.Context, c *rpc.Client, block *rpc.Block) (*chain.Params, error) {
+	height := block.Header.Level
+	p, err := r.GetParams(block.Protocol)
+	if err == nil && !p.IsCycleStart(height) {
+		return p, nil
+	}
+	// fetch params from chain
+	if height > 0 {
+		cons, err := c.GetConstantsHeight(ctx, height)
+		if err != nil {
+			return nil, fmt.Errorf("block init: %v", err)
+		}
+		p = cons.MapToChainParams()
+	} else {
+		p = chain.NewParams()
+	}
+	// changes will be updated during build
+	p = p.ForNetwork(block.ChainId).ForProtocol(block.Protocol)
+	p = r.Handler(block.Protocol).Params(p)
+	p.Deployment = block.Header.Proto
+	// adjust deployment number for genesis & bootstrap blocks
+	if height <= 1 {
+		p.Deployment--
+	}
+	return p, nil
 }
 
 // Register registers network parameters for a Tezos network.
@@ -27,6 +153,8 @@ func (r *Registry) Register(p *chain.Params) error {
 	if !p.Protocol.IsValid() {
 		return fmt.Errorf("invalid protocol hash %s", p.Protocol)
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	_, isUpdate := r.byProtocol[p.Protocol.String()]
 	r.byProtocol[p.Protocol.String()] = p
 	r.byDeployment[p.Deployment] = p
@@ -39,6 +167,8 @@ func (r *Registry) Register(p *chain.Params) error {
 }
 
 func (r *Registry) GetParams(h chain.ProtocolHash) (*chain.Params, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if p, ok := r.byProtocol[h.String()]; !ok {
 		return nil, fmt.Errorf("unknown protocol %s", h)
 	} else {
@@ -47,15 +177,20 @@ func (r *Registry) GetParams(h chain.ProtocolHash) (*chain.Params, error) {
 }
 
 func (r *Registry) GetParamsByHeight(height int64) *chain.Params {
+	r.mu.RLock()
 	for _, v := range r.byDeployment {
 		if height >= v.StartHeight && (v.EndHeight < 0 || height <= v.EndHeight) {
+			r.mu.RUnlock()
 			return v
 		}
 	}
+	r.mu.RUnlock()
 	return r.GetParamsLatest()
 }
 
 func (r *Registry) GetParamsByDeployment(v int) (*chain.Params, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if p, ok := r.byDeployment[v]; !ok {
 		return nil, fmt.Errorf("unknown protocol deployment %d", v)
 	} else {
@@ -64,10 +199,23 @@ func (r *Registry) GetParamsByDeployment(v int) (*chain.Params, error) {
 }
 
 func (r *Registry) GetAllParams() []*chain.Params {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.inOrder
 }
 
+// Deployments returns a copy of all params in activation order.
+func (r *Registry) Deployments() chain.Deployments {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d := make(chain.Deployments, len(r.inOrder))
+	copy(d, r.inOrder)
+	return d
+}
+
 func (r *Registry) GetParamsLatest() *chain.Params {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	l := len(r.inOrder)
 	if l == 0 {
 		return nil
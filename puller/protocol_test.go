@@ -0,0 +1,71 @@
+package puller
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/rpc"
+)
+
+type testLimitOp struct {
+	rpc.SetDepositsLimitOp
+	Extra string `json:"extra"`
+}
+
+type testHandler struct {
+	BaseHandler
+}
+
+func (h testHandler) Params(p *chain.Params) *chain.Params {
+	pp := *p
+	pp.BlocksPerCycle = 42
+	return &pp
+}
+
+func (h testHandler) Operations() map[chain.OpType]func() rpc.Operation {
+	return map[chain.OpType]func() rpc.Operation{
+		chain.OpTypeSetDepositsLimit: func() rpc.Operation { return &testLimitOp{} },
+	}
+}
+
+func TestRegistryHandler(t *testing.T) {
+	r := NewRegistry()
+	_, ok := r.Handler(chain.ProtoV010).(granadaHandler)
+	assert.True(t, ok)
+	h := r.Handler(chain.ProtoV008_2)
+	assert.Equal(t, BaseHandler{Proto: chain.ProtoV008_2}, h)
+	p := chain.NewParams()
+	assert.Equal(t, p, h.Params(p))
+
+	r.RegisterHandler(testHandler{BaseHandler{Proto: chain.ProtoV008_2}})
+	defer rpc.RegisterOperation(chain.ProtoV008_2, chain.OpTypeSetDepositsLimit, nil)
+	assert.Equal(t, int64(42), r.Handler(chain.ProtoV008_2).Params(p).BlocksPerCycle)
+	assert.NotEqual(t, int64(42), p.BlocksPerCycle)
+
+	// handler op types are used for blocks of their protocol only
+	for _, v := range []struct {
+		proto  chain.ProtocolHash
+		custom bool
+	}{
+		{chain.ProtoV008_2, true},
+		{chain.ProtoV010, false},
+	} {
+		var oh rpc.OperationHeader
+		err := json.Unmarshal([]byte(`{"protocol":"`+v.proto.String()+`",`+
+			`"contents":[{"kind":"set_deposits_limit","fee":"100","extra":"x"}]}`), &oh)
+		if !assert.NoError(t, err) || !assert.Len(t, oh.Contents, 1) {
+			continue
+		}
+		if v.custom {
+			op, ok := oh.Contents[0].(*testLimitOp)
+			if assert.True(t, ok) {
+				assert.Equal(t, "x", op.Extra)
+				assert.Equal(t, int64(100), op.Fee)
+			}
+		} else {
+			_, ok := oh.Contents[0].(*rpc.SetDepositsLimitOp)
+			assert.True(t, ok, v.proto.String())
+		}
+	}
+}
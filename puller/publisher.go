@@ -0,0 +1,272 @@
+package puller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/zyjblockchain/sandy_log/log"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"time"
+)
+
+const (
+	// PublisherTipKey is the key of the last published block, stored next
+	// to the index tips.
+	PublisherTipKey = "publisher"
+
+	EventApply  = "apply"
+	EventRevert = "revert"
+
+	EventKindBlock = "block"
+	EventKindOp    = "op"
+	EventKindFlow  = "flow"
+
+	// max number of blocks replayed from the database per connected block
+	// when the publisher falls behind the index
+	publisherMaxReplay = 64
+)
+
+// Message is a single keyed message for a topic.
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+}
+
+// Producer delivers messages to a message bus. Produce must only return nil
+// after all messages have been acknowledged by the bus.
+type Producer interface {
+	Produce(ctx context.Context, msgs []Message) error
+	Close() error
+}
+
+// Event is the envelope of all published messages.
+type Event struct {
+	Action string      `json:"action"` // apply or revert
+	Kind   string      `json:"kind"`   // block, op or flow
+	Height int64       `json:"height"`
+	Block  string      `json:"block"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+type BlockEvent struct {
+	*models.Block
+	Baker string `json:"baker,omitempty"`
+}
+
+type OpEvent struct {
+	*models.Op
+	Sender   string `json:"sender,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+}
+
+type FlowEvent struct {
+	*models.Flow
+	Address string `json:"address,omitempty"`
+}
+
+type PublisherConfig struct {
+	Producer   Producer
+	BlockTopic string
+	OpTopic    string
+	FlowTopic  string
+}
+
+// Publisher pushes indexed blocks, ops and flows to a message bus after they
+// have been committed. Delivery is at-least-once: the last published block is
+// stored as publisher tip and blocks missed due to delivery errors are replayed
+// from the database.
+type Publisher struct {
+	cfg     PublisherConfig
+	db      *gorm.DB
+	cachedb CacheDB
+	tip     *IndexTip
+}
+
+func NewPublisher(cfg PublisherConfig) *Publisher {
+	return &Publisher{cfg: cfg}
+}
+
+// Init loads the publisher tip. On first run publishing starts at the current
+// chain tip.
+func (p *Publisher) Init(db *gorm.DB, cachedb CacheDB, tip *models.ChainTip) error {
+	p.db = db
+	p.cachedb = cachedb
+	t, err := dbLoadIndexTip(cachedb, PublisherTipKey)
+	switch err {
+	case nil:
+		p.tip = t
+	case ErrNoTable:
+		hash := tip.BestHash.Clone()
+		p.tip = &IndexTip{Hash: &hash, Height: tip.BestHeight}
+		if err := dbStoreIndexTip(cachedb, PublisherTipKey, p.tip); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	log.Infof("Publishing events after block %d.", p.tip.Height)
+	return nil
+}
+
+func (p *Publisher) Close() error {
+	return p.cfg.Producer.Close()
+}
+
+// ConnectBlock publishes apply events for a committed block. When the
+// publisher is behind, missing blocks are replayed first and the current block
+// is left for a later replay if the gap could not be closed.
+func (p *Publisher) ConnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder) error {
+	if err := p.catchUp(ctx, block.Height-1); err != nil {
+		return err
+	}
+	if p.tip.Height != block.Height-1 {
+		return nil
+	}
+	msgs, err := p.buildMessages(EventApply, block, block.Ops, block.Flows, builderAddress(builder))
+	if err != nil {
+		return err
+	}
+	if err := p.cfg.Producer.Produce(ctx, msgs); err != nil {
+		return err
+	}
+	return p.storeTip(block.Height, block.Hash.String())
+}
+
+// DisconnectBlock publishes revert events for a block removed during reorg.
+// Blocks that have never been published are skipped.
+func (p *Publisher) DisconnectBlock(ctx context.Context, block *models.Block, builder models.BlockBuilder) error {
+	if p.tip.Height < block.Height {
+		return nil
+	}
+	msgs, err := p.buildMessages(EventRevert, block, block.Ops, block.Flows, builderAddress(builder))
+	if err != nil {
+		return err
+	}
+	if err := p.cfg.Producer.Produce(ctx, msgs); err != nil {
+		return err
+	}
+	return p.storeTip(block.Height-1, block.TZ.Parent().String())
+}
+
+// catchUp replays blocks up to height from the database.
+func (p *Publisher) catchUp(ctx context.Context, height int64) error {
+	for n := 0; p.tip.Height < height && n < publisherMaxReplay; n++ {
+		h := p.tip.Height + 1
+		block := &models.Block{}
+		if err := p.db.Where("height = ? and is_orphan = ?", h, false).First(block).Error; err != nil {
+			return fmt.Errorf("replay block %d: %v", h, err)
+		}
+		ops := make([]*models.Op, 0)
+		if err := p.db.Where("height = ?", h).Order("row_id").Find(&ops).Error; err != nil {
+			return fmt.Errorf("replay ops %d: %v", h, err)
+		}
+		flows := make([]*models.Flow, 0)
+		if err := p.db.Where("height = ?", h).Order("row_id").Find(&flows).Error; err != nil {
+			return fmt.Errorf("replay flows %d: %v", h, err)
+		}
+		lookup, err := p.dbAddress(block, ops, flows)
+		if err != nil {
+			return fmt.Errorf("replay accounts %d: %v", h, err)
+		}
+		msgs, err := p.buildMessages(EventApply, block, ops, flows, lookup)
+		if err != nil {
+			return err
+		}
+		if err := p.cfg.Producer.Produce(ctx, msgs); err != nil {
+			return err
+		}
+		if err := p.storeTip(h, block.Hash.String()); err != nil {
+			return err
+		}
+		log.Debugf("Replayed events for block %d", h)
+	}
+	return nil
+}
+
+func (p *Publisher) storeTip(height int64, hash string) error {
+	h, err := chain.ParseBlockHash(hash)
+	if err != nil {
+		return err
+	}
+	p.tip = &IndexTip{Hash: &h, Height: height}
+	return dbStoreIndexTip(p.cachedb, PublisherTipKey, p.tip)
+}
+
+func builderAddress(builder models.BlockBuilder) func(models.AccountID) string {
+	return func(id models.AccountID) string {
+		if id == 0 {
+			return ""
+		}
+		if acc, ok := builder.AccountById(id); ok {
+			return acc.String()
+		}
+		return ""
+	}
+}
+
+// dbAddress resolves all accounts referenced by a replayed block.
+func (p *Publisher) dbAddress(block *models.Block, ops []*models.Op, flows []*models.Flow) (func(models.AccountID) string, error) {
+	ids := []uint64{block.BakerId.Value()}
+	for _, op := range ops {
+		ids = append(ids, op.SenderId.Value(), op.ReceiverId.Value())
+	}
+	for _, f := range flows {
+		ids = append(ids, f.AccountId.Value())
+	}
+	accs := make([]*models.Account, 0)
+	if err := p.db.Select("row_id, hash, address_type").Where("row_id in (?)", ids).Find(&accs).Error; err != nil {
+		return nil, err
+	}
+	addrs := make(map[models.AccountID]string, len(accs))
+	for _, acc := range accs {
+		addrs[acc.RowId] = acc.String()
+	}
+	return func(id models.AccountID) string {
+		return addrs[id]
+	}, nil
+}
+
+func (p *Publisher) buildMessages(action string, block *models.Block, ops []*models.Op, flows []*models.Flow, addr func(models.AccountID) string) ([]Message, error) {
+	msgs := make([]Message, 0, 1+len(ops)+len(flows))
+	add := func(topic, kind, key string, data interface{}) error {
+		buf, err := json.Marshal(Event{
+			Action: action,
+			Kind:   kind,
+			Height: block.Height,
+			Block:  block.Hash.String(),
+			Time:   block.Timestamp,
+			Data:   data,
+		})
+		if err != nil {
+			return fmt.Errorf("encoding %s event for block %d: %v", kind, block.Height, err)
+		}
+		msgs = append(msgs, Message{Topic: topic, Key: []byte(key), Value: buf})
+		return nil
+	}
+
+	baker := addr(block.BakerId)
+	if err := add(p.cfg.BlockTopic, EventKindBlock, baker, BlockEvent{Block: block, Baker: baker}); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		ev := OpEvent{Op: op, Sender: addr(op.SenderId), Receiver: addr(op.ReceiverId)}
+		key := ev.Sender
+		if key == "" {
+			key = ev.Receiver
+		}
+		if err := add(p.cfg.OpTopic, EventKindOp, key, ev); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range flows {
+		ev := FlowEvent{Flow: f, Address: addr(f.AccountId)}
+		if err := add(p.cfg.FlowTopic, EventKindFlow, ev.Address, ev); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
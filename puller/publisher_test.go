@@ -0,0 +1,60 @@
+package puller
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/puller/models"
+)
+
+func TestPublisher_BuildMessages(t *testing.T) {
+	p := NewPublisher(PublisherConfig{
+		BlockTopic: "blocks",
+		OpTopic:    "ops",
+		FlowTopic:  "flows",
+	})
+	addrs := map[models.AccountID]string{
+		1: "tz1baker",
+		2: "tz1sender",
+		3: "KT1receiver",
+	}
+	block := &models.Block{Height: 42, BakerId: 1, Hash: "BLockHash"}
+	ops := []*models.Op{
+		{SenderId: 2, ReceiverId: 3},
+		{ReceiverId: 3},
+	}
+	flows := []*models.Flow{{AccountId: 2}}
+
+	msgs, err := p.buildMessages(EventRevert, block, ops, flows, func(id models.AccountID) string {
+		return addrs[id]
+	})
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 4)
+
+	expected := []struct{ topic, key string }{
+		{"blocks", "tz1baker"},
+		{"ops", "tz1sender"},
+		{"ops", "KT1receiver"},
+		{"flows", "tz1sender"},
+	}
+	for i, v := range expected {
+		assert.Equal(t, v.topic, msgs[i].Topic)
+		assert.Equal(t, v.key, string(msgs[i].Key))
+	}
+
+	ev := struct {
+		Action string `json:"action"`
+		Kind   string `json:"kind"`
+		Height int64  `json:"height"`
+		Data   struct {
+			Sender   string `json:"sender"`
+			Receiver string `json:"receiver"`
+		} `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(msgs[1].Value, &ev))
+	assert.Equal(t, EventRevert, ev.Action)
+	assert.Equal(t, EventKindOp, ev.Kind)
+	assert.Equal(t, int64(42), ev.Height)
+	assert.Equal(t, "tz1sender", ev.Data.Sender)
+	assert.Equal(t, "KT1receiver", ev.Data.Receiver)
+}
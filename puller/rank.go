@@ -4,209 +4,171 @@
 package puller
 
 import (
-	"context"
-	"github.com/zyjblockchain/sandy_log/log"
-	"sort"
-	"sync"
+	"github.com/jinzhu/gorm"
 	"tezos_index/chain"
 	model "tezos_index/puller/models"
-	util "tezos_index/utils"
-	"time"
 )
 
-const rankDefaultSize = 1 << 16
+// RankType selects the value accounts are ranked by.
+type RankType byte
 
-type AccountRankingEntry struct {
-	AccountId    model.AccountID
-	Address      chain.Address
-	Balance      int64 // total balance
-	TxFlow24h    int64 // tx volume in+out
-	TxTraffic24h int64 // number of tx in+out
-	RichRank     int   // assigned rank based on balance
-	FlowRank     int   // assigned rank based on flow
-	TrafficRank  int   // assigned rank based on traffic
+const (
+	RankRich    RankType = iota // total balance
+	RankFlow                    // 24h tx volume
+	RankTraffic                 // 24h tx count
+	RankInvalid = RankType(255)
+)
+
+func ParseRankType(s string) RankType {
+	switch s {
+	case "rich":
+		return RankRich
+	case "flow":
+		return RankFlow
+	case "traffic":
+		return RankTraffic
+	default:
+		return RankInvalid
+	}
 }
 
-type AccountRanking struct {
-	idmap   map[model.AccountID]*AccountRankingEntry // map for log-N lookups and updates
-	rich    ByRichRank
-	traffic ByTrafficRank
-	flow    ByFlowRank
+func (t RankType) IsValid() bool {
+	return t <= RankTraffic
 }
 
-func NewAccountRanking() *AccountRanking {
-	return &AccountRanking{
-		idmap:   make(map[model.AccountID]*AccountRankingEntry),
-		rich:    make(ByRichRank, 0, rankDefaultSize),
-		traffic: make(ByTrafficRank, 0, rankDefaultSize),
-		flow:    make(ByFlowRank, 0, rankDefaultSize),
+func (t RankType) String() string {
+	switch t {
+	case RankRich:
+		return "rich"
+	case RankFlow:
+		return "flow"
+	case RankTraffic:
+		return "traffic"
+	default:
+		return ""
 	}
 }
 
-func (h *AccountRanking) TopRich(n int) []*AccountRankingEntry {
-	return h.rich[:util.Min(n, len(h.flow))]
+func (t RankType) column() string {
+	switch t {
+	case RankFlow:
+		return "tx_flow_24h"
+	case RankTraffic:
+		return "tx_traffic_24h"
+	default:
+		return "balance"
+	}
 }
 
-func (h *AccountRanking) TopTraffic(n int) []*AccountRankingEntry {
-	return h.traffic[:util.Min(n, len(h.flow))]
+func (t RankType) value(r *model.AccountRank) int64 {
+	switch t {
+	case RankFlow:
+		return r.TxFlow24h
+	case RankTraffic:
+		return r.TxTraffic24h
+	default:
+		return r.Balance
+	}
 }
 
-func (h *AccountRanking) TopFlows(n int) []*AccountRankingEntry {
-	return h.flow[:util.Min(n, len(h.flow))]
+// AccountRankingEntry is an account's position in the rankings. Accounts
+// with equal values share a rank, zero values are not ranked.
+type AccountRankingEntry struct {
+	AccountId    model.AccountID `json:"account_id"`
+	Address      chain.Address   `json:"address"`
+	Height       int64           `json:"height"`
+	Balance      int64           `json:"balance"`        // total balance
+	TxFlow24h    int64           `json:"tx_flow_24h"`    // tx volume in+out
+	TxTraffic24h int64           `json:"tx_traffic_24h"` // number of tx in+out
+	RichRank     int             `json:"rich_rank"`      // assigned rank based on balance
+	FlowRank     int             `json:"flow_rank"`      // assigned rank based on flow
+	TrafficRank  int             `json:"traffic_rank"`   // assigned rank based on traffic
 }
 
-func (h *AccountRanking) GetAccount(id model.AccountID) (*AccountRankingEntry, bool) {
-	r, ok := h.idmap[id]
-	return r, ok
+func newRankingEntry(r *model.AccountRank) *AccountRankingEntry {
+	return &AccountRankingEntry{
+		AccountId:    r.AccountId,
+		Height:       r.Height,
+		Balance:      r.Balance,
+		TxFlow24h:    r.TxFlow24h,
+		TxTraffic24h: r.TxTraffic24h,
+	}
 }
 
-type ByRichRank []*AccountRankingEntry
-
-func (h ByRichRank) Len() int           { return len(h) }
-func (h ByRichRank) Less(i, j int) bool { return h[i].Balance > h[j].Balance }
-func (h ByRichRank) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-type ByTrafficRank []*AccountRankingEntry
-
-func (h ByTrafficRank) Len() int           { return len(h) }
-func (h ByTrafficRank) Less(i, j int) bool { return h[i].TxTraffic24h > h[j].TxTraffic24h }
-func (h ByTrafficRank) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-type ByFlowRank []*AccountRankingEntry
-
-func (h ByFlowRank) Len() int           { return len(h) }
-func (h ByFlowRank) Less(i, j int) bool { return h[i].TxFlow24h > h[j].TxFlow24h }
-func (h ByFlowRank) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-
-func (m *Indexer) GetRanking(ctx context.Context, now time.Time) (*AccountRanking, error) {
-	// lazy-load on first call
-	ranks := m.ranks.Load()
-	if ranks == nil {
-		// grab lock
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		// check again
-		ranks = m.ranks.Load()
-		// build if still not updated by other goroutine
-		if ranks == nil {
-			var err error
-			ranks, err = m.BuildAccountRanking(ctx, now)
-			if err != nil {
-				return nil, err
-			}
-			m.ranks.Store(ranks)
-		}
+func (e *AccountRankingEntry) setRank(t RankType, rank int) {
+	switch t {
+	case RankRich:
+		e.RichRank = rank
+	case RankFlow:
+		e.FlowRank = rank
+	case RankTraffic:
+		e.TrafficRank = rank
 	}
-	return ranks.(*AccountRanking), nil
 }
 
-func (m *Indexer) UpdateRanking(ctx context.Context, now time.Time) error {
-	ranks, err := m.BuildAccountRanking(ctx, now)
-	if err != nil {
-		return err
+// rankOf returns the dense rank of value among all accounts.
+func rankOf(db *gorm.DB, t RankType, value int64) (int, error) {
+	if value <= 0 {
+		return 0, nil
 	}
-	m.ranks.Store(ranks)
-	return nil
+	var res struct {
+		N int
+	}
+	col := t.column()
+	err := db.Model(&model.AccountRank{}).Select("count(distinct "+col+") as n").
+		Where(col+" > ?", value).Scan(&res).Error
+	return res.N + 1, err
 }
 
-func (m *Indexer) BuildAccountRanking(ctx context.Context, now time.Time) (*AccountRanking, error) {
-	start := time.Now()
-	ranks := NewAccountRanking()
-
-	// Step 1: capture accounts
-	var accs []*model.Account
-	err := m.statedb.Select("row_id, hash, address_type, frozen_deposits, "+
-		"frozen_rewards, frozen_fees, unclaimed_balance, spendable_balance, "+
-		"is_activated").Where("is_funded = ?", true).Find(&accs).Error
-	if err != nil {
+// listRanking returns a page of accounts ordered by rank, only the rank of
+// type t is set.
+func listRanking(db *gorm.DB, t RankType, offset, limit uint) ([]*AccountRankingEntry, error) {
+	col := t.column()
+	q := db.Where(col+" > ?", 0).Order(col + " desc").Order("account_id asc")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	if offset > 0 {
+		q = q.Offset(offset)
+	}
+	var rows []*model.AccountRank
+	if err := q.Find(&rows).Error; err != nil {
 		return nil, err
 	}
-	for _, a := range accs {
-		bal := a.FrozenDeposits + a.FrozenFees + a.FrozenRewards + a.SpendableBalance
-		if bal < 1 {
-			continue
-		}
-		acc := &AccountRankingEntry{
-			AccountId: a.RowId,
-			Address:   chain.NewAddress(a.Type, a.Hash),
-			Balance:   bal,
-		}
-		ranks.idmap[a.RowId] = acc
-		ranks.rich = append(ranks.rich, acc)
-		ranks.flow = append(ranks.flow, acc)
-		ranks.traffic = append(ranks.traffic, acc)
+	res := make([]*AccountRankingEntry, 0, len(rows))
+	if len(rows) == 0 {
+		return res, nil
 	}
-
-	var ops []*model.Op
-	err = m.statedb.Select("row_id, sender_id, receiver_id, "+
-		"volume").Where("time >= ? and type = ? and is_success = ?",
-		now.Add(-24*time.Hour), int64(chain.OpTypeTransaction), true).Find(&ops).Error
+	rank, err := rankOf(db, t, t.value(rows[0]))
 	if err != nil {
 		return nil, err
 	}
-	for _, o := range ops {
-		if sender, ok := ranks.idmap[o.SenderId]; ok {
-			sender.TxFlow24h += o.Volume
-			sender.TxTraffic24h++
-		}
-		if receiver, ok := ranks.idmap[o.ReceiverId]; ok {
-			receiver.TxFlow24h += o.Volume
-			receiver.TxTraffic24h++
+	for i, r := range rows {
+		if i > 0 && t.value(r) != t.value(rows[i-1]) {
+			rank++
 		}
+		e := newRankingEntry(r)
+		e.setRank(t, rank)
+		res = append(res, e)
 	}
+	return res, resolveRankingAddresses(db, res)
+}
 
-	// Step 3: sort embedded lists and assign rank order
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go func() {
-		sort.Stable(ranks.rich)
-		rank := 1
-		var last int64
-		for _, v := range ranks.rich {
-			if v.Balance == 0 {
-				continue
-			}
-			v.RichRank = rank
-			if v.Balance != last {
-				last = v.Balance
-				rank++
-			}
-		}
-		wg.Done()
-	}()
-	go func() {
-		sort.Stable(ranks.flow)
-		rank := 1
-		var last int64
-		for _, v := range ranks.flow {
-			if v.TxFlow24h == 0 {
-				continue
-			}
-			v.FlowRank = rank
-			if v.TxFlow24h != last {
-				last = v.TxFlow24h
-				rank++
-			}
-		}
-		wg.Done()
-	}()
-	go func() {
-		sort.Stable(ranks.traffic)
-		rank := 1
-		var last int64
-		for _, v := range ranks.rich {
-			if v.TxTraffic24h == 0 {
-				continue
-			}
-			v.TrafficRank = rank
-			if v.TxTraffic24h != last {
-				last = v.TxTraffic24h
-				rank++
-			}
-		}
-		wg.Done()
-	}()
-	wg.Wait()
-	log.Debugf("Ranks built in %s", time.Since(start))
-	return ranks, nil
+func resolveRankingAddresses(db *gorm.DB, entries []*AccountRankingEntry) error {
+	ids := make([]uint64, len(entries))
+	for i, e := range entries {
+		ids[i] = e.AccountId.Value()
+	}
+	var accs []*model.Account
+	if err := db.Select("row_id, hash, address_type").Where("row_id in (?)", ids).Find(&accs).Error; err != nil {
+		return err
+	}
+	addrs := make(map[model.AccountID]chain.Address, len(accs))
+	for _, a := range accs {
+		addrs[a.RowId] = a.Address()
+	}
+	for _, e := range entries {
+		e.Address = addrs[e.AccountId]
+	}
+	return nil
 }
@@ -0,0 +1,51 @@
+package puller
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+)
+
+func TestListRanking(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+
+	for _, r := range []*models.AccountRank{
+		{AccountId: 1, Balance: 300, TxTraffic24h: 2},
+		{AccountId: 2, Balance: 500},
+		{AccountId: 3, Balance: 300, TxTraffic24h: 5},
+		{AccountId: 4, Balance: 100, TxTraffic24h: 2},
+		{AccountId: 5},
+	} {
+		assert.NoError(t, db.Create(r).Error)
+	}
+
+	ranks, err := listRanking(db, RankRich, 0, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, ranks, 4) {
+		ids := []models.AccountID{ranks[0].AccountId, ranks[1].AccountId, ranks[2].AccountId, ranks[3].AccountId}
+		assert.Equal(t, []models.AccountID{2, 1, 3, 4}, ids)
+		assert.Equal(t, []int{1, 2, 2, 3}, []int{ranks[0].RichRank, ranks[1].RichRank, ranks[2].RichRank, ranks[3].RichRank})
+	}
+
+	// pages continue the rank of the previous page
+	ranks, err = listRanking(db, RankRich, 2, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, ranks, 2) {
+		assert.Equal(t, models.AccountID(3), ranks[0].AccountId)
+		assert.Equal(t, 2, ranks[0].RichRank)
+		assert.Equal(t, 3, ranks[1].RichRank)
+	}
+
+	ranks, err = listRanking(db, RankTraffic, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, ranks, 3) {
+		assert.Equal(t, []int{1, 2, 2}, []int{ranks[0].TrafficRank, ranks[1].TrafficRank, ranks[2].TrafficRank})
+		assert.Equal(t, 0, ranks[0].RichRank)
+	}
+
+	rank, err := rankOf(db, RankFlow, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rank)
+}
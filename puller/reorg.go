@@ -10,7 +10,9 @@ import (
 	"github.com/zyjblockchain/sandy_log/log"
 	"tezos_index/chain"
 	. "tezos_index/puller/models"
+	"tezos_index/reporting"
 	util "tezos_index/utils"
+	"time"
 )
 
 func (c *Crawler) Rollback(ctx context.Context, height int64, ignoreErrors bool) error {
@@ -84,6 +86,7 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 
 	// detach orphaned blocks from indexes first
 	if detach.Len() > 0 {
+		orphans := make([]*OrphanBlock, 0, detach.Len())
 		// guaranteed not to fail
 		e := detach.Front()
 		for block, parent := e.Value.(*Block), (*Block)(nil); block != nil; block = parent {
@@ -104,6 +107,7 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 			// we need resolved accounts to rebuild the previous balance set state
 			// so we keep identity data and rpc bundle and rebuild the current block
 			tz, bid, pid := block.TZ, block.RowId, block.ParentId
+			orphans = append(orphans, c.indexer.newOrphan(ctx, block))
 			block.Free()
 
 			// BuildReorg() uses previous parent or fork block as parent data!
@@ -120,20 +124,6 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 				block.ParentId = pid
 			}
 
-			// update indexes to rollback block
-
-			// disconnect block from indexes
-			log.Infof("REORGANIZE: dropping indexes for block %d %v", block.Height, block.Hash)
-			if err = c.indexer.DisconnectBlock(ctx, block, c.builder, ignoreErrors); err != nil {
-				return err
-			}
-
-			// flush after each detached block to make all delete/update ops durable
-			log.Infof("REORGANIZE: flushing databases")
-			if err := c.indexer.Flush(ctx); err != nil {
-				return fmt.Errorf("REORGANIZE: flushing tables failed for %d: %v", block.Height, err)
-			}
-
 			// rollback chain state to parent block
 			bHash, _ := chain.ParseBlockHash(parent.Hash.String())
 			newTip := &ChainTip{
@@ -150,8 +140,16 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 				Deployments:   tip.Deployments,
 			}
 
-			if err := dbStoreChainTip(c.indexer.cachedb, newTip); err != nil {
-				return fmt.Errorf("REORGANIZE: updating block database failed for %d: %v", block.Height, err)
+			// disconnect block from indexes, stores the parent as new chain tip
+			log.Infof("REORGANIZE: dropping indexes for block %d %v", block.Height, block.Hash)
+			if err = c.indexer.DisconnectBlock(ctx, block, c.builder, newTip, ignoreErrors); err != nil {
+				return err
+			}
+
+			// flush after each detached block to make all delete/update ops durable
+			log.Infof("REORGANIZE: flushing databases")
+			if err := c.indexer.Flush(ctx); err != nil {
+				return fmt.Errorf("REORGANIZE: flushing tables failed for %d: %v", block.Height, err)
 			}
 
 			// update chain tip
@@ -165,6 +163,29 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 		}
 		log.Infof("REORGANIZE: rollback to fork point %v (height %d) "+
 			"completed successfully.", tip.BestHash, tip.BestHeight)
+
+		// keep a trace of the fork, explicit rollbacks orphan nothing
+		if !rollbackOnly {
+			reorg := &Reorg{
+				Height:       forkBlock.Height,
+				Hash:         forkBlock.Hash,
+				Depth:        len(orphans),
+				NAttached:    attach.Len(),
+				OldTipHash:   orphans[0].Hash, // formerBest is freed while detaching
+				OldTipHeight: orphans[0].Height,
+				NewTipHash:   newBest.Hash,
+				NewTipHeight: newBest.Height,
+				Timestamp:    time.Now().UTC(),
+			}
+			// the log is informational, don't leave the chain detached
+			if err := c.indexer.StoreReorg(ctx, reorg, orphans); err != nil {
+				log.Errorf("REORGANIZE: storing reorg log at fork point %d: %v", reorg.Height, err)
+				reporting.Error(fmt.Errorf("storing reorg log: %v", err),
+					reporting.BlockTags(reorg.Height, reorg.Hash.String(), ""))
+			}
+			metricReorgs.Inc()
+			metricReorgDepth.Observe(float64(reorg.Depth))
+		}
 	}
 
 	// setup builder for attaching
@@ -208,44 +229,11 @@ func (c *Crawler) reorganize(ctx context.Context, formerBest, newBest *Block, ig
 		// update indexes; this will also generate a unique block id
 		// when the connected block is not yet known
 		log.Infof("REORGANIZE: indexing block %d %v", block.Height, block.Hash)
-		if err = c.indexer.ConnectBlock(ctx, block, c.builder); err != nil {
+		newTip := nextTip(tip, block)
+		if err = c.indexer.ConnectBlock(ctx, block, c.builder, newTip); err != nil {
 			return err
 		}
 
-		bHash, _ := chain.ParseBlockHash(block.Hash.String())
-		// foreward chain tip
-		newTip := &ChainTip{
-			Name:          tip.Name,
-			Symbol:        tip.Symbol,
-			ChainId:       tip.ChainId,
-			BestHash:      bHash,
-			BestId:        block.RowId,
-			BestHeight:    block.Height,
-			BestTime:      block.Timestamp,
-			GenesisTime:   tip.GenesisTime,
-			NYEveBlocks:   tip.NYEveBlocks,
-			QuarterBlocks: tip.QuarterBlocks,
-			Deployments:   tip.Deployments,
-		}
-
-		// update blockchain years
-		if newTip.GenesisTime.AddDate(0, 3*(len(newTip.QuarterBlocks)+1), 0).Before(block.Timestamp) {
-			newTip.QuarterBlocks = append(newTip.QuarterBlocks, block.Height)
-			log.Infof("Happy New Blockchain Quarter %d at block %d!", len(newTip.QuarterBlocks)+1, block.Height)
-		}
-		if newTip.GenesisTime.AddDate(len(newTip.NYEveBlocks)+1, 0, 0).Before(block.Timestamp) {
-			newTip.NYEveBlocks = append(newTip.NYEveBlocks, block.Height)
-			log.Infof("Happy New Blockchain Year %d at block %d!", len(newTip.NYEveBlocks)+1, block.Height)
-		}
-		// update deployments on protocol upgrade
-		if block.IsProtocolUpgrade() {
-			newTip.AddDeployment(block.Params)
-		}
-
-		if err := dbStoreChainTip(c.indexer.cachedb, newTip); err != nil {
-			return fmt.Errorf("REORGANIZE: updating block database failed for %d: %v", block.Height, err)
-		}
-
 		// update chainstate with new version
 		c.Lock()
 		c.tip = newTip
@@ -336,7 +324,7 @@ findfork:
 		log.Infof("REORGANIZE: will detach %d, %s", ancestor.Height, ancestor.Hash)
 
 		// make sure rpc info exists
-		if err := ancestor.FetchRPC(ctx, c.rpc); err != nil {
+		if err := ancestor.FetchRPC(ctx, c.rpc, c.indexer.reg.BlockParams); err != nil {
 			log.Errorf("REORGANIZE refetch block %d: %v", ancestor.Height, err)
 			return nil, nil, nil, err
 		}
@@ -365,7 +353,7 @@ findfork:
 	// from a previous reorg and others may not be in the DB.
 
 	// make sure rpc info exists
-	if err := best.FetchRPC(ctx, c.rpc); err != nil {
+	if err := best.FetchRPC(ctx, c.rpc, c.indexer.reg.BlockParams); err != nil {
 		log.Errorf("REORGANIZE refetch block %d: %v", best.Height, err)
 		return nil, nil, nil, err
 	}
@@ -387,7 +375,7 @@ findfork:
 			}
 		} else {
 			// block is known, so we only need to resolve the RPC data
-			if err := parent.FetchRPC(ctx, c.rpc); err != nil {
+			if err := parent.FetchRPC(ctx, c.rpc, c.indexer.reg.BlockParams); err != nil {
 				log.Errorf("REORGANIZE failed fetching main chain parent block: %v", err)
 				return nil, nil, nil, err
 			}
@@ -400,7 +388,7 @@ findfork:
 	}
 
 	// make sure rpc info exists for fork block
-	if err := ancestor.FetchRPC(ctx, c.rpc); err != nil {
+	if err := ancestor.FetchRPC(ctx, c.rpc, c.indexer.reg.BlockParams); err != nil {
 		log.Errorf("REORGANIZE refetch block %d: %v", ancestor.Height, err)
 		return nil, nil, nil, err
 	}
@@ -418,7 +406,7 @@ findfork:
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	if err := ancestor.Parent.FetchRPC(ctx, c.rpc); err != nil {
+	if err := ancestor.Parent.FetchRPC(ctx, c.rpc, c.indexer.reg.BlockParams); err != nil {
 		return nil, nil, nil, err
 	}
 
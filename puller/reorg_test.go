@@ -0,0 +1,73 @@
+package puller
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/models"
+	"time"
+)
+
+func TestIndexerReorgLog(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	m := NewIndexer(IndexerConfig{StateDB: db})
+	ctx := context.Background()
+
+	orphans := []*models.OrphanBlock{
+		models.NewOrphanBlock(&models.Block{Hash: "BLoldTip", Height: 11, Priority: 1, NOps: 7, BakerId: 3}),
+		models.NewOrphanBlock(&models.Block{Hash: "BLold", Height: 10, NOps: 2, BakerId: 4}),
+	}
+	reorg := &models.Reorg{
+		Height:       9,
+		Hash:         "BLfork",
+		Depth:        2,
+		NAttached:    3,
+		OldTipHash:   "BLoldTip",
+		OldTipHeight: 11,
+		NewTipHash:   "BLnewTip",
+		NewTipHeight: 12,
+		Timestamp:    time.Now().UTC(),
+	}
+	if !assert.NoError(t, m.StoreReorg(ctx, reorg, orphans)) {
+		return
+	}
+
+	reorgs, err := m.ListReorgs(ctx, ListRequest{Since: 8})
+	if assert.NoError(t, err) && assert.Len(t, reorgs, 1) {
+		assert.Equal(t, 2, reorgs[0].Depth)
+		assert.Equal(t, chain.StrBHash("BLnewTip"), reorgs[0].NewTipHash)
+	}
+	reorgs, err = m.ListReorgs(ctx, ListRequest{Since: 9})
+	assert.NoError(t, err)
+	assert.Len(t, reorgs, 0)
+
+	blocks, err := m.ListReorgOrphans(ctx, reorg.RowId)
+	if assert.NoError(t, err) && assert.Len(t, blocks, 2) {
+		assert.Equal(t, int64(10), blocks[0].Height)
+		assert.Equal(t, models.AccountID(3), blocks[1].BakerId)
+		assert.Equal(t, 7, blocks[1].NOps)
+	}
+	blocks, err = m.ListOrphans(ctx, ListRequest{Until: 10})
+	if assert.NoError(t, err) && assert.Len(t, blocks, 1) {
+		assert.Equal(t, chain.StrBHash("BLold"), blocks[0].Hash)
+	}
+}
+
+func TestIndexerOrphanBaker(t *testing.T) {
+	db := dbtest.Open(t)
+	defer db.Close()
+	m := NewIndexer(IndexerConfig{StateDB: db})
+	ctx := context.Background()
+
+	baker := &models.Account{RowId: 3, Type: chain.AddressTypeEd25519, Hash: make([]byte, 20)}
+	assert.NoError(t, db.Create(baker).Error)
+
+	// blocks loaded from the database only carry the baker id
+	o := m.newOrphan(ctx, &models.Block{Hash: "BLold", Height: 10, BakerId: 3})
+	assert.Equal(t, baker.String(), o.Baker)
+	o = m.newOrphan(ctx, &models.Block{Hash: "BLold", Height: 10, BakerId: 4})
+	assert.Equal(t, "", o.Baker)
+}
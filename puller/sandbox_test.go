@@ -0,0 +1,239 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-bson/bson"
+	"golang.org/x/crypto/blake2b"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"tezos_index/chain"
+	"time"
+)
+
+// The sandbox chain served by newSandboxNode runs Babylon from block 1 on a
+// private chain id, so no mainnet rules apply. testBaker bakes all blocks,
+// sandboxAlice and sandboxBob move funds and call sandboxContract, a
+// contract with a string to nat big_map.
+//
+// Block 2 originates sandboxContract, afterwards blocks rotate through a
+// transfer from alice to bob (allocating bob in block 3), a contract call
+// that sets or removes a key and a transfer from bob back to alice.
+var (
+	sandboxChainId  = chain.NewChainIdHash([]byte{0xf3, 0x1a, 0x9c, 0x02})
+	sandboxAliceKey = chain.Key{Type: chain.KeyTypeEd25519, Data: bytes.Repeat([]byte{0x01}, 32)}
+	sandboxAlice    = sandboxAliceKey.Address()
+	sandboxBob      = chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x02}, 20))
+	sandboxContract = chain.NewAddress(chain.AddressTypeContract, bytes.Repeat([]byte{0x03}, 20))
+)
+
+const (
+	sandboxBakerBalance = 4000000000000
+	sandboxAliceBalance = 1000000000
+	sandboxBurn         = 257000 // origination and allocation burn
+	sandboxStorageBurn  = 38000  // 38 bytes of origination storage
+	sandboxTransfer     = 1000000
+	sandboxReturn       = 100000
+)
+
+// sandboxHash derives a distinct hash payload for kind at height.
+func sandboxHash(kind string, height int64, n int) []byte {
+	h := blake2b.Sum256([]byte(fmt.Sprintf("%s/%d/%d", kind, height, n)))
+	return h[:]
+}
+
+// sandboxKeyHash is the script expression hash of a packed string key.
+func sandboxKeyHash(key string) chain.ExprHash {
+	buf := []byte{0x05, 0x01, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(key)))
+	h := blake2b.Sum256(append(buf, key...))
+	return chain.NewExprHash(h[:])
+}
+
+// sandboxKey returns the key and value set by the contract call at height,
+// a zero value removes the key.
+func sandboxKey(height int64) (string, int64) {
+	key := "k" + strconv.FormatInt(height%5, 10)
+	if height%7 == 0 {
+		return key, 0
+	}
+	return key, height
+}
+
+func sandboxGenesis() (string, string) {
+	r := strings.NewReplacer(chain.Mainnet.String(), sandboxChainId.String())
+	return r.Replace(genesisHeader), r.Replace(genesisBlock)
+}
+
+// sandboxActivation renders the block 1 header content which activates
+// Babylon with testBaker and sandboxAlice as bootstrap accounts.
+func sandboxActivation() string {
+	doc := bson.M{"bootstrap_accounts": [][]interface{}{
+		{testBakerKey.String(), strconv.FormatInt(sandboxBakerBalance, 10)},
+		{sandboxAliceKey.String(), strconv.FormatInt(sandboxAliceBalance, 10)},
+	}}
+	buf, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	params := append([]byte{0, 0, 0, 0}, buf...)
+	binary.BigEndian.PutUint32(params, uint32(len(buf)))
+	return fmt.Sprintf(`,"content":{"command":"activate","hash":"%s","fitness":["00","0000000000000000"],"protocol_parameters":"%s"}`,
+		chain.ProtoV005_2, hex.EncodeToString(params))
+}
+
+func contractUpdate(addr chain.Address, change int64) string {
+	return fmt.Sprintf(`{"kind":"contract","contract":"%s","change":"%d"}`, addr, change)
+}
+
+// sandboxFees renders the balance updates of a fee paid by src.
+func sandboxFees(src chain.Address, fee, height int64) string {
+	return fmt.Sprintf(`[%s,{"kind":"freezer","category":"fees","delegate":"%s","cycle":%d,"change":"%d"}]`,
+		contractUpdate(src, -fee), testBaker, (height-1)/testBlocksPerCycle, fee)
+}
+
+func sandboxTransaction(height int64, src, dst chain.Address, amount int64, allocate bool) string {
+	fee := 1000 + height
+	updates := []string{contractUpdate(src, -amount), contractUpdate(dst, amount)}
+	if allocate {
+		updates = append(updates, contractUpdate(src, -sandboxBurn))
+	}
+	return fmt.Sprintf(`{"kind":"transaction","source":"%s","fee":"%d","counter":"%d","gas_limit":"10300","storage_limit":"300",`+
+		`"amount":"%d","destination":"%s","metadata":{"balance_updates":%s,"operation_result":{"status":"applied",`+
+		`"balance_updates":[%s],"consumed_gas":"10207","allocated_destination_contract":%t}}}`,
+		src, fee, height, amount, dst, sandboxFees(src, fee, height), strings.Join(updates, ","), allocate)
+}
+
+func sandboxOrigination(height int64) string {
+	fee := 1000 + height
+	return fmt.Sprintf(`{"kind":"origination","source":"%[1]s","fee":"%[2]d","counter":"%[3]d","gas_limit":"15000","storage_limit":"300",`+
+		`"balance":"0","script":{"code":[{"prim":"parameter","args":[{"prim":"pair","args":[{"prim":"string"},{"prim":"nat"}]}]},`+
+		`{"prim":"storage","args":[{"prim":"big_map","args":[{"prim":"string"},{"prim":"nat"}]}]},`+
+		`{"prim":"code","args":[[{"prim":"CDR"},{"prim":"NIL","args":[{"prim":"operation"}]},{"prim":"PAIR"}]]}],"storage":[]},`+
+		`"metadata":{"balance_updates":%[4]s,"operation_result":{"status":"applied",`+
+		`"big_map_diff":[{"action":"alloc","big_map":"0","key_type":{"prim":"string"},"value_type":{"prim":"nat"}}],`+
+		`"balance_updates":[%[5]s,%[6]s],"originated_contracts":["%[7]s"],"consumed_gas":"14407","storage_size":"38",`+
+		`"paid_storage_size_diff":"38"}}}`,
+		sandboxAlice, fee, height, sandboxFees(sandboxAlice, fee, height),
+		contractUpdate(sandboxAlice, -sandboxStorageBurn), contractUpdate(sandboxAlice, -sandboxBurn), sandboxContract)
+}
+
+func sandboxCall(height int64) string {
+	fee := 2000 + height
+	key, val := sandboxKey(height)
+	diff := fmt.Sprintf(`{"action":"update","big_map":"0","key_hash":"%s","key":{"string":"%s"},"value":{"int":"%d"}}`,
+		sandboxKeyHash(key), key, val)
+	if val == 0 {
+		diff = fmt.Sprintf(`{"action":"remove","big_map":"0","key_hash":"%s","key":{"string":"%s"}}`, sandboxKeyHash(key), key)
+	}
+	return fmt.Sprintf(`{"kind":"transaction","source":"%s","fee":"%d","counter":"%d","gas_limit":"20000","storage_limit":"100",`+
+		`"amount":"0","destination":"%s","parameters":{"entrypoint":"default","value":{"prim":"Pair","args":[{"string":"%s"},{"int":"%d"}]}},`+
+		`"metadata":{"balance_updates":%s,"operation_result":{"status":"applied","storage":{"int":"0"},"big_map_diff":[%s],`+
+		`"balance_updates":[],"consumed_gas":"19311","storage_size":"120","paid_storage_size_diff":"0"}}}`,
+		sandboxAlice, fee, height, sandboxContract, key, val, sandboxFees(sandboxAlice, fee, height), diff)
+}
+
+// sandboxOps renders the manager operation list of the block at height.
+func sandboxOps(height int64) string {
+	var op string
+	switch {
+	case height < 2:
+		return "[]"
+	case height == 2:
+		op = sandboxOrigination(height)
+	case height%3 == 0:
+		op = sandboxTransaction(height, sandboxAlice, sandboxBob, sandboxTransfer, height == 3)
+	case height%3 == 1:
+		op = sandboxCall(height)
+	default:
+		op = sandboxTransaction(height, sandboxBob, sandboxAlice, sandboxReturn, false)
+	}
+	return fmt.Sprintf(`[{"protocol":"%s","chain_id":"%s","hash":"%s","branch":"%s","contents":[%s],"signature":"%s"}]`,
+		chain.ProtoV005_2, sandboxChainId, chain.NewOperationHash(sandboxHash("op", height, 0)), testBlockHash(height-1),
+		op, chain.NewSignature(chain.SignatureTypeGeneric, make([]byte, 64)))
+}
+
+// sandboxBlock renders the header and block at height.
+func sandboxBlock(height int64) (string, string) {
+	var content string
+	if height == 1 {
+		content = sandboxActivation()
+	}
+	header := fmt.Sprintf(`{"level":%d,"proto":1,"predecessor":"%s","timestamp":"%s","validation_pass":4,`+
+		`"operations_hash":"%s","fitness":["01","%016x"],"context":"%s","priority":0,"proof_of_work_nonce":"0000000000000000",`+
+		`"chain_id":"%s","hash":"%s"%s}`,
+		height, testBlockHash(height-1), time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(height)*time.Minute).Format(time.RFC3339),
+		chain.NewHash(chain.HashTypeOperationListList, sandboxHash("ops", height, 0)),
+		height, chain.NewHash(chain.HashTypeContext, sandboxHash("context", height, 0)),
+		sandboxChainId, testBlockHash(height), content)
+	block := fmt.Sprintf(`{"protocol":"%[1]s","chain_id":"%[9]s",`+
+		`"hash":"%[2]s","header":%[3]s,"metadata":{"protocol":"%[1]s","next_protocol":"%[1]s",`+
+		`"test_chain_status":{"status":"not_running"},"max_operations_ttl":60,"max_operation_data_length":16384,`+
+		`"max_block_header_length":238,"max_operation_list_length":[{"max_size":32768,"max_op":32},`+
+		`{"max_size":32768},{"max_size":135168,"max_op":132},{"max_size":524288}],`+
+		`"baker":"%[8]s","level":{"level":%[4]d,"level_position":%[5]d,"cycle":%[6]d,`+
+		`"cycle_position":%[7]d,"voting_period":0,"voting_period_position":%[5]d,"expected_commitment":false},`+
+		`"voting_period_kind":"proposal","nonce_hash":null,"consumed_gas":"0","deactivated":[],"balance_updates":[]},`+
+		`"operations":[[],[],[],%[10]s]}`,
+		chain.ProtoV005_2, testBlockHash(height), header, height, height-1, (height-1)/testBlocksPerCycle,
+		(height-1)%testBlocksPerCycle, testBaker, sandboxChainId, sandboxOps(height))
+	return header, block
+}
+
+// newSandboxNode serves the sandbox chain up to height head by height and
+// by hash together with constants and rights.
+func newSandboxNode(head int64) *httptest.Server {
+	genesisHeader, genesisBlock := sandboxGenesis()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/chains/main/blocks/")
+		switch {
+		case path == "head/header":
+			header, _ := sandboxBlock(head)
+			w.Write([]byte(header))
+			return
+		case path == "0/header" || path == testBlockHash(0).String()+"/header":
+			w.Write([]byte(genesisHeader))
+			return
+		case path == "0" || path == testBlockHash(0).String():
+			w.Write([]byte(genesisBlock))
+			return
+		case strings.HasSuffix(path, "/context/constants"):
+			w.Write([]byte(fmt.Sprintf(`{"proof_of_work_nonce_size":8,"nonce_length":32,"max_revelations_per_block":32,`+
+				`"max_operation_data_length":16384,"max_proposals_per_delegate":20,"preserved_cycles":5,"blocks_per_cycle":%d,`+
+				`"blocks_per_commitment":32,"blocks_per_roll_snapshot":256,"blocks_per_voting_period":32768,"time_between_blocks":["60","40"],`+
+				`"endorsers_per_block":32,"hard_gas_limit_per_operation":"800000","hard_gas_limit_per_block":"8000000",`+
+				`"proof_of_work_threshold":"70368744177663","tokens_per_roll":"8000000000","michelson_maximum_type_size":1000,`+
+				`"seed_nonce_revelation_tip":"125000","origination_size":257,"block_security_deposit":"0",`+
+				`"endorsement_security_deposit":"0","block_reward":"0","endorsement_reward":"0","cost_per_byte":"1000",`+
+				`"hard_storage_limit_per_operation":"60000","test_chain_duration":"1966080","quorum_min":2000,"quorum_max":7000,`+
+				`"min_proposal_quorum":500,"initial_endorsers":24,"delay_per_missing_endorsement":"8"}`, testBlocksPerCycle)))
+			return
+		case strings.HasSuffix(path, "/helpers/baking_rights"), strings.HasSuffix(path, "/helpers/endorsing_rights"):
+			// testBaker owns the first slot of every cycle
+			cycle, _ := strconv.ParseInt(r.URL.Query().Get("cycle"), 10, 64)
+			w.Write([]byte(fmt.Sprintf(`[{"delegate":"%s","level":%d,"priority":0,"slots":[0]}]`,
+				testBaker, cycle*testBlocksPerCycle+1)))
+			return
+		case strings.Contains(path, "/context/raw/json/cycle/"):
+			w.Write([]byte(`{"last_roll":[],"nonces":[],"random_seed":"","roll_snapshot":0}`))
+			return
+		}
+		for h := int64(1); h <= head; h++ {
+			switch path {
+			case strconv.FormatInt(h, 10), testBlockHash(h).String():
+				_, block := sandboxBlock(h)
+				w.Write([]byte(block))
+				return
+			case strconv.FormatInt(h, 10) + "/header", testBlockHash(h).String() + "/header":
+				header, _ := sandboxBlock(h)
+				w.Write([]byte(header))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+}
@@ -0,0 +1,750 @@
+package puller
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zyjblockchain/sandy_log/log"
+	"tezos_index/chain"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 500
+)
+
+// ApiError is the JSON body returned for all failed API requests.
+type ApiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Server serves indexed data over a versioned JSON/HTTP API. It runs next to
+// the crawler and is shut down together with it.
+type Server struct {
+	crawler *Crawler
+	srv     *http.Server
+}
+
+func NewServer(listen string, c *Crawler) *Server {
+	s := &Server{crawler: c}
+	s.srv = &http.Server{
+		Addr:         listen,
+		Handler:      s.routes(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	return s
+}
+
+func (s *Server) routes() http.Handler {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.GET("/metrics", s.getMetrics)
+	r.GET("/health", s.getHealth)
+	r.GET("/ready", s.getReady)
+	r.GET("/status", s.getStatus)
+
+	v1 := r.Group("/v1")
+	v1.GET("/blocks/:ident", s.getBlock)
+	v1.GET("/blocks/:ident/ops", s.listBlockOps)
+	v1.GET("/accounts/:address", s.getAccount)
+	v1.GET("/accounts/:address/ops", s.listAccountOps)
+	v1.GET("/accounts/:address/calls", s.listContractCalls)
+	v1.GET("/accounts/:address/pending", s.listPendingOps)
+	v1.GET("/accounts/:address/tokens", s.listTokenBalances)
+	v1.GET("/accounts/:address/transfers", s.listTokenTransfers)
+	v1.GET("/accounts/:address/metadata", s.getMetadata)
+	v1.GET("/accounts/:address/balance", s.getBalance)
+	v1.GET("/accounts/:address/balance/history", s.listBalanceHistory)
+	v1.GET("/accounts/:address/payouts/:cycle", s.getPayouts)
+	v1.GET("/accounts/:address/rank", s.getRanking)
+	v1.GET("/ops/:hash", s.getOp)
+	v1.GET("/chain/:height", s.getChain)
+	v1.GET("/supply/:height", s.getSupply)
+	v1.GET("/delegates", s.listDelegates)
+	v1.GET("/rankings/:type", s.listRanking)
+	v1.GET("/bigmaps/:id", s.getBigmap)
+	v1.GET("/tokens/:address", s.listTokens)
+	v1.GET("/tokens/:address/:id", s.getToken)
+	v1.GET("/tokens/:address/:id/metadata", s.getMetadata)
+	return r
+}
+
+func (s *Server) Start() {
+	log.Infof("Starting API server on %s.", s.srv.Addr)
+	go func() {
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("API server error: %v", err)
+		}
+	}()
+}
+
+// Stop waits for in-flight requests to finish until ctx expires.
+func (s *Server) Stop(ctx context.Context) {
+	log.Info("Stopping API server.")
+	if err := s.srv.Shutdown(ctx); err != nil {
+		log.Errorf("API server shutdown: %v", err)
+	}
+}
+
+// getMetrics serves crawler, index and RPC metrics in Prometheus text format.
+func (s *Server) getMetrics(c *gin.Context) {
+	s.crawler.updateMetrics()
+	promhttp.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// getHealth succeeds while database and RPC node are reachable.
+func (s *Server) getHealth(c *gin.Context) {
+	h := s.crawler.Health(c.Request.Context())
+	status := http.StatusOK
+	if !h.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, h)
+}
+
+// getReady succeeds when the index is synchronized with the node.
+func (s *Server) getReady(c *gin.Context) {
+	r := s.crawler.Ready()
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, r)
+}
+
+func (s *Server) getStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, s.crawler.StatusInfo(c.Request.Context()))
+}
+
+func (s *Server) indexer() *Indexer {
+	return s.crawler.GetIndexer()
+}
+
+// parseHeight accepts a block height or `head` for the current chain tip.
+func (s *Server) parseHeight(ident string) (int64, error) {
+	if ident == "head" {
+		return s.crawler.Height(), nil
+	}
+	height, err := strconv.ParseInt(ident, 10, 64)
+	if err != nil || height < 0 {
+		return 0, index.ErrInvalidBlockHeight
+	}
+	return height, nil
+}
+
+// parseListRequest reads paging and filter arguments from the query string.
+func parseListRequest(c *gin.Context) (ListRequest, error) {
+	r := ListRequest{
+		Limit: defaultListLimit,
+		Order: ParseOrderType(c.Query("order")),
+	}
+	if v := c.Query("type"); v != "" {
+		typ := chain.ParseOpType(v)
+		if !typ.IsValid() {
+			return r, errInvalidParam("type")
+		}
+		r = r.WithType(typ)
+	}
+	for _, v := range []struct {
+		name string
+		val  *int64
+	}{
+		{"since", &r.Since},
+		{"until", &r.Until},
+	} {
+		if q := c.Query(v.name); q != "" {
+			n, err := strconv.ParseInt(q, 10, 64)
+			if err != nil || n < 0 {
+				return r, errInvalidParam(v.name)
+			}
+			*v.val = n
+		}
+	}
+	if q := c.Query("limit"); q != "" {
+		n, err := strconv.ParseUint(q, 10, 32)
+		if err != nil || n == 0 || n > maxListLimit {
+			return r, errInvalidParam("limit")
+		}
+		r.Limit = uint(n)
+	}
+	if q := c.Query("offset"); q != "" {
+		n, err := strconv.ParseUint(q, 10, 32)
+		if err != nil {
+			return r, errInvalidParam("offset")
+		}
+		r.Offset = uint(n)
+	}
+	if q := c.Query("cursor"); q != "" {
+		n, err := strconv.ParseUint(q, 10, 64)
+		if err != nil {
+			return r, errInvalidParam("cursor")
+		}
+		r.Cursor = n
+	}
+	return r, nil
+}
+
+// writeOps returns a page of ops together with the cursor for the next page.
+func writeOps(c *gin.Context, ops []*models.Op) {
+	resp := struct {
+		Ops    []*models.Op `json:"ops"`
+		Cursor uint64       `json:"cursor,omitempty"`
+	}{
+		Ops: ops,
+	}
+	if l := len(ops); l > 0 {
+		resp.Cursor = ops[l-1].RowId.Value()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) lookupBlock(c *gin.Context) (*models.Block, error) {
+	ident := c.Param("ident")
+	if chain.HashTypeBlock.MatchPrefix(ident) {
+		h, err := chain.ParseBlockHash(ident)
+		if err != nil {
+			return nil, index.ErrInvalidBlockHash
+		}
+		return s.indexer().BlockByHash(c.Request.Context(), h)
+	}
+	height, err := s.parseHeight(ident)
+	if err != nil {
+		return nil, err
+	}
+	return s.indexer().BlockByHeight(c.Request.Context(), height)
+}
+
+func (s *Server) lookupAccount(c *gin.Context) (*models.Account, chain.Address, error) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		return nil, addr, ErrInvalidHash
+	}
+	acc, err := s.indexer().LookupAccount(c.Request.Context(), addr)
+	return acc, addr, err
+}
+
+func (s *Server) getBlock(c *gin.Context) {
+	block, err := s.lookupBlock(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, block)
+}
+
+func (s *Server) listBlockOps(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	block, err := s.lookupBlock(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	ops, err := s.indexer().ListBlockOps(c.Request.Context(), block.Height, r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	writeOps(c, ops)
+}
+
+func (s *Server) getOp(c *gin.Context) {
+	ops, err := s.indexer().LookupOp(c.Request.Context(), c.Param("hash"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ops)
+}
+
+func (s *Server) getAccount(c *gin.Context) {
+	acc, addr, err := s.lookupAccount(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Address string `json:"address"`
+		*models.Account
+	}{
+		Address: addr.String(),
+		Account: acc,
+	})
+}
+
+func (s *Server) listAccountOps(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	acc, _, err := s.lookupAccount(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	r.Account = acc.RowId
+	ops, err := s.indexer().ListAccountOps(c.Request.Context(), r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	writeOps(c, ops)
+}
+
+func (s *Server) listContractCalls(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	acc, _, err := s.lookupAccount(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	r.Account = acc.RowId
+	ops, err := s.indexer().ListContractCalls(c.Request.Context(), r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	writeOps(c, ops)
+}
+
+func (s *Server) listPendingOps(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	ops, err := s.indexer().ListPendingOps(c.Request.Context(), addr, r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	resp := struct {
+		Ops    []*models.PendingOp `json:"ops"`
+		Cursor uint64              `json:"cursor,omitempty"`
+	}{
+		Ops: ops,
+	}
+	if l := len(ops); l > 0 {
+		resp.Cursor = ops[l-1].RowId
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listTokenBalances(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	bals, err := s.indexer().ListTokenBalances(c.Request.Context(), addr, r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	resp := struct {
+		Balances []*models.TokenBalance `json:"balances"`
+		Cursor   uint64                 `json:"cursor,omitempty"`
+	}{
+		Balances: bals,
+	}
+	if l := len(bals); l > 0 {
+		resp.Cursor = bals[l-1].RowId
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listTokenTransfers(c *gin.Context) {
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	transfers, err := s.indexer().ListTokenTransfers(c.Request.Context(), addr, r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	resp := struct {
+		Transfers []*models.TokenTransfer `json:"transfers"`
+		Cursor    uint64                  `json:"cursor,omitempty"`
+	}{
+		Transfers: transfers,
+	}
+	if l := len(transfers); l > 0 {
+		resp.Cursor = transfers[l-1].RowId
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) listTokens(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	tokens, err := s.indexer().ListTokens(c.Request.Context(), addr)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (s *Server) getToken(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	id, ok := new(big.Int).SetString(c.Param("id"), 10)
+	if !ok || id.Sign() < 0 {
+		writeError(c, errInvalidParam("id"))
+		return
+	}
+	token, err := s.indexer().LookupToken(c.Request.Context(), addr, id.Text(10))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, token)
+}
+
+// getBalance returns the balance at `height` (a height or `head`) or, when
+// given, at `time` (RFC3339). Defaults to the current height.
+func (s *Server) getBalance(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	var bal *models.Balance
+	if v := c.Query("time"); v != "" {
+		tm, perr := time.Parse(time.RFC3339, v)
+		if perr != nil {
+			writeError(c, errInvalidParam("time"))
+			return
+		}
+		bal, err = s.indexer().BalanceAtTime(c.Request.Context(), addr, tm)
+	} else {
+		height, perr := s.parseHeight(c.DefaultQuery("height", "head"))
+		if perr != nil {
+			writeError(c, perr)
+			return
+		}
+		bal, err = s.indexer().BalanceAt(c.Request.Context(), addr, height)
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, bal)
+}
+
+// listBalanceHistory returns balances between heights `from` and `to`
+// (defaults to head), optionally sampled every `step` blocks.
+func (s *Server) listBalanceHistory(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	from, err := s.parseHeight(c.DefaultQuery("from", "0"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	to, err := s.parseHeight(c.DefaultQuery("to", "head"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	var step int64
+	if v := c.Query("step"); v != "" {
+		if step, err = strconv.ParseInt(v, 10, 64); err != nil || step < 0 {
+			writeError(c, errInvalidParam("step"))
+			return
+		}
+	}
+	hist, err := s.indexer().BalanceHistory(c.Request.Context(), addr, from, to, step)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, hist)
+}
+
+// getPayouts returns the payout report of a baker for a cycle as JSON or,
+// with `format=csv`, as CSV. Query args are `fee` (fraction), `min` (mutez)
+// and a comma separated `exclude` list.
+func (s *Server) getPayouts(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	cfg := PayoutConfig{}
+	if cfg.Cycle, err = strconv.ParseInt(c.Param("cycle"), 10, 64); err != nil {
+		writeError(c, errInvalidParam("cycle"))
+		return
+	}
+	if v := c.Query("fee"); v != "" {
+		if cfg.Fee, err = strconv.ParseFloat(v, 64); err != nil {
+			writeError(c, errInvalidParam("fee"))
+			return
+		}
+	}
+	if v := c.Query("min"); v != "" {
+		if cfg.MinPayout, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(c, errInvalidParam("min"))
+			return
+		}
+	}
+	if v := c.Query("exclude"); v != "" {
+		for _, a := range strings.Split(v, ",") {
+			ex, err := chain.ParseAddress(a)
+			if err != nil {
+				writeError(c, errInvalidParam("exclude"))
+				return
+			}
+			cfg.Exclude = append(cfg.Exclude, ex)
+		}
+	}
+	r, err := s.indexer().Payouts(c.Request.Context(), addr, cfg)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	switch c.Query("format") {
+	case "", "json":
+		c.JSON(http.StatusOK, r)
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		if err := r.WriteCSV(c.Writer); err != nil {
+			log.Errorf("API request %s: %v", c.Request.URL.Path, err)
+		}
+	default:
+		writeError(c, errInvalidParam("format"))
+	}
+}
+
+// getMetadata returns contract metadata or token metadata when the route
+// has a token id.
+func (s *Server) getMetadata(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	var tokenId string
+	if v := c.Param("id"); v != "" {
+		id, ok := new(big.Int).SetString(v, 10)
+		if !ok || id.Sign() < 0 {
+			writeError(c, errInvalidParam("id"))
+			return
+		}
+		tokenId = id.Text(10)
+	}
+	md, err := s.indexer().LookupMetadata(c.Request.Context(), addr, tokenId)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, md)
+}
+
+func (s *Server) getChain(c *gin.Context) {
+	height, err := s.parseHeight(c.Param("height"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	ch, err := s.indexer().ChainByHeight(c.Request.Context(), height)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+func (s *Server) getSupply(c *gin.Context) {
+	height, err := s.parseHeight(c.Param("height"))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	supply, err := s.indexer().SupplyByHeight(c.Request.Context(), height)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, supply)
+}
+
+func (s *Server) listDelegates(c *gin.Context) {
+	accs, err := s.indexer().ListAllDelegates(c.Request.Context())
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, accs)
+}
+
+func (s *Server) getRanking(c *gin.Context) {
+	addr, err := chain.ParseAddress(c.Param("address"))
+	if err != nil {
+		writeError(c, ErrInvalidHash)
+		return
+	}
+	acc, err := s.indexer().LookupAccount(c.Request.Context(), addr)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	rank, err := s.indexer().LookupRanking(c.Request.Context(), acc.RowId)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rank)
+}
+
+// listRanking returns a page of the `rich`, `flow` or `traffic` ranking,
+// paged by `offset` and `limit`.
+func (s *Server) listRanking(c *gin.Context) {
+	typ := ParseRankType(c.Param("type"))
+	if !typ.IsValid() {
+		writeError(c, errInvalidParam("type"))
+		return
+	}
+	r, err := parseListRequest(c)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	ranks, err := s.indexer().ListRanking(c.Request.Context(), typ, r)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Ranking []*AccountRankingEntry `json:"ranking"`
+	}{
+		Ranking: ranks,
+	})
+}
+
+func (s *Server) getBigmap(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeError(c, errInvalidParam("id"))
+		return
+	}
+	withLast, _ := strconv.ParseBool(c.Query("last"))
+	alloc, last, err := s.indexer().LookupBigmap(c.Request.Context(), id, withLast)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Alloc *models.BigMapItem `json:"alloc"`
+		Last  *models.BigMapItem `json:"last,omitempty"`
+	}{
+		Alloc: alloc,
+		Last:  last,
+	})
+}
+
+type errInvalidParam string
+
+func (e errInvalidParam) Error() string {
+	return "invalid parameter " + string(e)
+}
+
+var (
+	// errors reported as 404, also when wrapped
+	notFoundErrors = []error{
+		index.ErrNoBlockEntry,
+		index.ErrNoAccountEntry,
+		index.ErrNoContractEntry,
+		index.ErrNoOpEntry,
+		index.ErrNoBigMapEntry,
+		index.ErrNoTokenEntry,
+		index.ErrNoMetadataEntry,
+		index.ErrNoIncomeEntry,
+		index.ErrNoSnapshotEntry,
+		index.ErrNoRankEntry,
+		gorm.ErrRecordNotFound,
+	}
+
+	// errors reported as 400, also when wrapped
+	invalidErrors = []error{
+		ErrInvalidHash,
+		index.ErrInvalidBlockHeight,
+		index.ErrInvalidBlockHash,
+		index.ErrBalanceHistoryLimit,
+	}
+)
+
+// isAnyError returns true when err wraps one of targets.
+func isAnyError(err error, targets []error) bool {
+	for _, target := range targets {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError maps indexer errors to HTTP status codes.
+func writeError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	var param errInvalidParam
+	switch {
+	case isAnyError(err, notFoundErrors):
+		status = http.StatusNotFound
+	case isAnyError(err, invalidErrors), errors.As(err, &param):
+		status = http.StatusBadRequest
+	default:
+		log.Errorf("API request %s: %v", c.Request.URL.Path, err)
+	}
+	c.AbortWithStatusJSON(status, ApiError{
+		Status:  status,
+		Message: err.Error(),
+	})
+}
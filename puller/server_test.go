@@ -0,0 +1,208 @@
+package puller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"tezos_index/chain"
+	"tezos_index/puller/dbtest"
+	"tezos_index/puller/index"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestContext(target string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", target, nil)
+	return c
+}
+
+func TestParseListRequest(t *testing.T) {
+	r, err := parseListRequest(newTestContext("/v1/accounts/x/ops"))
+	assert.NoError(t, err)
+	assert.Nil(t, r.Typ)
+	assert.Equal(t, uint(defaultListLimit), r.Limit)
+	assert.Equal(t, OrderAsc, r.Order)
+
+	r, err = parseListRequest(newTestContext("/v1/accounts/x/ops?type=transaction&since=10&until=20&limit=5&cursor=99&order=desc"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r.Typ) {
+		assert.Equal(t, chain.OpTypeTransaction, *r.Typ)
+	}
+	assert.Equal(t, int64(10), r.Since)
+	assert.Equal(t, int64(20), r.Until)
+	assert.Equal(t, uint(5), r.Limit)
+	assert.Equal(t, uint64(99), r.Cursor)
+	assert.Equal(t, OrderDesc, r.Order)
+
+	for _, q := range []string{"type=foo", "limit=0", "limit=100000", "since=-1", "cursor=x"} {
+		_, err = parseListRequest(newTestContext("/v1/accounts/x/ops?" + q))
+		_, ok := err.(errInvalidParam)
+		assert.True(t, ok, q)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	for _, v := range []struct {
+		Err    error
+		Status int
+	}{
+		{index.ErrNoAccountEntry, 404},
+		{fmt.Errorf("account 5: %w", index.ErrNoAccountEntry), 404},
+		{fmt.Errorf("block: %w", gorm.ErrRecordNotFound), 404},
+		{index.ErrInvalidBlockHeight, 400},
+		{fmt.Errorf("height 7: %w", index.ErrInvalidBlockHeight), 400},
+		{errInvalidParam("limit"), 400},
+		{fmt.Errorf("query: %w", errInvalidParam("limit")), 400},
+		{fmt.Errorf("query: %v", index.ErrNoAccountEntry), 500},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", "/v1/accounts/x", nil)
+		writeError(c, v.Err)
+		assert.Equal(t, v.Status, w.Code, v.Err.Error())
+		var e ApiError
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+		assert.Equal(t, v.Err.Error(), e.Message)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	c := &Crawler{
+		state:  STATE_SYNCHRONIZING,
+		tip:    &models.ChainTip{BestHeight: 90},
+		bchead: &rpc.BlockHeader{Level: 100},
+		queue:  make(chan *models.Bundle, 4),
+	}
+	c.queue <- &models.Bundle{}
+	s := NewServer(":0", c)
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	body := w.Body.String()
+	for _, line := range []string{
+		"tezos_sync_lag_blocks 10",
+		"tezos_crawler_queue_depth 1",
+		`tezos_crawler_state{state="syncing"} 1`,
+		`tezos_crawler_state{state="synced"} 0`,
+		"tezos_blocks_connected_total ",
+		"# TYPE tezos_reorg_depth_blocks histogram",
+	} {
+		assert.True(t, strings.Contains(body, line), line)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+	s := NewServer(":0", c)
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), path)
+		return w.Code, body
+	}
+
+	code, body := get("/health")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", body["database"])
+	assert.Equal(t, "ok", body["node"])
+
+	// not ready until synchronized
+	code, body = get("/ready")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, float64(0), body["lag"])
+	c.state = STATE_SYNCHRONIZED
+	code, _ = get("/ready")
+	assert.Equal(t, 200, code)
+	c.bchead.Level = 10
+	code, body = get("/ready")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, float64(10), body["lag"])
+
+	code, body = get("/status")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "synced", body["status"])
+	assert.Equal(t, float64(0), body["indexed"])
+	assert.Len(t, body["indexes"], len(c.indexer.indexes))
+	assert.Equal(t, float64(10), body["cached_head"].(map[string]interface{})["level"])
+	assert.Equal(t, float64(0), body["rpc_head"].(map[string]interface{})["level"])
+	assert.Len(t, body["rpc_nodes"], 1)
+	assert.NotNil(t, body["params"])
+
+	srv.Close()
+	code, body = get("/health")
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "ok", body["database"])
+	assert.NotEqual(t, "ok", body["node"])
+}
+
+// hangingCache never answers a ping.
+type hangingCache struct {
+	*MemCache
+}
+
+func (hangingCache) Ping(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestServerHealthTimeout(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+	c.indexer.cachedb.cache = hangingCache{NewMemCache()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	h := c.Health(ctx)
+	assert.True(t, h.Healthy, "cache errors are reported only")
+	assert.Equal(t, "ok", h.Database)
+	assert.Equal(t, "ok", h.Node)
+	assert.Equal(t, context.DeadlineExceeded.Error(), h.Cache)
+	assert.True(t, time.Since(start) < healthTimeout)
+}
+
+func TestIndexerTipsConcurrent(t *testing.T) {
+	srv := newGenesisNode()
+	defer srv.Close()
+	db := dbtest.Open(t)
+	defer db.Close()
+	c := newGenesisCrawler(t, db, srv.URL)
+
+	// run with -race, status requests read tips while blocks are connected
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			c.indexer.setTips(int64(i), chain.BlockHash{})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, tip := range c.indexer.Tips() {
+			_ = tip.Height
+		}
+	}
+	wg.Wait()
+}
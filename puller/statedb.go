@@ -5,7 +5,6 @@ package puller
 
 import (
 	"encoding/json"
-	"github.com/go-redis/redis"
 	"github.com/zyjblockchain/sandy_log/log"
 	"tezos_index/chain"
 	. "tezos_index/puller/models"
@@ -23,13 +22,13 @@ var (
 	deploymentsBucketName = []byte("deployments")
 )
 
-func dbLoadChainTip(db *redis.Client) (*ChainTip, error) {
+func dbLoadChainTip(db CacheDB) (*ChainTip, error) {
 	tip := &ChainTip{}
-	val, err := db.Get(tipKey).Bytes()
-	if err != nil {
-		log.Errorf("get redis key: %s, error: %v", tipKey, err)
+	val, err := db.Get(tipKey)
+	if err != nil && err != ErrNoData {
+		log.Errorf("get cache key: %s, error: %v", tipKey, err)
 	}
-	if err == redis.Nil {
+	if err == ErrNoData {
 		return nil, ErrNoChainTip
 	} else if err != nil {
 		return nil, err
@@ -41,34 +40,38 @@ func dbLoadChainTip(db *redis.Client) (*ChainTip, error) {
 	return tip, nil
 }
 
-func dbStoreChainTip(db *redis.Client, tip *ChainTip) error {
+func dbStoreChainTip(db CacheDB, tip *ChainTip) error {
 	buf, err := json.Marshal(tip)
 	if err != nil {
 		return err
 	}
-	return db.Set(tipKey, buf, 0).Err()
+	return db.Set(tipKey, buf)
 }
 
+// IndexTip is the last block connected to an index. StartHeight is the
+// first block the index has seen, it is non-zero for indexes added to an
+// existing database.
 type IndexTip struct {
-	Hash   *chain.BlockHash `json:"hash,omitempty"`
-	Height int64            `json:"height"`
+	Hash        *chain.BlockHash `json:"hash,omitempty"`
+	Height      int64            `json:"height"`
+	StartHeight int64            `json:"start_height,omitempty"`
 }
 
-func dbStoreIndexTip(db *redis.Client, key string, tip *IndexTip) error {
+func dbStoreIndexTip(db CacheDB, key string, tip *IndexTip) error {
 	buf, err := json.Marshal(tip)
 	if err != nil {
 		return err
 	}
-	return db.Set(key, buf, 0).Err()
+	return db.Set(key, buf)
 }
 
-func dbLoadIndexTip(db *redis.Client, key string) (*IndexTip, error) {
+func dbLoadIndexTip(db CacheDB, key string) (*IndexTip, error) {
 	tip := &IndexTip{}
-	val, err := db.Get(key).Bytes()
-	if err != nil {
-		log.Errorf("get redis key: %s, err: %v", key, err)
+	val, err := db.Get(key)
+	if err != nil && err != ErrNoData {
+		log.Errorf("get cache key: %s, err: %v", key, err)
 	}
-	if err == redis.Nil {
+	if err == ErrNoData {
 		return nil, ErrNoTable
 	} else if err != nil {
 		return nil, err
@@ -78,11 +81,11 @@ func dbLoadIndexTip(db *redis.Client, key string) (*IndexTip, error) {
 	}
 }
 
-func dbLoadDeployments(db *redis.Client, tip *ChainTip) ([]*chain.Params, error) {
+func dbLoadDeployments(db CacheDB, tip *ChainTip) ([]*chain.Params, error) {
 	plist := make([]*chain.Params, 0, len(tip.Deployments))
 	for _, v := range tip.Deployments {
 		key := v.Protocol.Hash.String()
-		buf, err := db.Get(key).Bytes()
+		buf, err := db.Get(key)
 		if err != nil {
 			return nil, err
 		}
@@ -95,10 +98,10 @@ func dbLoadDeployments(db *redis.Client, tip *ChainTip) ([]*chain.Params, error)
 	return plist, nil
 }
 
-func dbStoreDeployment(db *redis.Client, p *chain.Params) error {
+func dbStoreDeployment(db CacheDB, p *chain.Params) error {
 	buf, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
-	return db.Set(p.Protocol.Hash.String(), buf, 0).Err()
+	return db.Set(p.Protocol.Hash.String(), buf)
 }
@@ -0,0 +1,95 @@
+package puller
+
+import (
+	"bytes"
+	"github.com/zyjblockchain/sandy_log/log"
+	"tezos_index/chain"
+	"tezos_index/rpc"
+)
+
+// verifyOpSignature checks the signature of a manager operation group against
+// the public key of its source. Signatures are only checked over the exact
+// bytes that were signed. The node does not serve them, so the group is forged
+// locally and the result is accepted only when it hashes to the operation
+// hash. Groups that cannot be checked (consensus and voting ops, encodings the
+// forger does not reproduce, unrevealed sources) are reported as valid.
+func (b *Builder) verifyOpSignature(oh *rpc.OperationHeader) bool {
+	if len(oh.Contents) == 0 || oh.Signature == "" {
+		return true
+	}
+	sig, err := chain.ParseSignature(oh.Signature)
+	if err != nil {
+		log.Warnf("verify op %s: %v", oh.Hash, err)
+		return false
+	}
+	key, ok := b.opSignerKey(oh)
+	if !ok {
+		return true
+	}
+	buf, err := rpc.Forge(oh.Branch, oh.Contents, b.block.Params)
+	if err != nil {
+		log.Debugf("verify op %s: skipping: %v", oh.Hash, err)
+		return true
+	}
+	// the operation hash commits to the signed bytes and the signature
+	raw := append(append([]byte{}, buf...), sig.Data...)
+	if !bytes.Equal(chain.Digest(raw), oh.Hash.Hash.Hash) {
+		log.Debugf("verify op %s: skipping: forged bytes differ from signed bytes", oh.Hash)
+		return true
+	}
+	if err := key.Verify(chain.WatermarkOperationBytes(buf), sig); err != nil {
+		log.Warnf("verify op %s: %v", oh.Hash, err)
+		return false
+	}
+	return true
+}
+
+// verifyBlockSignature checks the block header signature against the public
+// key of the baker. The signature covers the raw header without its trailing
+// 64 signature bytes. Blocks without a raw header or with an unrevealed baker
+// are reported as valid.
+func (b *Builder) verifyBlockSignature() bool {
+	raw := b.block.TZ.RawHeader
+	if len(raw) <= 64 || b.block.Baker == nil {
+		return true
+	}
+	acc := b.block.Baker
+	key := chain.NewKey(acc.PubkeyType.KeyType(), acc.PubkeyHash)
+	if !acc.IsRevealed || !key.IsValid() {
+		return true
+	}
+	n := len(raw) - 64
+	sig := chain.NewSignature(chain.SignatureTypeGeneric, raw[n:])
+	msg := chain.WatermarkBlockBytes(b.block.TZ.Block.ChainId, raw[:n])
+	if err := key.Verify(msg, sig); err != nil {
+		log.Warnf("verify block %s: %v", b.block.Hash, err)
+		return false
+	}
+	return true
+}
+
+// opSignerKey returns the public key a manager operation group must be signed
+// with. It is either revealed inside the group or known from an earlier reveal.
+func (b *Builder) opSignerKey(oh *rpc.OperationHeader) (chain.Key, bool) {
+	var src chain.Address
+	for _, op := range oh.Contents {
+		switch o := op.(type) {
+		case *rpc.RevelationOp:
+			return chain.NewKey(o.PublicKey.Type.KeyType(), o.PublicKey.Hash), true
+		case *rpc.TransactionOp:
+			src = o.Source
+		case *rpc.OriginationOp:
+			src = o.Source
+		case *rpc.DelegationOp:
+			src = o.Source
+		default:
+			return chain.Key{}, false
+		}
+	}
+	acc, ok := b.AccountByAddress(src)
+	if !ok || !acc.IsRevealed {
+		return chain.Key{}, false
+	}
+	key := chain.NewKey(acc.PubkeyType.KeyType(), acc.PubkeyHash)
+	return key, key.IsValid()
+}
@@ -0,0 +1,116 @@
+package puller
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/puller/models"
+	"tezos_index/rpc"
+)
+
+func TestVerifyOpSignature(t *testing.T) {
+	sk, err := chain.GenerateKey(chain.KeyTypeEd25519)
+	if !assert.NoError(t, err) {
+		return
+	}
+	pk := sk.Public()
+	src := sk.Address()
+	b := &Builder{
+		accHashMap: make(map[uint64]*models.Account),
+		dlgHashMap: make(map[uint64]*models.Account),
+		block:      &models.Block{Params: &chain.Params{OperationTagsVersion: 1}},
+	}
+	oh := &rpc.OperationHeader{
+		Branch: chain.NewBlockHash(bytes.Repeat([]byte{0xaa}, 32)),
+		Contents: rpc.Operations{
+			&rpc.RevelationOp{
+				GenericOp: rpc.GenericOp{Kind: chain.OpTypeReveal},
+				Source:    src,
+				Fee:       1268,
+				Counter:   1,
+				GasLimit:  10000,
+				PublicKey: chain.NewHash(chain.HashTypePkEd25519, pk.Data),
+			},
+			&rpc.TransactionOp{
+				GenericOp:   rpc.GenericOp{Kind: chain.OpTypeTransaction},
+				Source:      src,
+				Destination: src,
+				Fee:         1420,
+				Amount:      1,
+				Counter:     2,
+				GasLimit:    10600,
+			},
+		},
+	}
+	sign := func(sk chain.PrivateKey) {
+		buf, err := rpc.Forge(oh.Branch, oh.Contents, b.block.Params)
+		assert.NoError(t, err)
+		sig, err := sk.Sign(chain.WatermarkOperationBytes(buf))
+		assert.NoError(t, err)
+		oh.Signature = sig.String()
+		oh.Hash = chain.NewOperationHash(chain.Digest(append(buf, sig.Data...)))
+	}
+	sign(sk)
+	assert.True(t, b.verifyOpSignature(oh))
+
+	// content that does not hash to the operation hash is not checked
+	oh.Contents[1].(*rpc.TransactionOp).Amount = 2
+	assert.True(t, b.verifyOpSignature(oh))
+
+	// signed by another key
+	other, _ := chain.GenerateKey(chain.KeyTypeEd25519)
+	sign(other)
+	assert.False(t, b.verifyOpSignature(oh))
+
+	// key known from an earlier reveal
+	oh.Contents = oh.Contents[1:]
+	sign(sk)
+	assert.True(t, b.verifyOpSignature(oh), "unrevealed source is skipped")
+	acc := models.NewAccount(src)
+	acc.IsRevealed = true
+	acc.PubkeyType = chain.HashTypePkEd25519
+	acc.PubkeyHash = pk.Data
+	b.accHashMap[accountHashKey(acc)] = acc
+	assert.True(t, b.verifyOpSignature(oh))
+
+	acc.PubkeyHash = other.Public().Data
+	assert.False(t, b.verifyOpSignature(oh))
+}
+
+func TestVerifyBlockSignature(t *testing.T) {
+	sk, err := chain.GenerateKey(chain.KeyTypeSecp256k1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	chainId := chain.NewChainIdHash(bytes.Repeat([]byte{0x7a}, 4))
+	header := bytes.Repeat([]byte{0x55}, 100)
+	sig, err := sk.Sign(chain.WatermarkBlockBytes(chainId, header))
+	if !assert.NoError(t, err) {
+		return
+	}
+	baker := models.NewAccount(sk.Address())
+	baker.PubkeyType = chain.HashTypePkSecp256k1
+	baker.PubkeyHash = sk.Public().Data
+	b := &Builder{
+		block: &models.Block{
+			Baker: baker,
+			TZ: &models.Bundle{
+				Block:     &rpc.Block{ChainId: chainId},
+				RawHeader: append(header, sig.Data...),
+			},
+		},
+	}
+
+	assert.True(t, b.verifyBlockSignature(), "unrevealed baker is skipped")
+	baker.IsRevealed = true
+	assert.True(t, b.verifyBlockSignature())
+
+	// signed for another chain
+	b.block.TZ.Block.ChainId = chain.NewChainIdHash(bytes.Repeat([]byte{0x7b}, 4))
+	assert.False(t, b.verifyBlockSignature())
+
+	// no raw header fetched
+	b.block.TZ.RawHeader = nil
+	assert.True(t, b.verifyBlockSignature())
+}
@@ -0,0 +1,170 @@
+// Package reporting sends errors and panics to an error tracker. The backend
+// is pluggable, by default reports are dropped.
+package reporting
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tags describing where an error happened.
+const (
+	TagHeight   = "height"
+	TagHash     = "block_hash"
+	TagProtocol = "protocol"
+	TagIndex    = "index"
+	TagEndpoint = "endpoint"
+	TagPath     = "path"
+)
+
+type Level string
+
+const (
+	LevelError Level = "error"
+	LevelFatal Level = "fatal"
+)
+
+// Tags are indexed key/value pairs attached to an event.
+type Tags map[string]string
+
+// BlockTags returns tags for a block, empty values are omitted.
+func BlockTags(height int64, hash, protocol string) Tags {
+	t := Tags{TagHeight: fmt.Sprint(height)}
+	if hash != "" {
+		t[TagHash] = hash
+	}
+	if protocol != "" {
+		t[TagProtocol] = protocol
+	}
+	return t
+}
+
+// With returns a copy of t with key set to value.
+func (t Tags) With(key, value string) Tags {
+	c := make(Tags, len(t)+1)
+	for k, v := range t {
+		c[k] = v
+	}
+	c[key] = value
+	return c
+}
+
+// Event is a single error report.
+type Event struct {
+	ID      string
+	Time    time.Time
+	Level   Level
+	Type    string // Go type of the error or panic value
+	Message string
+	Stack   []string // goroutine stack for panics
+	Tags    Tags
+}
+
+// Reporter is an error tracking backend. Report must not block.
+type Reporter interface {
+	Report(e *Event)
+	Flush(timeout time.Duration) bool
+}
+
+var (
+	mu       sync.RWMutex
+	reporter Reporter = nopReporter{}
+)
+
+// SetReporter installs r as backend, nil disables reporting.
+func SetReporter(r Reporter) {
+	if r == nil {
+		r = nopReporter{}
+	}
+	mu.Lock()
+	reporter = r
+	mu.Unlock()
+}
+
+func current() Reporter {
+	mu.RLock()
+	defer mu.RUnlock()
+	return reporter
+}
+
+// Error reports err with tags.
+func Error(err error, tags Tags) {
+	if err == nil {
+		return
+	}
+	current().Report(newEvent(LevelError, fmt.Sprintf("%T", err), err.Error(), nil, tags))
+}
+
+// Panic reports a recovered panic value with the stack of the panicking
+// goroutine as returned by debug.Stack.
+func Panic(v interface{}, stack []byte, tags Tags) {
+	var lines []string
+	for _, l := range bytes.Split(stack, []byte("\n")) {
+		if len(l) > 0 {
+			lines = append(lines, string(l))
+		}
+	}
+	current().Report(newEvent(LevelFatal, fmt.Sprintf("%T", v), fmt.Sprint(v), lines, tags))
+}
+
+// Flush waits until pending reports are sent or timeout expires.
+func Flush(timeout time.Duration) bool {
+	return current().Flush(timeout)
+}
+
+func newEvent(level Level, typ, msg string, stack []string, tags Tags) *Event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Event{
+		ID:      hex.EncodeToString(id),
+		Time:    time.Now().UTC(),
+		Level:   level,
+		Type:    typ,
+		Message: msg,
+		Stack:   stack,
+		Tags:    tags,
+	}
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Report(*Event) {}
+
+func (nopReporter) Flush(time.Duration) bool { return true }
+
+// Recorder keeps reports in memory, it is used in tests.
+type Recorder struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Report(e *Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) Flush(time.Duration) bool { return true }
+
+// Events returns all recorded reports in order.
+func (r *Recorder) Events() []*Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*Event, len(r.events))
+	copy(res, r.events)
+	return res
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.events = nil
+	r.mu.Unlock()
+}
@@ -0,0 +1,78 @@
+package reporting
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	SetReporter(rec)
+	defer SetReporter(nil)
+
+	tags := BlockTags(12, "BLhash", "")
+	Error(errors.New("connect failed"), tags.With(TagIndex, "op"))
+	Error(nil, tags)
+	Panic("boom", []byte("goroutine 1 [running]:\n\nmain.main()\n"), nil)
+
+	ev := rec.Events()
+	if assert.Len(t, ev, 2) {
+		assert.Equal(t, LevelError, ev[0].Level)
+		assert.Equal(t, "connect failed", ev[0].Message)
+		assert.Equal(t, Tags{TagHeight: "12", TagHash: "BLhash", TagIndex: "op"}, ev[0].Tags)
+		assert.Len(t, ev[0].ID, 32)
+		assert.Equal(t, LevelFatal, ev[1].Level)
+		assert.Equal(t, "string", ev[1].Type)
+		assert.Equal(t, []string{"goroutine 1 [running]:", "main.main()"}, ev[1].Stack)
+	}
+	// With does not modify the original tags
+	assert.Len(t, tags, 2)
+}
+
+func TestSentry(t *testing.T) {
+	_, err := NewSentry("https://sentry.io/1", nil)
+	assert.Error(t, err)
+	_, err = NewSentry("https://key@sentry.io/", nil)
+	assert.Error(t, err)
+
+	type request struct {
+		path string
+		auth string
+		body map[string]interface{}
+	}
+	reqs := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		json.Unmarshal(buf, &body)
+		reqs <- request{r.URL.Path, r.Header.Get("X-Sentry-Auth"), body}
+	}))
+	defer srv.Close()
+
+	s, err := NewSentry("http://pub@"+srv.Listener.Addr().String()+"/prefix/42", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ev := newEvent(LevelError, "*errors.errorString", "failed", nil, BlockTags(1, "BLhash", "PsProto"))
+	s.Report(ev)
+	assert.True(t, s.Flush(time.Second))
+	r := <-reqs
+	assert.Equal(t, "/prefix/api/42/store/", r.path)
+	assert.Contains(t, r.auth, "sentry_key=pub")
+	assert.Equal(t, ev.ID, r.body["event_id"])
+	assert.Equal(t, "error", r.body["level"])
+	assert.Equal(t, "failed", r.body["message"])
+	assert.Equal(t, map[string]interface{}{"height": "1", "block_hash": "BLhash", "protocol": "PsProto"}, r.body["tags"])
+	exc, _ := r.body["exception"].([]interface{})
+	if assert.Len(t, exc, 1) {
+		e := exc[0].(map[string]interface{})
+		assert.Equal(t, "*errors.errorString", e["type"])
+		assert.NotNil(t, e["stacktrace"], "stack trace of the caller")
+	}
+}
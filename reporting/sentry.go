@@ -0,0 +1,52 @@
+package reporting
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Sentry sends reports to a Sentry project with the sentry-go client. The
+// client transport sends events in the background and drops them when its
+// queue is full, Flush waits for pending events on shutdown.
+type Sentry struct {
+	client *sentry.Client
+}
+
+// NewSentry returns a reporter for a DSN like
+// https://<key>@sentry.example.com/<project>. A nil client uses the default
+// HTTP client of the transport.
+func NewSentry(dsn string, client *http.Client) (*Sentry, error) {
+	c, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:        dsn,
+		HTTPClient: client,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sentry: %v", err)
+	}
+	return &Sentry{client: c}, nil
+}
+
+// Report captures e with the stack of the calling goroutine, for panics
+// this is the stack of the deferred recover including the panicking frames.
+func (s *Sentry) Report(e *Event) {
+	ev := sentry.NewEvent()
+	ev.EventID = sentry.EventID(e.ID)
+	ev.Timestamp = e.Time
+	ev.Level = sentry.Level(e.Level)
+	ev.Logger = "tzindex"
+	ev.Message = e.Message
+	ev.Tags = e.Tags
+	ev.Exception = []sentry.Exception{{
+		Type:       e.Type,
+		Value:      e.Message,
+		Stacktrace: sentry.NewStacktrace(),
+	}}
+	s.client.CaptureEvent(ev, nil, nil)
+}
+
+func (s *Sentry) Flush(timeout time.Duration) bool {
+	return s.client.Flush(timeout)
+}
@@ -15,10 +15,18 @@ type BalanceUpdate interface {
 	BalanceUpdateKind() string
 }
 
+// Balance update origins, v010+
+const (
+	BalanceUpdateOriginBlock     = "block"
+	BalanceUpdateOriginMigration = "migration"
+	BalanceUpdateOriginSubsidy   = "subsidy"
+)
+
 // GenericBalanceUpdate holds the common values among all BalanceUpdatesType variants
 type GenericBalanceUpdate struct {
 	Kind   string `json:"kind"`
 	Change int64  `json:"change,string"`
+	Origin string `json:"origin,omitempty"` // v010+
 }
 
 // BalanceUpdateKind returns the BalanceUpdateType's Kind field
@@ -153,6 +153,9 @@ type BlockMetadata struct {
 	// v008
 	LevelInfo        *BlockLevel       `json:"level_info"`
 	VotingPeriodInfo *VotingPeriodInfo `json:"voting_period_info"`
+
+	// v010
+	LiquidityBakingEscapeEma int64 `json:"liquidity_baking_escape_ema"`
 }
 
 // UnmarshalJSON unmarshals the BlockMetadata JSON
@@ -170,6 +173,11 @@ func (bhm *BlockMetadata) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	// test chains are gone since v009
+	if len(tmp.TestChainStatus) == 0 || string(tmp.TestChainStatus) == "null" {
+		return nil
+	}
+
 	tcs, err := unmarshalTestChainStatus(tmp.TestChainStatus)
 	if err != nil {
 		return err
@@ -255,6 +263,17 @@ func (c *Client) GetBlockHeader(ctx context.Context, height int64) (*BlockHeader
 	return &head, nil
 }
 
+// GetBlockHeaderRaw returns the signed binary header of a Tezos block.
+// https://tezos.gitlab.io/mainnet/api/rpc.html#get-block-id-header-raw
+func (c *Client) GetBlockHeaderRaw(ctx context.Context, blockID chain.BlockHash) ([]byte, error) {
+	var raw HexBytes
+	u := fmt.Sprintf("chains/%s/blocks/%s/header/raw", c.ChainID, blockID)
+	if err := c.Get(ctx, u, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
 // GetBlockPredHashes returns the block id's (hashes) of count preceeding blocks.
 // https://tezos.gitlab.io/mainnet/api/rpc.html#get-chains-chain-id-blocks
 func (c *Client) GetBlockPredHashes(ctx context.Context, blockID chain.BlockHash, count int) ([]chain.BlockHash, error) {
@@ -10,10 +10,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"time"
+
+	"tezos_index/reporting"
 )
 
 const (
@@ -24,65 +28,259 @@ const (
 	MAIN_NET = "main"
 )
 
+const (
+	DefaultTimeout    = 30 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// ClientConfig configures a client that spreads requests over one or more
+// nodes. Requests go to the first healthy endpoint in order, a failing
+// endpoint is skipped until its cooldown expires.
+type ClientConfig struct {
+	Endpoints  []string
+	HTTPClient *http.Client
+	Timeout    time.Duration // per request deadline, streams are not limited
+	MaxRetries int           // retries of temporary errors, negative disables retries
+	Backoff    time.Duration // initial retry delay and endpoint cooldown, doubled per retry
+	MaxBackoff time.Duration
+	RateLimit  float64 // max requests per second and endpoint, zero for no limit
+}
+
+func (c ClientConfig) withDefaults() ClientConfig {
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = DefaultMaxRetries
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = DefaultBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	return c
+}
+
 // Client manages communication with a Tezos RPC server.
 type Client struct {
 	// HTTP client used to communicate with the Tezos node API.
 	client *http.Client
-	// Base URL for API requests.
-	BaseURL *url.URL
+	// Node endpoints in order of preference.
+	endpoints []*endpoint
+	cfg       ClientConfig
 	// User agent name for client.
 	UserAgent string
 	// The chain the client will query.
 	ChainID string
 }
 
-// NewClient returns a new Tezos RPC client.
+// NewClient returns a new Tezos RPC client. baseURL may contain a comma
+// separated list of node URLs, later URLs are used as fallback.
 func NewClient(httpClient *http.Client, baseURL string) (*Client, error) {
-	log.Debugf("chain node url: %s", baseURL)
-	if httpClient == nil {
-		httpClient = http.DefaultClient
+	return NewClientWithConfig(ClientConfig{
+		Endpoints:  strings.Split(baseURL, ","),
+		HTTPClient: httpClient,
+	})
+}
+
+// NewClientWithConfig returns a new Tezos RPC client for all cfg.Endpoints.
+func NewClientWithConfig(cfg ClientConfig) (*Client, error) {
+	cfg = cfg.withDefaults()
+	c := &Client{client: cfg.HTTPClient, cfg: cfg, UserAgent: userAgent, ChainID: MAIN_NET}
+	for _, v := range cfg.Endpoints {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		log.Debugf("chain node url: %s", v)
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		c.endpoints = append(c.endpoints, newEndpoint(u, cfg.RateLimit))
 	}
-	u, err := url.Parse(baseURL)
-	if err != nil {
-		return nil, err
+	if len(c.endpoints) == 0 {
+		return nil, fmt.Errorf("rpc: missing node url")
 	}
-
-	c := &Client{client: httpClient, BaseURL: u, UserAgent: userAgent, ChainID: MAIN_NET}
 	return c, nil
 }
 
-func (c *Client) Get(ctx context.Context, urlpath string, result interface{}) error {
-	req, err := c.NewRequest(ctx, http.MethodGet, urlpath, nil)
-	if err != nil {
-		return err
+// Endpoints returns the health of all node endpoints.
+func (c *Client) Endpoints() []EndpointStatus {
+	now := time.Now()
+	res := make([]EndpointStatus, len(c.endpoints))
+	for i, e := range c.endpoints {
+		res[i] = e.status(now)
+	}
+	return res
+}
+
+// pick returns the first healthy endpoint or, when all are down, the one
+// that recovers first.
+func (c *Client) pick() *endpoint {
+	now := time.Now()
+	var next *endpoint
+	for _, e := range c.endpoints {
+		if e.healthy(now) {
+			return e
+		}
+		if next == nil || e.until().Before(next.until()) {
+			next = e
+		}
+	}
+	return next
+}
+
+func (c *Client) backoff(n int) time.Duration {
+	d := c.cfg.Backoff
+	for i := 0; i < n && d < c.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.cfg.MaxBackoff {
+		d = c.cfg.MaxBackoff
 	}
-	return c.Do(req, result)
+	return d
+}
+
+func (c *Client) Get(ctx context.Context, urlpath string, result interface{}) error {
+	return c.call(ctx, http.MethodGet, urlpath, nil, result)
 }
 
 func (c *Client) GetAsync(ctx context.Context, urlpath string, mon Monitor) error {
-	req, err := c.NewRequest(ctx, http.MethodGet, urlpath, nil)
+	e := c.pick()
+	if err := e.limit.wait(ctx); err != nil {
+		return err
+	}
+	req, err := c.newRequest(ctx, e, http.MethodGet, urlpath, nil)
 	if err != nil {
 		return err
 	}
-	return c.DoAsync(req, mon)
+	start := time.Now()
+	err = c.DoAsync(req, mon)
+	observe(e, urlpath, start, err)
+	switch {
+	case err == nil:
+		e.success(time.Since(start))
+	case ctx.Err() != nil:
+	case isEndpointError(err):
+		e.failure(err, c.backoff)
+	}
+	return err
+}
+
+func (c *Client) Post(ctx context.Context, urlpath string, body, result interface{}) error {
+	return c.call(ctx, http.MethodPost, urlpath, body, result)
 }
 
 func (c *Client) Put(ctx context.Context, urlpath string, body, result interface{}) error {
-	req, err := c.NewRequest(ctx, http.MethodPut, urlpath, body)
+	return c.call(ctx, http.MethodPut, urlpath, body, result)
+}
+
+// call sends a request to the preferred endpoint and retries temporary
+// failures with exponential backoff. Retries move to the next healthy
+// endpoint right away.
+func (c *Client) call(ctx context.Context, method, urlpath string, body, result interface{}) error {
+	for n := 0; ; n++ {
+		e := c.pick()
+		err := c.try(ctx, e, method, urlpath, body, result)
+		if err == nil {
+			return nil
+		}
+		if n >= c.cfg.MaxRetries || ctx.Err() != nil || !IsTemporary(err) {
+			return err
+		}
+		log.Debugf("rpc: %s %s on %s failed, retrying: %v", method, urlpath, e, err)
+		if c.pick() != e {
+			continue
+		}
+		t := time.NewTimer(c.backoff(n))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) try(ctx context.Context, e *endpoint, method, urlpath string, body, result interface{}) error {
+	if err := e.limit.wait(ctx); err != nil {
+		return err
+	}
+	tctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	req, err := c.newRequest(tctx, e, method, urlpath, body)
 	if err != nil {
 		return err
 	}
-	return c.Do(req, result)
+	start := time.Now()
+	err = c.Do(req, result)
+	observe(e, urlpath, start, err)
+	switch {
+	case err == nil:
+		e.success(time.Since(start))
+	case ctx.Err() != nil:
+		// cancelled by the caller, not the endpoint's fault
+	case isEndpointError(err):
+		e.failure(err, c.backoff)
+	}
+	return err
+}
+
+// IsTemporary returns true for errors that may succeed when retried, i.e.
+// connection failures, timeouts, overloaded or unavailable nodes and Tezos
+// errors of kind temporary.
+func IsTemporary(err error) bool {
+	switch e := err.(type) {
+	case *rpcError:
+		return e.ErrorKind() == ErrorKindTemporary
+	case *plainError:
+		return isRetryStatus(e.statusCode)
+	case *httpError:
+		return isRetryStatus(e.statusCode)
+	}
+	return isEndpointError(err)
+}
+
+func isRetryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
 }
 
-// NewRequest creates a Tezos RPC request.
+// isEndpointError returns true when err indicates a broken or overloaded
+// node rather than a failed call.
+func isEndpointError(err error) bool {
+	switch e := err.(type) {
+	case *rpcError:
+		return false
+	case *plainError:
+		return isRetryStatus(e.statusCode)
+	case *httpError:
+		return isRetryStatus(e.statusCode)
+	case *url.Error:
+		return true
+	case net.Error:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// NewRequest creates a Tezos RPC request for the preferred endpoint.
 func (c *Client) NewRequest(ctx context.Context, method, urlStr string, body interface{}) (*http.Request, error) {
+	return c.newRequest(ctx, c.pick(), method, urlStr, body)
+}
+
+func (c *Client) newRequest(ctx context.Context, e *endpoint, method, urlStr string, body interface{}) (*http.Request, error) {
 	rel, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, err
 	}
 
-	u := c.BaseURL.ResolveReference(rel)
+	u := e.url.ResolveReference(rel)
 
 	buf := new(bytes.Buffer)
 	if body != nil {
@@ -110,8 +308,26 @@ func (c *Client) NewRequest(ctx context.Context, method, urlStr string, body int
 	return req, nil
 }
 
+// reportDecodeError reports responses that do not match the expected types,
+// usually caused by protocol changes.
+func reportDecodeError(req *http.Request, err error) {
+	reporting.Error(err, reporting.Tags{
+		reporting.TagEndpoint: req.URL.Host,
+		reporting.TagPath:     metricPath(req.URL.Path),
+	})
+}
+
+// handleResponse reads the body before decoding so read failures are not
+// mistaken for decode errors.
 func (c *Client) handleResponse(ctx context.Context, resp *http.Response, v interface{}) error {
-	return json.NewDecoder(resp.Body).Decode(v)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &DecodeError{Path: resp.Request.URL.Path, Err: err}
+	}
+	return nil
 }
 
 func (c *Client) handleResponseMonitor(ctx context.Context, resp *http.Response, mon Monitor) {
@@ -135,7 +351,13 @@ func (c *Client) handleResponseMonitor(ctx context.Context, resp *http.Response,
 				mon.Err(io.EOF)
 				return
 			}
-			mon.Err(fmt.Errorf("rpc: decoding response: %v", err))
+			if isReadError(err) {
+				mon.Err(err)
+				return
+			}
+			derr := &DecodeError{Path: resp.Request.URL.Path, Err: err}
+			reportDecodeError(resp.Request, derr)
+			mon.Err(derr)
 			return
 		}
 		select {
@@ -175,7 +397,12 @@ func (c *Client) Do(req *http.Request, v interface{}) (err error) {
 		if v == nil {
 			return nil
 		}
-		return c.handleResponse(req.Context(), resp, v)
+		if err = c.handleResponse(req.Context(), resp, v); err != nil {
+			if _, ok := err.(*DecodeError); ok {
+				reportDecodeError(req, err)
+			}
+		}
+		return err
 	}
 
 	return handleError(resp)
@@ -210,6 +437,18 @@ func (c *Client) DoAsync(req *http.Request, mon Monitor) (err error) {
 	return
 }
 
+// isReadError reports whether a stream decoder failed reading the body
+// instead of decoding it.
+func isReadError(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return false
+	case net.Error:
+		return true
+	}
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
 func handleError(resp *http.Response) error {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -228,6 +467,7 @@ func handleError(resp *http.Response) error {
 		return &httpErr
 	}
 
+	// error bodies are not reported, proxies often send their own pages
 	var errs Errors
 	if err := json.Unmarshal(body, &errs); err != nil {
 		log.Errorf("rpc: error decoding RPC error: %v", err)
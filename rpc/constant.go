@@ -0,0 +1,34 @@
+package rpc
+
+import (
+	"tezos_index/chain"
+	"tezos_index/micheline"
+)
+
+// ConstantRegistrationOp represents a register_global_constant operation, v011+
+type ConstantRegistrationOp struct {
+	GenericOp
+	Source       chain.Address                   `json:"source"`
+	Fee          int64                           `json:"fee,string"`
+	Counter      int64                           `json:"counter,string"`
+	GasLimit     int64                           `json:"gas_limit,string"`
+	StorageLimit int64                           `json:"storage_limit,string"`
+	Value        *micheline.Prim                 `json:"value,omitempty"`
+	Metadata     *ConstantRegistrationOpMetadata `json:"metadata,omitempty"`
+}
+
+// ConstantRegistrationOpMetadata represents a register_global_constant operation metadata
+type ConstantRegistrationOpMetadata struct {
+	BalanceUpdates BalanceUpdates             `json:"balance_updates"` // fee-related
+	Result         ConstantRegistrationResult `json:"operation_result"`
+}
+
+// ConstantRegistrationResult represents a register_global_constant result
+type ConstantRegistrationResult struct {
+	BalanceUpdates BalanceUpdates   `json:"balance_updates"` // storage burn
+	ConsumedGas    int64            `json:"consumed_gas,string"`
+	StorageSize    int64            `json:"storage_size,string"`
+	GlobalAddress  chain.ExprHash   `json:"global_address"`
+	Status         chain.OpStatus   `json:"status"`
+	Errors         []OperationError `json:"errors,omitempty"`
+}
@@ -55,6 +55,12 @@ type Constants struct {
 	BakingRewardPerEndorsement_v6 [2]int64 `json:"-"`
 	EndorsementReward_v6          [2]int64 `json:"-"`
 
+	// New in Granada v010
+	MinimalBlockDelay                 int64 `json:"minimal_block_delay,string"`
+	LiquidityBakingSubsidy            int64 `json:"liquidity_baking_subsidy,string"`
+	LiquidityBakingSunsetLevel        int64 `json:"liquidity_baking_sunset_level"`
+	LiquidityBakingEscapeEmaThreshold int64 `json:"liquidity_baking_escape_ema_threshold"`
+
 	// Broken by v6
 	BlockReward_v1       int64 `json:"block_reward,string"` // default unmarshal
 	EndorsementReward_v1 int64 `json:"-"`
@@ -181,6 +187,10 @@ func (c Constants) MapToChainParams() *chain.Params {
 	p.MinProposalQuorum = c.MinProposalQuorum
 	p.QuorumMin = c.QuorumMin
 	p.QuorumMax = c.QuorumMax
+	p.MinimalBlockDelay = time.Duration(c.MinimalBlockDelay) * time.Second
+	p.LiquidityBakingSubsidy = c.LiquidityBakingSubsidy
+	p.LiquidityBakingSunsetLevel = c.LiquidityBakingSunsetLevel
+	p.LiquidityBakingEscapeEmaThreshold = c.LiquidityBakingEscapeEmaThreshold
 
 	for i, v := range c.TimeBetweenBlocks {
 		if i > 1 {
@@ -59,3 +59,16 @@ func (c *Client) GetContractBalanceHeight(ctx context.Context, addr chain.Addres
 	}
 	return strconv.ParseInt(bal, 10, 64)
 }
+
+// GetContractCounter returns the current counter of a contract at head, the
+// next manager operation must use counter + 1
+// https://tezos.gitlab.io/tezos/api/rpc.html#get-block-id-context-contracts-contract-id-counter
+func (c *Client) GetContractCounter(ctx context.Context, addr chain.Address) (int64, error) {
+	u := fmt.Sprintf("chains/%s/blocks/head/context/contracts/%s/counter", c.ChainID, addr)
+	var counter string
+	err := c.Get(ctx, u, &counter)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(counter, 10, 64)
+}
@@ -4,6 +4,7 @@
 package rpc
 
 import (
+	"encoding/json"
 	"tezos_index/chain"
 )
 
@@ -16,7 +17,24 @@ type DelegationOp struct {
 	GasLimit     int64                 `json:"gas_limit,string"`
 	StorageLimit int64                 `json:"storage_limit,string"`
 	Delegate     chain.Address         `json:"delegate,omitempty"`
-	Metadata     *DelegationOpMetadata `json:"metadata"`
+	Metadata     *DelegationOpMetadata `json:"metadata,omitempty"`
+}
+
+// MarshalJSON omits an empty delegate which the node expects to be absent
+// when a delegation is withdrawn.
+func (o DelegationOp) MarshalJSON() ([]byte, error) {
+	type alias DelegationOp
+	v := struct {
+		alias
+		Delegate *chain.Address `json:"delegate,omitempty"`
+	}{
+		alias: alias(o),
+	}
+	if o.Delegate.IsValid() {
+		v.Delegate = &o.Delegate
+	}
+	// marshal by pointer, OpType only implements TextMarshaler on its pointer
+	return json.Marshal(&v)
 }
 
 // DelegationOpMetadata represents a transaction operation metadata
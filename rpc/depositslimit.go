@@ -0,0 +1,32 @@
+package rpc
+
+import (
+	"tezos_index/chain"
+)
+
+// SetDepositsLimitOp represents a set_deposits_limit operation. The op is new
+// in Ithaca (v012) which is not registered yet. A missing limit removes the
+// baker's deposit limit.
+type SetDepositsLimitOp struct {
+	GenericOp
+	Source       chain.Address               `json:"source"`
+	Fee          int64                       `json:"fee,string"`
+	Counter      int64                       `json:"counter,string"`
+	GasLimit     int64                       `json:"gas_limit,string"`
+	StorageLimit int64                       `json:"storage_limit,string"`
+	Limit        *int64                      `json:"limit,string,omitempty"`
+	Metadata     *SetDepositsLimitOpMetadata `json:"metadata,omitempty"`
+}
+
+// SetDepositsLimitOpMetadata represents a set_deposits_limit operation metadata
+type SetDepositsLimitOpMetadata struct {
+	BalanceUpdates BalanceUpdates         `json:"balance_updates"` // fee-related
+	Result         SetDepositsLimitResult `json:"operation_result"`
+}
+
+// SetDepositsLimitResult represents a set_deposits_limit result
+type SetDepositsLimitResult struct {
+	ConsumedGas int64            `json:"consumed_gas,string"`
+	Status      chain.OpStatus   `json:"status"`
+	Errors      []OperationError `json:"errors,omitempty"`
+}
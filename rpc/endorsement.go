@@ -6,6 +6,7 @@ package rpc
 
 import (
 	"encoding/json"
+	"fmt"
 	"tezos_index/chain"
 )
 
@@ -23,9 +24,42 @@ type EndorsementOpMetadata struct {
 	Slots          []int          `json:"slots"`
 }
 
+// EndorsementWithSlotOp wraps a signed endorsement with the endorser's first
+// slot, v009+
 type EndorsementWithSlotOp struct {
 	GenericOp
 	Endorsement json.RawMessage        `json:"endorsement"`
 	Slot        int                    `json:"slot"`
 	Metadata    *EndorsementOpMetadata `json:"metadata"`
 }
+
+// Unwrap returns the wrapped endorsement with the outer op's metadata.
+func (e *EndorsementWithSlotOp) Unwrap() (*EndorsementOp, error) {
+	var inner struct {
+		Operations EndorsementOp `json:"operations"`
+	}
+	if err := json.Unmarshal(e.Endorsement, &inner); err != nil {
+		return nil, fmt.Errorf("decoding wrapped endorsement: %v", err)
+	}
+	op := inner.Operations
+	op.Kind = chain.OpTypeEndorsement
+	op.Metadata = e.Metadata
+	return &op, nil
+}
+
+// Endorsement returns op as plain endorsement, unwrapping endorsements with
+// slot. The second result is false for all other ops.
+func Endorsement(op Operation) (*EndorsementOp, bool) {
+	switch o := op.(type) {
+	case *EndorsementOp:
+		return o, true
+	case *EndorsementWithSlotOp:
+		e, err := o.Unwrap()
+		if err != nil {
+			log.Errorf("%v", err)
+			return nil, false
+		}
+		return e, true
+	}
+	return nil, false
+}
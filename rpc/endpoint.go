@@ -0,0 +1,168 @@
+package rpc
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// EndpointStatus is a snapshot of the health of a node endpoint.
+type EndpointStatus struct {
+	URL       string        `json:"url"`
+	Healthy   bool          `json:"healthy"`
+	Fails     int           `json:"fails"` // consecutive failures
+	Requests  int64         `json:"requests"`
+	Errors    int64         `json:"errors"`
+	Latency   time.Duration `json:"latency"` // moving average of successful requests
+	DownUntil time.Time     `json:"down_until,omitempty"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// endpoint tracks the health of a single node. Each consecutive failure
+// takes the endpoint out of rotation for an exponentially growing period.
+type endpoint struct {
+	url   *url.URL
+	limit *limiter
+
+	mu        sync.Mutex
+	fails     int
+	downUntil time.Time
+	requests  int64
+	errors    int64
+	latency   time.Duration
+	lastErr   error
+}
+
+func newEndpoint(u *url.URL, rate float64) *endpoint {
+	return &endpoint{
+		url:   u,
+		limit: newLimiter(rate),
+	}
+}
+
+func (e *endpoint) String() string {
+	return e.url.Host
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+func (e *endpoint) until() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.downUntil
+}
+
+func (e *endpoint) success(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	e.fails = 0
+	e.downUntil = time.Time{}
+	if e.latency == 0 {
+		e.latency = d
+	} else {
+		e.latency = (e.latency*7 + d) / 8
+	}
+}
+
+func (e *endpoint) failure(err error, cooldown func(int) time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	e.errors++
+	e.lastErr = err
+	e.downUntil = time.Now().Add(cooldown(e.fails))
+	e.fails++
+}
+
+func (e *endpoint) status(now time.Time) EndpointStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := EndpointStatus{
+		URL:      e.url.String(),
+		Healthy:  !now.Before(e.downUntil),
+		Fails:    e.fails,
+		Requests: e.requests,
+		Errors:   e.errors,
+		Latency:  e.latency,
+	}
+	if !s.Healthy {
+		s.DownUntil = e.downUntil
+	}
+	if e.lastErr != nil {
+		s.LastError = e.lastErr.Error()
+	}
+	return s
+}
+
+// limiter is a token bucket allowing rate requests per second with bursts of
+// up to one second worth of requests.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns nil when rate is not positive, a nil limiter never
+// blocks.
+func newLimiter(rate float64) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// using it.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *limiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	d := l.reserve(time.Now())
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
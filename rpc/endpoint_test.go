@@ -0,0 +1,180 @@
+package rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"tezos_index/reporting"
+	"time"
+)
+
+func testConfig(urls ...string) ClientConfig {
+	return ClientConfig{
+		Endpoints:  urls,
+		Timeout:    time.Second,
+		Backoff:    10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond,
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	var hits int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`"NetXdQprcVkpaWU"`))
+	}))
+	defer up.Close()
+
+	c, err := NewClientWithConfig(testConfig(down.URL, up.URL))
+	assert.NoError(t, err)
+	var id string
+	assert.NoError(t, c.Get(context.Background(), "chains/main/chain_id", &id))
+	assert.Equal(t, "NetXdQprcVkpaWU", id)
+
+	// the failed node stays out of rotation during its cooldown
+	assert.NoError(t, c.Get(context.Background(), "chains/main/chain_id", &id))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	status := c.Endpoints()
+	assert.False(t, status[0].Healthy)
+	assert.Equal(t, 1, status[0].Fails)
+	assert.True(t, status[1].Healthy)
+	assert.Equal(t, int64(2), status[1].Requests)
+}
+
+func TestClientRetry(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/permanent":
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`[{"kind":"permanent","id":"proto.alpha.contract.unknown"}]`))
+		case atomic.AddInt32(&hits, 1) < 3:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`[{"kind":"temporary","id":"node.prevalidation.busy"}]`))
+		default:
+			w.Write([]byte(`"ok"`))
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClientWithConfig(testConfig(srv.URL))
+	assert.NoError(t, err)
+	var res string
+	assert.NoError(t, c.Get(context.Background(), "temporary", &res))
+	assert.Equal(t, "ok", res)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	// application errors do not affect endpoint health
+	assert.True(t, c.Endpoints()[0].Healthy)
+
+	atomic.StoreInt32(&hits, 0)
+	err = c.Get(context.Background(), "permanent", &res)
+	assert.Error(t, err)
+	assert.False(t, IsTemporary(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// retries give up after MaxRetries
+	cfg := testConfig(srv.URL)
+	cfg.MaxRetries = 1
+	c, err = NewClientWithConfig(cfg)
+	assert.NoError(t, err)
+	atomic.StoreInt32(&hits, 0)
+	err = c.Get(context.Background(), "temporary", &res)
+	assert.True(t, IsTemporary(err))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestClientDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(srv.URL)
+	cfg.Timeout = 20 * time.Millisecond
+	cfg.MaxRetries = -1
+	c, err := NewClientWithConfig(cfg)
+	assert.NoError(t, err)
+	start := time.Now()
+	err = c.Get(context.Background(), "slow", nil)
+	assert.Error(t, err)
+	assert.True(t, IsTemporary(err))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	assert.False(t, c.Endpoints()[0].Healthy)
+}
+
+func TestLimiter(t *testing.T) {
+	assert.Nil(t, newLimiter(0))
+	assert.NoError(t, newLimiter(0).wait(context.Background()))
+
+	l := newLimiter(2)
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now))
+	assert.Equal(t, time.Duration(0), l.reserve(now.Add(time.Second)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newLimiter(1)
+	l.reserve(time.Now())
+	assert.Equal(t, context.Canceled, l.wait(ctx))
+}
+
+func TestMetricPath(t *testing.T) {
+	for in, out := range map[string]string{
+		"chains/main/blocks/head/header": "chains/main/blocks/head/header",
+		"chains/main/blocks/1234":        "chains/main/blocks/:block",
+		"chains/main/blocks/BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2": "chains/main/blocks/:block",
+		"chains/main/blocks/12/helpers/baking_rights?cycle=5&all=true":           "chains/main/blocks/:block/helpers/baking_rights",
+		"chains/main/blocks/head/context/contracts/tz1abc/counter":               "chains/main/blocks/head/context/contracts/:id/counter",
+		"chains/main/blocks/12/context/raw/json/cycle/5":                         "chains/main/blocks/:block/context/raw/json/cycle/:id",
+	} {
+		assert.Equal(t, out, metricPath(in), in)
+	}
+}
+
+func TestClientDecodeError(t *testing.T) {
+	rec := reporting.NewRecorder()
+	reporting.SetReporter(rec)
+	defer reporting.SetReporter(nil)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ops":
+			// custom UnmarshalJSON errors count as decode errors
+			w.Write([]byte(`[{"kind":"unknown_kind"}]`))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`<html>502 Bad Gateway</html>`))
+		}
+	}))
+	defer srv.Close()
+	c, err := NewClientWithConfig(testConfig(srv.URL))
+	assert.NoError(t, err)
+
+	var ops Operations
+	err = c.Get(context.Background(), "ops", &ops)
+	if assert.IsType(t, &DecodeError{}, err) {
+		assert.Equal(t, "decode", errorKind(err))
+	}
+	if ev := rec.Events(); assert.Len(t, ev, 1) {
+		assert.Equal(t, "*rpc.DecodeError", ev[0].Type)
+		assert.Equal(t, "ops", ev[0].Tags[reporting.TagPath])
+	}
+
+	// proxy error pages are not reported
+	rec.Reset()
+	assert.Error(t, c.Get(context.Background(), "chains/main/chain_id", &ops))
+	assert.Len(t, rec.Events(), 0)
+}
@@ -166,6 +166,18 @@ func (e *plainError) Error() string {
 	return e.msg
 }
 
+// DecodeError is returned when a successful response does not match the
+// expected types, e.g. after a protocol change. Err may come from a custom
+// UnmarshalJSON method.
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("rpc: decoding %s: %v", e.Path, e.Err)
+}
+
 var (
 	_ Error    = &GenericError{}
 	_ Error    = Errors{}
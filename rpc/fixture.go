@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FixtureTransport is a http.RoundTripper that records node replies to
+// fixture files or replays them from there, so tests can run the crawler
+// against real chain data without a node.
+//
+// Each request is stored as one gzipped file named after its url path and a
+// hash of method, path, query and body. Only successful replies are recorded,
+// requests without a fixture are answered with 404 Not Found on replay.
+type FixtureTransport struct {
+	Dir    string
+	Record bool              // call Next and write fixtures instead of replaying
+	Next   http.RoundTripper // used in record mode, defaults to http.DefaultTransport
+}
+
+// NewFixtureClient returns a client that replays fixtures from dir.
+func NewFixtureClient(dir string) (*Client, error) {
+	return NewClient(&http.Client{Transport: &FixtureTransport{Dir: dir}}, "http://fixture")
+}
+
+// NewRecordingClient returns a client for the node at baseURL that stores all
+// replies as fixtures in dir.
+func NewRecordingClient(dir, baseURL string) (*Client, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return NewClient(&http.Client{Transport: &FixtureTransport{Dir: dir, Record: true}}, baseURL)
+}
+
+func (t *FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		buf, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = buf
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	}
+	name := filepath.Join(t.Dir, fixtureName(req, body))
+	if t.Record {
+		return t.record(req, name)
+	}
+	return t.replay(req, name)
+}
+
+func (t *FixtureTransport) record(req *http.Request, name string) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	if _, err := zw.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(name, zbuf.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("rpc: writing fixture: %v", err)
+	}
+	return resp, nil
+}
+
+func (t *FixtureTransport) replay(req *http.Request, name string) (*http.Response, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		log.Debugf("rpc: missing fixture %s for %s %s", name, req.Method, req.URL)
+		return fixtureResponse(req, http.StatusNotFound, nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: reading fixture %s: %v", name, err)
+	}
+	buf, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: reading fixture %s: %v", name, err)
+	}
+	return fixtureResponse(req, http.StatusOK, buf), nil
+}
+
+func fixtureResponse(req *http.Request, code int, body []byte) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if code == http.StatusOK {
+		resp.Header.Set("Content-Type", mediaType)
+	}
+	return resp
+}
+
+// fixtureName derives a file name for a request that is stable across runs
+// and readable enough to find a block's fixtures by hand.
+func fixtureName(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	h.Write(bytes.TrimSpace(body))
+	path := strings.Trim(req.URL.Path, "/")
+	path = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(path)
+	if len(path) > 120 {
+		path = path[:120]
+	}
+	return path + "-" + hex.EncodeToString(h.Sum(nil)[:6]) + ".json.gz"
+}
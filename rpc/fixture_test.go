@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestFixtureTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc-fixture")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/chains/main/blocks/head/header" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"level":42,"proto":1}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	rec, err := NewRecordingClient(dir, srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var head, other map[string]interface{}
+	assert.NoError(t, rec.Get(ctx, "chains/main/blocks/head/header", &head))
+	assert.Error(t, rec.Get(ctx, "chains/main/blocks/1", &other))
+	assert.Equal(t, float64(42), head["level"])
+	assert.Equal(t, 2, calls)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "only successful replies are recorded")
+
+	// replay without the server
+	srv.Close()
+	rep, err := NewFixtureClient(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	head = nil
+	assert.NoError(t, rep.Get(ctx, "chains/main/blocks/head/header", &head))
+	assert.Equal(t, float64(42), head["level"])
+
+	err = rep.Get(ctx, "chains/main/blocks/1", &other)
+	if e, ok := err.(HTTPError); assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, e.StatusCode())
+	}
+	assert.Equal(t, 2, calls)
+}
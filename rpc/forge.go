@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"fmt"
+	"tezos_index/chain"
+)
+
+// Forge encodes a group of manager operations into Tezos binary wire format
+// without calling the node. The result is what the node's forge RPC returns
+// and is ready to be signed. Only reveal, transaction, origination and
+// delegation are supported.
+func Forge(branch chain.BlockHash, ops Operations, p *chain.Params) ([]byte, error) {
+	g := chain.OpGroup{
+		Branch:   branch,
+		Contents: make([]chain.ManagerOp, len(ops)),
+	}
+	for i, op := range ops {
+		mop, err := NewManagerOp(op)
+		if err != nil {
+			return nil, fmt.Errorf("rpc: forging op %d: %v", i, err)
+		}
+		g.Contents[i] = mop
+	}
+	buf, err := g.Encode(p)
+	if err == chain.ErrUnsupportedOpEncoding {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rpc: forging: %v", err)
+	}
+	return buf, nil
+}
+
+// NewManagerOp converts an rpc operation into its binary codec form.
+func NewManagerOp(op Operation) (chain.ManagerOp, error) {
+	switch o := op.(type) {
+	case *RevelationOp:
+		return &chain.Reveal{
+			Manager:   chain.Manager{Source: o.Source, Fee: o.Fee, Counter: o.Counter, GasLimit: o.GasLimit, StorageLimit: o.StorageLimit},
+			PublicKey: chain.NewKey(o.PublicKey.Type.KeyType(), o.PublicKey.Hash),
+		}, nil
+
+	case *TransactionOp:
+		tx := &chain.Transaction{
+			Manager:     chain.Manager{Source: o.Source, Fee: o.Fee, Counter: o.Counter, GasLimit: o.GasLimit, StorageLimit: o.StorageLimit},
+			Amount:      o.Amount,
+			Destination: o.Destination,
+		}
+		if o.Parameters != nil && o.Parameters.Value != nil {
+			params, err := o.Parameters.MarshalBinary()
+			if err != nil {
+				return nil, fmt.Errorf("parameters: %v", err)
+			}
+			tx.Parameters = params
+		}
+		return tx, nil
+
+	case *OriginationOp:
+		if o.Script == nil {
+			return nil, fmt.Errorf("missing script")
+		}
+		script, err := o.Script.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("script: %v", err)
+		}
+		return &chain.Origination{
+			Manager:  chain.Manager{Source: o.Source, Fee: o.Fee, Counter: o.Counter, GasLimit: o.GasLimit, StorageLimit: o.StorageLimit},
+			Balance:  o.Balance,
+			Delegate: o.Delegate,
+			Script:   script,
+		}, nil
+
+	case *DelegationOp:
+		dlg := &chain.Delegation{
+			Manager: chain.Manager{Source: o.Source, Fee: o.Fee, Counter: o.Counter, GasLimit: o.GasLimit, StorageLimit: o.StorageLimit},
+		}
+		if o.Delegate.IsValid() {
+			addr := o.Delegate
+			dlg.Delegate = &addr
+		}
+		return dlg, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported operation kind %s", op.OpKind())
+	}
+}
@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+)
+
+func TestForge(t *testing.T) {
+	branch := chain.NewBlockHash(bytes.Repeat([]byte{0xaa}, 32))
+	src := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x11}, 20))
+	dst := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x33}, 20))
+	dlg := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x44}, 20))
+	ops := Operations{
+		&RevelationOp{
+			GenericOp: GenericOp{Kind: chain.OpTypeReveal},
+			Source:    src,
+			Fee:       1257,
+			Counter:   1,
+			GasLimit:  10000,
+			PublicKey: chain.NewHash(chain.HashTypePkEd25519, bytes.Repeat([]byte{0x22}, 32)),
+		},
+		&TransactionOp{
+			GenericOp:    GenericOp{Kind: chain.OpTypeTransaction},
+			Source:       src,
+			Destination:  dst,
+			Fee:          1420,
+			Amount:       1000000,
+			Counter:      2,
+			GasLimit:     10600,
+			StorageLimit: 300,
+		},
+		&DelegationOp{
+			GenericOp: GenericOp{Kind: chain.OpTypeDelegation},
+			Source:    src,
+			Counter:   3,
+			GasLimit:  1100,
+			Delegate:  dlg,
+		},
+	}
+	expected := strings.Join([]string{
+		strings.Repeat("aa", 32),
+		// reveal
+		"6b", "00" + strings.Repeat("11", 20), "e909", "01", "904e", "00", "00" + strings.Repeat("22", 32),
+		// transaction
+		"6c", "00" + strings.Repeat("11", 20), "8c0b", "02", "e852", "ac02", "c0843d", "0000" + strings.Repeat("33", 20), "00",
+		// delegation
+		"6e", "00" + strings.Repeat("11", 20), "00", "03", "cc08", "00", "ff00" + strings.Repeat("44", 20),
+	}, "")
+
+	buf, err := Forge(branch, ops, &chain.Params{OperationTagsVersion: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, hex.EncodeToString(buf))
+
+	buf, err = Forge(branch, ops, &chain.Params{})
+	assert.Equal(t, chain.ErrUnsupportedOpEncoding, err)
+	assert.Nil(t, buf)
+
+	ops[1].(*TransactionOp).Fee = -1
+	_, err = Forge(branch, ops, &chain.Params{OperationTagsVersion: 1})
+	assert.Error(t, err)
+}
+
+func TestForgeParameters(t *testing.T) {
+	branch := chain.NewBlockHash(bytes.Repeat([]byte{0xaa}, 32))
+	src := chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x11}, 20))
+	dst := chain.NewAddress(chain.AddressTypeContract, bytes.Repeat([]byte{0x33}, 20))
+	prefix := strings.Join([]string{
+		strings.Repeat("aa", 32),
+		"6c", "00" + strings.Repeat("11", 20), "8c0b", "02", "e852", "ac02", "00", "01" + strings.Repeat("33", 20) + "00",
+	}, "")
+	unit := &micheline.Prim{Type: micheline.PrimNullary, OpCode: micheline.D_UNIT}
+	for _, v := range []struct {
+		Entrypoint string
+		Expected   string
+	}{
+		// Unit to the default entrypoint has no parameters
+		{"", "00"},
+		{"default", "00"},
+		// named entrypoints keep their tag or name
+		{"do", "ff" + "02" + "00000002030b"},
+		{"transfer", "ff" + "ff087472616e73666572" + "00000002030b"},
+	} {
+		ops := Operations{
+			&TransactionOp{
+				GenericOp:    GenericOp{Kind: chain.OpTypeTransaction},
+				Source:       src,
+				Destination:  dst,
+				Fee:          1420,
+				Counter:      2,
+				GasLimit:     10600,
+				StorageLimit: 300,
+				Parameters:   &micheline.Parameters{Entrypoint: v.Entrypoint, Value: unit},
+			},
+		}
+		buf, err := Forge(branch, ops, &chain.Params{OperationTagsVersion: 1})
+		assert.NoError(t, err, v.Entrypoint)
+		assert.Equal(t, prefix+v.Expected, hex.EncodeToString(buf), v.Entrypoint)
+	}
+}
+
+func TestDelegationOpMarshalJSON(t *testing.T) {
+	op := &DelegationOp{
+		GenericOp: GenericOp{Kind: chain.OpTypeDelegation},
+		Source:    chain.NewAddress(chain.AddressTypeEd25519, bytes.Repeat([]byte{0x11}, 20)),
+		Fee:       1,
+	}
+	buf, err := json.Marshal(Operations{op})
+	assert.NoError(t, err)
+	var v []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf, &v))
+	assert.Equal(t, "delegation", v[0]["kind"])
+	assert.Equal(t, "1", v[0]["fee"])
+	assert.NotContains(t, v[0], "delegate")
+	assert.NotContains(t, v[0], "metadata")
+}
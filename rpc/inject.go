@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"tezos_index/chain"
+)
+
+// operationGroup is the JSON form of an operation group accepted by the
+// forge, simulation and preapply RPCs.
+type operationGroup struct {
+	Protocol  *chain.ProtocolHash `json:"protocol,omitempty"`
+	Branch    chain.BlockHash     `json:"branch"`
+	Contents  Operations          `json:"contents"`
+	Signature *chain.Signature    `json:"signature,omitempty"`
+}
+
+type operationResult struct {
+	Contents Operations `json:"contents"`
+}
+
+// ForgeOperations asks the node to forge an operation group. Use Forge to
+// encode operations locally without trusting the node.
+func (c *Client) ForgeOperations(ctx context.Context, branch chain.BlockHash, ops Operations) ([]byte, error) {
+	var buf HexBytes
+	u := fmt.Sprintf("chains/%s/blocks/head/helpers/forge/operations", c.ChainID)
+	if err := c.Post(ctx, u, operationGroup{Branch: branch, Contents: ops}, &buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// RunOperation simulates an operation group on top of the current head without
+// checking signatures. The returned operations contain result metadata which can
+// be passed to OperationCosts to estimate gas and storage limits.
+func (c *Client) RunOperation(ctx context.Context, branch chain.BlockHash, ops Operations, chainId chain.ChainIdHash) (Operations, error) {
+	sig := chain.NewSignature(chain.SignatureTypeGeneric, make([]byte, 64))
+	req := struct {
+		Operation operationGroup    `json:"operation"`
+		ChainId   chain.ChainIdHash `json:"chain_id"`
+	}{
+		Operation: operationGroup{Branch: branch, Contents: ops, Signature: &sig},
+		ChainId:   chainId,
+	}
+	var res operationResult
+	u := fmt.Sprintf("chains/%s/blocks/head/helpers/scripts/run_operation", c.ChainID)
+	if err := c.Post(ctx, u, req, &res); err != nil {
+		return nil, err
+	}
+	return res.Contents, nil
+}
+
+// PreapplyOperations validates a signed operation group against the current head.
+func (c *Client) PreapplyOperations(ctx context.Context, proto chain.ProtocolHash, branch chain.BlockHash, ops Operations, sig chain.Signature) (Operations, error) {
+	req := []operationGroup{{
+		Protocol:  &proto,
+		Branch:    branch,
+		Contents:  ops,
+		Signature: &sig,
+	}}
+	res := make([]operationResult, 0, 1)
+	u := fmt.Sprintf("chains/%s/blocks/head/helpers/preapply/operations", c.ChainID)
+	if err := c.Post(ctx, u, req, &res); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("rpc: empty preapply result")
+	}
+	return res[0].Contents, nil
+}
+
+// InjectOperation injects a forged and signed operation group into the node's
+// mempool and returns the operation hash.
+func (c *Client) InjectOperation(ctx context.Context, signed []byte) (chain.OperationHash, error) {
+	var h chain.OperationHash
+	u := fmt.Sprintf("injection/operation?chain=%s", c.ChainID)
+	if err := c.Post(ctx, u, hex.EncodeToString(signed), &h); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// Costs holds the resources consumed by a simulated manager operation including
+// all internal operations it triggered.
+type Costs struct {
+	GasUsed     int64
+	StorageUsed int64 // paid storage bytes including allocation and origination burn
+}
+
+// OperationCosts extracts gas and storage usage from simulated or preapplied
+// operations. It fails when any of the operations was not applied.
+func OperationCosts(ops Operations, p *chain.Params) ([]Costs, error) {
+	costs := make([]Costs, len(ops))
+	for i, op := range ops {
+		var (
+			status chain.OpStatus
+			errs   []OperationError
+		)
+		switch o := op.(type) {
+		case *RevelationOp:
+			if o.Metadata == nil {
+				return nil, fmt.Errorf("rpc: op %d: missing metadata", i)
+			}
+			res := o.Metadata.Result
+			status, errs = res.Status, res.Errors
+			costs[i].GasUsed = res.ConsumedGas
+		case *DelegationOp:
+			if o.Metadata == nil {
+				return nil, fmt.Errorf("rpc: op %d: missing metadata", i)
+			}
+			res := o.Metadata.Result
+			status, errs = res.Status, res.Errors
+			costs[i].GasUsed = res.ConsumedGas
+		case *OriginationOp:
+			if o.Metadata == nil || o.Metadata.Result == nil {
+				return nil, fmt.Errorf("rpc: op %d: missing metadata", i)
+			}
+			res := o.Metadata.Result
+			status, errs = res.Status, res.Errors
+			costs[i].GasUsed = res.ConsumedGas
+			costs[i].StorageUsed = res.PaidStorageSizeDiff + p.OriginationSize
+		case *TransactionOp:
+			if o.Metadata == nil || o.Metadata.Result == nil {
+				return nil, fmt.Errorf("rpc: op %d: missing metadata", i)
+			}
+			res := o.Metadata.Result
+			status, errs = res.Status, res.Errors
+			costs[i].GasUsed = res.ConsumedGas
+			costs[i].StorageUsed = res.PaidStorageSizeDiff
+			if res.Allocated {
+				costs[i].StorageUsed += p.OriginationSize
+			}
+			for _, iop := range o.Metadata.InternalResults {
+				if iop.Result == nil {
+					continue
+				}
+				if !iop.Result.Status.IsSuccess() && len(errs) == 0 {
+					status, errs = iop.Result.Status, iop.Result.Errors
+				}
+				costs[i].GasUsed += iop.Result.ConsumedGas
+				costs[i].StorageUsed += iop.Result.PaidStorageSizeDiff
+				if iop.Result.Allocated || iop.Kind == chain.OpTypeOrigination {
+					costs[i].StorageUsed += p.OriginationSize
+				}
+			}
+		default:
+			return nil, fmt.Errorf("rpc: op %d: unsupported operation kind %s", i, op.OpKind())
+		}
+		if !status.IsSuccess() {
+			ids := make([]string, len(errs))
+			for j, e := range errs {
+				ids[j] = e.ID
+			}
+			return nil, fmt.Errorf("rpc: op %d %s: %s [%s]", i, op.OpKind(), status, strings.Join(ids, ", "))
+		}
+	}
+	return costs, nil
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tezos_rpc_request_duration_seconds",
+		Help:    "Duration of RPC requests by endpoint and path.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "path"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tezos_rpc_errors_total",
+		Help: "Failed RPC requests by endpoint, path and error kind.",
+	}, []string{"endpoint", "path", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcDuration, rpcErrors)
+}
+
+// observe records the duration and outcome of a request.
+func observe(e *endpoint, urlpath string, start time.Time, err error) {
+	path := metricPath(urlpath)
+	rpcDuration.WithLabelValues(e.String(), path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(e.String(), path, errorKind(err)).Inc()
+	}
+}
+
+// errorKind classifies err for metrics, Tezos errors use their kind.
+func errorKind(err error) string {
+	switch e := err.(type) {
+	case *rpcError:
+		if k := e.ErrorKind(); k != "" {
+			return k
+		}
+		return "rpc"
+	case *plainError, *httpError:
+		return "http"
+	case *DecodeError:
+		return "decode"
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	return "network"
+}
+
+// metricPath replaces block ids, heights, hashes and addresses in urlpath so
+// the number of label values stays bounded.
+func metricPath(urlpath string) string {
+	if i := strings.IndexByte(urlpath, '?'); i >= 0 {
+		urlpath = urlpath[:i]
+	}
+	parts := strings.Split(strings.Trim(urlpath, "/"), "/")
+	for i, p := range parts {
+		switch {
+		case i > 0 && parts[i-1] == "blocks" && p != "head":
+			parts[i] = ":block"
+		case i > 0 && (parts[i-1] == "contracts" || parts[i-1] == "delegates" || parts[i-1] == "big_maps"):
+			parts[i] = ":id"
+		case len(p) > 0 && (p[0] >= '0' && p[0] <= '9' || len(p) > 32):
+			parts[i] = ":id"
+		}
+	}
+	return strings.Join(parts, "/")
+}
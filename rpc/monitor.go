@@ -7,6 +7,7 @@ package rpc
 import (
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"tezos_index/chain"
@@ -127,9 +128,12 @@ func (b *Block) LogEntry() *BlockHeaderLogEntry {
 	}
 }
 
+// BlockHeaderMonitor receives new chain heads. It is safe to close the
+// monitor while the stream is still being decoded.
 type BlockHeaderMonitor struct {
 	result chan *BlockHeaderLogEntry
 	closed chan struct{}
+	once   sync.Once
 	err    error
 }
 
@@ -138,7 +142,7 @@ var _ Monitor = (*BlockHeaderMonitor)(nil)
 
 func NewBlockHeaderMonitor() *BlockHeaderMonitor {
 	return &BlockHeaderMonitor{
-		result: make(chan *BlockHeaderLogEntry),
+		result: make(chan *BlockHeaderLogEntry, 1),
 		closed: make(chan struct{}),
 	}
 }
@@ -148,11 +152,6 @@ func (m *BlockHeaderMonitor) New() interface{} {
 }
 
 func (m *BlockHeaderMonitor) Send(ctx context.Context, val interface{}) {
-	select {
-	case <-m.closed:
-		return
-	default:
-	}
 	select {
 	case <-ctx.Done():
 	case <-m.closed:
@@ -160,38 +159,43 @@ func (m *BlockHeaderMonitor) Send(ctx context.Context, val interface{}) {
 	}
 }
 
+// Recv waits for the next head. It returns the stream error or
+// ErrMonitorClosed after the monitor was closed and all received heads
+// were consumed.
 func (m *BlockHeaderMonitor) Recv(ctx context.Context) (*BlockHeaderLogEntry, error) {
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case <-m.closed:
-		return nil, ErrMonitorClosed
-	case res, ok := <-m.result:
-		if !ok {
-			if m.err != nil {
-				return nil, m.err
-			}
-			return nil, ErrMonitorClosed
+		// select picks at random, don't drop a head sent before the
+		// stream ended
+		select {
+		case res := <-m.result:
+			return res, nil
+		default:
+		}
+		if m.err != nil {
+			return nil, m.err
 		}
+		return nil, ErrMonitorClosed
+	case res := <-m.result:
 		return res, nil
 	}
-	// unreachable
-	return nil, nil
 }
 
 func (m *BlockHeaderMonitor) Err(err error) {
-	m.err = err
-	m.Close()
+	m.once.Do(func() {
+		m.err = err
+		close(m.closed)
+	})
 }
 
+// Close stops the monitor, the result channel is never closed so pending
+// sends cannot panic.
 func (m *BlockHeaderMonitor) Close() {
-	select {
-	case <-m.closed:
-		return
-	default:
-	}
-	close(m.closed)
-	close(m.result)
+	m.once.Do(func() {
+		close(m.closed)
+	})
 }
 
 func (m *BlockHeaderMonitor) Closed() <-chan struct{} {
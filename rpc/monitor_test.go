@@ -0,0 +1,53 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBlockHeaderMonitorClose(t *testing.T) {
+	mon := NewBlockHeaderMonitor()
+	sent := make(chan struct{})
+	go func() {
+		// the second send blocks until closed, must not panic
+		mon.Send(context.Background(), &BlockHeaderLogEntry{Level: 1})
+		mon.Send(context.Background(), &BlockHeaderLogEntry{Level: 2})
+		close(sent)
+	}()
+	mon.Close()
+	mon.Close()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send blocked after close")
+	}
+	// a buffered head may still be delivered
+	var err error
+	for i := 0; i < 2 && err == nil; i++ {
+		_, err = mon.Recv(context.Background())
+	}
+	assert.Equal(t, ErrMonitorClosed, err)
+
+	mon = NewBlockHeaderMonitor()
+	mon.Err(errors.New("broken"))
+	_, err = mon.Recv(context.Background())
+	assert.EqualError(t, err, "broken")
+}
+
+func TestBlockHeaderMonitorDrain(t *testing.T) {
+	// a head received right before the stream ended is still delivered
+	for i := 0; i < 100; i++ {
+		mon := NewBlockHeaderMonitor()
+		mon.Send(context.Background(), &BlockHeaderLogEntry{Level: 7})
+		mon.Err(errors.New("eof"))
+		head, err := mon.Recv(context.Background())
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(7), head.Level)
+		}
+		_, err = mon.Recv(context.Background())
+		assert.EqualError(t, err, "eof")
+	}
+}
@@ -7,6 +7,7 @@ package rpc
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"tezos_index/chain"
 )
@@ -43,12 +44,64 @@ func (e *GenericOp) OpKind() chain.OpType {
 	return e.Kind
 }
 
+var (
+	opDecoderMu sync.RWMutex
+	opDecoders  = make(map[string]map[chain.OpType]func() Operation)
+)
+
+// RegisterOperation registers a constructor for ops of kind in blocks of
+// protocol proto. Registered kinds take precedence over the built-in types,
+// a nil constructor removes the registration. Used by protocol handlers for
+// new or changed op layouts.
+func RegisterOperation(proto chain.ProtocolHash, kind chain.OpType, fn func() Operation) {
+	opDecoderMu.Lock()
+	defer opDecoderMu.Unlock()
+	key := proto.String()
+	if fn == nil {
+		delete(opDecoders[key], kind)
+		return
+	}
+	if opDecoders[key] == nil {
+		opDecoders[key] = make(map[chain.OpType]func() Operation)
+	}
+	opDecoders[key][kind] = fn
+}
+
+func lookupOperation(proto chain.ProtocolHash, kind chain.OpType) (func() Operation, bool) {
+	if !proto.IsValid() {
+		return nil, false
+	}
+	opDecoderMu.RLock()
+	defer opDecoderMu.RUnlock()
+	fn, ok := opDecoders[proto.String()][kind]
+	return fn, ok
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Contents are decoded with the
+// op types registered for the header's protocol.
+func (h *OperationHeader) UnmarshalJSON(data []byte) error {
+	type alias OperationHeader
+	v := struct {
+		*alias
+		Contents json.RawMessage `json:"contents"`
+	}{alias: (*alias)(h)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	return h.Contents.decode(h.Protocol, v.Contents)
+}
+
 // Operations is a slice of Operation (interface type) with custom JSON unmarshaller
 type Operations []Operation
 
-// UnmarshalJSON implements json.Unmarshaler
+// UnmarshalJSON implements json.Unmarshaler, ops are decoded as built-in
+// types only. Use OperationHeader to decode ops of a known protocol.
 func (e *Operations) UnmarshalJSON(data []byte) error {
-	if data == nil {
+	return e.decode(chain.ProtocolHash{}, data)
+}
+
+func (e *Operations) decode(proto chain.ProtocolHash, data []byte) error {
+	if len(data) == 0 {
 		return nil
 	}
 
@@ -69,6 +122,14 @@ opLoop:
 			return fmt.Errorf("generic operation: %v", err)
 		}
 
+		if fn, ok := lookupOperation(proto, tmp.Kind); ok {
+			(*e)[i] = fn()
+			if err := json.Unmarshal(r, (*e)[i]); err != nil {
+				return fmt.Errorf("operation kind %s: %v", tmp.Kind, err)
+			}
+			continue opLoop
+		}
+
 		switch tmp.Kind {
 		// anonymous operations
 		case chain.OpTypeActivateAccount:
@@ -88,6 +149,10 @@ opLoop:
 			(*e)[i] = &DelegationOp{}
 		case chain.OpTypeReveal:
 			(*e)[i] = &RevelationOp{}
+		case chain.OpTypeRegisterConstant:
+			(*e)[i] = &ConstantRegistrationOp{}
+		case chain.OpTypeSetDepositsLimit:
+			(*e)[i] = &SetDepositsLimitOp{}
 		// consensus operations
 		case chain.OpTypeEndorsement:
 			(*e)[i] = &EndorsementOp{}
@@ -146,6 +211,22 @@ type OperationHeaderWithError struct {
 	Error Errors `json:"error"`
 }
 
+// UnmarshalJSON implements json.Unmarshaler, it replaces the method promoted
+// from OperationHeader which would skip the error list.
+func (o *OperationHeaderWithError) UnmarshalJSON(data []byte) error {
+	if err := o.OperationHeader.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	var v struct {
+		Error Errors `json:"error"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	o.Error = v.Error
+	return nil
+}
+
 // OperationHeaderWithErrorAlt is a named array encoded OperationWithError with hash as a first array member.
 // See OperationAltList for details
 type OperationHeaderWithErrorAlt OperationHeaderWithError
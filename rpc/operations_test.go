@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"tezos_index/chain"
+	"tezos_index/micheline"
+)
+
+func TestOperationsEndorsementWithSlot(t *testing.T) {
+	data := `[{"kind":"endorsement_with_slot","endorsement":{"branch":"BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2",
+"operations":{"kind":"endorsement","level":1589250},"signature":"sigXeXB5JD5TaLb3xgTPKjgf9W45judiCmNP9UBdZBdmtHSGBxL1M8ZSUb6LpjGP2MdfUBTB4WHs5APnvyRV1LooU6QHJuDe"},
+"slot":3,"metadata":{"balance_updates":[],"delegate":"tz1KqTpEZ7Yob7QbPE4Hy4Wo8fHG8LhKxZSx","slots":[3,7]}}]`
+	var ops Operations
+	if !assert.NoError(t, json.Unmarshal([]byte(data), &ops)) {
+		return
+	}
+	assert.Equal(t, chain.OpTypeEndorsementWithSlot, ops[0].OpKind())
+	e, ok := Endorsement(ops[0])
+	if assert.True(t, ok) {
+		assert.Equal(t, chain.OpTypeEndorsement, e.Kind)
+		assert.Equal(t, int64(1589250), e.Level)
+		assert.Equal(t, []int{3, 7}, e.Metadata.Slots)
+	}
+}
+
+func TestTransactionResultLazyStorageDiff(t *testing.T) {
+	data := `{"status":"applied","consumed_gas":"1000","lazy_storage_diff":[
+{"kind":"big_map","id":"17","diff":{"action":"alloc","key_type":{"prim":"string"},"value_type":{"prim":"nat"},
+"updates":[{"key_hash":"expruCfqu42i2pfETXAKoykEskXHxZgrudQoRy8LsZHnBr9VzXewHA","key":{"string":"a"},"value":{"int":"1"}}]}},
+{"kind":"big_map","id":"18","diff":{"action":"copy","source":"17","updates":[
+{"key_hash":"expruCfqu42i2pfETXAKoykEskXHxZgrudQoRy8LsZHnBr9VzXewHA","key":{"string":"a"}}]}},
+{"kind":"sapling_state","id":"19","diff":{"action":"alloc","updates":{"commitments_and_ciphertexts":[],"nullifiers":[]},"memo_size":8}},
+{"kind":"big_map","id":"16","diff":{"action":"remove"}}]}`
+	var res TransactionResult
+	if !assert.NoError(t, json.Unmarshal([]byte(data), &res)) {
+		return
+	}
+	if !assert.Len(t, res.BigMapDiff, 5) {
+		return
+	}
+	d := res.BigMapDiff
+	assert.Equal(t, micheline.BigMapDiffActionAlloc, d[0].Action)
+	assert.Equal(t, int64(17), d[0].Id)
+	assert.Equal(t, micheline.T_STRING, d[0].KeyType)
+	assert.Equal(t, micheline.BigMapDiffActionUpdate, d[1].Action)
+	assert.Equal(t, "a", d[1].StringKey)
+	assert.NotNil(t, d[1].Value)
+	assert.Equal(t, micheline.BigMapDiffActionCopy, d[2].Action)
+	assert.Equal(t, int64(17), d[2].SourceId)
+	assert.Equal(t, int64(18), d[2].DestId)
+	assert.Equal(t, micheline.BigMapDiffActionRemove, d[3].Action)
+	assert.Equal(t, int64(18), d[3].Id)
+	assert.Equal(t, micheline.BigMapDiffActionRemove, d[4].Action)
+	assert.Equal(t, int64(16), d[4].Id)
+}
@@ -4,6 +4,7 @@
 package rpc
 
 import (
+	"encoding/json"
 	"tezos_index/chain"
 	"tezos_index/micheline"
 )
@@ -23,7 +24,37 @@ type OriginationOp struct {
 	Delegatable    *bool                  `json:"delegatable"` // true when missing before v5 Babylon
 	Delegate       *chain.Address         `json:"delegate"`
 	Script         *micheline.Script      `json:"script"`
-	Metadata       *OriginationOpMetadata `json:"metadata"`
+	Metadata       *OriginationOpMetadata `json:"metadata,omitempty"`
+}
+
+// MarshalJSON only emits fields known to protocol v005 and later, legacy manager
+// and flag fields are rejected by the node.
+func (o OriginationOp) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Kind         chain.OpType           `json:"kind"`
+		Source       chain.Address          `json:"source"`
+		Fee          int64                  `json:"fee,string"`
+		Counter      int64                  `json:"counter,string"`
+		GasLimit     int64                  `json:"gas_limit,string"`
+		StorageLimit int64                  `json:"storage_limit,string"`
+		Balance      int64                  `json:"balance,string"`
+		Delegate     *chain.Address         `json:"delegate,omitempty"`
+		Script       *micheline.Script      `json:"script,omitempty"`
+		Metadata     *OriginationOpMetadata `json:"metadata,omitempty"`
+	}{
+		Kind:         o.Kind,
+		Source:       o.Source,
+		Fee:          o.Fee,
+		Counter:      o.Counter,
+		GasLimit:     o.GasLimit,
+		StorageLimit: o.StorageLimit,
+		Balance:      o.Balance,
+		Delegate:     o.Delegate,
+		Script:       o.Script,
+		Metadata:     o.Metadata,
+	}
+	// marshal by pointer, OpType only implements TextMarshaler on its pointer
+	return json.Marshal(&v)
 }
 
 // OriginationOpMetadata represents a transaction operation metadata
@@ -34,12 +65,31 @@ type OriginationOpMetadata struct {
 
 // OriginationResult represents a contract creation result
 type OriginationResult struct {
-	BalanceUpdates      BalanceUpdates       `json:"balance_updates"` // burned fees
-	OriginatedContracts []chain.Address      `json:"originated_contracts"`
-	ConsumedGas         int64                `json:"consumed_gas,string"`
-	StorageSize         int64                `json:"storage_size,string"`
-	PaidStorageSizeDiff int64                `json:"paid_storage_size_diff,string"`
-	BigMapDiff          micheline.BigMapDiff `json:"big_map_diff,omitempty"`
-	Status              chain.OpStatus       `json:"status"`
-	Errors              []OperationError     `json:"errors,omitempty"`
+	BalanceUpdates      BalanceUpdates            `json:"balance_updates"` // burned fees
+	OriginatedContracts []chain.Address           `json:"originated_contracts"`
+	ConsumedGas         int64                     `json:"consumed_gas,string"`
+	StorageSize         int64                     `json:"storage_size,string"`
+	PaidStorageSizeDiff int64                     `json:"paid_storage_size_diff,string"`
+	BigMapDiff          micheline.BigMapDiff      `json:"big_map_diff,omitempty"`
+	LazyStorageDiff     micheline.LazyStorageDiff `json:"lazy_storage_diff,omitempty"` // v008+
+	Status              chain.OpStatus            `json:"status"`
+	Errors              []OperationError          `json:"errors,omitempty"`
+}
+
+// UnmarshalJSON converts lazy storage diffs to a legacy big map diff when
+// the node does not send big_map_diff anymore.
+func (r *OriginationResult) UnmarshalJSON(data []byte) error {
+	type alias OriginationResult
+	if err := json.Unmarshal(data, (*alias)(r)); err != nil {
+		return err
+	}
+	if len(r.BigMapDiff) > 0 || len(r.LazyStorageDiff) == 0 {
+		return nil
+	}
+	diff, err := r.LazyStorageDiff.BigMapDiff()
+	if err != nil {
+		return err
+	}
+	r.BigMapDiff = diff
+	return nil
 }
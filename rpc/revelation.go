@@ -16,7 +16,7 @@ type RevelationOp struct {
 	GasLimit     int64                 `json:"gas_limit,string"`
 	StorageLimit int64                 `json:"storage_limit,string"`
 	PublicKey    chain.Hash            `json:"public_key"`
-	Metadata     *RevelationOpMetadata `json:"metadata"`
+	Metadata     *RevelationOpMetadata `json:"metadata,omitempty"`
 }
 
 // RevelationOpMetadata represents a reveal operation metadata
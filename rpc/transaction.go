@@ -4,6 +4,7 @@
 package rpc
 
 import (
+	"encoding/json"
 	"tezos_index/chain"
 	"tezos_index/micheline"
 )
@@ -19,7 +20,7 @@ type TransactionOp struct {
 	GasLimit     int64                  `json:"gas_limit,string"`
 	StorageLimit int64                  `json:"storage_limit,string"`
 	Parameters   *micheline.Parameters  `json:"parameters,omitempty"`
-	Metadata     *TransactionOpMetadata `json:"metadata"`
+	Metadata     *TransactionOpMetadata `json:"metadata,omitempty"`
 }
 
 // TransactionOpMetadata represents a transaction operation metadata
@@ -31,15 +32,16 @@ type TransactionOpMetadata struct {
 
 // TransactionResult represents a transaction result
 type TransactionResult struct {
-	BalanceUpdates      BalanceUpdates       `json:"balance_updates"` // tx or contract related
-	ConsumedGas         int64                `json:"consumed_gas,string"`
-	Status              chain.OpStatus       `json:"status"`
-	Allocated           bool                 `json:"allocated_destination_contract"` // new addr created and payed
-	Errors              []OperationError     `json:"errors,omitempty"`
-	Storage             *micheline.Prim      `json:"storage,omitempty"`
-	StorageSize         int64                `json:"storage_size,string"`
-	PaidStorageSizeDiff int64                `json:"paid_storage_size_diff,string"`
-	BigMapDiff          micheline.BigMapDiff `json:"big_map_diff,omitempty"`
+	BalanceUpdates      BalanceUpdates            `json:"balance_updates"` // tx or contract related
+	ConsumedGas         int64                     `json:"consumed_gas,string"`
+	Status              chain.OpStatus            `json:"status"`
+	Allocated           bool                      `json:"allocated_destination_contract"` // new addr created and payed
+	Errors              []OperationError          `json:"errors,omitempty"`
+	Storage             *micheline.Prim           `json:"storage,omitempty"`
+	StorageSize         int64                     `json:"storage_size,string"`
+	PaidStorageSizeDiff int64                     `json:"paid_storage_size_diff,string"`
+	BigMapDiff          micheline.BigMapDiff      `json:"big_map_diff,omitempty"`
+	LazyStorageDiff     micheline.LazyStorageDiff `json:"lazy_storage_diff,omitempty"` // v008+
 
 	// when reused as internal origination result
 	OriginatedContracts []chain.Address `json:"originated_contracts,omitempty"`
@@ -57,3 +59,21 @@ type InternalResult struct {
 	Balance     int64                 `json:"balance,string"`        // origination
 	Script      *micheline.Script     `json:"script,omitempty"`      // origination
 }
+
+// UnmarshalJSON converts lazy storage diffs to a legacy big map diff when
+// the node does not send big_map_diff anymore.
+func (r *TransactionResult) UnmarshalJSON(data []byte) error {
+	type alias TransactionResult
+	if err := json.Unmarshal(data, (*alias)(r)); err != nil {
+		return err
+	}
+	if len(r.BigMapDiff) > 0 || len(r.LazyStorageDiff) == 0 {
+		return nil
+	}
+	diff, err := r.LazyStorageDiff.BigMapDiff()
+	if err != nil {
+		return err
+	}
+	r.BigMapDiff = diff
+	return nil
+}